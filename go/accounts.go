@@ -0,0 +1,63 @@
+package brerver
+
+import (
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The accounts section of Config
+type AccountRules struct {
+	UsernameMin     int    `json:"username_min" doc:"Shortest allowed username in characters" default:"1" minimum:"1"`
+	UsernameMax     int    `json:"username_max" doc:"Longest allowed username in characters" default:"32" minimum:"1"`
+	UsernamePattern string `json:"username_pattern" doc:"Regular expression usernames must match" default:"^[A-Za-z0-9_.-]+$"`
+	PasswordMin     int    `json:"password_min" doc:"Shortest allowed password in characters" default:"1" minimum:"1"`
+	PasswordMax     int    `json:"password_max" doc:"Longest allowed password in characters" default:"128" minimum:"1"`
+
+	usernamePattern *regexp.Regexp
+}
+
+// Why a REGISTER was refused, sent after the 0
+const (
+	usernameTaken  = "USERNAME_TAKEN"
+	usernameLength = "USERNAME_LENGTH"
+	usernameChars  = "USERNAME_CHARS"
+	passwordLength = "PASSWORD_LENGTH"
+	passwordChars  = "PASSWORD_CHARS"
+)
+
+// Returns the reason the credentials can't be registered, or the empty string if they can
+func (r AccountRules) check(username, password string) string {
+	if reason := r.checkUsername(username); reason != "" {
+		return reason
+	}
+
+	if n := utf8.RuneCountInString(password); n < r.PasswordMin || n > r.PasswordMax {
+		return passwordLength
+	}
+	if !utf8.ValidString(password) {
+		return passwordChars
+	}
+	for _, c := range password {
+		if unicode.IsControl(c) {
+			return passwordChars
+		}
+	}
+	return ""
+}
+
+func (r AccountRules) checkUsername(username string) string {
+	if n := utf8.RuneCountInString(username); n < r.UsernameMin || n > r.UsernameMax {
+		return usernameLength
+	}
+	if !utf8.ValidString(username) || !r.usernamePattern.MatchString(username) {
+		return usernameChars
+	}
+	// Whatever the pattern says, anything with a space in it would get split apart by the protocol
+	for _, c := range username {
+		if unicode.IsSpace(c) || unicode.IsControl(c) {
+			return usernameChars
+		}
+	}
+	return ""
+}
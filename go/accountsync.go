@@ -0,0 +1,118 @@
+package brerver
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Stands in on links for the empty credential of accounts vouched for by a directory or
+// identity provider, since a field can't be empty
+const noCredential = "-"
+
+// Linked servers share one set of accounts, so an account registered on any of them
+// can log in through all of them. Changes go out as they happen:
+//
+//	ACCOUNT <name> <credential>  registered, ignored where the name is already taken
+//	                             unless it comes from the leader
+//	PASSWD <name> <credential>   password changed
+//	UNREGISTER <name>            deleted along with everything about it
+//
+// and every account goes out as ACCOUNT when a link is made, to catch up on whatever
+// happened while the servers weren't linked.
+func (s *Server) writeAccounts(lines *bytes.Buffer) {
+	s.users.each(func(name, credential string) {
+		lines.WriteString(accountLine("ACCOUNT", name, credential))
+	})
+}
+
+func accountLine(command, name, credential string) string {
+	if credential == "" {
+		credential = noCredential
+	}
+	return fmt.Sprintf("%s %s %s\n", command, name, credential)
+}
+
+func (s *Server) shareAccount(name, credential string) {
+	s.broadcastLinks(accountLine("ACCOUNT", name, credential))
+}
+
+func (s *Server) sharePassword(name, credential string) {
+	s.broadcastLinks(accountLine("PASSWD", name, credential))
+}
+
+func (s *Server) shareUnregister(name string) {
+	s.broadcastLinks("UNREGISTER " + name + "\n")
+}
+
+// Applies an account change from a linked server
+func (s *Server) linkedAccount(l *serverLink, fields []string) {
+	command := fields[0]
+	if (command == "UNREGISTER" && len(fields) != 2) || (command != "UNREGISTER" && len(fields) != 3) {
+		s.logger.Warn("Dropped a malformed account change from a linked server", "server", l.name)
+		return
+	}
+	name := fields[1]
+	if s.settings().Accounts.checkUsername(name) != "" {
+		s.logger.Warn("Dropped an account change for an invalid username from a linked server", "server", l.name, "user", name)
+		return
+	}
+	var credential string
+	if command != "UNREGISTER" && fields[2] != noCredential {
+		if _, ok := parseCredential(fields[2]); !ok {
+			s.logger.Warn("Dropped an account change with an invalid credential from a linked server", "server", l.name, "user", name)
+			return
+		}
+		credential = fields[2]
+	}
+
+	if command == "UNREGISTER" {
+		// Held off until the account's connections are logged out, as UNREGISTER does
+		release := s.holdLogins(name)
+		if _, ok := s.users.remove(name); !ok {
+			release()
+			return
+		}
+		// Logging out waits on each connection, which may itself be waiting on this link to
+		// claim an account, so the link is left to carry on being read meanwhile
+		go func() {
+			defer release()
+			s.logOutEverywhere(name, nil)
+			s.purgeAccount(name)
+			s.logEvent(unregisterEvent, name, "", "")
+		}()
+		return
+	}
+
+	// Where both sides of a split took the name, the leader's account wins
+	fromLeader := s.leader() == l.name
+	var existing string
+	var ok bool
+	s.users.update(name, func(stored string, found bool) (string, bool) {
+		existing, ok = stored, found
+		if command == "ACCOUNT" && ok && !fromLeader {
+			return stored, true
+		}
+		return credential, true
+	})
+
+	switch {
+	case command == "ACCOUNT" && !ok:
+		s.logEvent(registerEvent, name, "", "")
+	case command == "ACCOUNT" && existing != credential && fromLeader:
+		s.logger.Warn("Replaced an account with the leader's by the same name", "server", l.name, "user", name)
+		// Whoever logged in to the account replaced isn't the leader's account holder, and
+		// nobody logs in to the leader's until they're all out. As with UNREGISTER, that's
+		// waited for away from the link.
+		release := s.holdLogins(name)
+		s.revokeSessions(name)
+		go func() {
+			defer release()
+			s.logOutEverywhere(name, nil)
+		}()
+	case command == "ACCOUNT" && existing != credential:
+		s.logger.Warn("Kept this server's account over a linked server's by the same name", "server", l.name, "user", name)
+	case command == "PASSWD" && existing != credential:
+		// Like PASSWD here, every session for the account stops working
+		s.revokeSessions(name)
+	}
+}
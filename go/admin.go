@@ -0,0 +1,184 @@
+package brerver
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+func (s *Server) isAdmin(u *user) bool {
+	if !u.loggedIn() {
+		return false
+	}
+	for _, admin := range s.settings().Admins {
+		if admin == u.name {
+			return true
+		}
+	}
+	return false
+}
+
+// ADMIN <subcommand> [<args>]
+func admin(s *Server, u *user, args []string) {
+	command := strings.Join(args[1:], " ")
+	if !s.isAdmin(u) {
+		s.audit(u, adminDeniedAudit, u.name, command)
+		adminFailed(u, args)
+		return
+	}
+
+	var rest string
+	if len(args) == 3 {
+		rest = args[2]
+	}
+	switch args[1] {
+	case "BAN":
+		s.audit(u, banAudit, u.name, rest)
+	case "UNBAN":
+		s.audit(u, unbanAudit, u.name, rest)
+	case "KICK":
+		s.audit(u, kickAudit, u.name, rest)
+	default:
+		s.audit(u, adminAudit, u.name, command)
+	}
+	switch args[1] {
+	case "BAN", "UNBAN":
+		adminBan(s, u, args[1], rest)
+	case "BANS":
+		adminBans(s, u)
+	case "SHUTDOWN":
+		u.send([]byte("RESULT ADMIN SHUTDOWN 1\n"))
+		s.userLogger(u).Info("Shutting down at an admin's request")
+		s.Shutdown()
+	case "KICK":
+		adminKick(s, u, rest)
+	case "PURGE":
+		adminPurge(s, u, rest)
+	case "RELOAD":
+		adminReload(s, u)
+	case "CONNECTIONS":
+		adminConnections(s, u)
+	default:
+		adminFailed(u, args)
+	}
+}
+
+func adminFailed(u *user, args []string) {
+	msg := fmt.Sprintf("RESULT %s 0\n", strings.Join(args, " "))
+	u.send([]byte(msg))
+}
+
+// ADMIN BAN <ip|cidr>, ADMIN UNBAN <ip|cidr>
+func adminBan(s *Server, u *user, subcommand, target string) {
+	var confirmation int
+	if ipNet, ok := parseBan(strings.TrimSpace(target)); ok {
+		if subcommand == "BAN" && s.bans.add(ipNet) {
+			confirmation = 1
+			s.enforceBans()
+		} else if subcommand == "UNBAN" && s.bans.remove(ipNet) {
+			confirmation = 1
+		}
+	}
+
+	msg := fmt.Sprintf("RESULT ADMIN %s %s %d\n", subcommand, target, confirmation)
+	u.send([]byte(msg))
+}
+
+// ADMIN BANS
+func adminBans(s *Server, u *user) {
+	var builder bytes.Buffer
+	builder.WriteString("RESULT ADMIN BANS")
+	bans := s.bans.list()
+	for _, ban := range bans {
+		builder.WriteRune(' ')
+		builder.WriteString(ban)
+		builder.WriteRune(',')
+	}
+	if len(bans) > 0 {
+		builder.Truncate(builder.Len() - 1)
+	}
+	builder.WriteRune('\n')
+	u.send(builder.Bytes())
+}
+
+// ADMIN KICK <user>
+//
+// Disconnects every connection logged in as the user, who can log straight back in.
+func adminKick(s *Server, u *user, target string) {
+	var confirmation int
+	s.connectionsLock.RLock()
+	for other := range s.connections {
+		if other.name == target && target != "" {
+			other.conn.Close()
+			confirmation = 1
+		}
+	}
+	s.connectionsLock.RUnlock()
+
+	msg := fmt.Sprintf("RESULT ADMIN KICK %s %d\n", target, confirmation)
+	u.send([]byte(msg))
+}
+
+// ADMIN PURGE <channel>
+//
+// Throws away the channel's history and pins, telling its members with PURGED <channel>.
+func adminPurge(s *Server, u *user, channelName string) {
+	channel, ok := s.channels.get(channelName)
+
+	var confirmation int
+	if ok {
+		channel.settingsLock.Lock()
+		channel.pins = nil
+		channel.usersLock.Lock()
+		channel.historyLock.Lock()
+		channel.history = nil
+		channel.historyLock.Unlock()
+		// Sent once the locks are released, as sending can wait on slow connections
+		members := channel.connections()
+		channel.usersLock.Unlock()
+		channel.settingsLock.Unlock()
+		msg := []byte(fmt.Sprintf("PURGED %s\n", channelName))
+		for _, member := range members {
+			member.send(msg)
+		}
+		confirmation = 1
+	}
+
+	msg := fmt.Sprintf("RESULT ADMIN PURGE %s %d\n", channelName, confirmation)
+	u.send([]byte(msg))
+}
+
+// ADMIN RELOAD
+func adminReload(s *Server, u *user) {
+	var confirmation int
+	if err := s.reload(); err != nil {
+		s.userLogger(u).Error("Failed to reload configuration", "err", err)
+	} else {
+		confirmation = 1
+	}
+	msg := fmt.Sprintf("RESULT ADMIN RELOAD %d\n", confirmation)
+	u.send([]byte(msg))
+}
+
+// ADMIN CONNECTIONS
+//
+// Lists each connection's address, who it is logged in as, or - if nobody, and how many
+// writes to it are waiting.
+func adminConnections(s *Server, u *user) {
+	var builder bytes.Buffer
+	builder.WriteString("RESULT ADMIN CONNECTIONS")
+	s.connectionsLock.RLock()
+	for other := range s.connections {
+		name := other.name
+		if name == "" {
+			name = "-"
+		}
+		builder.WriteString(fmt.Sprintf(" %s %s %d,", other.conn.RemoteAddr(), name, other.out.stats().Depth))
+	}
+	if len(s.connections) > 0 {
+		builder.Truncate(builder.Len() - 1)
+	}
+	s.connectionsLock.RUnlock()
+	builder.WriteRune('\n')
+	u.send(builder.Bytes())
+}
@@ -0,0 +1,41 @@
+package brerver
+
+import "time"
+
+// A security-relevant event, appended as a JSON line to audit_log. Unlike the event log
+// this is for people, not replay, so it records who did what from where.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	User   string    `json:"user,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+const (
+	loginAudit       = "login"
+	loginFailedAudit = "login_failed"
+	registerAudit    = "register"
+	passwdAudit      = "passwd"
+	unregisterAudit  = "unregister"
+	kickAudit        = "kick"
+	banAudit         = "ban"
+	unbanAudit       = "unban"
+	adminAudit       = "admin"
+	// An ADMIN command from someone who isn't one
+	adminDeniedAudit = "admin_denied"
+)
+
+// Records what the connection did, or tried to do, as user
+func (s *Server) audit(u *user, kind, user, detail string) {
+	if s.auditLog == nil {
+		return
+	}
+	s.auditLog.append(auditEntry{
+		Time:   time.Now(),
+		Kind:   kind,
+		User:   user,
+		Remote: u.conn.RemoteAddr().String(),
+		Detail: detail,
+	})
+}
@@ -0,0 +1,94 @@
+package brerver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Somewhere LOGIN can check a username and password against
+type authProvider interface {
+	// Reports whether the provider answers for the account at all, and if so whether
+	// the password is right. The first provider that knows an account decides.
+	authenticate(username, password string) (known bool, ok bool, err error)
+}
+
+// Accounts made with REGISTER, whose passwords the server keeps itself
+type localStore struct {
+	s *Server
+}
+
+func (l localStore) authenticate(username, password string) (bool, bool, error) {
+	pass, ok := l.s.users.get(username)
+
+	// Accounts without a password come from elsewhere, such as AUTH OIDC
+	if !ok || pass == "" {
+		return false, false, nil
+	}
+	return true, checkCredential(pass, password), nil
+}
+
+// AUTH <mechanism> <data>
+func authenticate(s *Server, u *user, args []string) {
+	switch args[1] {
+	case "OIDC":
+		oidcAuthenticate(s, u, args[2])
+	case scramMechanism:
+		// Anything but a client-final-message starts over, whatever an earlier attempt left
+		if !strings.HasPrefix(args[2], "c=") {
+			u.scram = nil
+		}
+		scramAuthenticate(s, u, args[2])
+	default:
+		msg := fmt.Sprintf("RESULT AUTH %s 0\n", args[1])
+		u.send([]byte(msg))
+	}
+}
+
+// Providers LOGIN asks in order, the local store first so a directory can never take
+// over an account someone registered here
+func (s *Server) authProviders() []authProvider {
+	providers := []authProvider{localStore{s}}
+	if s.store != nil {
+		providers = append(providers, s.store)
+	}
+	if directory := s.directoryProvider(); directory != nil {
+		providers = append(providers, directory)
+	}
+	return providers
+}
+
+// Reports whether the password is right for username according to whichever provider
+// knows it, returning that provider
+func (s *Server) checkPassword(username, password string) (authProvider, bool) {
+	if username == "" || password == "" {
+		return nil, false
+	}
+	for _, provider := range s.authProviders() {
+		known, ok, err := provider.authenticate(username, password)
+		if err != nil {
+			s.logger.Error("Failed to check the password", "user", username, "err", err)
+			return provider, false
+		}
+		if known {
+			return provider, ok
+		}
+	}
+	return nil, false
+}
+
+// Makes sure an account vouched for by an outside provider exists, creating it without a
+// password if need be. Fails if the name belongs to an account with a local password.
+func (s *Server) provision(username string) bool {
+	var password string
+	var ok bool
+	s.users.update(username, func(stored string, found bool) (string, bool) {
+		password, ok = stored, found
+		return stored, true
+	})
+
+	if !ok {
+		s.shareAccount(username, "")
+		s.logEvent(registerEvent, username, "", "")
+	}
+	return password == ""
+}
@@ -0,0 +1,100 @@
+package brerver
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// IPs and ranges refused at accept time
+type banList struct {
+	lock sync.RWMutex
+	nets []*net.IPNet
+}
+
+// Accepts CIDR ranges or single addresses
+func parseBan(text string) (*net.IPNet, bool) {
+	if !strings.Contains(text, "/") {
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, false
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+	}
+	_, ipNet, err := net.ParseCIDR(text)
+	return ipNet, err == nil
+}
+
+func (b *banList) add(ipNet *net.IPNet) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, banned := range b.nets {
+		if banned.String() == ipNet.String() {
+			return false
+		}
+	}
+	b.nets = append(b.nets, ipNet)
+	return true
+}
+
+func (b *banList) remove(ipNet *net.IPNet) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i, banned := range b.nets {
+		if banned.String() == ipNet.String() {
+			b.nets = append(b.nets[:i], b.nets[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *banList) list() []string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	var bans []string
+	for _, banned := range b.nets {
+		bans = append(bans, banned.String())
+	}
+	return bans
+}
+
+func (b *banList) banned(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, banned := range b.nets {
+		if banned.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Drops every live connection the ban list now covers
+func (s *Server) enforceBans() {
+	s.connectionsLock.RLock()
+	defer s.connectionsLock.RUnlock()
+
+	for u := range s.connections {
+		if s.bans.banned(u.conn.RemoteAddr()) {
+			u.conn.Close()
+		}
+	}
+}
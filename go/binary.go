@@ -0,0 +1,87 @@
+package brerver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Sent as the very first byte to pick binary framing, which no text or JSON command can start with
+const binaryMagic = 0
+
+// Binary frames are a 4 byte big-endian length followed by that many bytes of fields,
+// each a uvarint length and then the field itself. The first field is the command or
+// frame type, and the rest its arguments, as in JSON mode.
+func appendBinaryFrame(out []byte, kind string, args []string) []byte {
+	var payload []byte
+	var length [binary.MaxVarintLen64]byte
+	for _, field := range append([]string{kind}, args...) {
+		payload = append(payload, length[:binary.PutUvarint(length[:], uint64(len(field)))]...)
+		payload = append(payload, field...)
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+	out = append(out, size[:]...)
+	return append(out, payload...)
+}
+
+func encodeBinaryFrames(msg []byte) []byte {
+	var out []byte
+	eachFrame(msg, func(kind string, args []string) {
+		out = appendBinaryFrame(out, kind, args)
+	})
+	return out
+}
+
+// Reads the next binary frame, returning its fields, or false if it was longer than max
+// and skipped. Fields are nil if the frame was malformed.
+func readBinaryCommand(reader *bufio.Reader, max int) ([]string, bool, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(reader, size[:]); err != nil {
+		return nil, false, truncated(err)
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	// Compared and skipped without converting to int, which a length near 4GiB would
+	// wrap to a negative on 32-bit platforms
+	if uint64(n) > uint64(max) {
+		_, err := io.CopyN(io.Discard, reader, int64(n))
+		return nil, false, truncated(err)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, false, truncated(err)
+	}
+	return binaryFields(payload), true, nil
+}
+
+// The fields in a frame's payload, or nil if it is malformed
+func binaryFields(payload []byte) []string {
+	var fields []string
+	for len(payload) > 0 {
+		length, read := binary.Uvarint(payload)
+		if read <= 0 || length > uint64(len(payload)-read) {
+			return nil
+		}
+		payload = payload[read:]
+		fields = append(fields, string(payload[:length]))
+		payload = payload[length:]
+	}
+	return fields
+}
+
+// Turns a frame's fields into the command and its arguments, reporting whether they are
+// one. Malformed and empty frames aren't.
+func binaryCommand(fields []string) ([]string, bool) {
+	if len(fields) == 0 {
+		return nil, false
+	}
+	return commandWords(fields[0], fields[1:])
+}
+
+// A frame cut off by the connection closing never finished, the same as a line without its newline
+func truncated(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
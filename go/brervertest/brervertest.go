@@ -0,0 +1,169 @@
+// Package brervertest runs brerver servers in the test process, so bots and clients can
+// be tested against the real thing. Connections read with a deadline, failing the test
+// rather than hanging it when the server doesn't say what was expected.
+//
+//	server := brervertest.StartServer(t, brerver.WithConfig(`{"motd": "Hi"}`))
+//	conn := server.Dial(t)
+//	conn.SendExpect("REGISTER user password", "RESULT REGISTER 1")
+//	conn.Login("user", "password")
+//	conn.Expect("MOTD Hi")
+package brervertest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"brerver"
+)
+
+// How long a connection waits for each line before failing the test
+const Timeout = 5 * time.Second
+
+// A server serving in the test process until the test ends
+type Server struct {
+	*brerver.Server
+	// host:port to dial the line protocol at, or pipe for StartPipeServer
+	Addr string
+	pipe *brerver.PipeListener
+}
+
+// Starts a server on a port the system chooses, set up by options, and stops it once the
+// test and its cleanups are done. Give a configuration with brerver.WithConfig.
+func StartServer(t testing.TB, options ...brerver.Option) *Server {
+	t.Helper()
+	return start(t, brerver.NewServer(append([]brerver.Option{brerver.WithPort("0")}, options...)...), nil)
+}
+
+// Starts a server like StartServer, but with no port at all, its connections made in
+// memory, for tests that run many servers at once or can't listen
+func StartPipeServer(t testing.TB, options ...brerver.Option) *Server {
+	t.Helper()
+	ln := brerver.NewPipeListener()
+	return start(t, brerver.NewServer(append([]brerver.Option{brerver.WithListener(ln)}, options...)...), ln)
+}
+
+func start(t testing.TB, server *brerver.Server, pipe *brerver.PipeListener) *Server {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Run(ctx)
+	}()
+	server.WaitForStartup()
+	addr := server.Addr()
+	if addr == nil {
+		cancel()
+		t.Fatalf("Server failed to start: '%v'", <-stopped)
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+
+	// Listening on every interface, which this one is always among
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return &Server{server, fmt.Sprintf("127.0.0.1:%d", tcpAddr.Port), pipe}
+	}
+	return &Server{server, addr.String(), pipe}
+}
+
+// Opens a connection to the server, closed at the end of the test
+func (s *Server) Dial(t testing.TB) *Conn {
+	t.Helper()
+	var conn net.Conn
+	var err error
+	if s.pipe != nil {
+		conn, err = s.pipe.Dial()
+	} else {
+		conn, err = net.Dial("tcp", s.Addr)
+	}
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &Conn{Conn: conn, t: t, reader: bufio.NewReader(conn)}
+}
+
+// A connection speaking the line protocol, whose helpers fail the test it was dialed
+// for when anything goes wrong
+type Conn struct {
+	net.Conn
+	t      testing.TB
+	reader *bufio.Reader
+}
+
+// Sends each line, adding the newlines
+func (c *Conn) Send(lines ...string) {
+	c.t.Helper()
+	var builder strings.Builder
+	for _, line := range lines {
+		builder.WriteString(line + "\n")
+	}
+	c.SetWriteDeadline(time.Now().Add(Timeout))
+	if _, err := c.Write([]byte(builder.String())); err != nil {
+		c.t.Fatalf("Error writing to socket: '%s'", err.Error())
+	}
+}
+
+// Reads the next line, without its newline
+func (c *Conn) ReadLine() string {
+	c.t.Helper()
+	c.SetReadDeadline(time.Now().Add(Timeout))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Error reading from socket after '%s': '%s'", line, err.Error())
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// Reads a line for each of lines, failing unless they are the same, in the same order
+func (c *Conn) Expect(lines ...string) {
+	c.t.Helper()
+	for _, expected := range lines {
+		if line := c.ReadLine(); line != expected {
+			c.t.Fatalf("Expected '%s' but got '%s'", expected, line)
+		}
+	}
+}
+
+// Reads lines until one is line, for when what comes before it doesn't matter
+func (c *Conn) ExpectEventually(line string) {
+	c.t.Helper()
+	for c.ReadLine() != line {
+	}
+}
+
+// Sends line, then expects lines in answer
+func (c *Conn) SendExpect(line string, lines ...string) {
+	c.t.Helper()
+	c.Send(line)
+	c.Expect(lines...)
+}
+
+// Registers an account, failing unless it is made
+func (c *Conn) Register(username, password string) {
+	c.t.Helper()
+	c.SendExpect("REGISTER "+username+" "+password, "RESULT REGISTER 1")
+}
+
+// Asks for a session token with HELLO sessions, then logs in, failing unless both work,
+// and returns the token
+func (c *Conn) Login(username, password string) string {
+	c.t.Helper()
+	c.Send("HELLO sessions")
+	if line := c.ReadLine(); !strings.HasPrefix(line, "RESULT HELLO 1") {
+		c.t.Fatalf("Expected HELLO sessions to work but got '%s'", line)
+	}
+	c.SendExpect("LOGIN "+username+" "+password, "RESULT LOGIN 1")
+	line := c.ReadLine()
+	token, ok := strings.CutPrefix(line, "SESSION ")
+	if !ok || token == "" {
+		c.t.Fatalf("Expected a session token but got '%s'", line)
+	}
+	return token
+}
@@ -0,0 +1,43 @@
+package brervertest_test
+
+import (
+	"testing"
+
+	"brerver"
+	"brerver/brervertest"
+)
+
+func TestStartServer(t *testing.T) {
+	t.Parallel()
+	server := brervertest.StartServer(t, brerver.WithConfig(`{"motd": "Hi"}`))
+	alice := server.Dial(t)
+	bob := server.Dial(t)
+
+	alice.Register("alice", "password")
+	alice.Register("bob", "password")
+	if token := alice.Login("alice", "password"); token == "" {
+		t.Fatal("Expected a session token")
+	}
+	alice.Expect("MOTD Hi")
+	bob.Login("bob", "password")
+	bob.Expect("MOTD Hi")
+
+	alice.SendExpect("CREATE channel", "RESULT CREATE channel 1")
+	alice.SendExpect("JOIN channel", "RESULT JOIN channel 1")
+	bob.SendExpect("JOIN channel", "RESULT JOIN channel 1")
+	alice.Send("SAY channel hello", "PING")
+	alice.ExpectEventually("PONG")
+	bob.Expect("RECV alice channel hello")
+}
+
+func TestStartPipeServer(t *testing.T) {
+	t.Parallel()
+	server := brervertest.StartPipeServer(t)
+	if server.Addr != "pipe" {
+		t.Fatalf("Expected to be serving over pipes but got '%s'", server.Addr)
+	}
+	conn := server.Dial(t)
+	conn.Register("user", "password")
+	conn.Login("user", "password")
+	conn.SendExpect("PING", "PONG")
+}
@@ -0,0 +1,40 @@
+package brerver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Bumped when the protocol changes in a way a capability can't describe
+const protocolVersion = 1
+
+// Optional features, so newer clients can use them only where they exist
+var capabilities = []string{
+	"HISTORY",       // JOIN -since and EXPORT
+	"REACTIONS",     // REACT and REACTIONS
+	"PINS",          // PIN, UNPIN and PINLIMIT
+	"MEMBERLIMIT",   // MEMBERLIMIT and JOIN failing with FULL
+	"PRIVATE",       // CREATE -private, INVITE and UNINVITE
+	"NOTIFY",        // PRESENCE connections and NOTIFYPOLICY
+	"SESSIONS",      // HELLO sessions and RESUME
+	"SAYB",          // SAYB, RECVB and E2E channels
+	"REASONS",       // HELLO reasons
+	"MEMBERS",       // HELLO members, JOINED and LEFT
+	"JSON",          // HELLO json
+	"ZLIB",          // HELLO zlib
+	"BINARY",        // Binary framing when the first byte is zero
+	"SCRAM-SHA-256", // AUTH SCRAM-SHA-256
+}
+
+// CAPS
+//
+// Replies with the protocol version and every optional feature the server supports, like
+// RESULT CAPS 1 1 HISTORY REACTIONS.
+func caps(s *Server, u *user, args []string) {
+	if len(args) != 1 {
+		u.send([]byte("RESULT CAPS 0\n"))
+		return
+	}
+	msg := fmt.Sprintf("RESULT CAPS 1 %d %s\n", protocolVersion, strings.Join(capabilities, " "))
+	u.send([]byte(msg))
+}
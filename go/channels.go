@@ -0,0 +1,116 @@
+package brerver
+
+import (
+	"bytes"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A channel as CHANNELS lists it
+type listedChannel struct {
+	name    string
+	members int
+}
+
+// CHANNELS [-counts] [-match <glob>] [-after <channel>] [-limit <n>]
+//
+// Lists channels in order of name, separated by commas: those whose names match the glob
+// with -match and those after the channel with -after. -counts follows each name with =
+// and how many are joined to it here. Private channels are only listed to their members.
+//
+// Without -after or -limit every channel is listed. With either, the list is a page of no
+// more than -limit or channels_page_size channels, whichever is fewer, and when there are
+// more after it MORE CHANNELS <channel> comes first, naming the channel to list the next
+// page -after.
+func listChannels(s *Server, u *user, args []string) {
+	var counts, paged bool
+	var match, after string
+	limit := s.settings().ChannelsPageSize
+	options := strings.Fields(strings.Join(args[1:], " "))
+	for i := 0; i < len(options); i++ {
+		if options[i] == "-counts" {
+			counts = true
+			continue
+		}
+		if i+1 == len(options) {
+			u.send([]byte("RESULT CHANNELS " + u.outcome(0, badArguments) + "\n"))
+			return
+		}
+		option, value := options[i], options[i+1]
+		i++
+		switch option {
+		case "-match":
+			if _, err := path.Match(value, ""); err != nil {
+				u.send([]byte("RESULT CHANNELS " + u.outcome(0, badArguments) + "\n"))
+				return
+			}
+			match = value
+		case "-after":
+			after = value
+			paged = true
+		case "-limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				u.send([]byte("RESULT CHANNELS " + u.outcome(0, badArguments) + "\n"))
+				return
+			}
+			limit = min(limit, n)
+			paged = true
+		default:
+			u.send([]byte("RESULT CHANNELS " + u.outcome(0, badArguments) + "\n"))
+			return
+		}
+	}
+
+	var channels []listedChannel
+	s.channels.each(func(name string, c *channel) {
+		if after != "" && name <= after {
+			return
+		}
+		if !c.visibleTo(u, name) {
+			return
+		}
+		if matched, _ := path.Match(match, name); match != "" && !matched {
+			return
+		}
+		channels = append(channels, listedChannel{name, c.memberCount()})
+	})
+	slices.SortFunc(channels, func(a, b listedChannel) int {
+		return strings.Compare(a.name, b.name)
+	})
+	if paged && len(channels) > limit {
+		channels = channels[:limit]
+		u.send([]byte("MORE CHANNELS " + channels[limit-1].name + "\n"))
+	}
+
+	var builder bytes.Buffer
+	builder.WriteString("RESULT CHANNELS")
+	for i, c := range channels {
+		if i > 0 {
+			builder.WriteRune(',')
+		}
+		builder.WriteRune(' ')
+		builder.WriteString(c.name)
+		if counts {
+			builder.WriteRune('=')
+			builder.WriteString(strconv.Itoa(c.members))
+		}
+	}
+	builder.WriteRune('\n')
+	u.send(builder.Bytes())
+}
+
+// The channels in the arguments of a RESULT CHANNELS, reporting whether it succeeded.
+// Every name but the last is followed by a comma, so a lone 0 and a reason is a failure.
+func channelsListed(args []string) ([]string, bool) {
+	if len(args) == 2 && args[0] == "0" {
+		return nil, false
+	}
+	channels := make([]string, 0, len(args))
+	for _, name := range args {
+		channels = append(channels, strings.TrimSuffix(name, ","))
+	}
+	return channels, true
+}
@@ -0,0 +1,499 @@
+// Package client speaks the brerver line protocol, so that bots and other programs can
+// chat without framing commands and matching up their RESULTs themselves.
+//
+//	c, err := client.Dial(ctx, "localhost:8000", client.Options{Reconnect: true})
+//	if err != nil { ... }
+//	defer c.Close()
+//	err = c.Login(ctx, "bot", "password")
+//	err = c.Join(ctx, "general")
+//	for event := range c.Events() {
+//		if event.Kind == "RECV" && event.From != "bot" {
+//			c.Say(ctx, event.Channel, "hello "+event.From)
+//		}
+//	}
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events the client holds for Events before it stops reading from the server
+const eventBuffer = 256
+
+// How long reconnecting waits after its first failure, doubling to Options.MaxBackoff
+const firstBackoff = 100 * time.Millisecond
+
+// Returned by commands whose connection was lost before the server answered. Whether
+// the command took effect isn't known.
+var ErrDisconnected = errors.New("disconnected from the server")
+
+// Returned by commands on a client that has been closed
+var ErrClosed = errors.New("client closed")
+
+// How Dial reaches the server and what happens when the connection drops
+type Options struct {
+	// Connect with TLS using this configuration
+	TLS *tls.Config
+	// How long dialing may take, 10 seconds if zero
+	Timeout time.Duration
+	// Dial again whenever the connection drops, logging back in and joining the same
+	// channels, until Close or the password stops working. Without it, the client is
+	// done with once the connection drops, which closes Events.
+	Reconnect bool
+	// Longest wait between attempts to reconnect, 30 seconds if zero
+	MaxBackoff time.Duration
+	// Get JOINED and LEFT events as others join and leave the client's channels
+	Members bool
+}
+
+// Something the server sent that wasn't the answer to a command, or RECONNECTED once
+// the client has logged back in and rejoined after the connection dropped. Commands
+// sent while it was down fail with ErrDisconnected.
+type Event struct {
+	// The frame's type, like RECV, RECVB, NOTIFY or PRESENCE
+	Kind string
+	// Everything after the type. Frames that end in free text, like RECV, have all of it
+	// as the last argument.
+	Args []string
+	// For RECV and RECVB, who said Text in Channel, and for JOINED and LEFT, who joined or
+	// left Channel
+	From    string
+	Channel string
+	Text    string
+}
+
+// Why the server turned a command down
+type ResultError struct {
+	Command string
+	// Like NOT_JOINED, or empty if the server gave none
+	Reason string
+}
+
+func (e *ResultError) Error() string {
+	if e.Reason == "" {
+		return e.Command + " failed"
+	}
+	return e.Command + " failed: " + e.Reason
+}
+
+// A connection to a server, safe for use by several goroutines
+type Client struct {
+	addr    string
+	options Options
+	events  chan Event
+	closed  chan struct{}
+
+	// Held while sending, so that waiters are queued in the order their commands are
+	lock sync.Mutex
+	conn net.Conn
+	// Commands sent but not yet answered, oldest first, by command
+	pending map[string][]*waiter
+	// Remembered to log back in and rejoin with after reconnecting
+	username string
+	password string
+	channels map[string]bool
+	session  string
+}
+
+// A command waiting for its RESULT, which echoes some of its arguments before the 0 or 1
+type waiter struct {
+	echoed int
+	done   chan error
+}
+
+// Connects to the server at addr, which is host:port
+func Dial(ctx context.Context, addr string, options Options) (*Client, error) {
+	if options.Timeout == 0 {
+		options.Timeout = 10 * time.Second
+	}
+	if options.MaxBackoff == 0 {
+		options.MaxBackoff = 30 * time.Second
+	}
+	c := &Client{
+		addr:     addr,
+		options:  options,
+		events:   make(chan Event, eventBuffer),
+		closed:   make(chan struct{}),
+		pending:  map[string][]*waiter{},
+		channels: map[string]bool{},
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.run(conn)
+	// For ResultError.Reason. Servers without reasons refuse, and their errors go without.
+	var refused *ResultError
+	if err := c.do(ctx, 0, "HELLO", "reasons"); err != nil && !errors.As(err, &refused) {
+		c.Close()
+		return nil, err
+	}
+	if c.options.Members {
+		if err := c.do(ctx, 0, "HELLO", "members"); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.options.Timeout}
+	if c.options.TLS != nil {
+		return (&tls.Dialer{NetDialer: dialer, Config: c.options.TLS}).DialContext(ctx, "tcp", c.addr)
+	}
+	return dialer.DialContext(ctx, "tcp", c.addr)
+}
+
+// What the server sends other than answers to commands. Reading from the server waits
+// while it's full, so it needs draining. Closed once the client is closed, or when the
+// connection drops without Options.Reconnect.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// The session token from the last successful Login, for RESUME
+func (c *Client) Session() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.session
+}
+
+// Hangs up, failing commands still waiting with ErrClosed
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	return c.conn.Close()
+}
+
+func (c *Client) Register(ctx context.Context, username, password string) error {
+	return c.do(ctx, 0, "REGISTER", username, password)
+}
+
+// Logs in, remembering the account to log back in to after reconnecting, and asks for a
+// session token first
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	if err := c.do(ctx, 0, "HELLO", "sessions"); err != nil {
+		return err
+	}
+	if err := c.do(ctx, 0, "LOGIN", username, password); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.username, c.password = username, password
+	return nil
+}
+
+func (c *Client) Create(ctx context.Context, channel string) error {
+	return c.do(ctx, 1, "CREATE", channel)
+}
+
+// Joins channel, remembering to join it again after reconnecting
+func (c *Client) Join(ctx context.Context, channel string) error {
+	if err := c.do(ctx, 1, "JOIN", channel); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.channels[channel] = true
+	return nil
+}
+
+func (c *Client) Leave(ctx context.Context, channel string) error {
+	c.lock.Lock()
+	delete(c.channels, channel)
+	c.lock.Unlock()
+	return c.do(ctx, 1, "LEAVE", channel)
+}
+
+// Says text in channel. The server sends it back as a RECV event like everyone else's.
+func (c *Client) Say(ctx context.Context, channel, text string) error {
+	return c.do(ctx, 1, "SAY", channel, text)
+}
+
+// Sends command with its arguments and waits for its RESULT, whose first echoed
+// arguments are skipped before the 0 or 1
+func (c *Client) do(ctx context.Context, echoed int, command string, args ...string) error {
+	// Only the last of several arguments, like SAY's text, may have spaces in it
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, "\r\n") || ((len(args) == 1 || i < len(args)-1) && strings.Contains(arg, " ")) {
+			return fmt.Errorf("%s: '%s' isn't allowed there", command, arg)
+		}
+	}
+
+	w := &waiter{echoed: echoed, done: make(chan error, 1)}
+	c.lock.Lock()
+	select {
+	case <-c.closed:
+		c.lock.Unlock()
+		return ErrClosed
+	default:
+	}
+	line := strings.Join(append([]string{command}, args...), " ") + "\n"
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		c.lock.Unlock()
+		return ErrDisconnected
+	}
+	c.pending[command] = append(c.pending[command], w)
+	c.lock.Unlock()
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closed:
+		return ErrClosed
+	}
+}
+
+// Reads from the server until the client is closed, reconnecting if it should whenever
+// the connection drops
+func (c *Client) run(conn net.Conn) {
+	defer close(c.events)
+	reader := bufio.NewReader(conn)
+	for {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			kind, args := splitFrame(strings.TrimSuffix(line, "\n"))
+			if kind == "RESULT" {
+				c.answer(args)
+			} else if !c.handle(kind, args) {
+				return
+			}
+		}
+		conn.Close()
+
+		c.lock.Lock()
+		for command, waiters := range c.pending {
+			for _, w := range waiters {
+				w.done <- ErrDisconnected
+			}
+			delete(c.pending, command)
+		}
+		c.lock.Unlock()
+		if !c.options.Reconnect {
+			return
+		}
+		if conn, reader = c.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+// Hands the RESULT to the oldest command waiting on it
+func (c *Client) answer(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	c.lock.Lock()
+	waiters := c.pending[args[0]]
+	if len(waiters) == 0 {
+		c.lock.Unlock()
+		return
+	}
+	w := waiters[0]
+	c.pending[args[0]] = waiters[1:]
+	c.lock.Unlock()
+	w.done <- outcome(args, w.echoed)
+}
+
+// What a RESULT's arguments, starting with the command, say about it
+func outcome(args []string, echoed int) error {
+	rest := args[1:]
+	if len(rest) > echoed {
+		rest = rest[echoed:]
+	}
+	if len(rest) > 0 && rest[0] == "1" {
+		return nil
+	}
+	return &ResultError{Command: args[0], Reason: strings.Join(rest[min(1, len(rest)):], " ")}
+}
+
+// Passes on a frame that isn't a RESULT, returning false if the client was closed first
+func (c *Client) handle(kind string, args []string) bool {
+	if kind == "SESSION" && len(args) == 1 {
+		c.lock.Lock()
+		c.session = args[0]
+		c.lock.Unlock()
+	}
+	select {
+	case c.events <- newEvent(kind, args):
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// Dials again with backoff, logging back in and rejoining before the connection is used
+// for anything else, until that works or the client is closed. Gives up, closing the
+// client, if the server won't take the password any more.
+func (c *Client) reconnect() (net.Conn, *bufio.Reader) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	c.lock.Lock()
+	username, password := c.username, c.password
+	c.lock.Unlock()
+	backoff := firstBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, nil
+		}
+		backoff = min(backoff*2, c.options.MaxBackoff)
+
+		conn, err := c.dial(ctx)
+		if err != nil {
+			continue
+		}
+		reader := bufio.NewReader(conn)
+		var refused *ResultError
+		if err := c.rejoin(conn, reader, username, password); errors.As(err, &refused) {
+			conn.Close()
+			c.Close()
+			return nil, nil
+		} else if err != nil {
+			conn.Close()
+			continue
+		}
+
+		c.lock.Lock()
+		select {
+		case <-c.closed:
+			c.lock.Unlock()
+			conn.Close()
+			return nil, nil
+		default:
+		}
+		c.conn = conn
+		c.lock.Unlock()
+		if !c.handle("RECONNECTED", nil) {
+			return nil, nil
+		}
+		return conn, reader
+	}
+}
+
+// Logs in on a new connection and joins the channels that were joined before, where
+// they can still be joined
+func (c *Client) rejoin(conn net.Conn, reader *bufio.Reader, username, password string) error {
+	conn.SetDeadline(time.Now().Add(c.options.Timeout))
+	defer conn.SetDeadline(time.Time{})
+	var refused *ResultError
+	if err := c.exchange(conn, reader, 0, "HELLO", "reasons"); err != nil && !errors.As(err, &refused) {
+		return err
+	}
+	if c.options.Members {
+		if err := c.exchange(conn, reader, 0, "HELLO", "members"); err != nil {
+			return err
+		}
+	}
+	if username != "" {
+		if err := c.exchange(conn, reader, 0, "HELLO", "sessions"); err != nil {
+			return err
+		}
+		if err := c.exchange(conn, reader, 0, "LOGIN", username, password); err != nil {
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	channels := make([]string, 0, len(c.channels))
+	for channel := range c.channels {
+		channels = append(channels, channel)
+	}
+	c.lock.Unlock()
+	for _, channel := range channels {
+		if err := c.exchange(conn, reader, 1, "JOIN", channel); errors.As(err, &refused) {
+			c.lock.Lock()
+			delete(c.channels, channel)
+			c.lock.Unlock()
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends a command on a connection nothing else is using yet and reads until its RESULT,
+// passing on whatever comes before it
+func (c *Client) exchange(conn net.Conn, reader *bufio.Reader, echoed int, command string, args ...string) error {
+	line := strings.Join(append([]string{command}, args...), " ") + "\n"
+	if _, err := conn.Write([]byte(line)); err != nil {
+		return err
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		kind, frameArgs := splitFrame(strings.TrimSuffix(line, "\n"))
+		if kind == "RESULT" && len(frameArgs) > 0 && frameArgs[0] == command {
+			return outcome(frameArgs, echoed)
+		}
+		if kind != "RESULT" && !c.handle(kind, frameArgs) {
+			return ErrClosed
+		}
+	}
+}
+
+// How many arguments come before the free text at the end of frames that have some
+var frameFields = map[string]int{
+	"RECV":     2,
+	"RECVB":    2,
+	"HISTORY":  3,
+	"HISTORYB": 3,
+	"PINNED":   3,
+	"MOTD":     0,
+}
+
+// Splits a frame, without its newline, into its type and arguments
+func splitFrame(line string) (string, []string) {
+	kind, rest, found := strings.Cut(line, " ")
+	if !found {
+		return kind, nil
+	}
+	if n, ok := frameFields[kind]; ok {
+		return kind, strings.SplitN(rest, " ", n+1)
+	}
+	return kind, strings.Fields(rest)
+}
+
+func newEvent(kind string, args []string) Event {
+	event := Event{Kind: kind, Args: args}
+	if (kind == "RECV" || kind == "RECVB") && len(args) == 3 {
+		event.From, event.Channel, event.Text = args[0], args[1], args[2]
+	}
+	if (kind == "JOINED" || kind == "LEFT") && len(args) == 2 {
+		event.From, event.Channel = args[0], args[1]
+	}
+	return event
+}
@@ -0,0 +1,137 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"brerver"
+	"brerver/brervertest"
+	"brerver/client"
+)
+
+func dial(t *testing.T, addr string, options client.Options) *client.Client {
+	t.Helper()
+	c, err := client.Dial(context.Background(), addr, options)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Waits for the next event of kind, skipping others
+func expectEvent(t *testing.T, c *client.Client, kind string) client.Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-c.Events():
+			if !ok {
+				t.Fatalf("Expected %s but the events ended", kind)
+			}
+			if event.Kind == kind {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("Expected %s", kind)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+	addr := brervertest.StartServer(t).Addr
+	ctx := context.Background()
+	c := dial(t, addr, client.Options{})
+
+	if err := c.Login(ctx, "bot", "password"); err == nil {
+		t.Fatal("Expected logging in to an account that doesn't exist to fail")
+	}
+	if err := c.Register(ctx, "bot", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Login(ctx, "bot", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Session() == "" {
+		t.Fatal("Expected a session token after logging in")
+	}
+	var refused *client.ResultError
+	if err := c.Say(ctx, "channel", "too soon"); !errors.As(err, &refused) || refused.Reason != "NOT_JOINED" {
+		t.Fatalf("Expected NOT_JOINED but got '%v'", err)
+	}
+	if err := c.Create(ctx, "channel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Join(ctx, "channel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Join(ctx, "two words"); err == nil {
+		t.Fatal("Expected a channel name with a space to be refused")
+	}
+
+	// Commands from several goroutines each get their own answer
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			errs <- c.Say(ctx, "channel", fmt.Sprintf("hello %d", i))
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	event := expectEvent(t, c, "RECV")
+	if event.From != "bot" || event.Channel != "channel" || event.Text[:6] != "hello " {
+		t.Fatalf("Expected one of the messages but got %+v", event)
+	}
+
+	c.Close()
+	if err := c.Say(ctx, "channel", "closed"); err != client.ErrClosed {
+		t.Fatalf("Expected ErrClosed but got '%v'", err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	t.Parallel()
+	server := brervertest.StartServer(t, brerver.WithConfig(`{"admins": ["admin"]}`))
+	addr := server.Addr
+	ctx := context.Background()
+	admin := dial(t, addr, client.Options{Members: true})
+	bot := dial(t, addr, client.Options{Reconnect: true})
+	for _, step := range []error{
+		admin.Register(ctx, "admin", "password"),
+		admin.Register(ctx, "bot", "password"),
+		admin.Login(ctx, "admin", "password"),
+		admin.Create(ctx, "channel"),
+		admin.Join(ctx, "channel"),
+		bot.Login(ctx, "bot", "password"),
+		bot.Join(ctx, "channel"),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+	if event := expectEvent(t, admin, "JOINED"); event.From != "bot" || event.Channel != "channel" {
+		t.Fatalf("Expected the bot to join but got %+v", event)
+	}
+
+	// Kicked, the bot comes back logged in and in the channel
+	conn := server.Dial(t)
+	conn.Login("admin", "password")
+	conn.Send("ADMIN KICK bot")
+	conn.ExpectEventually("RESULT ADMIN KICK bot 1")
+	expectEvent(t, bot, "RECONNECTED")
+	if err := admin.Say(ctx, "channel", "welcome back"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if event := expectEvent(t, bot, "RECV"); event.Text == "welcome back" {
+			break
+		}
+	}
+}
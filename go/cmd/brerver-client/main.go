@@ -0,0 +1,150 @@
+// Brerver-client chats with a server from the terminal. Lines are said in the channel
+// last joined, or switched to with /join, and commands start with a slash:
+//
+//	/register <user> <password>  /login <user> <password>
+//	/create <channel>  /join <channel>  /leave <channel>
+//	/msg <channel> <text>  /quit
+//
+// Messages arrive as "[channel] user: text", and anything else the server sends as
+// "* " followed by the frame.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"brerver/client"
+)
+
+const usage = "Usage: 'brerver-client [-user <name> -password <password>] [-tls] [-reconnect=false] <addr>'"
+
+const help = `/register <user> <password>  make an account
+/login <user> <password>     log in to it
+/create <channel>            make a channel
+/join <channel>              join a channel and say lines there
+/leave <channel>             leave a channel
+/msg <channel> <text>        say text in a channel without switching to it
+/quit                        hang up`
+
+// Writes lines whole, so incoming messages don't break into each other
+type terminal struct {
+	lock sync.Mutex
+}
+
+func (t *terminal) println(format string, args ...any) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	fmt.Printf(format+"\n", args...)
+}
+
+func main() {
+	username := flag.String("user", "", "log in as this account on connecting")
+	password := flag.String("password", "", "password for -user")
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	reconnect := flag.Bool("reconnect", true, "dial again and rejoin when the connection drops")
+	flag.Parse()
+	if flag.NArg() != 1 || (*username == "") != (*password == "") {
+		log.Fatalln(usage)
+	}
+
+	ctx := context.Background()
+	options := client.Options{Reconnect: *reconnect}
+	if *useTLS {
+		options.TLS = &tls.Config{}
+	}
+	c, err := client.Dial(ctx, flag.Arg(0), options)
+	if err != nil {
+		log.Fatalln("Failed to connect: " + err.Error())
+	}
+	var quitting atomic.Bool
+	defer func() {
+		quitting.Store(true)
+		c.Close()
+	}()
+
+	out := &terminal{}
+	go func() {
+		for event := range c.Events() {
+			switch event.Kind {
+			case "RECV":
+				out.println("[%s] %s: %s", event.Channel, event.From, event.Text)
+			case "SESSION":
+			default:
+				out.println("* %s", strings.TrimSpace(event.Kind+" "+strings.Join(event.Args, " ")))
+			}
+		}
+		if !quitting.Load() {
+			out.println("* Disconnected")
+			os.Exit(1)
+		}
+	}()
+
+	if *username != "" {
+		if err := c.Login(ctx, *username, *password); err != nil {
+			log.Fatalln(err.Error())
+		}
+	}
+	out.println("Connected to %s, /help for commands", flag.Arg(0))
+
+	current := ""
+	lines := bufio.NewScanner(os.Stdin)
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			if current == "" {
+				out.println("* Join a channel first")
+				continue
+			}
+			report(out, c.Say(ctx, current, line))
+			continue
+		}
+
+		command, rest, _ := strings.Cut(line[1:], " ")
+		args := strings.Fields(rest)
+		switch {
+		case command == "quit":
+			return
+		case command == "help":
+			out.println("%s", help)
+		case command == "register" && len(args) == 2:
+			report(out, c.Register(ctx, args[0], args[1]))
+		case command == "login" && len(args) == 2:
+			report(out, c.Login(ctx, args[0], args[1]))
+		case command == "create" && len(args) == 1:
+			report(out, c.Create(ctx, args[0]))
+		case command == "join" && len(args) == 1:
+			if err := c.Join(ctx, args[0]); report(out, err) {
+				current = args[0]
+			}
+		case command == "leave" && len(args) == 1:
+			if err := c.Leave(ctx, args[0]); report(out, err) && current == args[0] {
+				current = ""
+			}
+		case command == "msg" && len(args) >= 2:
+			channel, text, _ := strings.Cut(strings.TrimSpace(rest), " ")
+			report(out, c.Say(ctx, channel, strings.TrimSpace(text)))
+		default:
+			out.println("* Unknown command or wrong arguments, /help for commands")
+		}
+	}
+}
+
+// Prints what went wrong, if anything, reporting whether it worked
+func report(out *terminal, err error) bool {
+	if err != nil {
+		out.println("* %s", err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"brerver"
+)
+
+// Flags not given on the command line can come from the environment, like BRERVER_PORT
+// for -port
+const environmentPrefix = "BRERVER_"
+
+func main() {
+	pidfile := flag.String("pidfile", "", "write the process ID to this file while running")
+	port := flag.String("port", "", "port to listen on, or - for only the listen addresses in the configuration; instead of the first argument")
+	configPath := flag.String("config", "", "JSON, TOML or YAML configuration file; instead of the second argument")
+	logLevel := flag.String("log-level", "info", "least severe logs to write: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "write logs as text or json")
+	flag.Parse()
+	if err := brerver.FlagsFromEnvironment(flag.CommandLine, environmentPrefix); err != nil {
+		log.Fatalln(err.Error())
+	}
+	logger, err := brerver.NewLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	slog.SetDefault(logger)
+	args := flag.Args()
+
+	// Everything but the subcommands can do without arguments when the flags or
+	// environment say where to listen
+	if len(args) < 1 && *port == "" {
+		fmt.Fprintf(os.Stderr, "Incorrect number of command line arguments\n")
+		fmt.Fprintf(os.Stderr, "Usage: './brerver [-pidfile <path>] [-log-level <level>] [-log-format text|json] [-port <port|->] [-config <path>] [<port|-> [<config.json|.toml|.yaml>]]', './brerver config-schema', './brerver replay [-speed <n>] [-sink <addr>] <eventlog>' or './brerver smoketest [-user <name> -password <password>] [-tls] <addr>'\n")
+		fmt.Fprintf(os.Stderr, "Flags can also be set with environment variables like %sPORT and %sCONFIG\n", environmentPrefix, environmentPrefix)
+		os.Exit(1)
+	}
+	if len(args) == 0 {
+		args = []string{""}
+	}
+
+	if args[0] == "replay" {
+		replay(args[1:])
+		return
+	}
+
+	if args[0] == "smoketest" {
+		smoketest(args[1:])
+		return
+	}
+
+	if args[0] == "config-schema" {
+		bytes, err := json.MarshalIndent(brerver.ConfigSchema(), "", "    ")
+		if err != nil {
+			log.Fatalln("Failed to generate configuration schema: " + err.Error())
+		}
+		fmt.Println(string(bytes))
+		return
+	}
+
+	if len(args) > 2 || (*port != "" && args[0] != "") || (*configPath != "" && len(args) == 2) {
+		log.Fatalln("Give the port and configuration either as arguments or with -port and -config, not both")
+	}
+	if *port == "" {
+		*port = args[0]
+	}
+	if *configPath == "" && len(args) == 2 {
+		*configPath = args[1]
+	}
+
+	options := []brerver.Option{brerver.WithPort(*port)}
+	if *configPath != "" {
+		path := *configPath
+		config, err := brerver.ReadConfig(path)
+		if err != nil {
+			log.Fatalln("Failed to read configuration file: " + err.Error())
+		}
+		options = append(options, brerver.WithConfig(config), brerver.WithConfigLoader(func() (string, error) {
+			return brerver.ReadConfig(path)
+		}))
+	}
+	server := brerver.NewServer(options...)
+	if err := server.InheritHandover(); err != nil {
+		log.Fatalln("Failed to take over from the previous process: " + err.Error())
+	}
+	if err := server.InheritSocketActivation(); err != nil {
+		log.Fatalln("Failed to take the sockets from systemd: " + err.Error())
+	}
+	if *pidfile != "" {
+		pid := strconv.Itoa(os.Getpid()) + "\n"
+		if err := os.WriteFile(*pidfile, []byte(pid), 0644); err != nil {
+			log.Fatalln("Failed to write pidfile: " + err.Error())
+		}
+		// After a handover the file belongs to the new process
+		defer func() {
+			if current, err := os.ReadFile(*pidfile); err == nil && string(current) == pid {
+				os.Remove(*pidfile)
+			}
+		}()
+	}
+
+	if brerver.RunAsService(server) {
+		return
+	}
+	stop := server.HandleSignals()
+	defer stop()
+	// Whoever started the server learns where it's listening, even on port 0
+	go func() {
+		server.WaitForStartup()
+		if addr := server.Addr(); addr != nil {
+			fmt.Println(addr.String())
+		}
+	}()
+	if err := server.Run(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Reconstructs the state in an event log, printing the messages to stdout or a TCP sink
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := flags.Float64("speed", 0, "replay this many times faster than it happened, as fast as possible if zero")
+	sinkAddr := flags.String("sink", "", "send messages to this TCP address instead of stdout")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalln("Usage: './brerver replay [-speed <n>] [-sink <addr>] <eventlog>'")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalln("Failed to open event log: " + err.Error())
+	}
+	defer file.Close()
+
+	var sink io.Writer = os.Stdout
+	if *sinkAddr != "" {
+		conn, err := net.Dial("tcp", *sinkAddr)
+		if err != nil {
+			log.Fatalln("Failed to connect to sink: " + err.Error())
+		}
+		defer conn.Close()
+		sink = conn
+	}
+
+	server, err := brerver.Replay(file, sink, *speed)
+	if err != nil {
+		log.Fatalln("Failed to replay event log: " + err.Error())
+	}
+	server.Describe(os.Stderr)
+}
+
+// Checks a deployed server works end to end, exiting non-zero if it doesn't
+func smoketest(args []string) {
+	flags := flag.NewFlagSet("smoketest", flag.ExitOnError)
+	var options brerver.SmoketestOptions
+	flags.StringVar(&options.Username, "user", "", "log in as this account instead of registering a throwaway one")
+	flags.StringVar(&options.Password, "password", "", "password for -user")
+	flags.BoolVar(&options.TLS, "tls", false, "connect with TLS")
+	flags.DurationVar(&options.Timeout, "timeout", 10*time.Second, "how long each step may take")
+	flags.Parse(args)
+	if flags.NArg() != 1 || (options.Username == "") != (options.Password == "") {
+		log.Fatalln("Usage: './brerver smoketest [-user <name> -password <password>] [-tls] [-timeout <duration>] <addr>'")
+	}
+
+	if err := brerver.Smoketest(flags.Arg(0), options); err != nil {
+		log.Fatalln("Smoke test failed: " + err.Error())
+	}
+	fmt.Println("Smoke test passed")
+}
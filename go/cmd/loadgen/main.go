@@ -0,0 +1,192 @@
+// Loadgen opens connections to a running server, has them all join the same channels and
+// say messages at a steady rate between them, then reports how long the messages took to
+// be delivered.
+//
+//	loadgen [-conns <n>] [-channels <m>] [-rate <messages/s>] [-duration <d>] <addr>
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What the messages loadgen says start with, followed by when they were said
+const marker = "loadgen"
+
+type client struct {
+	name   string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Sends command and reads lines until the RESULT for it, which it returns
+func (c *client) do(command string) (string, error) {
+	if _, err := fmt.Fprintf(c.conn, "%s\n", command); err != nil {
+		return "", err
+	}
+	result := "RESULT " + strings.Fields(command)[0] + " "
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", command, err)
+		}
+		if strings.HasPrefix(line, result) {
+			return strings.TrimSuffix(line, "\n"), nil
+		}
+	}
+}
+
+// Connects as name, registering it unless an earlier run already has, and joins channels
+func connect(addr, name, password string, channels []string) (*client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{name: name, conn: conn, reader: bufio.NewReader(conn)}
+	if _, err := c.do("REGISTER " + name + " " + password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if line, err := c.do("LOGIN " + name + " " + password); err != nil || line != "RESULT LOGIN 1" {
+		conn.Close()
+		return nil, fmt.Errorf("logging in as %s: %q %v", name, line, err)
+	}
+	for _, channel := range channels {
+		// The channel may be there already, which joining will tell
+		if _, err := c.do("CREATE " + channel); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if line, err := c.do("JOIN " + channel); err != nil || line != "RESULT JOIN "+channel+" 1" {
+			conn.Close()
+			return nil, fmt.Errorf("joining %s: %q %v", channel, line, err)
+		}
+	}
+	return c, nil
+}
+
+// Delivery latencies gathered from every connection
+type latencies struct {
+	lock    sync.Mutex
+	samples []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.samples = append(l.samples, d)
+}
+
+// The latency below which fraction p of the samples fall
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[min(int(p*float64(len(sorted))), len(sorted)-1)]
+}
+
+func main() {
+	conns := flag.Int("conns", 10, "connections to open")
+	numChannels := flag.Int("channels", 1, "channels every connection joins")
+	rate := flag.Float64("rate", 100, "messages said each second, across all connections")
+	duration := flag.Duration("duration", 10*time.Second, "how long to keep saying messages")
+	prefix := flag.String("prefix", "loadgen", "start of the account and channel names used")
+	password := flag.String("password", "loadgen-password", "password for the accounts")
+	flag.Parse()
+	if flag.NArg() != 1 || *conns < 1 || *numChannels < 1 || *rate <= 0 {
+		fmt.Fprintf(os.Stderr, "Usage: 'loadgen [-conns <n>] [-channels <m>] [-rate <messages/s>] [-duration <d>] [-prefix <name>] [-password <password>] <addr>'\n")
+		os.Exit(1)
+	}
+	addr := flag.Arg(0)
+
+	channels := make([]string, *numChannels)
+	for i := range channels {
+		channels[i] = fmt.Sprintf("%s-%d", *prefix, i)
+	}
+	clients := make([]*client, *conns)
+	for i := range clients {
+		c, err := connect(addr, fmt.Sprintf("%s-%d", *prefix, i), *password, channels)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		defer c.conn.Close()
+		clients[i] = c
+	}
+	log.Printf("%d connections in %d channels, saying %.0f messages a second for %s", *conns, *numChannels, *rate, *duration)
+
+	var sent, received, refused atomic.Int64
+	measured := &latencies{}
+	var reading sync.WaitGroup
+	for _, c := range clients {
+		reading.Add(1)
+		go func(c *client) {
+			defer reading.Done()
+			for {
+				line, err := c.reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				fields := strings.Fields(line)
+				switch {
+				case len(fields) == 5 && fields[0] == "RECV" && fields[3] == marker:
+					if said, err := strconv.ParseInt(fields[4], 10, 64); err == nil {
+						measured.add(time.Duration(time.Now().UnixNano() - said))
+						received.Add(1)
+					}
+				case len(fields) >= 4 && fields[0] == "RESULT" && fields[1] == "SAY" && fields[3] != "1":
+					refused.Add(1)
+				}
+			}
+		}(c)
+	}
+
+	// Each connection says its share of the messages, going round the channels
+	interval := time.Duration(float64(*conns) * float64(time.Second) / *rate)
+	deadline := time.Now().Add(*duration)
+	var saying sync.WaitGroup
+	for i, c := range clients {
+		saying.Add(1)
+		go func(i int, c *client) {
+			defer saying.Done()
+			// Spread the connections out over the first interval
+			time.Sleep(interval * time.Duration(i) / time.Duration(len(clients)))
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for n := i; time.Now().Before(deadline); n++ {
+				channel := channels[n%len(channels)]
+				if _, err := fmt.Fprintf(c.conn, "SAY %s %s %d\n", channel, marker, time.Now().UnixNano()); err != nil {
+					return
+				}
+				sent.Add(1)
+				<-ticker.C
+			}
+		}(i, c)
+	}
+	saying.Wait()
+	// Give the last messages time to arrive
+	time.Sleep(time.Second)
+	for _, c := range clients {
+		c.conn.Close()
+	}
+	reading.Wait()
+
+	measured.lock.Lock()
+	samples := measured.samples
+	measured.lock.Unlock()
+	slices.Sort(samples)
+	expected := sent.Load() * int64(*conns)
+	fmt.Printf("sent %d (%.1f/s), refused %d, delivered %d of %d\n", sent.Load(), float64(sent.Load())/duration.Seconds(), refused.Load(), received.Load(), expected)
+	if len(samples) > 0 {
+		fmt.Printf("latency p50 %s p90 %s p99 %s max %s\n", percentile(samples, 0.5), percentile(samples, 0.9), percentile(samples, 0.99), samples[len(samples)-1])
+	}
+}
@@ -0,0 +1,30 @@
+package brerver
+
+import "net"
+
+// Writes msg as is, once everything queued before it has been, then compresses
+// everything after it. Both happen under writeLock, so nothing the writer takes off the
+// queue meanwhile can slip in between and reach the client uncompressed. It doesn't go
+// through the queue, where slow_consumers could throw it away.
+func (u *user) sendThenCompress(msg []byte) {
+	u.flush()
+	u.writeOut(outgoing{msg: u.encode(msg), ticket: u.out.begin(), thenCompress: true})
+}
+
+// Must be called with writeLock held. The messages go out together, in one writev where
+// the connection has it, and compressed ones are flushed together so the client can act
+// on them without waiting for more.
+func (u *user) write(msgs ...[]byte) error {
+	u.setWriteDeadline()
+	if u.compressor == nil {
+		buffers := net.Buffers(msgs)
+		_, err := buffers.WriteTo(u.conn)
+		return err
+	}
+	for _, msg := range msgs {
+		if _, err := u.compressor.Write(msg); err != nil {
+			return err
+		}
+	}
+	return u.compressor.Flush()
+}
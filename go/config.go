@@ -0,0 +1,370 @@
+package brerver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Everything that can be set from the configuration file, which is JSON.
+//
+// The tags double as the documentation printed by config-schema: doc describes the
+// option, default is applied before parsing, and the rest are JSON Schema constraints.
+type Config struct {
+	Listen []ListenAddress `json:"listen" doc:"Addresses to accept connections on, all served alike, in addition to the port on the command line unless that is -"`
+
+	TLSCert string `json:"tls_cert" doc:"Serve TLS using this PEM certificate" requires:"tls_key"`
+	TLSKey  string `json:"tls_key" doc:"PEM private key for tls_cert" requires:"tls_cert"`
+	TLSPort string `json:"tls_port" doc:"Serve TLS on its own port, leaving the main port as plain TCP" requires:"tls_cert"`
+
+	WebSocketPort    string          `json:"websocket_port" doc:"Also serve the line protocol over WebSocket at /ws on this HTTP port, for browsers"`
+	WebSocketOrigins []string        `json:"websocket_origins" doc:"Origins like https://chat.example.com whose pages may open WebSockets, besides pages served from websocket_port's own host; * allows any" requires:"websocket_port"`
+	HTTPPort         string          `json:"http_port" doc:"Also serve a JSON API under /api and Server-Sent Events feeds of channels under /events on this HTTP port, for scripts and dashboards, along with /healthz and /readyz probes"`
+	Webhooks         []WebhookConfig `json:"webhooks" doc:"Endpoints under /hooks on http_port that systems like CI and monitoring can POST {\"text\"} to, posting it in a channel" requires:"http_port"`
+	GRPCPort         string          `json:"grpc_port" doc:"Also serve the Chat service from chatpb/chat.proto over gRPC on this port"`
+	MetricsPort      string          `json:"metrics_port" doc:"Serve Prometheus metrics at /metrics on this HTTP port, along with /healthz and /readyz probes"`
+	DebugAddress     string          `json:"debug_address" doc:"Serve net/http/pprof under /debug/pprof/ at this host:port, like 127.0.0.1:6060, and sample mutex contention for it; keep it off public interfaces"`
+	UnixSocket       string          `json:"unix_socket" doc:"Also accept connections on a unix socket at this path, replacing a stale socket left there"`
+	UnixSocketMode   string          `json:"unix_socket_mode" doc:"Octal permissions for unix_socket, so filesystem permissions decide which local users can connect" default:"0660"`
+	IRCPort          string          `json:"irc_port" doc:"Also serve IRC clients on this port, mapping NICK, USER, PASS, JOIN, PART, PRIVMSG and LIST onto accounts and channels"`
+
+	TLSClientCA    string `json:"tls_client_ca" doc:"Require client certificates signed by this PEM CA bundle" requires:"tls_cert"`
+	TLSClientLogin bool   `json:"tls_client_login" doc:"Log clients in as the account their certificate maps to, skipping LOGIN; needs tls_client_ca" default:"false"`
+
+	RateLimits       map[string]RateLimit `json:"rate_limits" doc:"Token buckets for each command class, unlimited if absent" keys:"auth,chat,presence"`
+	RateLimitStrikes int                  `json:"rate_limit_strikes" doc:"Disconnect after this many rate limited commands in a row, never if zero" default:"0" minimum:"0"`
+
+	MaxLineLength  int `json:"max_line_length" doc:"Longest command accepted in bytes, not counting the newline; longer ones get ERROR TOOLONG" default:"1024" minimum:"1"`
+	MaxLineStrikes int `json:"max_line_strikes" doc:"Disconnect after this many too long commands in a row, never if zero" default:"3" minimum:"0"`
+
+	ChannelsPageSize int `json:"channels_page_size" doc:"Most channels CHANNELS -after or -limit lists at once, the rest coming from CHANNELS -after the last one listed" default:"1000" minimum:"1"`
+
+	ReadDeadlineSeconds int `json:"read_deadline_seconds" doc:"Disconnect clients that send nothing at all for this long, even partway through a command; 0 never does" default:"0" minimum:"0"`
+	FanoutWorkers       int `json:"fanout_workers" doc:"Goroutines sharing out messages to channels with more than fanout_threshold members, each sending to a slice of them; 0 sends from the sender's goroutine alone" default:"4" minimum:"0"`
+	FanoutThreshold     int `json:"fanout_threshold" doc:"Members a channel needs for its messages to be shared out between fanout_workers" default:"1000" minimum:"1"`
+
+	WriteDeadlineSeconds int    `json:"write_deadline_seconds" doc:"Disconnect clients that take longer than this to accept a write, so one that stops reading can't hold up broadcasts to its channels; 0 waits as long as it takes" default:"0" minimum:"0"`
+	SlowConsumers        string `json:"slow_consumers" doc:"What happens to messages for a client with 256 already waiting to be written: block holds up whoever is sending, drop_oldest throws away the oldest waiting and lossy the new one, telling the client how many with DROPPED, and disconnect drops the client after ERROR SLOW" default:"block" enum:"block,drop_oldest,lossy,disconnect"`
+
+	Flood FloodLimit `json:"flood" doc:"Temporarily mute users who SAY too much in one channel"`
+
+	MOTD string `json:"motd" doc:"Message of the day, sent a line at a time as MOTD frames after logging in"`
+
+	DefaultChannels []string `json:"default_channels" doc:"Channels everyone joins on logging in, as if they had sent JOIN; any that don't exist are made, with no operator"`
+
+	Admins []string `json:"admins" doc:"Usernames allowed to use ADMIN commands"`
+	Bans   []string `json:"bans" doc:"IP addresses and CIDR ranges refused at accept time"`
+
+	ProxyProtocol []string `json:"proxy_protocol" doc:"IP addresses and CIDR ranges of load balancers that open connections to the TCP ports with a PROXY protocol v1 or v2 header, whose client address then stands in for theirs"`
+
+	ShutdownSeconds int `json:"shutdown_seconds" doc:"How long shutting down waits for clients to take what is still being sent to them and for connections to close" default:"10" minimum:"0"`
+	IdleSeconds     int `json:"idle_seconds" doc:"Disconnect clients that send no commands, PINGs included, for this long; 0 never does" default:"0" minimum:"0"`
+
+	MaxConnections      int    `json:"max_connections" doc:"Connections served at once before new ones get ERROR BUSY, unlimited if zero" default:"0" minimum:"0"`
+	MaxConnectionsPerIP int    `json:"max_connections_per_ip" doc:"Connections served at once from one IP before new ones get ERROR TOOMANY, unlimited if zero" default:"0" minimum:"0"`
+	BusyAction          string `json:"busy_action" doc:"What happens to connections over max_connections: reject answers them with ERROR BUSY and hangs up, and pause stops accepting until there's room, leaving them waiting in the listen backlog" default:"reject" enum:"reject,pause"`
+
+	Scripts        []string        `json:"scripts" doc:"Starlark files whose on_message and on_join functions run on those events"`
+	CommandPlugins []CommandPlugin `json:"command_plugins" doc:"Commands the server doesn't have itself that other processes answer over HTTP"`
+
+	EventLog string `json:"event_log" doc:"Append every state change to this file as JSON lines, for brerver replay"`
+	AuditLog string `json:"audit_log" doc:"Append logins, registrations, kicks, bans and admin commands to this file as JSON lines"`
+
+	Accounts       AccountRules  `json:"accounts" doc:"What REGISTER accepts as a username and password"`
+	PlaintextLogin bool          `json:"plaintext_login" doc:"Accept LOGIN, which sends the password as is; without it local accounts need AUTH SCRAM-SHA-256" default:"true"`
+	Lockout        LockoutConfig `json:"lockout" doc:"Lock out logins to accounts and from IPs that keep getting the password wrong"`
+
+	OIDC OIDCConfig `json:"oidc" doc:"Let an OpenID Connect identity provider vouch for accounts with AUTH OIDC"`
+	LDAP LDAPConfig `json:"ldap" doc:"Check LOGIN passwords against a directory for accounts not registered here"`
+
+	Stats StatsConfig `json:"stats" doc:"Post a status ticker of server statistics to a channel"`
+
+	Pins PinLimits `json:"pins" doc:"How many pins channels hold and how long they can last"`
+
+	ServerName            string       `json:"server_name" doc:"What this server is called by the servers it links to, one word"`
+	FederationPort        string       `json:"federation_port" doc:"Accept links from peer servers on this port" requires:"server_name"`
+	FederationPingSeconds int          `json:"federation_ping_seconds" doc:"How often links to peers are pinged; a peer that doesn't answer for three pings is split off until it can be linked again" default:"10" minimum:"1"`
+	Peers                 []PeerConfig `json:"peers" doc:"Servers to link with, dialing those with an address again with backoff whenever a link can't be made or drops; nothing else can link without federation_secret" requires:"server_name"`
+	FederationAddress     string       `json:"federation_address" doc:"host:port other servers reach the federation_port at, told to linked servers so that they pass it on and the whole mesh links here" requires:"federation_port"`
+	FederationSharding    bool         `json:"federation_sharding" doc:"Give each channel a home server by consistent hashing, which relays its messages to only the servers with members in it; every server must set it and know of the same servers" default:"false" requires:"server_name"`
+	FederationSecret      string       `json:"federation_secret" doc:"Secret for linking with servers not in peers, which are learned of from linked servers; they must have the same federation_secret" requires:"server_name"`
+}
+
+// Reads a JSON configuration over the defaults, checking it makes sense
+func ParseConfig(text string) (Config, error) {
+	var config Config
+	if err := applyDefaults(&config); err != nil {
+		return config, err
+	}
+	if strings.TrimSpace(text) != "" {
+		decoder := json.NewDecoder(bytes.NewBufferString(text))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return config, describeJSONError(text, err)
+		}
+	}
+
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return config, errors.New("tls_cert and tls_key must be set together")
+	}
+	if config.TLSPort != "" && config.TLSCert == "" {
+		return config, errors.New("tls_port requires tls_cert and tls_key")
+	}
+	if config.TLSClientCA != "" && config.TLSCert == "" {
+		return config, errors.New("tls_client_ca requires tls_cert and tls_key")
+	}
+	if config.TLSClientLogin && config.TLSClientCA == "" {
+		return config, errors.New("tls_client_login requires tls_client_ca")
+	}
+	for _, address := range config.Listen {
+		if !address.valid() {
+			return config, fmt.Errorf("listen address '%s' is not host:port", address.Address)
+		}
+		if address.TLS && config.TLSCert == "" {
+			return config, fmt.Errorf("listen address '%s' uses tls, which requires tls_cert and tls_key", address.Address)
+		}
+	}
+	if config.DebugAddress != "" && !(ListenAddress{Address: config.DebugAddress}).valid() {
+		return config, fmt.Errorf("debug_address '%s' is not host:port", config.DebugAddress)
+	}
+	if !validCommand(strings.ReplaceAll(config.MOTD, "\n", "")) {
+		return config, errors.New("motd can't contain control characters other than newlines and tabs")
+	}
+	for _, channel := range config.DefaultChannels {
+		if !validArgs(channel) {
+			return config, fmt.Errorf("default channel '%s' can't be empty or contain spaces or control characters", channel)
+		}
+	}
+	if mode, err := strconv.ParseUint(config.UnixSocketMode, 8, 32); err != nil || mode > 0777 {
+		return config, errors.New("unix_socket_mode must be octal permissions like 0660")
+	}
+	for class, limit := range config.RateLimits {
+		if class != authClass && class != chatClass && class != presenceClass {
+			return config, fmt.Errorf("unknown rate limit class '%s'", class)
+		}
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return config, fmt.Errorf("rate limit for '%s' needs a positive rate and burst", class)
+		}
+	}
+	if config.RateLimitStrikes < 0 {
+		return config, errors.New("rate_limit_strikes can't be negative")
+	}
+	if config.MaxLineLength < 1 {
+		return config, errors.New("max_line_length must be positive")
+	}
+	if config.MaxLineStrikes < 0 {
+		return config, errors.New("max_line_strikes can't be negative")
+	}
+	if config.ChannelsPageSize < 1 {
+		return config, errors.New("channels_page_size must be positive")
+	}
+	if config.FanoutWorkers < 0 {
+		return config, errors.New("fanout_workers can't be negative")
+	}
+	if config.FanoutThreshold < 1 {
+		return config, errors.New("fanout_threshold must be positive")
+	}
+	if config.ReadDeadlineSeconds < 0 || config.WriteDeadlineSeconds < 0 {
+		return config, errors.New("read and write deadlines can't be negative")
+	}
+	switch config.SlowConsumers {
+	case blockPolicy, dropOldestPolicy, lossyPolicy, disconnectPolicy:
+	default:
+		return config, errors.New("slow_consumers must be block, drop_oldest, lossy or disconnect")
+	}
+	if config.Flood.Messages < 0 || config.Flood.Seconds < 0 || config.Flood.MuteSeconds < 0 {
+		return config, errors.New("flood limits can't be negative")
+	}
+	if config.Flood.Messages > 0 && (config.Flood.Seconds == 0 || config.Flood.MuteSeconds == 0) {
+		return config, errors.New("flood needs seconds and mute_seconds along with messages")
+	}
+	if config.Lockout.Attempts < 0 || config.Lockout.Seconds < 0 {
+		return config, errors.New("lockout attempts and seconds can't be negative")
+	}
+	if config.Lockout.Attempts > 0 && config.Lockout.Seconds == 0 {
+		return config, errors.New("lockout needs seconds along with attempts")
+	}
+	if config.ShutdownSeconds < 0 {
+		return config, errors.New("shutdown_seconds can't be negative")
+	}
+	if config.IdleSeconds < 0 {
+		return config, errors.New("idle_seconds can't be negative")
+	}
+	if config.MaxConnections < 0 || config.MaxConnectionsPerIP < 0 {
+		return config, errors.New("connection limits can't be negative")
+	}
+	if config.BusyAction != rejectBusy && config.BusyAction != pauseBusy {
+		return config, errors.New("busy_action must be reject or pause")
+	}
+	accounts := &config.Accounts
+	if accounts.UsernameMin < 1 || accounts.UsernameMax < accounts.UsernameMin {
+		return config, errors.New("accounts needs 1 <= username_min <= username_max")
+	}
+	if accounts.PasswordMin < 1 || accounts.PasswordMax < accounts.PasswordMin {
+		return config, errors.New("accounts needs 1 <= password_min <= password_max")
+	}
+	pattern, err := regexp.Compile(accounts.UsernamePattern)
+	if err != nil {
+		return config, fmt.Errorf("accounts username_pattern: %w", err)
+	}
+	accounts.usernamePattern = pattern
+	if (config.OIDC.Issuer == "") != (config.OIDC.ClientID == "") {
+		return config, errors.New("oidc issuer and client_id must be set together")
+	}
+	if config.OIDC.UsernameClaim == "" {
+		return config, errors.New("oidc username_claim can't be empty")
+	}
+	if config.Pins.Max < 1 || config.Pins.MaxSeconds < 0 {
+		return config, errors.New("pins needs a positive max and max_seconds that isn't negative")
+	}
+	if config.Stats.IntervalSeconds < 60 {
+		return config, errors.New("stats interval_seconds must be at least 60")
+	}
+	for _, name := range config.Stats.Include {
+		if _, ok := statistics[name]; !ok {
+			return config, fmt.Errorf("unknown statistic '%s'", name)
+		}
+	}
+	ldapConfig := config.LDAP
+	if (ldapConfig.URL == "") != (ldapConfig.BindDN == "") {
+		return config, errors.New("ldap url and bind_dn must be set together")
+	}
+	if ldapConfig.URL == "" && (ldapConfig.StartTLS || ldapConfig.DisableRegister) {
+		return config, errors.New("ldap start_tls and disable_register require url")
+	}
+	if ldapConfig.URL != "" && !strings.HasPrefix(ldapConfig.URL, "ldap://") && !strings.HasPrefix(ldapConfig.URL, "ldaps://") {
+		return config, errors.New("ldap url must start with ldap:// or ldaps://")
+	}
+	if ldapConfig.StartTLS && !strings.HasPrefix(ldapConfig.URL, "ldap://") {
+		return config, errors.New("ldap start_tls needs an ldap:// url")
+	}
+	if ldapConfig.URL != "" && !config.PlaintextLogin {
+		return config, errors.New("ldap requires plaintext_login, as directory passwords are checked by binding with them")
+	}
+	if ldapConfig.URL != "" && (strings.Count(ldapConfig.BindDN, "%s") != 1 || strings.Count(ldapConfig.BindDN, "%") != 1) {
+		return config, errors.New("ldap bind_dn needs exactly one %s for the username")
+	}
+
+	if config.ServerName != "" && !validServerName(config.ServerName) {
+		return config, errors.New("server_name must be one word without control characters")
+	}
+	if (config.FederationPort != "" || len(config.Peers) > 0 || config.FederationSecret != "" || config.FederationSharding) && config.ServerName == "" {
+		return config, errors.New("federation_port, peers, federation_secret and federation_sharding require server_name")
+	}
+	if config.FederationAddress != "" && (config.FederationPort == "" || !(ListenAddress{Address: config.FederationAddress}).valid()) {
+		return config, errors.New("federation_address must be host:port and requires federation_port")
+	}
+	if config.FederationSecret != "" && !validServerName(config.FederationSecret) {
+		return config, errors.New("federation_secret must be one word without control characters")
+	}
+	if config.FederationPingSeconds < 1 {
+		return config, errors.New("federation_ping_seconds must be positive")
+	}
+	peers := map[string]bool{}
+	for _, peer := range config.Peers {
+		if !peer.valid() {
+			return config, fmt.Errorf("peer '%s' needs a one word name and secret, and an address that is host:port if any", peer.Name)
+		}
+		if peer.Name == config.ServerName || peers[peer.Name] {
+			return config, fmt.Errorf("peer name '%s' is server_name or another peer's", peer.Name)
+		}
+		peers[peer.Name] = true
+	}
+
+	if len(config.Webhooks) > 0 && config.HTTPPort == "" {
+		return config, errors.New("webhooks require http_port")
+	}
+	webhooks := map[string]bool{}
+	for _, hook := range config.Webhooks {
+		if !hook.valid() {
+			return config, fmt.Errorf("webhook '%s' needs a one word name and token, a channel and a user", hook.Name)
+		}
+		if webhooks[hook.Name] {
+			return config, fmt.Errorf("webhook name '%s' is another webhook's", hook.Name)
+		}
+		if config.Accounts.checkUsername(hook.User) == "" {
+			return config, fmt.Errorf("webhook '%s' user '%s' could be registered; pick a name REGISTER refuses, like ci*", hook.Name, hook.User)
+		}
+		webhooks[hook.Name] = true
+	}
+
+	plugins := map[string]bool{}
+	for _, plugin := range config.CommandPlugins {
+		if !plugin.valid() {
+			return config, fmt.Errorf("command plugin '%s' needs a command in capital letters and an http:// or https:// url", plugin.Command)
+		}
+		if builtins.has(plugin.Command) || plugins[plugin.Command] {
+			return config, fmt.Errorf("command plugin '%s' is built in or another plugin's", plugin.Command)
+		}
+		plugins[plugin.Command] = true
+	}
+
+	for _, ban := range config.Bans {
+		if _, ok := parseBan(ban); !ok {
+			return config, fmt.Errorf("ban '%s' is not an IP address or CIDR range", ban)
+		}
+	}
+	for _, proxy := range config.ProxyProtocol {
+		if _, ok := parseBan(proxy); !ok {
+			return config, fmt.Errorf("proxy_protocol '%s' is not an IP address or CIDR range", proxy)
+		}
+	}
+	return config, nil
+}
+
+// Says where in text a syntax or type error is, which encoding/json only gives as an offset
+func describeJSONError(text string, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// Counts the character it choked on
+		offset = syntaxErr.Offset - 1
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			return fmt.Errorf("%s should be %s, not %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+	if offset < 0 {
+		offset = 0
+	} else if offset > int64(len(text)) {
+		offset = int64(len(text))
+	}
+	before := text[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := len(before) - strings.LastIndex(before, "\n")
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+func (c Config) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if c.TLSClientCA != "" {
+		bundle, err := os.ReadFile(c.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
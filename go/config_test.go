@@ -0,0 +1,242 @@
+package brerver
+
+import (
+	"encoding/json"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	valid := []string{
+		"",
+		"{}",
+		`{"tls_cert": "cert.pem", "tls_key": "key.pem"}`,
+		`{"tls_cert": "cert.pem", "tls_key": "key.pem", "tls_port": "8443"}`,
+		`{"tls_cert": "cert.pem", "tls_key": "key.pem", "tls_client_ca": "ca.pem", "tls_client_login": true}`,
+		`{"rate_limits": {"auth": {"rate": 0.5, "burst": 3}}, "rate_limit_strikes": 5}`,
+		`{"admins": ["root"], "bans": ["10.0.0.1", "192.168.0.0/16", "::1"]}`,
+		`{"oidc": {"issuer": "https://id.example.com", "client_id": "brerver", "username_claim": "preferred_username"}}`,
+		`{"ldap": {"url": "ldap://ldap.example.com", "bind_dn": "uid=%s,ou=people,dc=example,dc=com", "start_tls": true, "disable_register": true}}`,
+		`{"stats": {"channel": "status", "interval_seconds": 300, "include": ["channels", "users_online"]}}`,
+		`{"pins": {"max": 3, "max_seconds": 86400}}`,
+		`{"lockout": {"attempts": 5, "seconds": 300}}`,
+		`{"max_line_length": 4096, "max_line_strikes": 0}`,
+		`{"unix_socket": "/run/brerver.sock", "unix_socket_mode": "0600"}`,
+		`{"proxy_protocol": ["10.0.0.0/8", "::1"]}`,
+		`{"debug_address": "127.0.0.1:6060"}`,
+		`{"server_name": "a", "federation_port": "7100", "peers": [{"name": "b", "address": "b.example.com:7100", "secret": "s3cret"}, {"name": "c", "secret": "other"}]}`,
+		`{"server_name": "a", "federation_port": "7100", "federation_address": "a.example.com:7100", "federation_secret": "s3cret"}`,
+		`{"server_name": "a", "federation_sharding": true}`,
+		`{"idle_seconds": 300}`,
+		`{"fanout_workers": 0}`,
+		`{"slow_consumers": "disconnect"}`,
+		`{"max_connections": 100, "busy_action": "pause"}`,
+		`{"http_port": "8080", "webhooks": [{"name": "ci", "token": "s3cret", "channel": "builds", "user": "ci*"}]}`,
+		`{"command_plugins": [{"command": "POLL", "url": "http://127.0.0.1:9000/poll"}, {"command": "ROLL", "url": "https://dice.example.com"}]}`,
+		`{"fanout_workers": 16, "fanout_threshold": 100}`,
+		`{"read_deadline_seconds": 600, "write_deadline_seconds": 10}`,
+		`{"motd": "Welcome\n\tBe nice"}`,
+		`{"channels_page_size": 50}`,
+		`{"default_channels": ["general", "announcements"]}`,
+		`{"listen": [{"address": "127.0.0.1:7000"}, {"address": "[::]:7001"}, {"address": ":7443", "tls": true}], "tls_cert": "cert.pem", "tls_key": "key.pem"}`,
+	}
+	for _, text := range valid {
+		if _, err := ParseConfig(text); err != nil {
+			t.Errorf("Expected '%s' to parse but got '%s'", text, err.Error())
+		}
+	}
+
+	invalid := []string{
+		"not json",
+		`{"unknown": 1}`,
+		`{"tls_cert": "cert.pem"}`,
+		`{"tls_port": "8443"}`,
+		`{"tls_client_ca": "ca.pem"}`,
+		`{"tls_cert": "cert.pem", "tls_key": "key.pem", "tls_client_login": true}`,
+		`{"rate_limits": {"admin": {"rate": 1, "burst": 1}}}`,
+		`{"rate_limits": {"chat": {"rate": 0, "burst": 1}}}`,
+		`{"rate_limit_strikes": -1}`,
+		`{"bans": ["10.0.0.256"]}`,
+		`{"accounts": {"username_min": 10, "username_max": 5}}`,
+		`{"accounts": {"username_pattern": "["}}`,
+		`{"oidc": {"issuer": "https://id.example.com"}}`,
+		`{"oidc": {"issuer": "https://id.example.com", "client_id": "brerver", "username_claim": ""}}`,
+		`{"ldap": {"url": "ldap://ldap.example.com"}}`,
+		`{"ldap": {"url": "http://ldap.example.com", "bind_dn": "uid=%s"}}`,
+		`{"ldap": {"url": "ldaps://ldap.example.com", "bind_dn": "uid=%s", "start_tls": true}}`,
+		`{"ldap": {"url": "ldap://ldap.example.com", "bind_dn": "uid=%s,cn=%s"}}`,
+		`{"ldap": {"disable_register": true}}`,
+		`{"stats": {"channel": "status", "interval_seconds": 5}}`,
+		`{"stats": {"channel": "status", "include": ["uptime"]}}`,
+		`{"pins": {"max": 0}}`,
+		`{"lockout": {"attempts": 5}}`,
+		`{"max_line_length": 0}`,
+		`{"max_line_strikes": -1}`,
+		`{"lockout": {"attempts": -1, "seconds": 300}}`,
+		`{"unix_socket_mode": "rw-rw----"}`,
+		`{"unix_socket_mode": "7777"}`,
+		`{"proxy_protocol": ["balancer"]}`,
+		`{"debug_address": "6060"}`,
+		`{"federation_port": "7100"}`,
+		`{"server_name": "two words"}`,
+		`{"server_name": "a", "peers": [{"name": "a", "address": "a.example.com:7100", "secret": "s3cret"}]}`,
+		`{"server_name": "a", "peers": [{"name": "b", "address": "b.example.com", "secret": "s3cret"}]}`,
+		`{"server_name": "a", "peers": [{"name": "b", "address": "b.example.com:7100"}]}`,
+		`{"server_name": "a", "federation_address": "a.example.com:7100"}`,
+		`{"server_name": "a", "federation_port": "7100", "federation_address": "a.example.com"}`,
+		`{"federation_secret": "s3cret"}`,
+		`{"federation_sharding": true}`,
+		`{"server_name": "a", "federation_secret": "two words"}`,
+		`{"shutdown_seconds": -1}`,
+		`{"idle_seconds": -1}`,
+		`{"fanout_workers": -1}`,
+		`{"slow_consumers": "ignore"}`,
+		`{"busy_action": "queue"}`,
+		`{"webhooks": [{"name": "ci", "token": "s3cret", "channel": "builds", "user": "ci*"}]}`,
+		`{"http_port": "8080", "webhooks": [{"name": "ci", "channel": "builds", "user": "ci*"}]}`,
+		`{"http_port": "8080", "webhooks": [{"name": "ci", "token": "a", "channel": "builds", "user": "ci*"}, {"name": "ci", "token": "b", "channel": "builds", "user": "ci*"}]}`,
+		`{"http_port": "8080", "webhooks": [{"name": "ci", "token": "s3cret", "channel": "builds", "user": "ci"}]}`,
+		`{"command_plugins": [{"command": "SAY", "url": "http://127.0.0.1:9000"}]}`,
+		`{"command_plugins": [{"command": "roll", "url": "http://127.0.0.1:9000"}]}`,
+		`{"command_plugins": [{"command": "ROLL", "url": "ftp://127.0.0.1"}]}`,
+		`{"command_plugins": [{"command": "ROLL", "url": "http://a"}, {"command": "ROLL", "url": "http://b"}]}`,
+		`{"fanout_threshold": 0}`,
+		`{"channels_page_size": 0}`,
+		`{"default_channels": ["general", "off topic"]}`,
+		`{"default_channels": [""]}`,
+		`{"write_deadline_seconds": -1}`,
+		`{"motd": "\u001b[2J"}`,
+		`{"listen": [{"address": "7000"}]}`,
+		`{"listen": [{"address": "127.0.0.1:"}]}`,
+		`{"listen": [{"address": ":7443", "tls": true}]}`,
+	}
+	for _, text := range invalid {
+		if _, err := ParseConfig(text); err == nil {
+			t.Errorf("Expected '%s' to fail to parse", text)
+		}
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema := ConfigSchema()
+	properties := schema["properties"].(map[string]any)
+
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		name := jsonName(configType.Field(i))
+		property, ok := properties[name].(map[string]any)
+		if !ok {
+			t.Errorf("Expected '%s' in the schema", name)
+			continue
+		}
+		if _, ok := property["description"]; !ok {
+			t.Errorf("Expected '%s' to be documented", name)
+		}
+	}
+
+	if _, err := json.Marshal(schema); err != nil {
+		t.Errorf("Expected the schema to marshal but got '%s'", err.Error())
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"brerver.json": `{
+			"admins": ["root"],
+			"listen": [{"address": "127.0.0.1:7000"}],
+			"rate_limits": {"chat": {"rate": 0.5, "burst": 3}},
+			"lockout": {"attempts": 5, "seconds": 300}
+		}`,
+		"brerver.toml": `
+admins = ["root"]
+
+[[listen]]
+address = "127.0.0.1:7000"
+
+[rate_limits.chat]
+rate = 0.5
+burst = 3
+
+[lockout]
+attempts = 5
+seconds = 300
+`,
+		"brerver.yaml": `
+admins: [root]
+listen:
+  - address: 127.0.0.1:7000
+rate_limits:
+  chat: {rate: 0.5, burst: 3}
+lockout:
+  attempts: 5
+  seconds: 300
+`,
+	}
+	for path, text := range files {
+		converted, err := configJSON(path, text)
+		if err != nil {
+			t.Errorf("Expected %s to convert but got '%s'", path, err.Error())
+			continue
+		}
+		config, err := ParseConfig(converted)
+		if err != nil {
+			t.Errorf("Expected %s to parse but got '%s'", path, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(config.Admins, []string{"root"}) || len(config.Listen) != 1 || config.Listen[0].Address != "127.0.0.1:7000" ||
+			config.RateLimits["chat"] != (RateLimit{Rate: 0.5, Burst: 3}) || config.Lockout != (LockoutConfig{Attempts: 5, Seconds: 300}) {
+			t.Errorf("Unexpected configuration from %s: %+v", path, config)
+		}
+	}
+
+	if converted, err := configJSON("brerver.toml", "unknown = 1"); err != nil {
+		t.Errorf("Expected unknown options to get as far as ParseConfig but got '%s'", err.Error())
+	} else if _, err := ParseConfig(converted); err == nil {
+		t.Errorf("Expected unknown options to be refused")
+	}
+	if _, err := configJSON("brerver.yaml", "admins: [root"); err == nil {
+		t.Errorf("Expected broken YAML to be refused")
+	}
+
+	errors := map[string]string{
+		"{\n  \"admins\": [\"root\"],\n  \"bans\": [\"10.0.0.1\",]\n}": "line 3, column 23",
+		`{"lockout": {"attempts": "five"}}`:                            "lockout.attempts should be int, not string",
+	}
+	for text, expected := range errors {
+		if _, err := ParseConfig(text); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error mentioning '%s' but got '%v'", expected, err)
+		}
+	}
+}
+
+func TestFlagsFromEnvironment(t *testing.T) {
+	t.Setenv("TEST_PORT", "7000")
+	t.Setenv("TEST_CONFIG", "brerver.toml")
+	t.Setenv("TEST_PID_FILE", "brerver.pid")
+
+	flags := flag.NewFlagSet("brerver", flag.ContinueOnError)
+	port := flags.String("port", "", "")
+	config := flags.String("config", "", "")
+	pidfile := flags.String("pid-file", "", "")
+	if err := flags.Parse([]string{"-config", "brerver.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := FlagsFromEnvironment(flags, "TEST_"); err != nil {
+		t.Fatalf("Expected the environment to apply but got '%s'", err.Error())
+	}
+	if *port != "7000" || *pidfile != "brerver.pid" {
+		t.Errorf("Expected flags from the environment but got port '%s' and pid file '%s'", *port, *pidfile)
+	}
+	if *config != "brerver.yaml" {
+		t.Errorf("Expected the command line to win over the environment but got '%s'", *config)
+	}
+
+	t.Setenv("TEST_COUNT", "many")
+	flags = flag.NewFlagSet("brerver", flag.ContinueOnError)
+	flags.Int("count", 0, "")
+	if err := FlagsFromEnvironment(flags, "TEST_"); err == nil || !strings.Contains(err.Error(), "TEST_COUNT") {
+		t.Errorf("Expected an error naming TEST_COUNT but got '%v'", err)
+	}
+}
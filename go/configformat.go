@@ -0,0 +1,69 @@
+package brerver
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Turns a TOML or YAML configuration file into the JSON ParseConfig reads, going by the
+// extension of path. Anything that isn't .toml, .yaml or .yml is taken to be JSON already.
+// The options and their names are the same whatever the format.
+func configJSON(path, text string) (string, error) {
+	var values map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		if _, err := toml.Decode(text, &values); err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal([]byte(text), &values); err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return text, nil
+	}
+	if values == nil {
+		return "", nil
+	}
+	bytes, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return string(bytes), nil
+}
+
+// Sets each flag that wasn't on the command line from its environment variable, if that
+// is set: prefix followed by the flag's name in upper case with dashes as underscores
+func FlagsFromEnvironment(flags *flag.FlagSet, prefix string) error {
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		name := prefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if given[f.Name] || !ok || err != nil {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s: %w", name, setErr)
+		}
+	})
+	return err
+}
+
+// Reads a JSON, TOML or YAML configuration file as JSON
+func ReadConfig(path string) (string, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return configJSON(path, string(bytes))
+}
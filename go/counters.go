@@ -0,0 +1,41 @@
+package brerver
+
+// Counts kept up as they change, so that metrics, the stats ticker and CHANNELS -counts
+// can read them without taking connectionsLock or the usersLocks that broadcasts need
+
+// Must be called with usersLock held for writing. Every change to users goes through
+// here or removeMember, so that joined stays its size. Reports whether the account wasn't
+// a member already, rather than another of its connections.
+func (c *channel) setMember(u *user) bool {
+	_, ok := c.users[u.name]
+	if !ok {
+		c.joined.Add(1)
+	}
+	c.users[u.name] = u
+	return !ok
+}
+
+// Must be called with usersLock held for writing. Reports whether name was a member.
+func (c *channel) removeMember(name string) bool {
+	if _, ok := c.users[name]; ok {
+		c.joined.Add(-1)
+		delete(c.users, name)
+		return true
+	}
+	return false
+}
+
+// Users joined to the channel here
+func (c *channel) memberCount() int {
+	return int(c.joined.Load())
+}
+
+// Open client connections
+func (s *Server) connectionCount() int {
+	return int(s.openConnections.Load())
+}
+
+// Connections logged in to an account, counting each of an account's connections
+func (s *Server) loggedInCount() int {
+	return int(s.loggedInConnections.Load())
+}
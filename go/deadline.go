@@ -0,0 +1,45 @@
+package brerver
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+func (s *Server) writeDeadline() time.Duration {
+	return time.Duration(s.settings().WriteDeadlineSeconds) * time.Second
+}
+
+// Sets how long the next read may wait for the client, if there's a limit
+func (s *Server) setReadDeadline(u *user) {
+	var deadline time.Time
+	if seconds := s.settings().ReadDeadlineSeconds; seconds > 0 {
+		deadline = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	u.conn.SetReadDeadline(deadline)
+}
+
+// Must be called with writeLock held, before each write
+func (u *user) setWriteDeadline() {
+	if u.writeDeadline == nil {
+		return
+	}
+	var deadline time.Time
+	if timeout := u.writeDeadline(); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	u.conn.SetWriteDeadline(deadline)
+}
+
+// A write that timed out may have sent part of a message, so nothing after it would
+// make sense to the client. Closing the connection ends the reader too, which cleans up.
+func (u *user) writeFailed(err error) {
+	if timedOut(err) {
+		u.conn.Close()
+	}
+}
+
+func timedOut(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
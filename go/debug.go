@@ -0,0 +1,27 @@
+package brerver
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// 1 in this many contended mutex events is sampled for /debug/pprof/mutex
+const mutexProfileFraction = 100
+
+// Serves net/http/pprof under /debug/pprof/ for profiling a live server. Anyone who
+// can reach it can read the server's memory and stall it, so it belongs on localhost.
+func (s *Server) serveDebug(ln net.Listener) {
+	runtime.SetMutexProfileFraction(mutexProfileFraction)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if err := http.Serve(ln, mux); err != nil {
+		s.logger.Info("Stopped serving debug endpoints", "err", err)
+	}
+}
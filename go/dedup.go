@@ -0,0 +1,92 @@
+package brerver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Messages relayed between servers carry an id, <server>:<epoch>:<seq>, made by the
+// server they were said on, whose epoch changes every time it starts. Servers deliver
+// each id only once, so a message that reaches one by two paths, or again when a backlog
+// is replayed after a relink, isn't seen twice by its users.
+
+const (
+	// Ids remembered for each epoch of a server, after which the oldest are forgotten
+	seenMessages = 4096
+	// Epochs remembered for each server, so that a backlog from before it last started
+	// is still checked against what was delivered then
+	seenEpochs = 4
+)
+
+// The ids lately delivered from one server, by epoch
+type seenIDs struct {
+	epochs map[string]*seenEpoch
+	// Oldest first
+	order []string
+}
+
+type seenEpoch struct {
+	ids   map[uint64]bool
+	order []uint64
+}
+
+// A new id for a message said here
+func (s *Server) messageID() string {
+	seq := s.lastMessage.Add(1)
+	return fmt.Sprintf("%s:%s:%d", s.settings().ServerName, s.epoch, seq)
+}
+
+// Reports whether id hasn't been delivered before, remembering it if so. Ids that don't
+// parse count as seen, as they can't be told apart.
+func (s *Server) firstSighting(id string) bool {
+	origin, seqField, ok := cutLast(id, ":")
+	if !ok {
+		return false
+	}
+	server, epoch, ok := cutLast(origin, ":")
+	if !ok {
+		return false
+	}
+	seq, err := strconv.ParseUint(seqField, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	s.seenLock.Lock()
+	defer s.seenLock.Unlock()
+	byEpoch, ok := s.seen[server]
+	if !ok {
+		byEpoch = &seenIDs{epochs: map[string]*seenEpoch{}}
+		s.seen[server] = byEpoch
+	}
+	// A server that started again begins counting again
+	seen, ok := byEpoch.epochs[epoch]
+	if !ok {
+		if len(byEpoch.order) >= seenEpochs {
+			delete(byEpoch.epochs, byEpoch.order[0])
+			byEpoch.order = byEpoch.order[1:]
+		}
+		seen = &seenEpoch{ids: map[uint64]bool{}}
+		byEpoch.epochs[epoch] = seen
+		byEpoch.order = append(byEpoch.order, epoch)
+	}
+	if seen.ids[seq] {
+		return false
+	}
+	if len(seen.order) >= seenMessages {
+		delete(seen.ids, seen.order[0])
+		seen.order = seen.order[1:]
+	}
+	seen.ids[seq] = true
+	seen.order = append(seen.order, seq)
+	return true
+}
+
+// Like strings.Cut, around the last sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
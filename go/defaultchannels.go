@@ -0,0 +1,46 @@
+package brerver
+
+import "slices"
+
+// Makes any of names that don't exist yet. Nobody runs them, as nobody made them.
+func (s *Server) createDefaultChannels(names []string) {
+	for _, name := range names {
+		s.channels.update(name, func(c *channel, ok bool) (*channel, bool) {
+			if ok {
+				return c, true
+			}
+			s.logEvent(createEvent, "", name, "")
+			return newChannel(""), true
+		})
+	}
+}
+
+// Joins u to each of default_channels, answering as JOIN would. Channels the account is
+// already in, here or through another connection, are left alone, as joining would take
+// them away from the other connection.
+func (s *Server) joinDefaultChannels(u *user) {
+	for _, name := range s.settings().DefaultChannels {
+		if c, ok := s.channels.get(name); ok && !c.hasMember(u.name) {
+			join(s, u, []string{"JOIN", name})
+		}
+	}
+}
+
+// Whether name is joined to the channel here, through any connection
+func (c *channel) hasMember(name string) bool {
+	c.usersLock.RLock()
+	defer c.usersLock.RUnlock()
+	_, ok := c.users[name]
+	return ok
+}
+
+// Whether every channel u is joined to is one of default_channels
+func (s *Server) onlyDefaultChannels(u *user) bool {
+	defaults := s.settings().DefaultChannels
+	for name := range u.channels {
+		if !slices.Contains(defaults, name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,14 @@
+// Package brerver is a chat server speaking a line based protocol: REGISTER and LOGIN
+// to accounts, CREATE and JOIN channels, and SAY to them, each answered with a RESULT,
+// with messages arriving as RECV. The same accounts and channels can also be reached
+// over TLS, WebSocket, IRC, gRPC and an HTTP API, and servers can be linked together.
+//
+// cmd/brerver is the command line server. Other programs can serve chat themselves:
+//
+//	server := brerver.NewServer(brerver.WithPort("8000"), brerver.WithConfig(`{"motd": "Welcome"}`))
+//	go server.Run(ctx)
+//	server.WaitForStartup()
+//
+// The configuration is the JSON Config describes, which ParseConfig checks and
+// ConfigSchema lists as a JSON Schema.
+package brerver
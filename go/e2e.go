@@ -0,0 +1,117 @@
+package brerver
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+func (c *channel) isE2E() bool {
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+	return c.e2e
+}
+
+// Relays a base64 payload the server can't read, keeping it in history unless the channel is E2E
+func (s *Server) postBinary(c *channel, from, channelName, blob string) {
+	e2e := c.isE2E()
+	// Recorded along with who to send it to, as post does
+	c.usersLock.RLock()
+	if !e2e {
+		s.logEvent(saybEvent, from, channelName, blob)
+		c.record(from, blob, true)
+	}
+	members := c.connections()
+	c.usersLock.RUnlock()
+
+	line := newSharedLine("RECVB", from, channelName, blob)
+	s.broadcast(members, func(u *user) { u.sendShared(line) })
+	line.release()
+}
+
+// SAYB <channel> <base64>
+//
+// Like SAY, but for payloads clients have encrypted or that aren't text, which members
+// receive untouched as RECVB <user> <channel> <base64>. Scripts and notifications never
+// see them, since there's nothing the server can read.
+func sayBinary(s *Server, u *user, args []string) {
+	channelName := args[1]
+	blob := args[2]
+
+	var confirmation int
+	var reason string
+	defer func() {
+		msg := fmt.Sprintf("RESULT SAYB %s %s\n", channelName, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
+	}()
+
+	channel, ok := u.channels[channelName]
+	if !ok {
+		reason = notJoined
+		return
+	}
+	if _, err := base64.StdEncoding.DecodeString(blob); err != nil || blob == "" {
+		reason = badArguments
+		return
+	}
+	if !s.floodCheck(u, channelName, channel) {
+		reason = mutedInChannel
+		return
+	}
+
+	s.postBinary(channel, u.name, channelName, blob)
+	s.relay("SAYB", u.name, channelName, blob)
+	s.countMessage()
+	confirmation = 1
+}
+
+// E2E <channel>
+// E2E <channel> ON|OFF
+//
+// Fetches whether the channel is end-to-end encrypted, or lets an operator change it.
+// Nothing said in an E2E channel is kept in history or the event log, whether by SAY or SAYB.
+func setE2E(s *Server, u *user, args []string) {
+	channelName := args[1]
+
+	channel, ok := s.channels.get(channelName)
+	// Private channels aren't there to anyone not let in
+	ok = ok && channel.admits(u.name)
+
+	if len(args) == 2 {
+		if !ok {
+			u.send([]byte(fmt.Sprintf("RESULT E2E %s %s\n", channelName, u.outcome(0, noSuchChannel))))
+			return
+		}
+		setting := "OFF"
+		if channel.isE2E() {
+			setting = "ON"
+		}
+		u.send([]byte(fmt.Sprintf("RESULT E2E %s 1 %s\n", channelName, setting)))
+		return
+	}
+
+	setting := args[2]
+	if setting != "ON" && setting != "OFF" {
+		return
+	}
+	var confirmation int
+	var reason string
+	defer func() {
+		msg := fmt.Sprintf("RESULT E2E %s %s %s\n", channelName, setting, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
+	}()
+
+	if !ok {
+		reason = noSuchChannel
+		return
+	}
+	if !u.loggedIn() {
+		return
+	}
+	channel.settingsLock.Lock()
+	defer channel.settingsLock.Unlock()
+	if !channel.operators[u.name] {
+		return
+	}
+	channel.e2e = setting == "ON"
+	confirmation = 1
+}
@@ -0,0 +1,165 @@
+package brerver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Everything that changes the server's state, appended as JSON lines to event_log so
+// that replay can reconstruct it. Passwords are deliberately left out.
+type event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	User    string    `json:"user,omitempty"`
+	Channel string    `json:"channel,omitempty"`
+	Text    string    `json:"text,omitempty"`
+}
+
+const (
+	registerEvent = "register"
+	createEvent   = "create"
+	joinEvent     = "join"
+	leaveEvent    = "leave"
+	sayEvent      = "say"
+	saybEvent     = "sayb"
+	// The account and everything about it is gone
+	unregisterEvent = "unregister"
+)
+
+type eventLog struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func openEventLog(path string) (*eventLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Appends v as a JSON line
+func (l *eventLog) append(v interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.encoder.Encode(v)
+}
+
+func (s *Server) logEvent(kind, user, channel, text string) {
+	if s.events == nil {
+		return
+	}
+	s.events.append(event{
+		Time:    time.Now(),
+		Kind:    kind,
+		User:    user,
+		Channel: channel,
+		Text:    text,
+	})
+}
+
+// Rebuilds a server's state from an event log, writing each message to sink as the
+// RECV line members saw. With a speed above zero, the gaps between events are
+// reproduced that many times faster.
+func Replay(log io.Reader, sink io.Writer, speed float64) (*Server, error) {
+	s := NewServer()
+	// Stand-ins for whoever was connected, which swallow what they are sent
+	ghosts := map[string]*user{}
+	ghost := func(name string) *user {
+		if u, ok := ghosts[name]; ok {
+			return u
+		}
+		conn, other := net.Pipe()
+		go io.Copy(io.Discard, other)
+		u := &user{name: name, conn: conn, channels: map[string]*channel{}}
+		ghosts[name] = u
+		return u
+	}
+	defer func() {
+		for _, u := range ghosts {
+			u.conn.Close()
+		}
+	}()
+
+	var last time.Time
+	scanner := bufio.NewScanner(log)
+	for line := 1; scanner.Scan(); line++ {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return s, fmt.Errorf("line %d: %w", line, err)
+		}
+		if speed > 0 && !last.IsZero() && e.Time.After(last) {
+			time.Sleep(time.Duration(float64(e.Time.Sub(last)) / speed))
+		}
+		last = e.Time
+
+		c, ok := s.channels.get(e.Channel)
+		switch e.Kind {
+		case registerEvent:
+			s.users.set(e.User, "")
+		case createEvent:
+			created := newChannel(e.User)
+			created.private = e.Text == "-private"
+			s.channels.set(e.Channel, created)
+		case joinEvent:
+			if !ok {
+				return s, fmt.Errorf("line %d: join of unknown channel '%s'", line, e.Channel)
+			}
+			u := ghost(e.User)
+			c.add(u, e.Channel, "")
+			u.channels[e.Channel] = c
+		case leaveEvent:
+			if ok {
+				c.usersLock.Lock()
+				c.removeMember(e.User)
+				c.usersLock.Unlock()
+				delete(ghost(e.User).channels, e.Channel)
+			}
+		case unregisterEvent:
+			s.users.remove(e.User)
+			s.purgeAccount(e.User)
+			if u, ok := ghosts[e.User]; ok {
+				u.channels = map[string]*channel{}
+			}
+		case sayEvent:
+			if !ok {
+				return s, fmt.Errorf("line %d: message to unknown channel '%s'", line, e.Channel)
+			}
+			s.post(c, e.User, e.Channel, e.Text)
+			if sink != nil {
+				fmt.Fprintf(sink, "RECV %s %s %s\n", e.User, e.Channel, e.Text)
+			}
+		case saybEvent:
+			if !ok {
+				return s, fmt.Errorf("line %d: message to unknown channel '%s'", line, e.Channel)
+			}
+			s.postBinary(c, e.User, e.Channel, e.Text)
+			if sink != nil {
+				fmt.Fprintf(sink, "RECVB %s %s %s\n", e.User, e.Channel, e.Text)
+			}
+		default:
+			return s, fmt.Errorf("line %d: unknown event '%s'", line, e.Kind)
+		}
+	}
+	return s, scanner.Err()
+}
+
+// A summary of the reconstructed state for whoever is debugging
+func (s *Server) Describe(w io.Writer) {
+	fmt.Fprintf(w, "%d accounts, %d channels\n", s.users.len(), s.channels.len())
+	s.channels.each(func(name string, c *channel) {
+		var members []string
+		for member := range c.users {
+			members = append(members, member)
+		}
+		fmt.Fprintf(w, "%s: %d messages, members %v\n", name, c.lastSeq(), members)
+	})
+}
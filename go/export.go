@@ -0,0 +1,131 @@
+package brerver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// How often each user may start an export
+	exportInterval = time.Minute
+	// Exports are cut off at this many bytes
+	exportSizeLimit = 1 << 20
+	// How long a finished export can be downloaded for
+	exportLifetime = 10 * time.Minute
+)
+
+type export struct {
+	name    string
+	created time.Time
+	lines   []string
+}
+
+// EXPORT <channel> <from> <to>
+//
+// Prepares the channel's history in the range in the background, then sends
+// EXPORT <channel> <token> <count> once it can be fetched with DOWNLOAD.
+func exportHistory(s *Server, u *user, args []string) {
+	channelName := args[1]
+
+	channel, from, to, ok := startExport(s, u, channelName, args[2])
+	var confirmation int
+	if ok {
+		confirmation = 1
+	}
+	msg := fmt.Sprintf("RESULT EXPORT %s %d\n", channelName, confirmation)
+	u.send([]byte(msg))
+	if !ok {
+		return
+	}
+
+	name := u.name
+	go func() {
+		var lines []string
+		size := 0
+		for _, m := range channel.between(from, to) {
+			line := historyLine(channelName, m)
+			if size+len(line) > exportSizeLimit {
+				break
+			}
+			size += len(line)
+			lines = append(lines, line)
+		}
+
+		token := newToken()
+		s.exportsLock.Lock()
+		for token, export := range s.exports {
+			if time.Since(export.created) > exportLifetime {
+				delete(s.exports, token)
+			}
+		}
+		s.exports[token] = &export{
+			name:    name,
+			created: time.Now(),
+			lines:   lines,
+		}
+		s.exportsLock.Unlock()
+
+		msg := fmt.Sprintf("EXPORT %s %s %d\n", channelName, token, len(lines))
+		u.send([]byte(msg))
+	}()
+}
+
+// Checks the request and the user's quota
+func startExport(s *Server, u *user, channelName, bounds string) (*channel, position, position, bool) {
+	var from, to position
+	fields := strings.Fields(bounds)
+	if len(fields) != 2 {
+		return nil, from, to, false
+	}
+	from, ok := parsePosition(fields[0])
+	if !ok {
+		return nil, from, to, false
+	}
+	to, ok = parsePosition(fields[1])
+	if !ok {
+		return nil, from, to, false
+	}
+
+	if !u.loggedIn() {
+		return nil, from, to, false
+	}
+	channel, ok := u.channels[channelName]
+	if !ok {
+		return nil, from, to, false
+	}
+
+	s.exportsLock.Lock()
+	defer s.exportsLock.Unlock()
+	if last, ok := s.lastExport[u.name]; ok && time.Since(last) < exportInterval {
+		return nil, from, to, false
+	}
+	s.lastExport[u.name] = time.Now()
+	return channel, from, to, true
+}
+
+// DOWNLOAD <token>
+func download(s *Server, u *user, args []string) {
+	token := args[1]
+
+	s.exportsLock.Lock()
+	export, ok := s.exports[token]
+	if ok && (export.name != u.name || time.Since(export.created) > exportLifetime) {
+		ok = false
+	}
+	s.exportsLock.Unlock()
+
+	var confirmation int
+	if ok && u.loggedIn() {
+		confirmation = 1
+	}
+	msg := fmt.Sprintf("RESULT DOWNLOAD %s %d\n", token, confirmation)
+	u.send([]byte(msg))
+	if confirmation == 0 {
+		return
+	}
+
+	for _, line := range export.lines {
+		u.send([]byte(line))
+	}
+}
@@ -0,0 +1,64 @@
+package brerver
+
+import (
+	"context"
+	"sync"
+)
+
+// Goroutines that share out broadcasts to channels with more than fanout_threshold
+// members, each sending to a slice of them. The broadcaster waits for every slice before
+// going on, so each member still gets a sender's messages in the order they were said.
+type fanoutPool struct {
+	jobs    chan func()
+	workers int
+	// Closed once the workers have stopped, after which broadcasts are sent inline
+	done <-chan struct{}
+}
+
+// Starts workers goroutines taking broadcasts until ctx is done
+func newFanoutPool(ctx context.Context, workers int) *fanoutPool {
+	p := &fanoutPool{jobs: make(chan func()), workers: workers, done: ctx.Done()}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-p.jobs:
+					job()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// Calls send with every one of members, from the fan-out workers if there are enough of them
+func (s *Server) broadcast(members []*user, send func(*user)) {
+	p := s.fanout
+	if p == nil || len(members) <= s.settings().FanoutThreshold {
+		for _, u := range members {
+			send(u)
+		}
+		return
+	}
+
+	size := (len(members) + p.workers - 1) / p.workers
+	var sent sync.WaitGroup
+	for start := 0; start < len(members); start += size {
+		part := members[start:min(start+size, len(members))]
+		job := func() {
+			defer sent.Done()
+			for _, u := range part {
+				send(u)
+			}
+		}
+		sent.Add(1)
+		select {
+		case p.jobs <- job:
+		case <-p.done:
+			job()
+		}
+	}
+	sent.Wait()
+}
@@ -0,0 +1,385 @@
+package brerver
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A server to link with, and what it's expected to call itself
+type PeerConfig struct {
+	Name    string `json:"name" doc:"The server_name the peer goes by"`
+	Address string `json:"address" doc:"host:port of the peer's federation_port, to dial it rather than wait for it to dial in"`
+	Secret  string `json:"secret" doc:"Shared with the peer, which must have the same secret for this server; links prove they know it without sending it"`
+}
+
+func (p PeerConfig) valid() bool {
+	return validServerName(p.Name) && validServerName(p.Secret) && (p.Address == "" || (ListenAddress{Address: p.Address}).valid())
+}
+
+const (
+	// How long either end of a link waits for the other's half of the handshake
+	linkHandshakeTimeout = 10 * time.Second
+	// Dialing a peer again backs off from the first to the second, doubling each time
+	linkRetryMin = 250 * time.Millisecond
+	linkRetryMax = 30 * time.Second
+	// Longest line accepted from a linked server, which relays whole commands
+	linkLineLength = 64 * 1024
+)
+
+// A connection to another server, over which the two act as one. Links start with the
+// dialing end sending SERVER <name> <nonce>, and the other answering SERVER <name>
+// <nonce> <proof> and getting PROOF <proof> back, where each proof is an HMAC under the
+// secret of both nonces, both names and which end is proving. Links are dropped unless the other end is a
+// configured peer that proves it has the secret configured for it, or one that proves it
+// has the federation_secret.
+type serverLink struct {
+	name string
+	conn net.Conn
+	// Which end dialed, which decides which of two links between the same servers stays
+	dialer string
+	// The peer's members by channel while it catches up, only touched by serveLink
+	catchingUp map[string]map[string]bool
+
+	writeLock sync.Mutex
+}
+
+func (l *serverLink) send(line string) error {
+	l.writeLock.Lock()
+	defer l.writeLock.Unlock()
+	_, err := l.conn.Write([]byte(line))
+	return err
+}
+
+// Reports whether name is usable as a server_name, which is sent as one word
+func validServerName(name string) bool {
+	return name != "" && validCommand(name) && !strings.ContainsAny(name, " \t")
+}
+
+// Keeps a link to peer up until ctx is done, dialing again with backoff whenever it
+// can't connect or the link drops
+func (s *Server) linkPeer(ctx context.Context, peer PeerConfig) {
+	backoff := linkRetryMin
+	for {
+		// The peer may have dialed us first
+		if !s.linked(peer.Name) {
+			if err := s.dialPeer(ctx, peer); err != nil {
+				s.logger.Warn("Failed to link to server", "server", peer.Name, "address", peer.Address, "err", err)
+			} else {
+				backoff = linkRetryMin
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > linkRetryMax {
+			backoff = linkRetryMax
+		}
+	}
+}
+
+// Dials peer and serves the link until it drops, returning an error only if it was never
+// established
+func (s *Server) dialPeer(ctx context.Context, peer PeerConfig) error {
+	dialer := net.Dialer{Timeout: linkHandshakeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.Address)
+	if err != nil {
+		return err
+	}
+	name := s.settings().ServerName
+	l := &serverLink{name: peer.Name, conn: conn, dialer: name}
+	reader := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(linkHandshakeTimeout))
+	nonce := newToken()
+	if err := l.send("SERVER " + name + " " + nonce + "\n"); err != nil {
+		conn.Close()
+		return err
+	}
+	line, _, err := readCommand(reader, linkLineLength)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	fields := strings.Split(line, " ")
+	if len(fields) != 4 || fields[0] != "SERVER" || fields[1] != peer.Name || !validProof(fields[3], peer.Secret, "acceptor", nonce, fields[2], name, peer.Name) {
+		conn.Close()
+		return fmt.Errorf("%s didn't prove it was %s with its secret", peer.Address, peer.Name)
+	}
+	if err := l.send("PROOF " + linkProof(peer.Secret, "dialer", nonce, fields[2], name, peer.Name) + "\n"); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if !s.addLink(l) {
+		conn.Close()
+		return errors.New("already linked")
+	}
+	s.serveLink(ctx, l, reader)
+	return nil
+}
+
+// Serves the federation_port, where peers dial in
+func (s *Server) serveFederation(ctx context.Context, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.logger.Info("Stopped serving federation", "err", err)
+			return
+		}
+		go s.acceptLink(ctx, conn)
+	}
+}
+
+func (s *Server) acceptLink(ctx context.Context, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(linkHandshakeTimeout))
+	line, ok, err := readCommand(reader, linkLineLength)
+	if err != nil || !ok {
+		conn.Close()
+		return
+	}
+	conf := s.settings()
+	fields := strings.Split(line, " ")
+	ok = len(fields) == 3 && fields[0] == "SERVER"
+	var peer PeerConfig
+	if ok {
+		peer, ok = conf.peer(fields[1])
+	}
+	if !ok {
+		s.logger.Warn("Refused a link from something that isn't a peer", "remote", conn.RemoteAddr().String())
+		conn.Write([]byte("ERROR LINK\n"))
+		conn.Close()
+		return
+	}
+
+	nonce := newToken()
+	proof := linkProof(peer.Secret, "acceptor", fields[2], nonce, peer.Name, conf.ServerName)
+	if _, err := conn.Write([]byte("SERVER " + conf.ServerName + " " + nonce + " " + proof + "\n")); err != nil {
+		conn.Close()
+		return
+	}
+	line, ok, err = readCommand(reader, linkLineLength)
+	if err != nil || !ok {
+		conn.Close()
+		return
+	}
+	if given, found := strings.CutPrefix(line, "PROOF "); !found || !validProof(given, peer.Secret, "dialer", fields[2], nonce, peer.Name, conf.ServerName) {
+		s.logger.Warn("Refused a link from a server without its secret", "server", peer.Name, "remote", conn.RemoteAddr().String())
+		conn.Write([]byte("ERROR LINK\n"))
+		conn.Close()
+		return
+	}
+
+	l := &serverLink{name: peer.Name, conn: conn, dialer: peer.Name}
+	if !s.addLink(l) {
+		conn.Write([]byte("ERROR LINKED\n"))
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.serveLink(ctx, l, reader)
+}
+
+// The peer called name that may link here, if there's a secret for it
+func (c Config) peer(name string) (PeerConfig, bool) {
+	peer := PeerConfig{Name: name, Secret: c.secretFor(name)}
+	if peer.Secret == "" || peer.Name == c.ServerName || !validServerName(peer.Name) {
+		return PeerConfig{}, false
+	}
+	for _, configured := range c.Peers {
+		if configured.Name == peer.Name {
+			peer = configured
+		}
+	}
+	return peer, true
+}
+
+// What one end of a link sends to show it has the secret, where role is "dialer" or
+// "acceptor". Everything about the handshake goes into it, so that a proof one server
+// makes as acceptor can't be passed off as a dialer's on another link, or the reverse.
+func linkProof(secret, role, dialerNonce, acceptorNonce, dialer, acceptor string) string {
+	message := strings.Join([]string{role, dialerNonce, acceptorNonce, dialer, acceptor}, " ")
+	return hex.EncodeToString(hmacSHA256([]byte(secret), []byte(message)))
+}
+
+// Compares proofs in constant time, so that timing gives away nothing about the right one
+func validProof(given, secret, role, dialerNonce, acceptorNonce, dialer, acceptor string) bool {
+	return hmac.Equal([]byte(given), []byte(linkProof(secret, role, dialerNonce, acceptorNonce, dialer, acceptor)))
+}
+
+// Registers l in servers, reporting whether it was kept. When both servers dial each
+// other at once, the link dialed by the server whose name sorts first wins on both ends.
+func (s *Server) addLink(l *serverLink) bool {
+	s.serversLock.Lock()
+	defer s.serversLock.Unlock()
+	if existing, ok := s.servers[l.name]; ok {
+		// A server dialing again replaces its own link, which must have dropped
+		if existing.dialer < l.dialer {
+			return false
+		}
+		existing.conn.Close()
+	}
+	s.servers[l.name] = l
+	s.linkedPeer(l)
+	s.logger.Info("Linked to server", "server", l.name)
+	return true
+}
+
+func (s *Server) removeLink(l *serverLink) {
+	var split []string
+	s.serversLock.Lock()
+	if s.servers[l.name] == l {
+		delete(s.servers, l.name)
+		split = s.splitPeer(l)
+		s.abandonClaims(l.name)
+		s.logger.Info("Unlinked from server", "server", l.name)
+	}
+	s.serversLock.Unlock()
+	s.tellChannels("SPLIT", l.name, split)
+}
+
+func (s *Server) linked(name string) bool {
+	s.serversLock.RLock()
+	defer s.serversLock.RUnlock()
+	_, ok := s.servers[name]
+	return ok
+}
+
+// Sends line to every linked server, and keeps it for those that are split. A link that
+// can't take it is split off then and there, keeping line.
+func (s *Server) broadcastLinks(line string) {
+	s.serversLock.Lock()
+	links := make([]*serverLink, 0, len(s.servers))
+	for _, l := range s.servers {
+		links = append(links, l)
+	}
+	s.backlogSplit(line)
+	s.serversLock.Unlock()
+
+	for _, l := range links {
+		if err := l.send(line); err != nil {
+			s.logger.Warn("Failed to send to a linked server", "server", l.name, "err", err)
+			l.conn.Close()
+			s.removeLink(l)
+			s.serversLock.Lock()
+			if peer, ok := s.peers[l.name]; ok && !peer.split.IsZero() {
+				peer.keep(line)
+			}
+			s.serversLock.Unlock()
+		}
+	}
+}
+
+// Passes a message said here on to linked servers as SAY or SAYB <id> <channel> <user>
+// <text>. Every server links to every other, so messages are only ever relayed by the
+// server they were said on, or with federation_sharding by the channel's home. Private
+// channels aren't relayed, as a linked server can't tell who was let in.
+func (s *Server) relay(command, from, channelName, text string) {
+	if c, ok := s.channels.get(channelName); ok && c.private {
+		return
+	}
+	s.sendHome(channelName, fmt.Sprintf("%s %s %s %s %s\n", command, s.messageID(), channelName, from, text))
+}
+
+// Delivers a message relayed from a linked server to the members of the channel here,
+// if there is one by that name and it isn't private, reporting false if it was malformed
+// or already delivered
+func (s *Server) deliverRelayed(l *serverLink, fields []string) bool {
+	if len(fields) != 5 {
+		s.logger.Warn("Dropped a malformed message from a linked server", "server", l.name)
+		return false
+	}
+	command, id, channelName, from, text := fields[0], fields[1], fields[2], fields[3], fields[4]
+	if !s.firstSighting(id) {
+		s.logger.Debug("Dropped a message already delivered", "server", l.name, "id", id)
+		return false
+	}
+	c, ok := s.channels.get(channelName)
+	if ok && c.private {
+		// Said in a public channel elsewhere that shares the name
+		s.logger.Debug("Dropped a message for a private channel", "server", l.name, "channel", channelName)
+		return true
+	}
+	if !ok {
+		// Users here can still be mentioned
+		if command == "SAY" {
+			s.notify(nil, from, channelName, text)
+		}
+		return true
+	}
+	if command == "SAYB" {
+		s.postBinary(c, from, channelName, text)
+		return true
+	}
+	s.post(c, from, channelName, text)
+	s.notify(c, from, channelName, text)
+	return true
+}
+
+// Reads from a link until it drops, goes quiet for too long or ctx is done
+func (s *Server) serveLink(ctx context.Context, l *serverLink, reader *bufio.Reader) {
+	defer s.removeLink(l)
+	stop := context.AfterFunc(ctx, func() { l.conn.Close() })
+	defer stop()
+	defer l.conn.Close()
+	// Sent while reading, so that neither end waits on the other to read
+	go s.catchUp(l)
+	interval := time.Duration(s.settings().FederationPingSeconds) * time.Second
+	done := make(chan struct{})
+	defer close(done)
+	go pingLink(l, interval, done)
+
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(linkPingsMissed * interval))
+		line, ok, err := readCommand(reader, linkLineLength)
+		if timedOut(err) {
+			s.logger.Warn("Dropping a linked server that stopped answering pings", "server", l.name)
+			return
+		}
+		if err != nil {
+			return
+		}
+		if !ok || !validCommand(line) {
+			s.logger.Warn("Dropped an invalid line from a linked server", "server", l.name)
+			continue
+		}
+		command, _, _ := strings.Cut(line, " ")
+		switch command {
+		case "SAY", "SAYB":
+			s.deliverRelayed(l, strings.SplitN(line, " ", 5))
+		case "ACCOUNT", "PASSWD", "UNREGISTER":
+			s.linkedAccount(l, strings.Split(line, " "))
+		case "JOIN", "LEAVE", "MEMBERS":
+			s.linkedMembership(l, strings.Split(line, " "))
+		case "PRESENCE":
+			s.linkedPresence(l, strings.Split(line, " "))
+		case "CLAIM":
+			s.decideClaim(l, strings.Split(line, " "))
+		case "CLAIMED":
+			s.claimed(l, strings.Split(line, " "))
+		case "ROUTE":
+			s.routed(l, line)
+		case "PEERS":
+			s.learnPeers(ctx, l, strings.Split(line, " "))
+		case "SYNCED":
+			s.synced(l)
+		case "PING":
+			l.send("PONG\n")
+		case "PONG":
+		default:
+			s.logger.Debug("Unknown command from a linked server", "server", l.name, "command", command)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package brerver
+
+import (
+	"fmt"
+	"time"
+)
+
+// The flood section of Config
+type FloodLimit struct {
+	Messages    int `json:"messages" doc:"SAYs allowed to one channel within seconds, unlimited if zero" default:"0" minimum:"0"`
+	Seconds     int `json:"seconds" doc:"Length of the window messages are counted over" default:"0" minimum:"0"`
+	MuteSeconds int `json:"mute_seconds" doc:"How long a user who floods stays muted in that channel" default:"0" minimum:"0"`
+}
+
+// Reports whether u may SAY in the channel, muting them if this SAY is one too many
+func (s *Server) floodCheck(u *user, channelName string, c *channel) bool {
+	now := time.Now()
+	if c.mutes(u.name, now) {
+		return false
+	}
+
+	limit := s.settings().Flood
+	if limit.Messages == 0 {
+		return true
+	}
+
+	if u.recentSays == nil {
+		u.recentSays = map[string][]time.Time{}
+	}
+	window := now.Add(-time.Duration(limit.Seconds) * time.Second)
+	recent := u.recentSays[channelName]
+	for len(recent) > 0 && recent[0].Before(window) {
+		recent = recent[1:]
+	}
+	recent = append(recent, now)
+	u.recentSays[channelName] = recent
+	if len(recent) <= limit.Messages {
+		return true
+	}
+
+	mute := time.Duration(limit.MuteSeconds) * time.Second
+	c.settingsLock.Lock()
+	c.muted[u.name] = now.Add(mute)
+	c.settingsLock.Unlock()
+	delete(u.recentSays, channelName)
+
+	msg := []byte(fmt.Sprintf("MUTED %s %s %d\n", u.name, channelName, limit.MuteSeconds))
+	u.send(msg)
+	for _, operator := range c.joinedOperators(u) {
+		operator.send(msg)
+	}
+	return false
+}
+
+// Every operator currently in the channel except skip, to send to once the channel's
+// locks are released, as sending can wait on slow connections
+func (c *channel) joinedOperators(skip *user) []*user {
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+	c.usersLock.RLock()
+	defer c.usersLock.RUnlock()
+
+	var operators []*user
+	for name, member := range c.users {
+		if c.operators[name] && member != skip {
+			operators = append(operators, member)
+		}
+	}
+	return operators
+}
+
+// Reports whether name is muted in the channel, by flood protection or a script, at now
+func (c *channel) mutes(name string, now time.Time) bool {
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+	until, muted := c.muted[name]
+	return muted && now.Before(until)
+}
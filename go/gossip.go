@@ -0,0 +1,83 @@
+package brerver
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Linked servers tell each other every server they know how to reach, as
+// PEERS <name>=<address>..., so that a server only has to be pointed at one member of a
+// mesh to end up linked to all of them. Each sends its list while catching up and again
+// whenever it learns of a server it didn't know, which stops once everyone knows them all.
+
+// Starts keeping a link to peer up, unless that's already being done. Called with
+// serversLock held.
+func (s *Server) dialLater(ctx context.Context, peer PeerConfig) {
+	if s.dialing[peer.Name] {
+		return
+	}
+	s.dialing[peer.Name] = true
+	s.known[peer.Name] = peer.Address
+	go s.linkPeer(ctx, peer)
+}
+
+// The PEERS line for every server this one knows the address of, itself included if it
+// has a federation_address, or the empty string if it knows of none
+func (s *Server) peersLine() string {
+	conf := s.settings()
+	var peers []string
+	if conf.FederationAddress != "" {
+		peers = append(peers, conf.ServerName+"="+conf.FederationAddress)
+	}
+	s.serversLock.RLock()
+	for name, address := range s.known {
+		peers = append(peers, name+"="+address)
+	}
+	s.serversLock.RUnlock()
+	if len(peers) == 0 {
+		return ""
+	}
+	sort.Strings(peers)
+	return "PEERS " + strings.Join(peers, " ") + "\n"
+}
+
+// Dials the servers in a PEERS line from l that this one didn't know of, and passes the
+// news on to everyone linked if there were any. Servers this one has no secret for are
+// left alone.
+func (s *Server) learnPeers(ctx context.Context, l *serverLink, fields []string) {
+	conf := s.settings()
+	learned := false
+	s.serversLock.Lock()
+	for _, field := range fields[1:] {
+		name, address, ok := strings.Cut(field, "=")
+		peer := PeerConfig{Name: name, Address: address, Secret: conf.secretFor(name)}
+		if !ok || name == conf.ServerName || peer.Secret == "" || !peer.valid() {
+			continue
+		}
+		if _, known := s.known[name]; known {
+			continue
+		}
+		s.logger.Info("Learned of a server from a linked one", "server", name, "address", address, "from", l.name)
+		s.dialLater(ctx, peer)
+		learned = true
+	}
+	if learned {
+		s.placeServers()
+	}
+	s.serversLock.Unlock()
+
+	if learned {
+		s.broadcastLinks(s.peersLine())
+	}
+}
+
+// What name has to present to link with this server, or the empty string if it can't
+func (c Config) secretFor(name string) string {
+	for _, peer := range c.Peers {
+		if peer.Name == name {
+			return peer.Secret
+		}
+	}
+	return c.FederationSecret
+}
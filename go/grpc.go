@@ -0,0 +1,344 @@
+package brerver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"brerver/chatpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// How long a request waits for its RESULT when the caller set no deadline
+const rpcTimeout = 10 * time.Second
+
+// Bans or the connection limits turned the request away
+var errRefused = errors.New("connection refused")
+
+// Serves chat.proto, with every RPC going through an ordinary connection over a pipe so
+// that it runs the same handlers, limits and checks as the line protocol
+type chatService struct {
+	chatpb.UnimplementedChatServer
+	s *Server
+}
+
+func (s *Server) serveGRPC(ln net.Listener) {
+	server := grpc.NewServer()
+	chatpb.RegisterChatServer(server, &chatService{s: s})
+	if err := server.Serve(ln); err != nil {
+		s.logger.Info("Stopped serving gRPC", "err", err)
+	}
+}
+
+// Our end of a connection opened for an RPC
+type rpcConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// Closed once the server has finished with the connection, sessions detached and all
+	done chan struct{}
+}
+
+// Opens a connection over a pipe for a request from remote, served until ctx is done
+func (s *Server) dialRPC(ctx context.Context, remote net.Addr) (*rpcConn, error) {
+	conn, pipe := net.Pipe()
+	relayed := relayedConn{pipe, remote}
+	if !s.welcome(relayed) {
+		conn.Close()
+		return nil, errRefused
+	}
+
+	c := &rpcConn{conn: conn, reader: bufio.NewReader(conn), done: make(chan struct{})}
+	go func() {
+		userConnection(ctx, s, relayed)
+		close(c.done)
+	}()
+	// Callers pass reasons on in their answers
+	if err := c.hello(ctx, "reasons"); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *chatService) dial(ctx context.Context) (*rpcConn, error) {
+	var remote net.Addr = &net.TCPAddr{}
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr
+	}
+	conn, err := c.s.dialRPC(ctx, remote)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return conn, nil
+}
+
+func (c *rpcConn) close() {
+	c.conn.Close()
+	<-c.done
+}
+
+func (c *rpcConn) send(words ...string) error {
+	_, err := fmt.Fprintf(c.conn, "%s\n", strings.Join(words, " "))
+	return err
+}
+
+// Reads the next frame, waiting until the context's deadline or rpcTimeout if it has none
+func (c *rpcConn) next(ctx context.Context) (string, []string, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(rpcTimeout)
+	}
+	c.conn.SetReadDeadline(deadline)
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	kind, args := splitFrame(strings.TrimSuffix(line, "\n"))
+	return kind, args, nil
+}
+
+// Reads frames until one of kind whose first argument is first, returning its arguments after that
+func (c *rpcConn) await(ctx context.Context, kind, first string) ([]string, error) {
+	for {
+		frameKind, args, err := c.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if frameKind == kind && (first == "" || (len(args) > 0 && args[0] == first)) {
+			if first != "" {
+				args = args[1:]
+			}
+			return args, nil
+		}
+	}
+}
+
+// Reads the RESULT for command, skipping the arguments echoed before the 0 or 1, and
+// returns whether it succeeded and the reason if not
+func (c *rpcConn) result(ctx context.Context, command string, echoed int) (bool, string, error) {
+	args, err := c.await(ctx, "RESULT", command)
+	if err != nil {
+		return false, "", err
+	}
+	if len(args) <= echoed {
+		return false, "", errors.New("malformed result")
+	}
+	args = args[echoed:]
+	return args[0] == "1", strings.Join(args[1:], " "), nil
+}
+
+// Sends CHANNELS with options and reads the channels it lists, along with the channel to
+// list the next page after if it said there are more. ok is false if it failed.
+func (c *rpcConn) channels(ctx context.Context, options ...string) (channels []string, next string, ok bool, err error) {
+	c.send(append([]string{"CHANNELS"}, options...)...)
+	for {
+		kind, args, err := c.next(ctx)
+		if err != nil {
+			return nil, "", false, err
+		}
+		switch {
+		case kind == "MORE" && len(args) == 2 && args[0] == "CHANNELS":
+			next = args[1]
+		case kind == "RESULT" && len(args) > 0 && args[0] == "CHANNELS":
+			channels, ok = channelsListed(args[1:])
+			return channels, next, ok, nil
+		}
+	}
+}
+
+// Logs the connection in with a session token from LOGIN, which only works while no
+// other connection holds the session
+func (c *rpcConn) resume(ctx context.Context, session string) (bool, error) {
+	if !validArgs(session) {
+		return false, nil
+	}
+	c.send("RESUME", session)
+	ok, _, err := c.result(ctx, "RESUME", 0)
+	return ok, err
+}
+
+// Turns on HELLO options, like sessions for the SESSION token that follows a successful
+// LOGIN or PASSWD
+func (c *rpcConn) hello(ctx context.Context, options ...string) error {
+	c.send(append([]string{"HELLO"}, options...)...)
+	ok, _, err := c.result(ctx, "HELLO", 0)
+	if err == nil && !ok {
+		err = errors.New("hello refused")
+	}
+	return err
+}
+
+// Arguments from requests end up in the line protocol, so they can't break it
+func validArgs(args ...string) bool {
+	for _, arg := range args {
+		if arg == "" || strings.Contains(arg, " ") || !validCommand(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+var errInvalidArgs = status.Error(codes.InvalidArgument, "arguments can't be empty or contain spaces or control characters")
+
+// The connection went away or stopped answering
+func unavailable(err error) error {
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+func (c *chatService) Register(ctx context.Context, req *chatpb.RegisterRequest) (*chatpb.Result, error) {
+	if !validArgs(req.Username, req.Password) {
+		return nil, errInvalidArgs
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	conn.send("REGISTER", req.Username, req.Password)
+	ok, reason, err := conn.result(ctx, "REGISTER", 0)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	return &chatpb.Result{Ok: ok, Reason: reason}, nil
+}
+
+func (c *chatService) Login(ctx context.Context, req *chatpb.LoginRequest) (*chatpb.LoginReply, error) {
+	if !validArgs(req.Username, req.Password) {
+		return nil, errInvalidArgs
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	if err := conn.hello(ctx, "sessions"); err != nil {
+		return nil, unavailable(err)
+	}
+	conn.send("LOGIN", req.Username, req.Password)
+	ok, reason, err := conn.result(ctx, "LOGIN", 0)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	result := &chatpb.Result{Ok: ok, Reason: reason}
+	if !ok {
+		return &chatpb.LoginReply{Result: result}, nil
+	}
+	session, err := conn.await(ctx, "SESSION", "")
+	if err != nil || len(session) != 1 {
+		return nil, status.Error(codes.Internal, "no session")
+	}
+	// Closing detaches the session, which is what lets it be resumed
+	return &chatpb.LoginReply{Result: result, Session: session[0]}, nil
+}
+
+func (c *chatService) Create(ctx context.Context, req *chatpb.CreateRequest) (*chatpb.Result, error) {
+	if !validArgs(req.Channel) {
+		return nil, errInvalidArgs
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	if req.Session != "" {
+		resumed, err := conn.resume(ctx, req.Session)
+		if err != nil {
+			return nil, unavailable(err)
+		}
+		if !resumed {
+			return &chatpb.Result{Reason: notLoggedIn}, nil
+		}
+	}
+	conn.send("CREATE", req.Channel)
+	ok, reason, err := conn.result(ctx, "CREATE", 1)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	return &chatpb.Result{Ok: ok, Reason: reason}, nil
+}
+
+func (c *chatService) ListChannels(ctx context.Context, req *chatpb.ListChannelsRequest) (*chatpb.ChannelList, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	// Every channel, a page at a time
+	channels := []string{}
+	options := []string{"-limit", strconv.Itoa(c.s.settings().ChannelsPageSize)}
+	for {
+		page, next, _, err := conn.channels(ctx, options...)
+		if err != nil {
+			return nil, unavailable(err)
+		}
+		channels = append(channels, page...)
+		if next == "" {
+			return &chatpb.ChannelList{Channels: channels}, nil
+		}
+		options = []string{"-after", next}
+	}
+}
+
+func (c *chatService) Chat(stream chatpb.Chat_ChatServer) error {
+	conn, err := c.dial(stream.Context())
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	// Frames go out until the server hangs up, which also ends the stream
+	sent := make(chan error, 1)
+	go func() {
+		for {
+			line, err := conn.reader.ReadString('\n')
+			if err != nil {
+				sent <- nil
+				return
+			}
+			kind, args := splitFrame(strings.TrimSuffix(line, "\n"))
+			if err := stream.Send(&chatpb.Frame{Type: kind, Args: args}); err != nil {
+				sent <- err
+				return
+			}
+		}
+	}()
+
+	received := make(chan error, 1)
+	go func() {
+		for {
+			command, err := stream.Recv()
+			if err != nil {
+				received <- err
+				return
+			}
+			words, ok := commandWords(command.Command, command.Args)
+			if !ok {
+				received <- status.Error(codes.InvalidArgument, "only the last argument may contain spaces, and none may contain control characters")
+				return
+			}
+			if err := conn.send(words...); err != nil {
+				received <- nil
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-sent:
+		return err
+	case err := <-received:
+		if status.Code(err) == codes.InvalidArgument {
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,320 @@
+package brerver
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Marks the keys of listeners from systemd socket activation, which keep it through
+// handovers
+const activatedPrefix = "activated "
+
+// Written by the new process once it's serving, after which the old one shuts down
+const handoverReadyLine = "ready\n"
+
+// What a new process needs from the old one to carry on where it left off during a
+// handover. Connections themselves don't survive it, but their sessions can be resumed.
+type handoverState struct {
+	Accounts map[string]string          `json:"accounts"`
+	Channels map[string]handoverChannel `json:"channels"`
+	Sessions map[string]handoverSession `json:"sessions"`
+	SaltKey  []byte                     `json:"salt_key"`
+}
+
+type handoverMessage struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	From   string    `json:"from"`
+	Text   string    `json:"text"`
+	Binary bool      `json:"binary,omitempty"`
+	// When a pin runs out, if it does
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+type handoverChannel struct {
+	History        []handoverMessage    `json:"history"`
+	NextSeq        uint64               `json:"next_seq"`
+	Operators      map[string]bool      `json:"operators"`
+	Muted          map[string]time.Time `json:"muted"`
+	Reactions      map[string]bool      `json:"reactions"`
+	Pins           []handoverMessage    `json:"pins"`
+	PinLimit       int                  `json:"pin_limit"`
+	MemberLimit    int                  `json:"member_limit"`
+	Members        map[string]bool      `json:"members"`
+	NotifyDefault  string               `json:"notify_default"`
+	NotifyPolicies map[string]string    `json:"notify_policies"`
+	E2E            bool                 `json:"e2e"`
+	Private        bool                 `json:"private"`
+	Invited        map[string]bool      `json:"invited"`
+}
+
+// Every session is handed over detached, since its connection stays behind
+type handoverSession struct {
+	Name     string            `json:"name"`
+	Detached time.Time         `json:"detached"`
+	Channels map[string]uint64 `json:"channels"`
+}
+
+func handoverMessageOf(m message) handoverMessage {
+	return handoverMessage{Seq: m.seq, Time: m.time, From: m.from, Text: m.text, Binary: m.binary}
+}
+
+func (m handoverMessage) message() message {
+	return message{seq: m.Seq, time: m.Time, from: m.From, text: m.Text, binary: m.Binary}
+}
+
+func (s *Server) handoverState() handoverState {
+	state := handoverState{
+		Accounts: map[string]string{},
+		Channels: map[string]handoverChannel{},
+		Sessions: map[string]handoverSession{},
+		SaltKey:  s.saltKey,
+	}
+
+	s.users.each(func(name, credential string) {
+		state.Accounts[name] = credential
+	})
+
+	// Where each account is joined, which attached sessions are resumed into
+	joined := map[string]map[string]uint64{}
+	s.channels.each(func(name string, c *channel) {
+		c.usersLock.RLock()
+		c.historyLock.Lock()
+		handed := handoverChannel{NextSeq: c.nextSeq, MemberLimit: c.memberLimit}
+		for _, m := range c.history {
+			handed.History = append(handed.History, handoverMessageOf(m))
+		}
+		c.historyLock.Unlock()
+		for member := range c.users {
+			if joined[member] == nil {
+				joined[member] = map[string]uint64{}
+			}
+			joined[member][name] = handed.NextSeq
+		}
+		c.usersLock.RUnlock()
+
+		c.settingsLock.RLock()
+		handed.Operators = c.operators
+		handed.Muted = c.muted
+		handed.Reactions = c.reactions
+		handed.PinLimit = c.pinLimit
+		handed.Members = c.members
+		handed.NotifyDefault = c.notifyDefault
+		handed.NotifyPolicies = c.notifyPolicies
+		handed.E2E = c.e2e
+		handed.Private = c.private
+		handed.Invited = c.invited
+		for _, p := range c.pins {
+			pinned := handoverMessageOf(p.message)
+			pinned.Expires = p.expires
+			handed.Pins = append(handed.Pins, pinned)
+		}
+		// Copies, since the maps carry on changing after the lock is released
+		state.Channels[name] = copyMaps(handed)
+		c.settingsLock.RUnlock()
+	})
+
+	s.sessionsLock.Lock()
+	s.expireSessions()
+	for token, session := range s.sessions {
+		handed := handoverSession{Name: session.name, Detached: session.detached, Channels: session.channels}
+		if session.attached {
+			handed.Detached = time.Now()
+			handed.Channels = joined[session.name]
+		}
+		state.Sessions[token] = handed
+	}
+	s.sessionsLock.Unlock()
+	return state
+}
+
+func copyMaps(c handoverChannel) handoverChannel {
+	c.Operators = copyMap(c.Operators)
+	c.Muted = copyMap(c.Muted)
+	c.Reactions = copyMap(c.Reactions)
+	c.Members = copyMap(c.Members)
+	c.NotifyPolicies = copyMap(c.NotifyPolicies)
+	c.Invited = copyMap(c.Invited)
+	return c
+}
+
+func copyMap[V any](m map[string]V) map[string]V {
+	copied := make(map[string]V, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// Takes on the state of the process handing over, before any connections are served
+func (s *Server) restoreHandover(state handoverState) {
+	if len(state.SaltKey) > 0 {
+		s.saltKey = state.SaltKey
+	}
+	for name, credential := range state.Accounts {
+		s.users.set(name, credential)
+	}
+
+	for name, handed := range state.Channels {
+		c := newChannel("")
+		for _, m := range handed.History {
+			c.history = append(c.history, m.message())
+		}
+		c.nextSeq = handed.NextSeq
+		c.pinLimit = handed.PinLimit
+		c.memberLimit = handed.MemberLimit
+		c.e2e = handed.E2E
+		c.private = handed.Private
+		for k, v := range handed.Invited {
+			c.invited[k] = v
+		}
+		if handed.NotifyDefault != "" {
+			c.notifyDefault = handed.NotifyDefault
+		}
+		for k, v := range handed.Operators {
+			c.operators[k] = v
+		}
+		for k, v := range handed.Muted {
+			c.muted[k] = v
+		}
+		if len(handed.Reactions) > 0 {
+			c.reactions = copyMap(handed.Reactions)
+		}
+		for k, v := range handed.Members {
+			c.members[k] = v
+		}
+		for k, v := range handed.NotifyPolicies {
+			c.notifyPolicies[k] = v
+		}
+		for _, pinned := range handed.Pins {
+			p := pin{message: pinned.message(), expires: pinned.Expires}
+			if !p.expires.IsZero() {
+				channelName, seq, expires := name, p.seq, p.expires
+				time.AfterFunc(time.Until(expires), func() { s.expirePin(c, channelName, seq, expires) })
+			}
+			c.pins = append(c.pins, p)
+		}
+		s.channels.set(name, c)
+	}
+
+	s.sessionsLock.Lock()
+	for token, handed := range state.Sessions {
+		s.sessions[token] = &session{name: handed.Name, detached: handed.Detached, channels: handed.Channels}
+	}
+	s.sessionsLock.Unlock()
+}
+
+// Listens on address, or takes over the listener passed on for it by a process handing
+// over or by systemd. Either way the listener can be handed over in turn.
+func (s *Server) listen(network, address string) (net.Listener, error) {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	key := network + " " + address
+	found := s.findInherited(network, address)
+	ln, ok := s.inherited[found]
+	if ok {
+		delete(s.inherited, found)
+		if strings.HasPrefix(found, activatedPrefix) {
+			// The socket is systemd's to keep, through any handovers too
+			key = found
+		} else if unixLn, isUnix := ln.(*net.UnixListener); isUnix {
+			// Listeners made from files leave their socket behind, unlike ones from Listen
+			unixLn.SetUnlinkOnClose(true)
+		}
+	} else {
+		var err error
+		if ln, err = net.Listen(network, address); err != nil {
+			return nil, err
+		}
+	}
+	s.listening[key] = ln
+	return ln, nil
+}
+
+func (s *Server) inherits(network, address string) bool {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+	_, ok := s.inherited[s.findInherited(network, address)]
+	return ok
+}
+
+// The key of the inherited listener for address, if there is one. Handed over
+// listeners are named after the address they were listened on with, but systemd's can
+// only be told apart by what they're bound to. Must be called with listenersLock held.
+func (s *Server) findInherited(network, address string) string {
+	key := network + " " + address
+	if _, ok := s.inherited[key]; ok {
+		return key
+	}
+	for key, ln := range s.inherited {
+		if strings.HasPrefix(key, activatedPrefix) && boundTo(ln, network, address) {
+			return key
+		}
+	}
+	return ""
+}
+
+// Reports whether ln is bound to what listening on network and address would bind
+func boundTo(ln net.Listener, network, address string) bool {
+	switch bound := ln.Addr().(type) {
+	case *net.UnixAddr:
+		return network == "unix" && bound.Name == address
+	case *net.TCPAddr:
+		if network != "tcp" {
+			return false
+		}
+		wanted, err := net.ResolveTCPAddr(network, address)
+		if err != nil || wanted.Port != bound.Port {
+			return false
+		}
+		if wanted.IP == nil {
+			return bound.IP.IsUnspecified()
+		}
+		return wanted.IP.Equal(bound.IP)
+	}
+	return false
+}
+
+// Takes a socket systemd passed in, which is served like the port on the command line
+// unless some other option listens on its address
+func (s *Server) activate(ln net.Listener) {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+	s.inherited[activatedPrefix+ln.Addr().Network()+" "+ln.Addr().String()] = ln
+}
+
+// The sockets systemd passed in that no option listens on
+func (s *Server) activatedListeners() []net.Listener {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	var listeners []net.Listener
+	for key, ln := range s.inherited {
+		if strings.HasPrefix(key, activatedPrefix) {
+			delete(s.inherited, key)
+			s.listening[key] = ln
+			listeners = append(listeners, ln)
+		}
+	}
+	return listeners
+}
+
+// Closes whatever was handed over that the configuration no longer listens on, and
+// tells the process handing over that this one is serving
+func (s *Server) finishInheriting() {
+	s.listenersLock.Lock()
+	for key, ln := range s.inherited {
+		s.logger.Warn("Closing a handed over listener that isn't configured any more", "listener", key)
+		ln.Close()
+		delete(s.inherited, key)
+	}
+	s.listenersLock.Unlock()
+
+	if s.handoverReady != nil {
+		s.handoverReady.Write([]byte(handoverReadyLine))
+		s.handoverReady.Close()
+		s.handoverReady = nil
+	}
+}
@@ -0,0 +1,173 @@
+//go:build !windows
+
+package brerver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Asks for a handover to a new process started from the executable on disk
+var handoverSignal os.Signal = syscall.SIGUSR2
+
+// Lists the listeners the new process inherits, as "network address" in the order of
+// their file descriptors
+const handoverEnv = "BRERVER_HANDOVER"
+
+// Descriptors the new process finds what it's handed on
+const (
+	handoverStateFD = 3 + iota
+	handoverReadyFD
+	handoverFirstListenerFD
+)
+
+// How long the new process has to start serving before the handover is abandoned
+const handoverTimeout = 30 * time.Second
+
+// Starts a new process from the executable on disk with the same arguments, passes it
+// every listener and the server's state, and shuts down once it is serving. Clients
+// reconnect to the new process and RESUME, since their sessions go with it. Anything
+// that changes between taking the state and shutting down stays behind.
+func (s *Server) handover() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	s.listenersLock.Lock()
+	var names []string
+	var files []*os.File
+	for key, ln := range s.listening {
+		filer, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		file, err := filer.File()
+		if err != nil {
+			s.listenersLock.Unlock()
+			closeFiles(files)
+			return err
+		}
+		names = append(names, key)
+		files = append(files, file)
+	}
+	s.listenersLock.Unlock()
+	defer closeFiles(files)
+	listeners, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	stateReader, stateWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stateWriter.Close()
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		stateReader.Close()
+		return err
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, handoverEnv+"=") {
+			cmd.Env = append(cmd.Env, variable)
+		}
+	}
+	cmd.Env = append(cmd.Env, handoverEnv+"="+string(listeners))
+	cmd.ExtraFiles = append([]*os.File{stateReader, readyWriter}, files...)
+	err = cmd.Start()
+	stateReader.Close()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(stateWriter).Encode(s.handoverState()); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	stateWriter.Close()
+
+	ready := make(chan bool, 1)
+	go func() {
+		line, _ := io.ReadAll(readyReader)
+		ready <- string(line) == handoverReadyLine
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			cmd.Wait()
+			return errors.New("the new process exited before serving")
+		}
+	case <-time.After(handoverTimeout):
+		cmd.Process.Kill()
+		return errors.New("the new process took too long to start serving")
+	}
+	cmd.Process.Release()
+
+	// The socket file belongs to the new process now
+	s.listenersLock.Lock()
+	for _, ln := range s.listening {
+		if unixLn, ok := ln.(*net.UnixListener); ok {
+			unixLn.SetUnlinkOnClose(false)
+		}
+	}
+	s.listenersLock.Unlock()
+	s.Shutdown()
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// Picks up what the process handing over passed on, if this process was started by a
+// handover
+func (s *Server) InheritHandover() error {
+	value, ok := os.LookupEnv(handoverEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(handoverEnv)
+
+	var names []string
+	if err := json.Unmarshal([]byte(value), &names); err != nil {
+		return err
+	}
+	s.listenersLock.Lock()
+	for i, name := range names {
+		file := os.NewFile(uintptr(handoverFirstListenerFD+i), name)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			s.listenersLock.Unlock()
+			return err
+		}
+		s.inherited[name] = ln
+	}
+	s.listenersLock.Unlock()
+
+	stateFile := os.NewFile(handoverStateFD, "handover state")
+	defer stateFile.Close()
+	var state handoverState
+	if err := json.NewDecoder(stateFile).Decode(&state); err != nil {
+		return err
+	}
+	s.restoreHandover(state)
+	s.handoverReady = os.NewFile(handoverReadyFD, "handover ready")
+	return nil
+}
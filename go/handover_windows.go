@@ -0,0 +1,20 @@
+//go:build windows
+
+package brerver
+
+import (
+	"errors"
+	"os"
+)
+
+// Windows has no way to pass listeners to a new process, so no signal asks for it
+var handoverSignal os.Signal
+
+func (s *Server) handover() error {
+	return errors.New("handover isn't supported on Windows")
+}
+
+// There's never anything to take over on Windows
+func (s *Server) InheritHandover() error {
+	return nil
+}
@@ -0,0 +1,47 @@
+package brerver
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Adds /healthz and /readyz for Kubernetes and load balancers to probe
+func (s *Server) handleProbes(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+}
+
+// Answers as long as the process is serving at all
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// Only ready between binding every listener and starting to shut down, so traffic is
+// sent elsewhere while the server starts and drains
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	s.connectionsLock.Lock()
+	closing := s.closing
+	s.connectionsLock.Unlock()
+	select {
+	case <-s.shutdown:
+		closing = true
+	default:
+	}
+	ready := false
+	select {
+	case <-s.started:
+		ready = true
+	default:
+	}
+
+	switch {
+	case closing:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "shutting down")
+	case !ready:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "starting")
+	default:
+		fmt.Fprintln(w, "ready")
+	}
+}
@@ -0,0 +1,76 @@
+package brerver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HELLO [json] [zlib] [sessions] [reasons] [members]
+//
+// Lets a client find out how it can log in before it has to, replying with the
+// mechanisms AUTH and LOGIN accept, like RESULT HELLO 1 LOGIN SCRAM-SHA-256. With json,
+// the connection switches to JSON mode first, so the reply is already JSON. Binary
+// connections chose their framing when they connected and can't switch.
+//
+// With zlib, everything the server sends after the reply is one zlib stream, flushed
+// after each message. Commands from the client stay as they were. Compression can't be
+// turned off again.
+//
+// With sessions, the server sends SESSION <token> after each LOGIN and PASSWD from now on,
+// for RESUME. A connection already logged in gets one straight after the reply.
+//
+// With reasons, a RESULT that failed says why after its 0, like RESULT JOIN general 0
+// NO_SUCH_CHANNEL. Without it the 0 stands alone, as it always has.
+//
+// With members, the connection gets JOINED <user> <channel> and LEFT <user> <channel> as
+// others join and leave its channels. Without it, it has to ask WHO.
+func hello(s *Server, u *user, args []string) {
+	var json, compress, sessions, reasons, members bool
+	for _, option := range strings.Fields(strings.Join(args[1:], " ")) {
+		switch {
+		case option == "json" && !json && u.wireFormat() != binaryFormat:
+			json = true
+		case option == "zlib" && !compress && u.compressor == nil:
+			compress = true
+		case option == "sessions" && !sessions:
+			sessions = true
+		case option == "reasons" && !reasons:
+			reasons = true
+		case option == "members" && !members:
+			members = true
+		default:
+			u.send([]byte("RESULT HELLO 0\n"))
+			return
+		}
+	}
+	if json {
+		u.setWireFormat(jsonFormat)
+	}
+	if reasons {
+		u.reasons = true
+	}
+	if members {
+		u.members.Store(true)
+	}
+
+	var mechanisms []string
+	if s.settings().PlaintextLogin {
+		mechanisms = append(mechanisms, "LOGIN")
+	}
+	mechanisms = append(mechanisms, scramMechanism)
+	if s.oidcProvider() != nil {
+		mechanisms = append(mechanisms, "OIDC")
+	}
+	msg := fmt.Sprintf("RESULT HELLO 1 %s\n", strings.Join(mechanisms, " "))
+	if compress {
+		u.sendThenCompress([]byte(msg))
+	} else {
+		u.send([]byte(msg))
+	}
+	if sessions {
+		u.sessions = true
+		if u.loggedIn() && u.session == "" {
+			s.startSession(u)
+		}
+	}
+}
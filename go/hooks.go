@@ -0,0 +1,89 @@
+package brerver
+
+import (
+	"context"
+	"net"
+	"slices"
+)
+
+// A command as it is dispatched: its name, like SAY, and the arguments after it. As in
+// the protocol, the first argument is a word and the second the rest of the line.
+type Command struct {
+	Name string
+	Args []string
+}
+
+// The connection a command came in on, as hooks see it
+type Session struct {
+	s *Server
+	u *user
+}
+
+// Who the connection is logged in as, empty until it is
+func (session *Session) Username() string {
+	return session.u.name
+}
+
+// Where the connection is from, after any PROXY header
+func (session *Session) RemoteAddr() net.Addr {
+	return session.u.conn.RemoteAddr()
+}
+
+// Sends the client a line of its own, which shouldn't end in a newline
+func (session *Session) Send(line string) {
+	session.u.send([]byte(line + "\n"))
+}
+
+// Runs around each command a connection sends, with the connection's context. An error
+// from a hook run before a command stops it; see WithBeforeCommand and WithAfterCommand.
+type Hook func(ctx context.Context, session *Session, command Command) error
+
+// Runs hook before every command, in the order they were given, once it has got past
+// rate limiting. An error keeps the command from running and answers it with RESULT
+// <command> 0 REJECTED, along with whatever the hook sent itself.
+func WithBeforeCommand(hook Hook) Option {
+	return func(s *Server) {
+		s.beforeCommand = append(s.beforeCommand, hook)
+	}
+}
+
+// Runs hook after every command the server knows has been handled. Errors are only
+// logged, as the command has already happened.
+func WithAfterCommand(hook Hook) Option {
+	return func(s *Server) {
+		s.afterCommand = append(s.afterCommand, hook)
+	}
+}
+
+// The command hooks see, copied as words is reused for the next one
+func hookCommand(words []string) Command {
+	return Command{Name: words[0], Args: slices.Clone(words[1:])}
+}
+
+// Reports whether every hook before the command let it go ahead
+func (s *Server) beforeHooks(ctx context.Context, session *Session, words []string) bool {
+	if len(s.beforeCommand) == 0 {
+		return true
+	}
+	command := hookCommand(words)
+	for _, hook := range s.beforeCommand {
+		if err := hook(ctx, session, command); err != nil {
+			s.userLogger(session.u).Debug("Command rejected by a hook", "command", command.Name, "err", err)
+			session.Send("RESULT " + command.Name + " " + session.u.outcome(0, rejectedByScript))
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) afterHooks(ctx context.Context, session *Session, words []string) {
+	if len(s.afterCommand) == 0 {
+		return
+	}
+	command := hookCommand(words)
+	for _, hook := range s.afterCommand {
+		if err := hook(ctx, session, command); err != nil {
+			s.userLogger(session.u).Warn("Command hook failed", "command", command.Name, "err", err)
+		}
+	}
+}
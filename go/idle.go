@@ -0,0 +1,41 @@
+package brerver
+
+import "time"
+
+// Counts down from a connection's last command to when it's dropped for being idle,
+// following idle_seconds as it's reloaded
+type idleTimer struct {
+	s     *Server
+	timer *time.Timer
+}
+
+func (s *Server) newIdleTimer() *idleTimer {
+	t := &idleTimer{s: s}
+	t.reset()
+	return t
+}
+
+// Fires when the connection has been idle too long, or never if idle_seconds is 0
+func (t *idleTimer) expired() <-chan time.Time {
+	if t.timer == nil {
+		return nil
+	}
+	return t.timer.C
+}
+
+// Starts the count again, as every command does, PINGs included
+func (t *idleTimer) reset() {
+	t.stop()
+	seconds := t.s.settings().IdleSeconds
+	if seconds <= 0 {
+		t.timer = nil
+		return
+	}
+	t.timer = time.NewTimer(time.Duration(seconds) * time.Second)
+}
+
+func (t *idleTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
@@ -0,0 +1,387 @@
+package brerver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// What the gateway calls itself in the prefix of its replies
+const ircServerName = "brerver"
+
+// IRC lines are at most 512 bytes with the CRLF
+const ircLineLength = 510
+
+// Channels LIST asks for at a time, which channels_page_size may make fewer
+const ircListPage = 1000
+
+// Marks connections to hand to ircConnection rather than userConnection
+type ircListener struct {
+	net.Listener
+}
+
+type ircConn struct {
+	net.Conn
+}
+
+func (l ircListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return ircConn{conn}, nil
+}
+
+// Translates between an IRC client and an ordinary connection, so that IRC clients go
+// through the very same handlers as everyone else. Commands are rewritten into ours and
+// written to the pipe, and frames read back from it are rewritten into IRC.
+type ircGateway struct {
+	irc      net.Conn
+	internal net.Conn
+
+	lock       sync.Mutex
+	nick       string
+	password   string
+	userSent   bool
+	loginSent  bool
+	registered bool
+
+	// Where LIST has got to, only touched by relayFrames: whether the start of the list
+	// has gone out, and the channel the next page comes after if there's more
+	listing   bool
+	listAfter string
+}
+
+func ircConnection(ctx context.Context, s *Server, conn net.Conn) {
+	internal, pipe := net.Pipe()
+	g := &ircGateway{irc: conn, internal: internal}
+	go userConnection(ctx, s, relayedConn{pipe, conn.RemoteAddr()})
+	go g.relayFrames()
+	// Failure reasons go into the numerics' text, and others joining and leaving become
+	// JOIN and PART
+	g.command("HELLO reasons members")
+
+	defer internal.Close()
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, ok, err := readCommand(reader, ircLineLength)
+		if err != nil {
+			return
+		}
+		if !ok {
+			continue
+		}
+		command, params := parseIRC(strings.TrimSuffix(line, "\r"))
+		if !g.handle(command, params) {
+			return
+		}
+	}
+}
+
+// Splits [:prefix] COMMAND [params] [:trailing] into the command and its parameters
+func parseIRC(line string) (string, []string) {
+	if strings.HasPrefix(line, ":") {
+		if i := strings.Index(line, " "); i >= 0 {
+			line = line[i+1:]
+		} else {
+			line = ""
+		}
+	}
+	var trailing *string
+	if i := strings.Index(line, " :"); i >= 0 {
+		rest := line[i+2:]
+		trailing = &rest
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params := fields[1:]
+	if trailing != nil {
+		params = append(params, *trailing)
+	}
+	return strings.ToUpper(fields[0]), params
+}
+
+func (g *ircGateway) reply(format string, args ...interface{}) {
+	fmt.Fprintf(g.irc, format+"\r\n", args...)
+}
+
+// Sends a numeric reply addressed to the client
+func (g *ircGateway) numeric(code string, text string) {
+	g.lock.Lock()
+	nick := g.nick
+	g.lock.Unlock()
+	if nick == "" {
+		nick = "*"
+	}
+	g.reply(":%s %s %s %s", ircServerName, code, nick, text)
+}
+
+func (g *ircGateway) command(format string, args ...interface{}) {
+	fmt.Fprintf(g.internal, format+"\n", args...)
+}
+
+// Channels are #name to IRC clients and name to everyone else
+func ircChannel(name string) (string, bool) {
+	if !strings.HasPrefix(name, "#") || len(name) == 1 || strings.ContainsAny(name, " ,") {
+		return "", false
+	}
+	return name[1:], true
+}
+
+// Handles one line from the client, returning false if the connection should close
+func (g *ircGateway) handle(command string, params []string) bool {
+	switch command {
+	case "":
+		return true
+	case "CAP":
+		// No capabilities to negotiate, but clients that ask expect an answer
+		if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+			g.reply(":%s CAP * LS :", ircServerName)
+		} else if len(params) > 1 && strings.ToUpper(params[0]) == "REQ" {
+			g.reply(":%s CAP * NAK :%s", ircServerName, params[1])
+		}
+		return true
+	case "PING":
+		token := ircServerName
+		if len(params) > 0 {
+			token = params[0]
+		}
+		g.reply(":%s PONG %s :%s", ircServerName, ircServerName, token)
+		return true
+	case "QUIT":
+		return false
+	case "PASS", "NICK", "USER":
+		return g.register(command, params)
+	}
+
+	g.lock.Lock()
+	registered := g.registered
+	g.lock.Unlock()
+	if !registered {
+		g.numeric("451", ":You have not registered")
+		return true
+	}
+
+	switch command {
+	case "JOIN":
+		if len(params) == 0 {
+			g.numeric("461", "JOIN :Not enough parameters")
+			return true
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			channel, ok := ircChannel(name)
+			if !ok {
+				g.numeric("403", name+" :No such channel")
+				continue
+			}
+			// IRC channels spring into being when first joined
+			g.command("CREATE %s", channel)
+			g.command("JOIN %s", channel)
+		}
+	case "PART":
+		if len(params) == 0 {
+			g.numeric("461", "PART :Not enough parameters")
+			return true
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			channel, ok := ircChannel(name)
+			if !ok {
+				g.numeric("403", name+" :No such channel")
+				continue
+			}
+			g.command("LEAVE %s", channel)
+		}
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 {
+			g.numeric("412", ":No text to send")
+			return true
+		}
+		channel, ok := ircChannel(params[0])
+		if !ok {
+			// There are only channels, no private messages
+			g.numeric("401", params[0]+" :No such nick/channel")
+			return true
+		}
+		g.command("SAY %s %s", channel, params[1])
+	case "LIST":
+		g.command("CHANNELS -counts -limit %d", ircListPage)
+	default:
+		g.numeric("421", command+" :Unknown command")
+	}
+	return true
+}
+
+// Logs in as the nick with PASS once NICK and USER have both come, which is when IRC
+// considers a client registered
+func (g *ircGateway) register(command string, params []string) bool {
+	if len(params) == 0 {
+		g.numeric("461", command+" :Not enough parameters")
+		return true
+	}
+
+	g.lock.Lock()
+	if g.loginSent {
+		g.lock.Unlock()
+		g.numeric("462", ":You may not reregister")
+		return true
+	}
+	switch command {
+	case "PASS":
+		g.password = params[0]
+	case "NICK":
+		g.nick = params[0]
+	case "USER":
+		g.userSent = true
+	}
+	ready := g.nick != "" && g.userSent
+	nick, password := g.nick, g.password
+	g.loginSent = ready && password != ""
+	g.lock.Unlock()
+
+	if !ready {
+		return true
+	}
+	if password == "" {
+		g.numeric("464", ":Password required, send PASS before NICK and USER")
+		return false
+	}
+	if strings.ContainsAny(nick, " :") || strings.Contains(password, " ") {
+		g.numeric("432", nick+" :Erroneous nickname")
+		return false
+	}
+	g.command("LOGIN %s %s", nick, password)
+	return true
+}
+
+// Rewrites what the server sends the connection into IRC, until either side hangs up
+func (g *ircGateway) relayFrames() {
+	defer g.irc.Close()
+	reader := bufio.NewReader(g.internal)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		kind, args := splitFrame(strings.TrimSuffix(line, "\n"))
+		if !g.translate(kind, args) {
+			return
+		}
+	}
+}
+
+// Returns false if the client should be disconnected
+func (g *ircGateway) translate(kind string, args []string) bool {
+	g.lock.Lock()
+	nick := g.nick
+	g.lock.Unlock()
+	source := func(name string) string {
+		return fmt.Sprintf("%s!%s@%s", name, name, ircServerName)
+	}
+
+	switch kind {
+	case "RECV":
+		if len(args) == 3 && args[0] != nick {
+			g.reply(":%s PRIVMSG #%s :%s", source(args[0]), args[1], args[2])
+		}
+	case "JOINED":
+		if len(args) == 2 {
+			g.reply(":%s JOIN #%s", source(args[0]), args[1])
+		}
+	case "LEFT":
+		if len(args) == 2 {
+			g.reply(":%s PART #%s", source(args[0]), args[1])
+		}
+	case "MUTED":
+		if len(args) == 3 {
+			g.reply(":%s NOTICE #%s :%s is muted for %s seconds", ircServerName, args[1], args[0], args[2])
+		}
+	case "ERROR":
+		g.reply(":%s NOTICE %s :%s", ircServerName, nick, strings.Join(args, " "))
+	case "MOTD":
+		if len(args) == 1 {
+			g.reply(":%s NOTICE %s :%s", ircServerName, nick, args[0])
+		}
+	case "SHUTDOWN":
+		g.reply(":%s NOTICE %s :Server shutting down", ircServerName, nick)
+	case "MORE":
+		if len(args) == 2 && args[0] == "CHANNELS" {
+			g.listAfter = args[1]
+		}
+	case "RESULT":
+		if len(args) == 0 {
+			return true
+		}
+		return g.result(args[0], args[1:], nick, source(nick))
+	}
+	return true
+}
+
+// Our RESULT lines carry the command and its arguments, so no state is needed to know what
+// they answer, only to carry LIST on over pages
+func (g *ircGateway) result(command string, args []string, nick, source string) bool {
+	switch command {
+	case "LOGIN":
+		if len(args) == 0 || args[0] != "1" {
+			g.numeric("464", ":Password incorrect")
+			return false
+		}
+		g.lock.Lock()
+		g.registered = true
+		g.lock.Unlock()
+		g.numeric("001", ":Welcome to brerver, "+nick)
+		g.numeric("002", ":Your host is "+ircServerName)
+		g.numeric("003", ":This server speaks IRC through a gateway")
+		g.numeric("004", ircServerName+" brerver o o")
+		g.numeric("422", ":MOTD File is missing")
+	case "JOIN":
+		if len(args) < 2 {
+			return true
+		}
+		channel := "#" + args[0]
+		if args[1] != "1" {
+			g.numeric("403", channel+" :Cannot join channel ("+strings.Join(args[2:], " ")+")")
+			return true
+		}
+		g.reply(":%s JOIN %s", source, channel)
+		g.numeric("353", "= "+channel+" :"+nick)
+		g.numeric("366", channel+" :End of /NAMES list")
+	case "LEAVE":
+		if len(args) < 2 {
+			return true
+		}
+		if args[1] == "1" {
+			g.reply(":%s PART #%s", source, args[0])
+		} else {
+			g.numeric("442", "#"+args[0]+" :You're not on that channel")
+		}
+	case "SAY":
+		if len(args) >= 2 && args[1] != "1" {
+			g.numeric("404", "#"+args[0]+" :Cannot send to channel ("+strings.Join(args[2:], " ")+")")
+		}
+	case "CHANNELS":
+		if !g.listing {
+			g.numeric("321", "Channel :Users  Name")
+			g.listing = true
+		}
+		for _, listed := range args {
+			name, count, _ := cutLast(strings.TrimSuffix(listed, ","), "=")
+			g.numeric("322", "#"+name+" "+count+" :")
+		}
+		// The rest of the list a page at a time, like gRPC's ListChannels
+		if g.listAfter != "" {
+			g.command("CHANNELS -counts -after %s", g.listAfter)
+			g.listAfter = ""
+			return true
+		}
+		g.numeric("323", ":End of /LIST")
+		g.listing = false
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package brerver
+
+import "encoding/json"
+
+// A command in JSON mode, like {"command": "SAY", "args": ["channel", "hello there"]}
+type jsonCommand struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// Anything the server sends in JSON mode, like {"type": "RECV", "args": ["user", "channel", "hello there"]}
+type jsonFrame struct {
+	Type string   `json:"type"`
+	Args []string `json:"args"`
+}
+
+func parseJSONCommand(line string) ([]string, bool) {
+	var command jsonCommand
+	if err := json.Unmarshal([]byte(line), &command); err != nil {
+		return nil, false
+	}
+	return commandWords(command.Command, command.Args)
+}
+
+// One object per line
+func encodeJSONFrames(msg []byte) []byte {
+	var out []byte
+	eachFrame(msg, func(kind string, args []string) {
+		encoded, _ := json.Marshal(jsonFrame{Type: kind, Args: args})
+		out = append(append(out, encoded...), '\n')
+	})
+	return out
+}
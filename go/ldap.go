@@ -0,0 +1,82 @@
+package brerver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// The ldap section of Config
+type LDAPConfig struct {
+	URL             string `json:"url" doc:"ldap:// or ldaps:// URL of a directory LOGIN checks passwords against" requires:"bind_dn"`
+	BindDN          string `json:"bind_dn" doc:"DN to bind as to check a password, with %s standing for the username" requires:"url"`
+	StartTLS        bool   `json:"start_tls" doc:"Upgrade ldap:// connections with StartTLS before binding" default:"false"`
+	DisableRegister bool   `json:"disable_register" doc:"Refuse REGISTER, so accounts only come from the directory" default:"false"`
+}
+
+// How long a bind may take before LOGIN gives up on the directory
+const ldapTimeout = 10 * time.Second
+
+// Checks passwords by binding to a directory as the user, so it answers for every
+// account the local store doesn't
+type ldapProvider struct {
+	config   LDAPConfig
+	accounts AccountRules
+}
+
+func (p ldapProvider) authenticate(username, password string) (bool, bool, error) {
+	// The account gets created here on success, so it has to be one REGISTER would allow
+	if p.accounts.checkUsername(username) != "" {
+		return true, false, nil
+	}
+
+	conn, err := ldap.DialURL(p.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return true, false, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+
+	if p.config.StartTLS {
+		parsed, err := url.Parse(p.config.URL)
+		if err != nil {
+			return true, false, err
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: parsed.Hostname()}); err != nil {
+			return true, false, err
+		}
+	}
+
+	err = conn.Bind(fmt.Sprintf(p.config.BindDN, escapeDNValue(username)), password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return true, false, nil
+	}
+	if err != nil {
+		return true, false, err
+	}
+	return true, true, nil
+}
+
+// Escapes a value for use in a DN, as RFC 4514 describes
+func escapeDNValue(value string) string {
+	var builder strings.Builder
+	for i, c := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, c),
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			builder.WriteRune('\\')
+			builder.WriteRune(c)
+		case c == 0:
+			builder.WriteString(`\00`)
+		default:
+			builder.WriteRune(c)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,151 @@
+package brerver
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Linked servers leave REGISTER to one of them, the leader, so that a name registered on
+// two of them at once ends up as one account everywhere rather than a different one on
+// each. The leader is whichever of a server and those it's linked to has the name that
+// sorts first, which every server in a fully linked mesh agrees on without a vote.
+// Others send it CLAIM <id> <name> <credential> and wait for CLAIMED <id> <outcome>, the
+// account having come before that as ACCOUNT, like it does to every linked server.
+//
+// Each side of a netsplit elects its own leader, so a name can be taken on both. Once
+// they link again the account from the leader replaces any other by the same name, and
+// connections logged in to the one replaced are logged out.
+//
+// Servers that aren't all linked to each other, like a mesh still learning of servers
+// from PEERS or one where only some links are up, can disagree on the leader the same
+// way: a server linked only to c picks c while c, linked to b, picks b. A name can then
+// be taken twice until the leader links to the rest.
+
+// How long a REGISTER waits on the leader before giving up
+const claimTimeout = 5 * time.Second
+
+// A REGISTER waiting on the leader
+type claim struct {
+	leader  string
+	outcome chan string
+}
+
+func (s *Server) leader() string {
+	leader := s.settings().ServerName
+	s.serversLock.RLock()
+	defer s.serversLock.RUnlock()
+	for name := range s.servers {
+		if name < leader {
+			leader = name
+		}
+	}
+	return leader
+}
+
+// Registers name with credential, through the leader if it's another server, returning
+// why it couldn't or the empty string if it did
+func (s *Server) claimAccount(name, credential string) string {
+	leader := s.leader()
+	if leader == s.settings().ServerName {
+		return s.addAccount(name, credential)
+	}
+
+	c := claim{leader: leader, outcome: make(chan string, 1)}
+	s.serversLock.Lock()
+	s.lastClaim++
+	id := strconv.FormatUint(s.lastClaim, 10)
+	s.claims[id] = c
+	s.serversLock.Unlock()
+	defer func() {
+		s.serversLock.Lock()
+		delete(s.claims, id)
+		s.serversLock.Unlock()
+	}()
+
+	if !s.sendTo(leader, accountLine("CLAIM "+id, name, credential)) {
+		return noLeader
+	}
+	select {
+	case outcome := <-c.outcome:
+		if outcome == "1" {
+			return ""
+		}
+		if reason, ok := strings.CutPrefix(outcome, "0 "); ok {
+			return reason
+		}
+		return noLeader
+	case <-time.After(claimTimeout):
+		s.logger.Warn("The leader didn't answer a claim for an account", "server", leader, "user", name)
+		return noLeader
+	}
+}
+
+// Adds the account here and shares it, unless the name is taken
+func (s *Server) addAccount(name, credential string) string {
+	if !s.users.add(name, credential) {
+		return usernameTaken
+	}
+
+	s.shareAccount(name, credential)
+	s.logEvent(registerEvent, name, "", "")
+	return ""
+}
+
+// Decides a CLAIM from a linked server that takes this one to be the leader
+func (s *Server) decideClaim(l *serverLink, fields []string) {
+	if len(fields) != 4 {
+		s.logger.Warn("Dropped a malformed claim from a linked server", "server", l.name)
+		return
+	}
+	id, name, credential := fields[1], fields[2], fields[3]
+	if credential == noCredential {
+		credential = ""
+	}
+	reason := s.settings().Accounts.checkUsername(name)
+	_, valid := parseCredential(credential)
+	switch {
+	case reason != "":
+	case credential != "" && !valid:
+		reason = badArguments
+	case s.leader() != s.settings().ServerName:
+		// It knows of fewer servers than this one does, and will soon hear of the leader
+		reason = noLeader
+	default:
+		reason = s.addAccount(name, credential)
+	}
+	if reason == "" {
+		l.send("CLAIMED " + id + " 1\n")
+		return
+	}
+	l.send("CLAIMED " + id + " 0 " + reason + "\n")
+}
+
+// Hands the leader's answer to the REGISTER waiting on it
+func (s *Server) claimed(l *serverLink, fields []string) {
+	if len(fields) < 3 {
+		s.logger.Warn("Dropped a malformed claim outcome from a linked server", "server", l.name)
+		return
+	}
+	s.serversLock.RLock()
+	c, ok := s.claims[fields[1]]
+	s.serversLock.RUnlock()
+	if ok && c.leader == l.name {
+		select {
+		case c.outcome <- strings.Join(fields[2:], " "):
+		default:
+		}
+	}
+}
+
+// Fails every REGISTER waiting on name, whose link dropped. Called with serversLock held.
+func (s *Server) abandonClaims(name string) {
+	for _, c := range s.claims {
+		if c.leader == name {
+			select {
+			case c.outcome <- "0 " + noLeader:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package brerver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// What busy_action can do with connections over max_connections
+const (
+	// Answer them with ERROR BUSY and hang up
+	rejectBusy = "reject"
+	// Leave them waiting to be accepted until there's room
+	pauseBusy = "pause"
+)
+
+// Counts the connection against the per-IP and global caps, returning the error
+// line to turn it away with if it doesn't fit
+func (s *Server) admit(conn net.Conn) (string, bool) {
+	ip := remoteIP(conn)
+
+	s.admittedLock.Lock()
+	defer s.admittedLock.Unlock()
+	if max := s.settings().MaxConnections; max > 0 && s.admittedTotal >= max {
+		return "ERROR BUSY\n", false
+	}
+	if max := s.settings().MaxConnectionsPerIP; max > 0 && ip != "" && s.admitted[ip] >= max {
+		return "ERROR TOOMANY\n", false
+	}
+	s.admitted[ip]++
+	s.admittedTotal++
+	return "", true
+}
+
+func (s *Server) release(conn net.Conn) {
+	ip := remoteIP(conn)
+
+	s.admittedLock.Lock()
+	defer s.admittedLock.Unlock()
+	s.admitted[ip]--
+	if s.admitted[ip] == 0 {
+		delete(s.admitted, ip)
+	}
+	s.admittedTotal--
+	s.makeRoom()
+}
+
+// Must be called with admittedLock held
+func (s *Server) makeRoom() {
+	if s.vacancy != nil {
+		close(s.vacancy)
+		s.vacancy = nil
+	}
+}
+
+// Blocks while max_connections are served and busy_action is pause, so that the
+// connections over it wait in the listen backlog rather than each taking a file
+// descriptor to be turned away with. Returns false once ctx is done.
+func (s *Server) waitForRoom(ctx context.Context) bool {
+	for {
+		s.admittedLock.Lock()
+		conf := s.settings()
+		if conf.BusyAction != pauseBusy || conf.MaxConnections == 0 || s.admittedTotal+s.accepted < conf.MaxConnections {
+			s.admittedLock.Unlock()
+			return ctx.Err() == nil
+		}
+		if s.vacancy == nil {
+			s.vacancy = make(chan struct{})
+		}
+		vacancy := s.vacancy
+		s.admittedLock.Unlock()
+
+		// Looking again now and then picks up max_connections being raised by a reload
+		select {
+		case <-vacancy:
+		case <-time.After(acceptRetryDelay):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Counts connections from when they're accepted until they're admitted or turned away,
+// which may wait on a PROXY header, so that accepting doesn't run ahead of the cap
+func (s *Server) accepting(n int) {
+	s.admittedLock.Lock()
+	defer s.admittedLock.Unlock()
+	s.accepted += n
+	if n < 0 {
+		s.makeRoom()
+	}
+}
+
+// Turns away banned addresses and connections over the caps, returning whether conn
+// should be served
+func (s *Server) welcome(conn net.Conn) bool {
+	if s.bans.banned(conn.RemoteAddr()) {
+		conn.Close()
+		return false
+	}
+	if msg, ok := s.admit(conn); !ok {
+		reject(conn, msg)
+		return false
+	}
+	return true
+}
+
+// Tells the client why before hanging up, without holding up the accept loop
+func reject(conn net.Conn, msg string) {
+	go func() {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(msg))
+		conn.Close()
+	}()
+}
+
+// Reads up to the next newline, returning the command without it. Commands longer than
+// max are read to the end and thrown away, returning false, so they never take up more
+// than max bytes plus the reader's buffer.
+func readCommand(reader *bufio.Reader, max int) (string, bool, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		// Lines that fit in the reader's buffer, as almost all do, are copied only once,
+		// into the string returned
+		if err == nil && line == nil && !tooLong {
+			chunk = chunk[:len(chunk)-1]
+			if len(chunk) > max {
+				return "", false, nil
+			}
+			return string(chunk), true, nil
+		}
+		if !tooLong {
+			line = append(line, bytes.TrimSuffix(chunk, []byte("\n"))...)
+			if len(line) > max {
+				tooLong, line = true, nil
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return string(line), !tooLong, nil
+	}
+}
+
+// Reports whether line is UTF-8 without control characters apart from tabs, so that
+// nothing relayed from it can end a line early or pass for another frame
+func validCommand(line string) bool {
+	if !utf8.ValidString(line) {
+		return false
+	}
+	for _, c := range line {
+		if unicode.IsControl(c) && c != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// Empty for connections that don't come from an IP, like unix sockets
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,60 @@
+package brerver
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// Buffers bigger than this aren't kept, so one huge message doesn't pin its buffer
+const pooledLineMax = 64 * 1024
+
+var linePool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// A line formatted once for every recipient of a broadcast. Its buffer comes from
+// linePool and goes back once the broadcaster and every writer it was queued for are
+// done with it.
+type sharedLine struct {
+	buf  *bytes.Buffer
+	refs atomic.Int32
+}
+
+// Formats words as one space separated line, held by the caller until it calls release
+func newSharedLine(words ...string) *sharedLine {
+	l := &sharedLine{buf: linePool.Get().(*bytes.Buffer)}
+	for i, word := range words {
+		if i > 0 {
+			l.buf.WriteByte(' ')
+		}
+		l.buf.WriteString(word)
+	}
+	l.buf.WriteByte('\n')
+	l.refs.Store(1)
+	return l
+}
+
+func (l *sharedLine) hold() {
+	l.refs.Add(1)
+}
+
+func (l *sharedLine) release() {
+	if l.refs.Add(-1) != 0 {
+		return
+	}
+	if l.buf.Cap() <= pooledLineMax {
+		l.buf.Reset()
+		linePool.Put(l.buf)
+	}
+	l.buf = nil
+}
+
+// Sends a broadcast line. Text connections queue the shared bytes themselves, and the
+// others their own encoding of them.
+func (u *user) sendShared(l *sharedLine) {
+	if u.wireFormat() != textFormat {
+		u.send(bytes.Clone(l.buf.Bytes()))
+		return
+	}
+	l.hold()
+	u.enqueue(outgoing{msg: l.buf.Bytes(), shared: l})
+}
@@ -0,0 +1,14 @@
+package brerver
+
+import "net"
+
+// One of Config.Listen
+type ListenAddress struct {
+	Address string `json:"address" doc:"host:port to listen on, like 127.0.0.1:7000 or [::]:7001; an empty host means every interface"`
+	TLS     bool   `json:"tls" doc:"Serve TLS on this address using tls_cert" default:"false"`
+}
+
+func (a ListenAddress) valid() bool {
+	_, port, err := net.SplitHostPort(a.Address)
+	return err == nil && port != ""
+}
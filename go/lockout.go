@@ -0,0 +1,94 @@
+package brerver
+
+import "time"
+
+// The lockout section of Config
+type LockoutConfig struct {
+	Attempts int `json:"attempts" doc:"Failed logins to one account, or from one IP, before further attempts are locked, never if zero" default:"0" minimum:"0"`
+	Seconds  int `json:"seconds" doc:"How long attempts stay locked, and how long a failed login counts towards attempts" default:"0" minimum:"0"`
+}
+
+// Failed logins against an account or from an IP since it was last locked or logged in
+type failures struct {
+	count  int
+	last   time.Time
+	locked time.Time
+}
+
+// Reports whether the lock has run out, or there is none and the last failure is too
+// old to count, so that f can be forgotten
+func (f *failures) expired(now time.Time, window time.Duration) bool {
+	if !f.locked.IsZero() {
+		return !now.Before(f.locked)
+	}
+	return now.Sub(f.last) >= window
+}
+
+func accountKey(username string) string {
+	return "account " + username
+}
+
+func ipKey(u *user) string {
+	return "ip " + remoteIP(u.conn)
+}
+
+// Reports whether logging in as username is locked, either for the account or for where u connects from
+func (s *Server) lockedOut(u *user, username string) bool {
+	if s.settings().Lockout.Attempts == 0 {
+		return false
+	}
+
+	now := time.Now()
+	s.failuresLock.Lock()
+	defer s.failuresLock.Unlock()
+	for _, key := range []string{accountKey(username), ipKey(u)} {
+		if f, ok := s.failures[key]; ok && now.Before(f.locked) {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts a failed login, locking the account or the IP once it has failed too many times
+func (s *Server) loginFailed(u *user, username string) {
+	lockout := s.settings().Lockout
+	if lockout.Attempts == 0 {
+		return
+	}
+
+	now := time.Now()
+	window := time.Duration(lockout.Seconds) * time.Second
+	s.failuresLock.Lock()
+	defer s.failuresLock.Unlock()
+	// Guessing at many accounts or from many IPs leaves an entry for each, so those that
+	// have run out are swept up now and then
+	if now.Sub(s.failuresSwept) >= window {
+		for key, f := range s.failures {
+			if f.expired(now, window) {
+				delete(s.failures, key)
+			}
+		}
+		s.failuresSwept = now
+	}
+	for _, key := range []string{accountKey(username), ipKey(u)} {
+		f, ok := s.failures[key]
+		// A lock that has run out, or failures too long ago, start the count again
+		if !ok || f.expired(now, window) {
+			f = &failures{}
+			s.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if f.count >= lockout.Attempts {
+			f.locked = now.Add(window)
+		}
+	}
+}
+
+// Forgets the account's failures. Those from the IP stay, so that guessing at many
+// accounts doesn't get easier for knowing the password to one.
+func (s *Server) loginSucceeded(username string) {
+	s.failuresLock.Lock()
+	defer s.failuresLock.Unlock()
+	delete(s.failures, accountKey(username))
+}
@@ -0,0 +1,34 @@
+package brerver
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Builds the logger for the -log-level and -log-format flags: debug, info, warn or
+// error, written as text or json
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level '%s'", level)
+	}
+	options := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format '%s'", format)
+}
+
+// Logs for the connection, tagged with where it's from and who it's logged in as
+func (s *Server) userLogger(u *user) *slog.Logger {
+	logger := s.logger.With("remote", u.conn.RemoteAddr().String())
+	if u.loggedIn() {
+		logger = logger.With("user", u.name)
+	}
+	return logger
+}
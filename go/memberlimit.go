@@ -0,0 +1,56 @@
+package brerver
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Whether u can't be added to the channel for it having as many members as it takes. Must
+// be called with usersLock held.
+func (c *channel) full(u *user) bool {
+	if c.memberLimit == 0 || len(c.users) < c.memberLimit {
+		return false
+	}
+	// Another connection to the same account is already counted
+	_, ok := c.users[u.name]
+	return !ok
+}
+
+// MEMBERLIMIT <channel> <limit>
+//
+// Lets an operator cap how many can be joined to the channel, JOIN failing with FULL once
+// it has that many, or lift the cap with 0. Anyone already joined stays, even if there
+// are now more than the limit.
+func setMemberLimit(s *Server, u *user, args []string) {
+	channelName := args[1]
+	limitText := args[2]
+
+	var confirmation int
+	var reason string
+	defer func() {
+		msg := fmt.Sprintf("RESULT MEMBERLIMIT %s %s %s\n", channelName, limitText, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
+	}()
+
+	channel, ok := u.channels[channelName]
+	if !ok {
+		reason = notJoined
+		return
+	}
+	limit, err := strconv.Atoi(limitText)
+	if err != nil || limit < 0 {
+		reason = badArguments
+		return
+	}
+
+	channel.settingsLock.RLock()
+	operator := channel.operators[u.name]
+	channel.settingsLock.RUnlock()
+	if !operator {
+		return
+	}
+	channel.usersLock.Lock()
+	channel.memberLimit = limit
+	channel.usersLock.Unlock()
+	confirmation = 1
+}
@@ -0,0 +1,157 @@
+package brerver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds in seconds of the buckets command latencies are counted in
+var commandBuckets = []float64{0.0001, 0.001, 0.01, 0.1, 1}
+
+// A Prometheus histogram of how long one command takes to handle
+type commandTiming struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type metrics struct {
+	lock     sync.Mutex
+	messages uint64
+	// Messages that found a connection's queue full
+	overflows uint64
+	commands  map[string]*commandTiming
+}
+
+func (m *metrics) countMessage() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.messages++
+}
+
+func (m *metrics) countOverflow() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.overflows++
+}
+
+func (m *metrics) observeCommand(command string, took time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.commands == nil {
+		m.commands = map[string]*commandTiming{}
+	}
+	timing, ok := m.commands[command]
+	if !ok {
+		timing = &commandTiming{buckets: make([]uint64, len(commandBuckets))}
+		m.commands[command] = timing
+	}
+	seconds := took.Seconds()
+	for i, bound := range commandBuckets {
+		if seconds <= bound {
+			timing.buckets[i]++
+		}
+	}
+	timing.count++
+	timing.sum += seconds
+}
+
+// Serves /metrics in the Prometheus text format
+func (s *Server) serveMetrics(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.writeMetrics)
+	s.handleProbes(mux)
+	if err := http.Serve(ln, mux); err != nil {
+		s.logger.Info("Stopped serving metrics", "err", err)
+	}
+}
+
+func (s *Server) writeMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "brerver_connections", "gauge", "Open client connections", nil, float64(s.connectionCount()))
+	writeMetric(w, "brerver_users_logged_in", "gauge", "Connections logged in to an account", nil, float64(s.loggedInCount()))
+	queues, _ := s.QueueStats()
+	writeMetric(w, "brerver_send_queue_depth", "gauge", "Writes waiting on open connections", nil, float64(queues.Depth))
+	writeMetric(w, "brerver_send_queue_drops", "gauge", "Writes to open connections that never made it to the client", nil, float64(queues.Drops))
+	writeMetric(w, "brerver_send_queue_oldest_seconds", "gauge", "How long the oldest write still waiting on any connection has waited", nil, queues.OldestPending.Seconds())
+
+	s.metrics.lock.Lock()
+	messages := s.metrics.messages
+	overflows := s.metrics.overflows
+	commands := make([]string, 0, len(s.metrics.commands))
+	timings := map[string]commandTiming{}
+	for command, timing := range s.metrics.commands {
+		commands = append(commands, command)
+		timings[command] = commandTiming{append([]uint64(nil), timing.buckets...), timing.count, timing.sum}
+	}
+	s.metrics.lock.Unlock()
+	writeMetric(w, "brerver_messages_total", "counter", "Messages said in channels", nil, float64(messages))
+	writeMetric(w, "brerver_slow_consumer_overflows_total", "counter", "Messages sent to connections with full queues, handled as slow_consumers says", nil, float64(overflows))
+
+	sort.Strings(commands)
+	fmt.Fprintln(w, "# HELP brerver_command_duration_seconds Time taken to handle each command")
+	fmt.Fprintln(w, "# TYPE brerver_command_duration_seconds histogram")
+	for _, command := range commands {
+		timing := timings[command]
+		for i, bound := range commandBuckets {
+			labels := []string{"command", command, "le", strconv.FormatFloat(bound, 'g', -1, 64)}
+			writeSample(w, "brerver_command_duration_seconds_bucket", labels, float64(timing.buckets[i]))
+		}
+		writeSample(w, "brerver_command_duration_seconds_bucket", []string{"command", command, "le", "+Inf"}, float64(timing.count))
+		writeSample(w, "brerver_command_duration_seconds_sum", []string{"command", command}, timing.sum)
+		writeSample(w, "brerver_command_duration_seconds_count", []string{"command", command}, float64(timing.count))
+	}
+
+	members := map[string]int{}
+	s.channels.each(func(name string, channel *channel) {
+		members[name] = channel.memberCount()
+	})
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "# HELP brerver_channel_members Users joined to each channel")
+	fmt.Fprintln(w, "# TYPE brerver_channel_members gauge")
+	for _, name := range names {
+		writeSample(w, "brerver_channel_members", []string{"channel", name}, float64(members[name]))
+	}
+}
+
+// Writes a metric with a single sample
+func writeMetric(w io.Writer, name, kind, help string, labels []string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	writeSample(w, name, labels, value)
+}
+
+// Label values may only escape backslashes, quotes and newlines
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Labels come in name, value pairs
+func writeSample(w io.Writer, name string, labels []string, value float64) {
+	fmt.Fprint(w, name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		separator := ","
+		if i == 0 {
+			separator = "{"
+		}
+		fmt.Fprintf(w, "%s%s=\"%s\"", separator, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	if len(labels) > 0 {
+		fmt.Fprint(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
@@ -0,0 +1,225 @@
+package brerver
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Lines kept for a peer while its link is down, after which the oldest are dropped
+	splitBacklog = 1000
+	// A link is dropped after this many ping intervals without hearing from the peer
+	linkPingsMissed = 3
+)
+
+// What this server knows of a peer, kept while their link is down so that the two can
+// catch up once it's back
+type peerState struct {
+	// Which of its users are in each channel
+	members map[string]map[string]bool
+	// When the link dropped, zero while the peer is linked
+	split time.Time
+	// What would have been sent to the peer since the split, oldest first
+	backlog []string
+	dropped int
+}
+
+// Sends PING on l every interval until done is closed. The peer answers PONG, though
+// anything it sends shows the link is alive.
+func pingLink(l *serverLink, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if l.send("PING\n") != nil {
+				return
+			}
+		}
+	}
+}
+
+// Called with serversLock held when l is registered
+func (s *Server) linkedPeer(l *serverLink) {
+	if _, ok := s.peers[l.name]; !ok {
+		s.peers[l.name] = &peerState{members: map[string]map[string]bool{}}
+	}
+}
+
+// Called with serversLock held when l drops, other than by being replaced. The peer's
+// users stay members of their channels, marked as split, and returns those channels,
+// whose local members are to be told SPLIT <server> <channel>.
+func (s *Server) splitPeer(l *serverLink) []string {
+	peer := s.peers[l.name]
+	peer.split = time.Now()
+	peer.backlog, peer.dropped = nil, 0
+	channels := make([]string, 0, len(peer.members))
+	for channelName := range peer.members {
+		channels = append(channels, channelName)
+	}
+	return channels
+}
+
+// Keeps line for every split peer. Called with serversLock held.
+func (s *Server) backlogSplit(line string) {
+	for name, peer := range s.peers {
+		if _, linked := s.servers[name]; !linked && !peer.split.IsZero() {
+			peer.keep(line)
+		}
+	}
+}
+
+// Adds line to the backlog, dropping the oldest if it's full
+func (p *peerState) keep(line string) {
+	if len(p.backlog) >= splitBacklog {
+		p.backlog = p.backlog[1:]
+		p.dropped++
+	}
+	p.backlog = append(p.backlog, line)
+}
+
+// Brings a newly made link up to date, before anything else is sent on it: every
+// account, whatever the peer missed while split, and which users are in which public
+// channels here as MEMBERS <channel> <user>..., the servers this one knows of as PEERS,
+// ending with SYNCED.
+func (s *Server) catchUp(l *serverLink) {
+	l.writeLock.Lock()
+	defer l.writeLock.Unlock()
+
+	var lines bytes.Buffer
+	s.writeAccounts(&lines)
+
+	s.serversLock.Lock()
+	if peer, ok := s.peers[l.name]; ok {
+		for _, line := range peer.backlog {
+			lines.WriteString(line)
+		}
+		if peer.dropped > 0 {
+			s.logger.Warn("A linked server missed messages while split", "server", l.name, "count", peer.dropped)
+		}
+		peer.backlog, peer.dropped = nil, 0
+	}
+	s.serversLock.Unlock()
+
+	s.channels.each(func(name string, c *channel) {
+		if c.private {
+			return
+		}
+		c.usersLock.RLock()
+		members := make([]string, 0, len(c.users))
+		for member := range c.users {
+			members = append(members, member)
+		}
+		c.usersLock.RUnlock()
+		if len(members) > 0 {
+			sort.Strings(members)
+			fmt.Fprintf(&lines, "MEMBERS %s %s\n", name, strings.Join(members, " "))
+		}
+	})
+	lines.WriteString(s.peersLine())
+	lines.WriteString("SYNCED\n")
+	l.conn.Write(lines.Bytes())
+}
+
+// Tells linked servers that name joined or left channelName, unless it's private
+func (s *Server) shareMembership(command, channelName, name string) {
+	if c, ok := s.channels.get(channelName); ok && c.private {
+		return
+	}
+	s.broadcastLinks(fmt.Sprintf("%s %s %s\n", command, channelName, name))
+}
+
+// Applies JOIN, LEAVE and MEMBERS from a linked server. MEMBERS only come while the
+// link catches up, and replace what was known of the peer's members at SYNCED.
+func (s *Server) linkedMembership(l *serverLink, fields []string) {
+	if len(fields) < 3 || (fields[0] != "MEMBERS" && len(fields) != 3) {
+		s.logger.Warn("Dropped a malformed membership change from a linked server", "server", l.name)
+		return
+	}
+	command, channelName, names := fields[0], fields[1], fields[2:]
+	if command == "MEMBERS" {
+		if l.catchingUp == nil {
+			l.catchingUp = map[string]map[string]bool{}
+		}
+		members := map[string]bool{}
+		for _, name := range names {
+			members[name] = true
+		}
+		l.catchingUp[channelName] = members
+		return
+	}
+
+	s.serversLock.Lock()
+	defer s.serversLock.Unlock()
+	peer, ok := s.peers[l.name]
+	if !ok {
+		return
+	}
+	members := peer.members[channelName]
+	if command == "JOIN" {
+		if members == nil {
+			members = map[string]bool{}
+			peer.members[channelName] = members
+		}
+		members[names[0]] = true
+	} else if members != nil {
+		delete(members, names[0])
+		if len(members) == 0 {
+			delete(peer.members, channelName)
+		}
+	}
+}
+
+// Ends catching up: the peer's members are now what it sent, and if it was split the
+// channels it had members in then or has now are told UNSPLIT <server> <channel>
+func (s *Server) synced(l *serverLink) {
+	members := l.catchingUp
+	if members == nil {
+		members = map[string]map[string]bool{}
+	}
+	l.catchingUp = nil
+
+	var rejoined []string
+	s.serversLock.Lock()
+	peer, ok := s.peers[l.name]
+	if ok && !peer.split.IsZero() {
+		s.logger.Info("Caught up with a server after a split", "server", l.name, "split", time.Since(peer.split).Round(time.Second).String())
+		for channelName := range peer.members {
+			rejoined = append(rejoined, channelName)
+		}
+		for channelName := range members {
+			if _, already := peer.members[channelName]; !already {
+				rejoined = append(rejoined, channelName)
+			}
+		}
+		peer.split = time.Time{}
+	}
+	if ok {
+		peer.members = members
+	}
+	s.serversLock.Unlock()
+	s.tellChannels("UNSPLIT", l.name, rejoined)
+}
+
+// Sends <command> <server> <channel> to the local members of each of channels that
+// exists here
+func (s *Server) tellChannels(command, server string, channels []string) {
+	for _, channelName := range channels {
+		c, ok := s.channels.get(channelName)
+		if !ok {
+			continue
+		}
+		msg := []byte(fmt.Sprintf("%s %s %s\n", command, server, channelName))
+		c.usersLock.RLock()
+		members := c.connections()
+		c.usersLock.RUnlock()
+		for _, u := range members {
+			u.send(msg)
+		}
+	}
+}
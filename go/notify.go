@@ -0,0 +1,76 @@
+package brerver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// When a channel's messages reach a member's presence-only connections as NOTIFY
+const (
+	notifyAll      = "all"
+	notifyMentions = "mentions"
+	notifyNone     = "none"
+)
+
+func validNotifyPolicy(policy string) bool {
+	return policy == notifyAll || policy == notifyMentions || policy == notifyNone
+}
+
+// The policy username gets, their own if they have set one and the channel's default otherwise
+func (c *channel) notifyPolicy(username string) string {
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+	if policy, ok := c.notifyPolicies[username]; ok {
+		return policy
+	}
+	return c.notifyDefault
+}
+
+func (c *channel) isMember(username string) bool {
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+	return c.members[username]
+}
+
+// NOTIFYPOLICY <channel> DEFAULT <all|mentions|none>
+// NOTIFYPOLICY <channel> <all|mentions|none|inherit>
+//
+// Sets the policy members get unless they choose their own, which only operators can
+// do, or chooses the user's own, where inherit goes back to the channel's default.
+func notifyPolicy(s *Server, u *user, args []string) {
+	channelName := args[1]
+	setting := args[2]
+
+	var confirmation int
+	var reason string
+	defer func() {
+		msg := fmt.Sprintf("RESULT NOTIFYPOLICY %s %s %s\n", channelName, setting, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
+	}()
+
+	if !u.loggedIn() {
+		return
+	}
+	channel, ok := s.channels.get(channelName)
+	// Private channels aren't there to anyone not let in
+	if !ok || !channel.admits(u.name) {
+		reason = noSuchChannel
+		return
+	}
+
+	channel.settingsLock.Lock()
+	defer channel.settingsLock.Unlock()
+	if policy := strings.TrimPrefix(setting, "DEFAULT "); policy != setting {
+		if !channel.operators[u.name] || !validNotifyPolicy(policy) {
+			return
+		}
+		channel.notifyDefault = policy
+	} else if setting == "inherit" {
+		delete(channel.notifyPolicies, u.name)
+	} else if validNotifyPolicy(setting) {
+		channel.notifyPolicies[u.name] = setting
+	} else {
+		return
+	}
+	confirmation = 1
+}
@@ -0,0 +1,319 @@
+package brerver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The oidc section of Config
+type OIDCConfig struct {
+	Issuer        string `json:"issuer" doc:"Accept AUTH OIDC with ID tokens from this issuer, whose keys are found by discovery" requires:"client_id"`
+	ClientID      string `json:"client_id" doc:"Audience the ID tokens must be issued for" requires:"issuer"`
+	UsernameClaim string `json:"username_claim" doc:"Claim holding the chat account name" default:"sub"`
+}
+
+// How far apart our clock and the issuer's may be when checking exp and nbf
+const oidcLeeway = time.Minute
+
+// How often unknown key IDs may send us back to the issuer for its keys
+const oidcRefetchInterval = time.Minute
+
+// Verifies ID tokens against the keys an issuer publishes, fetching them on first use
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	lock    sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// Closed once the key set being fetched has been swapped in, or nil when there isn't
+	// a fetch going on
+	refreshing chan struct{}
+}
+
+func newOIDCProvider(config OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// AUTH OIDC <id token>
+//
+// Signs the connection in as the account named by the token's username claim, creating
+// it on first use. Accounts created this way have no password, so LOGIN can't be used
+// for them, and an account that already has a password is never taken over.
+func oidcAuthenticate(s *Server, u *user, token string) {
+	provider := s.oidcProvider()
+	if provider == nil || u.loggedIn() {
+		u.send([]byte("RESULT AUTH OIDC 0\n"))
+		return
+	}
+
+	claims, err := provider.verify(token)
+	if err != nil {
+		s.userLogger(u).Warn("Rejected ID token", "err", err)
+		s.audit(u, loginFailedAudit, "", "oidc: "+err.Error())
+		u.send([]byte("RESULT AUTH OIDC 0\n"))
+		return
+	}
+	username, _ := claims[provider.config.UsernameClaim].(string)
+	if username == "" || s.settings().Accounts.checkUsername(username) != "" {
+		s.userLogger(u).Warn("Rejected ID token with an unusable claim", "claim", provider.config.UsernameClaim)
+		u.send([]byte("RESULT AUTH OIDC 0\n"))
+		return
+	}
+
+	if !s.provision(username) {
+		u.send([]byte("RESULT AUTH OIDC 0\n"))
+		return
+	}
+
+	if !loggedIn(s, u, username, "oidc", "RESULT AUTH OIDC 1\n") {
+		u.send([]byte("RESULT AUTH OIDC 0\n"))
+	}
+}
+
+// Checks the token's signature, issuer, audience and lifetime, returning its claims
+func (p *oidcProvider) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	if issuer, _ := claims["iss"].(string); issuer != p.config.Issuer {
+		return nil, fmt.Errorf("issued by '%s'", issuer)
+	}
+	if !audienceContains(claims["aud"], p.config.ClientID) {
+		return nil, errors.New("issued for another audience")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return nil, errors.New("expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return fmt.Errorf("algorithm '%s' doesn't match an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(signature) != 2*size {
+			return fmt.Errorf("algorithm '%s' doesn't match an EC key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		sig := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type")
+}
+
+// Looks up the issuer's signing key by ID, refetching the key set if it isn't one we know.
+// The lock isn't held while fetching, so keys we know don't wait on the issuer, and
+// lookups that need the new set wait for the one fetch rather than starting their own.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.lock.Lock()
+	if key, ok := p.keys[kid]; ok {
+		p.lock.Unlock()
+		return key, nil
+	}
+	refreshing := p.refreshing
+	if refreshing != nil {
+		p.lock.Unlock()
+		<-refreshing
+	} else {
+		if time.Since(p.fetched) < oidcRefetchInterval {
+			p.lock.Unlock()
+			return nil, fmt.Errorf("unknown key '%s'", kid)
+		}
+		p.fetched = time.Now()
+		refreshing = make(chan struct{})
+		p.refreshing = refreshing
+		p.lock.Unlock()
+
+		keys, err := p.fetchKeys()
+		p.lock.Lock()
+		if err == nil {
+			p.keys = keys
+		}
+		p.refreshing = nil
+		close(refreshing)
+		p.lock.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("fetching keys: %w", err)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key '%s'", kid)
+}
+
+func (p *oidcProvider) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	url := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(url, &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("discovery document is for '%s'", discovery.Issuer)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(key.X, key.Y) {
+				continue
+			}
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (p *oidcProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,82 @@
+package brerver
+
+import (
+	"crypto/x509"
+	"log/slog"
+	"net"
+)
+
+// Something NewServer sets a server up with
+type Option func(*Server)
+
+// Accounts kept somewhere other than the server, which LOGIN checks passwords against
+// for usernames nobody registered here
+type Store interface {
+	// Reports whether the store has the account at all, and if so whether the password
+	// is right for it
+	Authenticate(username, password string) (known bool, ok bool, err error)
+}
+
+// Serves the line protocol on this TCP port, on every interface. A port of 0 has the
+// system choose one, which Addr tells, and - is the same as none, leaving just the
+// addresses in the configuration.
+func WithPort(port string) Option {
+	return func(s *Server) {
+		s.port = port
+	}
+}
+
+// Serves the line protocol on ln as well, which is closed once the server stops. Any
+// listener will do, like a PipeListener, so an embedding program or a test can hand over
+// connections without a port of their own.
+func WithListener(ln net.Listener) Option {
+	return func(s *Server) {
+		s.given = append(s.given, ln)
+	}
+}
+
+// Sends the server's logs to logger rather than slog.Default
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// Checks LOGIN passwords against store for accounts not registered here, before any
+// ldap directory. Accounts it vouches for are made here without a password.
+func WithStore(store Store) Option {
+	return func(s *Server) {
+		s.store = storeProvider{store}
+	}
+}
+
+// Has Run serve with the JSON configuration in config rather than the defaults
+func WithConfig(config string) Option {
+	return func(s *Server) {
+		s.initialConfig = config
+	}
+}
+
+// Where ADMIN RELOAD reads the configuration from, usually the file the server started with
+func WithConfigLoader(load func() (string, error)) Option {
+	return func(s *Server) {
+		s.configLoader = load
+	}
+}
+
+// Replaces the default of logging in as the certificate's common name when
+// tls_client_login is set
+func WithCertificateMapping(mapping func(*x509.Certificate) string) Option {
+	return func(s *Server) {
+		s.certificateUser = mapping
+	}
+}
+
+// Asks a Store as LOGIN asks any other provider
+type storeProvider struct {
+	store Store
+}
+
+func (p storeProvider) authenticate(username, password string) (bool, bool, error) {
+	return p.store.Authenticate(username, password)
+}
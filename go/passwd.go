@@ -0,0 +1,47 @@
+package brerver
+
+import "fmt"
+
+// PASSWD <old> <new>
+//
+// Changes the password of the logged in account. Every session token issued for the
+// account stops working, and this connection gets a fresh one after the result.
+func passwd(s *Server, u *user, args []string) {
+	oldPassword := args[1]
+	newPassword := args[2]
+
+	if !u.loggedIn() {
+		u.send([]byte("RESULT PASSWD 0\n"))
+		return
+	}
+	if reason := s.settings().Accounts.check(u.name, newPassword); reason != "" {
+		msg := fmt.Sprintf("RESULT PASSWD %s\n", u.outcome(0, reason))
+		u.send([]byte(msg))
+		return
+	}
+
+	credential := newCredential(newPassword)
+	changed := false
+	s.users.update(u.name, func(stored string, ok bool) (string, bool) {
+		// Accounts from a directory or identity provider have no password here to change
+		if stored == "" || !checkCredential(stored, oldPassword) {
+			return stored, ok
+		}
+		changed = true
+		return credential, true
+	})
+	if !changed {
+		u.send([]byte("RESULT PASSWD 0\n"))
+		return
+	}
+	s.sharePassword(u.name, credential)
+
+	s.audit(u, passwdAudit, u.name, "")
+	s.revokeSessions(u.name)
+	u.send([]byte("RESULT PASSWD 1\n"))
+	if u.sessions {
+		s.startSession(u)
+	} else {
+		u.session = ""
+	}
+}
@@ -0,0 +1,237 @@
+package brerver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The pins section of Config
+type PinLimits struct {
+	Max        int `json:"max" doc:"Most pins a channel can hold, which bounds what JOIN sends; operators can set lower limits per channel" default:"10" minimum:"1"`
+	MaxSeconds int `json:"max_seconds" doc:"Longest a pin can be set to last, unlimited if zero" default:"0" minimum:"0"`
+}
+
+// Why a pin went away, sent with UNPINNED when it wasn't an operator's UNPIN
+const (
+	unpinLimit   = "LIMIT"
+	unpinExpired = "EXPIRED"
+)
+
+type pin struct {
+	message
+	expires time.Time
+}
+
+func pinnedLine(channelName string, p pin) string {
+	return fmt.Sprintf("PINNED %s %d %s %s\n", channelName, p.seq, p.from, p.text)
+}
+
+// The channel's pins, oldest first
+func (c *channel) pinned() []pin {
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+	return append([]pin(nil), c.pins...)
+}
+
+func sendPins(u *user, channelName string, pins []pin) {
+	for _, p := range pins {
+		u.send([]byte(pinnedLine(channelName, p)))
+	}
+}
+
+// Tells members about each pin in removed. Must be called once the channel's locks are
+// released, as sending can wait on slow connections.
+func announceUnpins(members []*user, channelName string, removed []pin, reason string) {
+	for _, p := range removed {
+		msg := []byte(strings.TrimSpace(fmt.Sprintf("UNPINNED %s %d %s", channelName, p.seq, reason)) + "\n")
+		for _, member := range members {
+			member.send(msg)
+		}
+	}
+}
+
+// The members joined to the channel here, to tell about its pins once settingsLock is
+// released. Must be called with settingsLock held.
+func (c *channel) pinWatchers() []*user {
+	c.usersLock.RLock()
+	defer c.usersLock.RUnlock()
+	return c.connections()
+}
+
+// Drops the oldest pins until there are no more than limit. Must be called with settingsLock held.
+func (c *channel) trimPins(limit int) []pin {
+	if len(c.pins) <= limit {
+		return nil
+	}
+	removed := append([]pin(nil), c.pins[:len(c.pins)-limit]...)
+	c.pins = append([]pin(nil), c.pins[len(c.pins)-limit:]...)
+	return removed
+}
+
+// Drops the pin of seq, if it is still there and, when expires is set, still due to expire
+// then. Must be called with settingsLock held.
+func (c *channel) removePin(seq uint64, expires time.Time) (pin, bool) {
+	for i, p := range c.pins {
+		if p.seq == seq && (expires.IsZero() || p.expires.Equal(expires)) {
+			c.pins = append(c.pins[:i:i], c.pins[i+1:]...)
+			return p, true
+		}
+	}
+	return pin{}, false
+}
+
+// The most pins the channel holds, which operators can lower from the configured maximum
+func (s *Server) pinLimit(c *channel) int {
+	if c.pinLimit > 0 && c.pinLimit < s.settings().Pins.Max {
+		return c.pinLimit
+	}
+	return s.settings().Pins.Max
+}
+
+// PIN <channel> <seq> [<seconds>]
+//
+// Pins a message still in the channel's history, unpinning the oldest if the channel is
+// full. Pins sent with seconds unpin themselves once they have lasted that long.
+func pinMessage(s *Server, u *user, args []string) {
+	channelName := args[1]
+	fields := strings.Fields(args[2])
+	if len(fields) != 1 && len(fields) != 2 {
+		return
+	}
+
+	var confirmation int
+	defer func() {
+		msg := fmt.Sprintf("RESULT PIN %s %s %d\n", channelName, fields[0], confirmation)
+		u.send([]byte(msg))
+	}()
+
+	channel, ok := u.channels[channelName]
+	if !ok {
+		return
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return
+	}
+	var lifetime time.Duration
+	if len(fields) == 2 {
+		seconds, err := strconv.Atoi(fields[1])
+		if err != nil || seconds < 1 || (s.settings().Pins.MaxSeconds > 0 && seconds > s.settings().Pins.MaxSeconds) {
+			return
+		}
+		lifetime = time.Duration(seconds) * time.Second
+	}
+	messages := channel.filter(func(m message) bool { return m.seq == seq })
+	// There's no telling what a SAYB says, so nothing to show pinned
+	if len(messages) == 0 || messages[0].binary {
+		return
+	}
+
+	channel.settingsLock.Lock()
+	if !channel.operators[u.name] {
+		channel.settingsLock.Unlock()
+		return
+	}
+	// Pinning again refreshes the pin rather than adding a second one
+	channel.removePin(seq, time.Time{})
+	p := pin{message: messages[0]}
+	if lifetime > 0 {
+		p.expires = time.Now().Add(lifetime)
+		time.AfterFunc(lifetime, func() { s.expirePin(channel, channelName, seq, p.expires) })
+	}
+	channel.pins = append(channel.pins, p)
+	removed := channel.trimPins(s.pinLimit(channel))
+	members := channel.pinWatchers()
+	channel.settingsLock.Unlock()
+
+	announceUnpins(members, channelName, removed, unpinLimit)
+	msg := []byte(pinnedLine(channelName, p))
+	for _, member := range members {
+		member.send(msg)
+	}
+	confirmation = 1
+}
+
+func (s *Server) expirePin(c *channel, channelName string, seq uint64, expires time.Time) {
+	c.settingsLock.Lock()
+	p, ok := c.removePin(seq, expires)
+	members := c.pinWatchers()
+	c.settingsLock.Unlock()
+	if ok {
+		announceUnpins(members, channelName, []pin{p}, unpinExpired)
+	}
+}
+
+// UNPIN <channel> <seq>
+func unpinMessage(s *Server, u *user, args []string) {
+	channelName := args[1]
+	seqText := args[2]
+
+	var confirmation int
+	defer func() {
+		msg := fmt.Sprintf("RESULT UNPIN %s %s %d\n", channelName, seqText, confirmation)
+		u.send([]byte(msg))
+	}()
+
+	channel, ok := u.channels[channelName]
+	if !ok {
+		return
+	}
+	seq, err := strconv.ParseUint(seqText, 10, 64)
+	if err != nil {
+		return
+	}
+
+	channel.settingsLock.Lock()
+	if !channel.operators[u.name] {
+		channel.settingsLock.Unlock()
+		return
+	}
+	p, ok := channel.removePin(seq, time.Time{})
+	members := channel.pinWatchers()
+	channel.settingsLock.Unlock()
+	if !ok {
+		return
+	}
+	announceUnpins(members, channelName, []pin{p}, "")
+	confirmation = 1
+}
+
+// PINLIMIT <channel> <limit>
+//
+// Lets an operator hold the channel to fewer pins than the server allows, unpinning the
+// oldest ones if there are now too many.
+func setPinLimit(s *Server, u *user, args []string) {
+	channelName := args[1]
+	limitText := args[2]
+
+	var confirmation int
+	defer func() {
+		msg := fmt.Sprintf("RESULT PINLIMIT %s %s %d\n", channelName, limitText, confirmation)
+		u.send([]byte(msg))
+	}()
+
+	channel, ok := u.channels[channelName]
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(limitText)
+	if err != nil || limit < 1 || limit > s.settings().Pins.Max {
+		return
+	}
+
+	channel.settingsLock.Lock()
+	if !channel.operators[u.name] {
+		channel.settingsLock.Unlock()
+		return
+	}
+	channel.pinLimit = limit
+	removed := channel.trimPins(limit)
+	members := channel.pinWatchers()
+	channel.settingsLock.Unlock()
+
+	announceUnpins(members, channelName, removed, unpinLimit)
+	confirmation = 1
+}
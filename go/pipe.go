@@ -0,0 +1,72 @@
+package brerver
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// A listener whose connections are made in memory with net.Pipe rather than on a port,
+// for WithListener. Tests can't collide over ports with it, and a program embedding the
+// server can talk to it without opening one.
+//
+//	ln := brerver.NewPipeListener()
+//	server := brerver.NewServer(brerver.WithListener(ln))
+//	go server.Run(ctx)
+//	conn, err := ln.Dial()
+type PipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Connects to the server, waiting for it to accept
+func (l *PipeListener) Dial() (net.Conn, error) {
+	return l.DialContext(context.Background())
+}
+
+// Connects to the server, waiting for it to accept until ctx is done. Fails once the
+// listener is closed.
+func (l *PipeListener) DialContext(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Err: net.ErrClosed}
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Err: ctx.Err()}
+	}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Stops the listener, without touching connections already made
+func (l *PipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,140 @@
+package brerver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+	"unicode"
+)
+
+// How long a command_plugins process has to answer
+const pluginTimeout = 5 * time.Second
+
+// The most of a command_plugins response that is read
+const maxPluginResponse = 64 * 1024
+
+// A command served by another process, which it is POSTed to over HTTP
+type CommandPlugin struct {
+	Command string `json:"command" doc:"The command, in capital letters, which can't be one the server has itself"`
+	URL     string `json:"url" doc:"http:// or https:// URL the command is POSTed to as JSON with its user and args, answered with lines of text to send back"`
+}
+
+func (p CommandPlugin) valid() bool {
+	u, err := url.Parse(p.URL)
+	return validCommandName(p.Command) && err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Answers a command added with RegisterCommand, usually with RESULT <name> and whatever
+// else it sends through the session. It runs on the connection's goroutine, so nothing
+// else the client sent is handled until it returns.
+type CommandHandler func(ctx context.Context, session *Session, command Command)
+
+// Commands the server has to have to themselves: capital letters only
+func validCommandName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > unicode.MaxASCII || !unicode.IsUpper(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Adds name to the commands clients can send, handled by handler, ahead of any from
+// command_plugins. Fails if the name isn't capital letters or the server already has it.
+func (s *Server) RegisterCommand(name string, handler CommandHandler) error {
+	if !validCommandName(name) {
+		return fmt.Errorf("command '%s' must be capital letters", name)
+	}
+	if builtins.has(name) {
+		return fmt.Errorf("command '%s' is built in", name)
+	}
+	s.commandsLock.Lock()
+	defer s.commandsLock.Unlock()
+	if _, ok := s.commands[name]; ok {
+		return fmt.Errorf("command '%s' is already registered", name)
+	}
+	s.commands[name] = handler
+	return nil
+}
+
+// Takes away a command added with RegisterCommand
+func (s *Server) UnregisterCommand(name string) {
+	s.commandsLock.Lock()
+	defer s.commandsLock.Unlock()
+	delete(s.commands, name)
+}
+
+// Handles a command registered or served by a plugin, reporting whether there was one
+func (s *Server) customCommand(ctx context.Context, session *Session, words []string) bool {
+	s.commandsLock.RLock()
+	handler, ok := s.commands[words[0]]
+	s.commandsLock.RUnlock()
+	if ok {
+		handler(ctx, session, hookCommand(words))
+		return true
+	}
+
+	s.configLock.RLock()
+	plugin, ok := s.plugins[words[0]]
+	s.configLock.RUnlock()
+	if !ok {
+		return false
+	}
+	lines, err := callPlugin(ctx, plugin, session.Username(), words[1:])
+	if err != nil {
+		s.userLogger(session.u).Warn("Command plugin failed", "command", plugin.Command, "err", err)
+		session.Send("RESULT " + plugin.Command + " " + session.u.outcome(0, pluginUnavailable))
+		return true
+	}
+	for _, line := range lines {
+		session.Send(line)
+	}
+	return true
+}
+
+// POSTs the command to the plugin, returning the lines it answered with
+func callPlugin(ctx context.Context, plugin CommandPlugin, username string, args []string) ([]string, error) {
+	body, err := json.Marshal(map[string]any{"command": plugin.Command, "user": username, "args": args})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, plugin.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("answered %s", response.Status)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(io.LimitReader(response.Body, maxPluginResponse))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if !validCommand(line) {
+			return nil, errors.New("answered with control characters")
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,116 @@
+package brerver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PRESENCE
+//
+// Turns a logged in connection into a presence-only one that never joins channels and
+// only receives PRESENCE and NOTIFY frames, for companions that just need to know when to
+// wake the real client up. Companions log in like anyone else, so they're let out of
+// default_channels.
+func presence(s *Server, u *user, args []string) {
+	var confirmation int
+	if u.loggedIn() && !u.presenceOnly && s.onlyDefaultChannels(u) {
+		for name, channel := range u.channels {
+			s.part(u, name, channel)
+		}
+		u.presenceOnly = true
+		s.presenceLock.Lock()
+		s.presence[u] = struct{}{}
+		s.presenceLock.Unlock()
+		confirmation = 1
+	}
+
+	msg := fmt.Sprintf("RESULT PRESENCE %d\n", confirmation)
+	u.send([]byte(msg))
+}
+
+// PING, the keepalive for connections which otherwise send nothing
+func ping(s *Server, u *user, args []string) {
+	u.send([]byte("PONG\n"))
+}
+
+// Tells presence-only connections here and on linked servers that name came or went
+func (s *Server) announcePresence(name string, online bool) {
+	var status int
+	if online {
+		status = 1
+	}
+	line := fmt.Sprintf("PRESENCE %s %d\n", name, status)
+	s.broadcastLinks(line)
+	s.tellPresence(line)
+}
+
+// Applies PRESENCE <name> <0|1> from a linked server
+func (s *Server) linkedPresence(l *serverLink, fields []string) {
+	if len(fields) != 3 || (fields[2] != "0" && fields[2] != "1") {
+		s.logger.Warn("Dropped a malformed presence change from a linked server", "server", l.name)
+		return
+	}
+	s.tellPresence(strings.Join(fields, " ") + "\n")
+}
+
+func (s *Server) tellPresence(line string) {
+	msg := []byte(line)
+	s.presenceLock.RLock()
+	defer s.presenceLock.RUnlock()
+	for watcher := range s.presence {
+		watcher.send(msg)
+	}
+}
+
+// Lets presence-only connections know about a message, as their notification policy for
+// the channel says: every message for members under all, only @mentions under mentions.
+// Members on linked servers count as members, and c is nil for a message relayed from a
+// channel with none here, where only @mentions are notified.
+func (s *Server) notify(c *channel, from, channelName, message string) {
+	mentioned := map[string]bool{}
+	for _, word := range strings.Fields(message) {
+		if strings.HasPrefix(word, "@") {
+			mentioned[word[1:]] = true
+		}
+	}
+	msg := []byte(fmt.Sprintf("NOTIFY %s %s\n", channelName, from))
+
+	s.presenceLock.RLock()
+	defer s.presenceLock.RUnlock()
+	for watcher := range s.presence {
+		if watcher.name == from {
+			continue
+		}
+		// Not even a mention lets on that a private channel is there
+		if c != nil && !c.admits(watcher.name) {
+			continue
+		}
+		policy := notifyMentions
+		if c != nil {
+			policy = c.notifyPolicy(watcher.name)
+		}
+		switch policy {
+		case notifyAll:
+			if mentioned[watcher.name] || c.isMember(watcher.name) || s.remoteMember(channelName, watcher.name) {
+				watcher.send(msg)
+			}
+		case notifyMentions:
+			if mentioned[watcher.name] {
+				watcher.send(msg)
+			}
+		}
+	}
+}
+
+func (s *Server) leavePresence(u *user) {
+	if !u.loggedIn() {
+		return
+	}
+	if u.presenceOnly {
+		s.presenceLock.Lock()
+		delete(s.presence, u)
+		s.presenceLock.Unlock()
+	} else {
+		s.announcePresence(u.name, false)
+	}
+}
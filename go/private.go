@@ -0,0 +1,105 @@
+package brerver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Whether username may join the channel: anyone unless it's private, and then only its
+// operators, whoever they've invited and anyone who has been a member before, until
+// UNINVITE
+func (c *channel) admits(username string) bool {
+	if !c.private {
+		return true
+	}
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+	return c.operators[username] || c.invited[username] || c.members[username]
+}
+
+// Whether CHANNELS and WHO let on to u that the channel exists
+func (c *channel) visibleTo(u *user, channelName string) bool {
+	return !c.private || u.channels[channelName] == c
+}
+
+// INVITE <channel> <username>
+//
+// Lets an operator admit username to a private channel, telling them with INVITED
+// <channel> <operator> if they're connected. Invitations to other channels only do the
+// telling.
+func invite(s *Server, u *user, args []string) {
+	channelName := args[1]
+	username := args[2]
+
+	var confirmation int
+	var reason string
+	defer func() {
+		msg := fmt.Sprintf("RESULT INVITE %s %s %s\n", channelName, username, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
+	}()
+
+	channel, ok := u.channels[channelName]
+	if !ok {
+		reason = notJoined
+		return
+	}
+	if strings.Contains(username, " ") {
+		reason = badArguments
+		return
+	}
+
+	channel.settingsLock.Lock()
+	if !channel.operators[u.name] {
+		channel.settingsLock.Unlock()
+		return
+	}
+	channel.invited[username] = true
+	channel.settingsLock.Unlock()
+
+	// Sent once connectionsLock is released, as sending can wait on slow connections
+	var invitees []*user
+	s.connectionsLock.RLock()
+	for other := range s.connections {
+		if other.name == username {
+			invitees = append(invitees, other)
+		}
+	}
+	s.connectionsLock.RUnlock()
+	msg := []byte(fmt.Sprintf("INVITED %s %s\n", channelName, u.name))
+	for _, invitee := range invitees {
+		invitee.send(msg)
+	}
+	confirmation = 1
+}
+
+// UNINVITE <channel> <username>
+//
+// Takes back an operator's invitation, and the way back in that having been a member
+// gives, so username can't join the private channel again until invited. Connections
+// already in the channel stay until they leave. Operators can't be uninvited.
+func uninvite(s *Server, u *user, args []string) {
+	channelName := args[1]
+	username := args[2]
+
+	var confirmation int
+	var reason string
+	defer func() {
+		msg := fmt.Sprintf("RESULT UNINVITE %s %s %s\n", channelName, username, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
+	}()
+
+	channel, ok := u.channels[channelName]
+	if !ok {
+		reason = notJoined
+		return
+	}
+
+	channel.settingsLock.Lock()
+	defer channel.settingsLock.Unlock()
+	if !channel.operators[u.name] || channel.operators[username] {
+		return
+	}
+	delete(channel.invited, username)
+	delete(channel.members, username)
+	confirmation = 1
+}
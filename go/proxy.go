@@ -0,0 +1,200 @@
+package brerver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a load balancer has to send the PROXY header once it connects
+const proxyHeaderTimeout = 5 * time.Second
+
+// Starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Wraps connections from load balancers in proxiedConn, leaving everyone else's alone
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	logger  *slog.Logger
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(remoteIP(conn)); ip != nil {
+		for _, trusted := range l.trusted {
+			if trusted.Contains(ip) {
+				return &proxiedConn{Conn: conn, logger: l.logger}, nil
+			}
+		}
+	}
+	return conn, nil
+}
+
+// A connection from a load balancer, which answers to the client address from its
+// PROXY header. The header is read on first use rather than in Accept, so a slow
+// balancer only holds up its own connection.
+type proxiedConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+	logger *slog.Logger
+}
+
+func (c *proxiedConn) readHeader() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.reader = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		remote, err := readProxyHeader(c.reader)
+		if err != nil {
+			c.logger.Warn("Bad PROXY header", "remote", c.remote.String(), "err", err)
+			c.err = err
+			c.Conn.Close()
+			return
+		}
+		// Health checks and the like speak for the balancer itself
+		if remote != nil {
+			c.remote = remote
+		}
+	})
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		// Nothing was ever said on the connection as far as anyone else is concerned
+		return 0, io.EOF
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remote
+}
+
+// Reports whether conn, under any TLS or IRC wrapping, has a PROXY header to be read
+// before it's known who it's from
+func awaitsHeader(conn net.Conn) bool {
+	if irc, ok := conn.(ircConn); ok {
+		conn = irc.Conn
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	_, ok := conn.(*proxiedConn)
+	return ok
+}
+
+// Reads a v1 or v2 PROXY header, returning the client's address, or nil if the header
+// doesn't carry one
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	// Anything else gets turned away without waiting for more than its first byte
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV2Signature[0]:
+		start, err := reader.Peek(len(proxyV2Signature))
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(start, proxyV2Signature) {
+			return readProxyV2(reader)
+		}
+	case 'P':
+		start, err := reader.Peek(len("PROXY "))
+		if err != nil {
+			return nil, err
+		}
+		if string(start) == "PROXY " {
+			return readProxyV1(reader)
+		}
+	}
+	return nil, errors.New("no PROXY header")
+}
+
+// PROXY TCP4|TCP6 <source> <destination> <source port> <destination port>\r\n, or
+// PROXY UNKNOWN ...\r\n, in at most 107 bytes
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line, ok, err := readCommand(reader, 107-len("\n"))
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !strings.HasSuffix(line, "\r") {
+		return nil, errors.New("malformed v1 header")
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\r"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errors.New("malformed v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// The signature, a version and command byte, a family and protocol byte, then the
+// length of the addresses that follow
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	versionCommand := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	if versionCommand>>4 != 2 {
+		return nil, errors.New("unsupported version")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL is from the balancer itself, and PROXY is the only other command
+	if versionCommand&0xF == 0 {
+		return nil, nil
+	}
+	if versionCommand&0xF != 1 {
+		return nil, errors.New("unsupported command")
+	}
+	switch family {
+	case 0x11:
+		// TCP over IPv4: source and destination addresses, then ports
+		if len(body) < 12 {
+			return nil, errors.New("short v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// UDP and unix sockets have nothing we can use
+	return nil, nil
+}
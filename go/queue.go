@@ -0,0 +1,296 @@
+package brerver
+
+import (
+	"compress/zlib"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Messages a connection's writer holds before slow_consumers decides what happens to more
+const sendQueueLength = 256
+
+// What slow_consumers can do with a message for a connection whose queue is full
+const (
+	// Wait for room, holding up whoever is sending
+	blockPolicy = "block"
+	// Throw away the oldest queued message to make room
+	dropOldestPolicy = "drop_oldest"
+	// Throw away the new message
+	lossyPolicy = "lossy"
+	// Throw away everything queued and hang up after ERROR SLOW
+	disconnectPolicy = "disconnect"
+)
+
+// How long a connection dropped for being slow has to take ERROR SLOW before it's closed
+const slowConsumerGrace = time.Second
+
+// Most messages the writer takes off the queue to send in one write
+const writeBatchLength = 64
+
+// A message waiting for a connection's writer
+type outgoing struct {
+	msg    []byte
+	ticket uint64
+	// Everything after msg is compressed, for HELLO zlib
+	thenCompress bool
+	// Closed once the writer gets here, with nothing to write
+	flushed chan struct{}
+	// Where msg came from, released once it's written
+	shared *sharedLine
+}
+
+// Tracks the writes waiting on a connection, so slow consumers show up before they
+// stall everyone broadcasting to them
+type outbound struct {
+	lock       sync.Mutex
+	nextTicket uint64
+	pending    map[uint64]time.Time
+	drops      uint64
+}
+
+// How far behind writes to connections are, from Server.QueueStats
+type QueueStats struct {
+	// Writes waiting on or in the middle of being written to the connection
+	Depth int
+	// Writes that failed or were thrown away and never made it to the client
+	Drops uint64
+	// How long the oldest pending write has been waiting
+	OldestPending time.Duration
+}
+
+// One connection's QueueStats
+type ConnectionQueueStats struct {
+	RemoteAddr string
+	QueueStats
+}
+
+func (o *outbound) begin() uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.pending == nil {
+		o.pending = map[uint64]time.Time{}
+	}
+	o.nextTicket++
+	o.pending[o.nextTicket] = time.Now()
+	return o.nextTicket
+}
+
+func (o *outbound) end(ticket uint64, dropped bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	delete(o.pending, ticket)
+	if dropped {
+		o.drops++
+	}
+}
+
+func (o *outbound) stats() QueueStats {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	stats := QueueStats{
+		Depth: len(o.pending),
+		Drops: o.drops,
+	}
+	for _, since := range o.pending {
+		if age := time.Since(since); age > stats.OldestPending {
+			stats.OldestPending = age
+		}
+	}
+	return stats
+}
+
+// Queues msg for the connection's writer, so that a slow client only holds up broadcasts
+// to it once its queue is full. Connections without a writer are written to directly.
+func (u *user) send(msg []byte) {
+	u.enqueue(outgoing{msg: u.encode(msg)})
+}
+
+func (u *user) enqueue(out outgoing) {
+	out.ticket = u.out.begin()
+	if u.queue == nil {
+		u.writeOut(out)
+		return
+	}
+	for !u.slow.Load() {
+		select {
+		case u.queue <- out:
+			return
+		case <-u.done:
+			u.discard(out)
+			return
+		default:
+		}
+
+		switch u.overflow() {
+		case dropOldestPolicy:
+			select {
+			case oldest := <-u.queue:
+				if u.discard(oldest) {
+					u.lost.Add(1)
+				}
+			default:
+			}
+		case lossyPolicy:
+			if u.discard(out) {
+				u.lost.Add(1)
+			}
+			return
+		case disconnectPolicy:
+			u.discard(out)
+			u.dropSlow()
+			return
+		default:
+			select {
+			case u.queue <- out:
+			case <-u.done:
+				u.discard(out)
+			}
+			return
+		}
+	}
+	u.discard(out)
+}
+
+// Gives up on out, reporting whether it was a message the client now won't get
+func (u *user) discard(out outgoing) bool {
+	if out.flushed != nil {
+		u.out.end(out.ticket, false)
+		close(out.flushed)
+		return false
+	}
+	if out.shared != nil {
+		out.shared.release()
+	}
+	u.out.end(out.ticket, true)
+	return true
+}
+
+// Throws away what's queued for a connection too slow to keep, telling it why if it
+// reads again soon enough. Everything sent to it from then on is thrown away too.
+func (u *user) dropSlow() {
+	if !u.slow.CompareAndSwap(false, true) {
+		return
+	}
+	for drained := false; !drained; {
+		select {
+		case out := <-u.queue:
+			u.discard(out)
+		default:
+			drained = true
+		}
+	}
+	select {
+	case u.queue <- outgoing{msg: u.encode([]byte("ERROR SLOW\n")), ticket: u.out.begin()}:
+	default:
+	}
+	time.AfterFunc(slowConsumerGrace, func() { u.conn.Close() })
+}
+
+// Counts a connection's queue filling up, returning what slow_consumers says to do
+func (s *Server) overflowed() string {
+	s.metrics.countOverflow()
+	return s.settings().SlowConsumers
+}
+
+// Writes what's queued until the connection is done. Whatever has piled up behind the
+// first message goes out with it in one write, up to a flush, which ends the batch so
+// that it's only closed once everything before it is written.
+func (u *user) writeQueued() {
+	batch := make([]outgoing, 0, writeBatchLength)
+	for {
+		select {
+		case out := <-u.queue:
+			batch = append(batch[:0], out)
+		case <-u.done:
+			return
+		}
+	piledUp:
+		for len(batch) < writeBatchLength && batch[len(batch)-1].flushed == nil {
+			select {
+			case out := <-u.queue:
+				batch = append(batch, out)
+			default:
+				break piledUp
+			}
+		}
+		u.writeOut(batch...)
+		clear(batch)
+	}
+}
+
+func (u *user) writeOut(batch ...outgoing) {
+	var err error
+	u.writeLock.Lock()
+	buffers := u.buffers[:0]
+	for _, out := range batch {
+		if out.flushed == nil {
+			buffers = append(buffers, out.msg)
+		}
+	}
+	if len(buffers) > 0 {
+		// Whatever was thrown away is owned up to before the next messages that weren't
+		if lost := u.lost.Swap(0); lost > 0 {
+			buffers = append(buffers, nil)
+			copy(buffers[1:], buffers)
+			buffers[0] = u.encode([]byte("DROPPED " + strconv.FormatUint(lost, 10) + "\n"))
+		}
+		u.buffers = buffers
+		err = u.write(buffers...)
+		if err == nil && batch[len(batch)-1].thenCompress {
+			u.compressor = zlib.NewWriter(u.conn)
+		}
+	}
+	u.writeLock.Unlock()
+
+	for _, out := range batch {
+		if out.flushed != nil {
+			u.out.end(out.ticket, false)
+			close(out.flushed)
+			continue
+		}
+		if out.shared != nil {
+			out.shared.release()
+		}
+		u.out.end(out.ticket, err != nil)
+	}
+	if err != nil {
+		u.writeFailed(err)
+	}
+}
+
+// Waits for everything queued so far to be written
+func (u *user) flush() {
+	flushed := make(chan struct{})
+	u.enqueue(outgoing{flushed: flushed})
+	select {
+	case <-flushed:
+	case <-u.done:
+	}
+}
+
+// The aggregate over every connection along with each connection's own numbers
+func (s *Server) QueueStats() (QueueStats, []ConnectionQueueStats) {
+	s.connectionsLock.RLock()
+	defer s.connectionsLock.RUnlock()
+
+	var total QueueStats
+	connections := make([]ConnectionQueueStats, 0, len(s.connections))
+	for u := range s.connections {
+		stats := u.out.stats()
+		connections = append(connections, ConnectionQueueStats{
+			RemoteAddr: u.conn.RemoteAddr().String(),
+			QueueStats: stats,
+		})
+
+		total.Depth += stats.Depth
+		total.Drops += stats.Drops
+		if stats.OldestPending > total.OldestPending {
+			total.OldestPending = stats.OldestPending
+		}
+	}
+	return total, connections
+}
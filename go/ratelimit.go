@@ -0,0 +1,87 @@
+package brerver
+
+import "time"
+
+// Commands are limited per class so that chatting can't starve logging in and vice versa
+const (
+	authClass     = "auth"
+	chatClass     = "chat"
+	presenceClass = "presence"
+)
+
+// A token bucket in Config.RateLimits
+type RateLimit struct {
+	Rate  float64 `json:"rate" doc:"Commands per second allowed on average" exclusiveMinimum:"0"`
+	Burst int     `json:"burst" doc:"Commands allowed in a burst" minimum:"1"`
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(limit RateLimit) bool {
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		if b.tokens > float64(limit.Burst) {
+			b.tokens = float64(limit.Burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (s *Server) allow(u *user, class string) bool {
+	limit, ok := s.settings().RateLimits[class]
+	if !ok {
+		return true
+	}
+
+	if u.buckets == nil {
+		u.buckets = map[string]*bucket{}
+	}
+	b, ok := u.buckets[class]
+	if !ok {
+		b = &bucket{}
+		u.buckets[class] = b
+	}
+	return b.take(limit)
+}
+
+func commandClass(u *user, command string) string {
+	if u.presenceOnly {
+		return presenceClass
+	}
+	switch command {
+	case "HELLO", "CAPS", "LOGIN", "AUTH", "REGISTER", "PASSWD", "UNREGISTER", "RESUME":
+		return authClass
+	}
+	return chatClass
+}
+
+// Reports whether the command may go ahead, and whether the connection has been
+// limited so many times in a row that it should be dropped
+func (s *Server) rateLimit(u *user, words []string) (bool, bool) {
+	if s.allow(u, commandClass(u, words[0])) {
+		u.strikes = 0
+		return true, false
+	}
+
+	u.strikes++
+	builtins.refuse(u, words, rateLimited)
+
+	strikes := s.settings().RateLimitStrikes
+	if strikes > 0 && u.strikes >= strikes {
+		s.userLogger(u).Info("Disconnecting after rate limited commands", "count", u.strikes)
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,156 @@
+package brerver
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Custom reactions look like :shipit:
+var shortcodePattern = regexp.MustCompile("^:[A-Za-z0-9_+-]{1,32}:$")
+
+// Long enough for emoji joined into one, like families and flags with modifiers
+const emojiMaxRunes = 16
+
+// Reports whether reaction is a shortcode or made only of non-ASCII symbols, such as an emoji
+func validReaction(reaction string) bool {
+	if shortcodePattern.MatchString(reaction) {
+		return true
+	}
+	if reaction == "" || !utf8.ValidString(reaction) || utf8.RuneCountInString(reaction) > emojiMaxRunes {
+		return false
+	}
+	for _, c := range reaction {
+		if c < utf8.RuneSelf || unicode.IsSpace(c) || unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether the channel allows reaction, which it does for anything valid if its set is empty
+func (c *channel) allowsReaction(reaction string) bool {
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+	return len(c.reactions) == 0 || c.reactions[reaction]
+}
+
+// The channel's allowed reactions, sorted
+func (c *channel) allowedReactions() []string {
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+
+	reactions := make([]string, 0, len(c.reactions))
+	for reaction := range c.reactions {
+		reactions = append(reactions, reaction)
+	}
+	sort.Strings(reactions)
+	return reactions
+}
+
+func (c *channel) hasMessage(seq uint64) bool {
+	return len(c.filter(func(m message) bool { return m.seq == seq })) > 0
+}
+
+// REACT <channel> <seq> <reaction>
+//
+// Reacts to a message still in the channel's history, telling every member.
+func react(s *Server, u *user, args []string) {
+	channelName := args[1]
+	fields := strings.Fields(args[2])
+	if len(fields) != 2 {
+		return
+	}
+	seqText, reaction := fields[0], fields[1]
+
+	var confirmation int
+	defer func() {
+		msg := fmt.Sprintf("RESULT REACT %s %s %d\n", channelName, seqText, confirmation)
+		u.send([]byte(msg))
+	}()
+
+	channel, ok := u.channels[channelName]
+	if !ok {
+		return
+	}
+	p, ok := parsePosition(seqText)
+	if !ok || !p.time.IsZero() || !channel.hasMessage(p.seq) {
+		return
+	}
+	if !validReaction(reaction) || !channel.allowsReaction(reaction) {
+		return
+	}
+
+	channel.usersLock.RLock()
+	members := channel.connections()
+	channel.usersLock.RUnlock()
+	msg := []byte(fmt.Sprintf("REACT %s %d %s %s\n", channelName, p.seq, u.name, reaction))
+	for _, member := range members {
+		member.send(msg)
+	}
+	confirmation = 1
+}
+
+// REACTIONS <channel>
+// REACTIONS <channel> SET [<reaction>...]
+//
+// Fetches the channel's allowed reactions, or lets an operator replace them. An empty
+// set allows any reaction.
+func reactions(s *Server, u *user, args []string) {
+	channelName := args[1]
+
+	channel, ok := s.channels.get(channelName)
+	// Private channels aren't there to anyone not let in
+	ok = ok && channel.admits(u.name)
+
+	if len(args) == 2 {
+		if !ok {
+			u.send([]byte(fmt.Sprintf("RESULT REACTIONS %s %s\n", channelName, u.outcome(0, noSuchChannel))))
+			return
+		}
+		allowed := channel.allowedReactions()
+		msg := fmt.Sprintf("RESULT REACTIONS %s 1", channelName)
+		if len(allowed) > 0 {
+			msg += " " + strings.Join(allowed, " ")
+		}
+		u.send([]byte(msg + "\n"))
+		return
+	}
+
+	fields := strings.Fields(args[2])
+	if len(fields) == 0 || fields[0] != "SET" {
+		return
+	}
+	var confirmation int
+	var reason string
+	defer func() {
+		msg := fmt.Sprintf("RESULT REACTIONS %s SET %s\n", channelName, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
+	}()
+
+	if !ok {
+		reason = noSuchChannel
+		return
+	}
+	if !u.loggedIn() {
+		return
+	}
+	allowed := make(map[string]bool)
+	for _, reaction := range fields[1:] {
+		if !validReaction(reaction) {
+			return
+		}
+		allowed[reaction] = true
+	}
+
+	channel.settingsLock.Lock()
+	defer channel.settingsLock.Unlock()
+	if !channel.operators[u.name] {
+		return
+	}
+	channel.reactions = allowed
+	confirmation = 1
+}
@@ -0,0 +1,45 @@
+package brerver
+
+import "strconv"
+
+// Why a command failed, sent after the 0 in its RESULT to connections that sent HELLO
+// reasons. Others get the bare 0 they always have, so clients that split RESULT lines on
+// spaces keep working, and ones that want to say more can ask and switch on these.
+const (
+	// Log in first
+	notLoggedIn = "NOT_LOGGED_IN"
+	// Presence-only connections can't join channels
+	presenceOnlyConnection = "PRESENCE_ONLY"
+	noSuchChannel          = "NO_SUCH_CHANNEL"
+	channelExists          = "CHANNEL_EXISTS"
+	alreadyJoined          = "ALREADY_JOINED"
+	// The channel has as many members as MEMBERLIMIT lets it
+	channelFull = "FULL"
+	// JOIN the channel before saying anything in it
+	notJoined = "NOT_JOINED"
+	// Flood protection or an operator has muted the user in this channel for now
+	mutedInChannel = "MUTED"
+	// A script's on_join or on_message hook, or a hook from WithBeforeCommand, said no
+	rejectedByScript = "REJECTED"
+	// The arguments were there but made no sense, like JOIN -since with a bad position
+	badArguments = "BAD_ARGUMENTS"
+	// The server's configuration turns the command off
+	featureDisabled = "DISABLED"
+	// Too many commands too quickly, by rate_limits
+	rateLimited = "RATE_LIMITED"
+	// Too many failed logins to the account or from the address
+	tooManyFailures = "LOCKED"
+	// Linked servers leave REGISTER to one of them, which couldn't be reached
+	noLeader = "NO_LEADER"
+	// The process serving a command from command_plugins couldn't be reached or failed
+	pluginUnavailable = "UNAVAILABLE"
+)
+
+// The end of a RESULT line: 1, or 0 followed by the reason if there is one and the
+// connection asked for reasons with HELLO reasons
+func (u *user) outcome(confirmation int, reason string) string {
+	if confirmation == 1 || reason == "" || !u.reasons {
+		return strconv.Itoa(confirmation)
+	}
+	return "0 " + reason
+}
@@ -0,0 +1,111 @@
+package brerver
+
+import (
+	"errors"
+	"reflect"
+)
+
+// The configuration in effect, which ADMIN RELOAD can swap out at any time
+func (s *Server) settings() Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config
+}
+
+func (s *Server) loadedScripts() []*script {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.scripts
+}
+
+func (s *Server) directoryProvider() authProvider {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.directory
+}
+
+func (s *Server) oidcProvider() *oidcProvider {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.oidc
+}
+
+// Puts conf into effect along with everything built from it. Nothing changes if the
+// scripts fail to load.
+func (s *Server) configure(conf Config) error {
+	scripts, err := loadScripts(s, conf.Scripts)
+	if err != nil {
+		return err
+	}
+	var directory authProvider
+	if conf.LDAP.URL != "" {
+		directory = ldapProvider{config: conf.LDAP, accounts: conf.Accounts}
+	}
+	plugins := map[string]CommandPlugin{}
+	for _, plugin := range conf.CommandPlugins {
+		plugins[plugin.Command] = plugin
+	}
+
+	s.configLock.Lock()
+	old := s.config
+	s.config = conf
+	s.scripts = scripts
+	s.directory = directory
+	s.plugins = plugins
+	// Keep the issuer's keys if it hasn't changed
+	if conf.OIDC.Issuer == "" {
+		s.oidc = nil
+	} else if s.oidc == nil || s.oidc.config != conf.OIDC {
+		s.oidc = newOIDCProvider(conf.OIDC)
+	}
+	s.configLock.Unlock()
+	s.createDefaultChannels(conf.DefaultChannels)
+
+	// Bans that came from the old configuration are lifted unless the new one has them too,
+	// while ones made with ADMIN BAN stay
+	kept := map[string]bool{}
+	for _, ban := range conf.Bans {
+		ipNet, _ := parseBan(ban)
+		kept[ipNet.String()] = true
+		s.bans.add(ipNet)
+	}
+	for _, ban := range old.Bans {
+		if ipNet, _ := parseBan(ban); !kept[ipNet.String()] {
+			s.bans.remove(ipNet)
+		}
+	}
+	s.enforceBans()
+	return nil
+}
+
+// Reads the configuration again and puts it into effect, leaving the old one in place if
+// the new one is no good
+func (s *Server) reload() error {
+	if s.configLoader == nil {
+		return errors.New("no configuration to reload from")
+	}
+	text, err := s.configLoader()
+	if err != nil {
+		return err
+	}
+	conf, err := ParseConfig(text)
+	if err != nil {
+		return err
+	}
+
+	// Listeners, the event log and the stats ticker are set up once at startup
+	old := s.settings()
+	if old.TLSCert != conf.TLSCert || old.TLSKey != conf.TLSKey || old.TLSPort != conf.TLSPort ||
+		old.TLSClientCA != conf.TLSClientCA || old.EventLog != conf.EventLog || old.AuditLog != conf.AuditLog ||
+		(old.Stats.Channel == "") != (conf.Stats.Channel == "") || old.Stats.IntervalSeconds != conf.Stats.IntervalSeconds ||
+		old.ServerName != conf.ServerName || !reflect.DeepEqual(old.Peers, conf.Peers) || old.FanoutWorkers != conf.FanoutWorkers {
+		s.logger.Warn("Some reloaded options only take effect on restart: TLS, event_log, audit_log, the stats interval, server_name, peers and fanout_workers")
+	}
+	if !reflect.DeepEqual(old.Listen, conf.Listen) || old.UnixSocket != conf.UnixSocket || old.UnixSocketMode != conf.UnixSocketMode ||
+		old.WebSocketPort != conf.WebSocketPort || old.HTTPPort != conf.HTTPPort || old.GRPCPort != conf.GRPCPort || old.MetricsPort != conf.MetricsPort ||
+		old.IRCPort != conf.IRCPort || old.FederationPort != conf.FederationPort || old.DebugAddress != conf.DebugAddress ||
+		!reflect.DeepEqual(old.ProxyProtocol, conf.ProxyProtocol) {
+		s.logger.Warn("Listeners only change on restart: listen, unix_socket, proxy_protocol, debug_address and the websocket, http, grpc, metrics, irc and federation ports")
+	}
+	return s.configure(conf)
+}
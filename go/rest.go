@@ -0,0 +1,548 @@
+package brerver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serves a JSON API under /api for scripts and dashboards that would rather not hold a
+// connection open. Like gRPC, each request runs as an ordinary connection over a pipe.
+//
+//	GET    /api/channels?match=&after=&limit=   names of channels as CHANNELS lists them, with a Next-After header if there are more
+//	GET    /api/channels/<name>/history?since=  messages after since, a sequence number or timestamp
+//	POST   /api/channels/<name>/messages        {"text"}
+//	POST   /api/accounts                        {"username", "password"}
+//	POST   /api/sessions                        {"username", "password"}, replies {"session"}
+//	PUT    /api/account/password                {"old", "new"}, replies a fresh {"session"}
+//	DELETE /api/account                         {"password"}
+//
+// Everything but listing channels, registering and logging in needs the session token
+// from /api/sessions as Authorization: Bearer <token>. It stands in for RESUME, so it
+// can't be used while a connection holds the session.
+//
+// /events/<channel> streams a channel's messages, see apiEvents, and /hooks/<name> takes
+// posts from the webhooks configured, see webhook.
+func (s *Server) serveHTTP(ctx context.Context, ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/channels", s.apiChannels)
+	mux.HandleFunc("/api/channels/", s.apiChannel)
+	mux.HandleFunc("/api/accounts", s.apiAccounts)
+	mux.HandleFunc("/api/sessions", s.apiSessions)
+	mux.HandleFunc("/api/account", s.apiAccount)
+	mux.HandleFunc("/api/account/password", s.apiPassword)
+	mux.HandleFunc("/events/", s.apiEvents)
+	mux.HandleFunc("/hooks/", s.webhook)
+	s.handleProbes(mux)
+	server := &http.Server{Handler: mux, BaseContext: func(net.Listener) context.Context { return ctx }}
+	if err := server.Serve(ln); err != nil {
+		s.logger.Info("Stopped serving HTTP", "err", err)
+	}
+}
+
+// The error for a password that didn't confirm a change to the session's own account, which
+// is told apart from a session that isn't logged in
+const wrongPassword = "WRONG_PASSWORD"
+
+type apiMessage struct {
+	Seq    uint64 `json:"seq"`
+	From   string `json:"from"`
+	Text   string `json:"text"`
+	Binary bool   `json:"binary,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, reason string) {
+	writeJSON(w, code, map[string]string{"error": reason})
+}
+
+// The status code for a failed command's reason
+func reasonStatus(reason string) int {
+	switch reason {
+	case notLoggedIn:
+		return http.StatusUnauthorized
+	case noSuchChannel:
+		return http.StatusNotFound
+	case channelExists:
+		return http.StatusConflict
+	case mutedInChannel:
+		return http.StatusTooManyRequests
+	case rejectedByScript, featureDisabled:
+		return http.StatusForbidden
+	case tooManyFailures:
+		return http.StatusTooManyRequests
+	case wrongPassword:
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// Writes the response for a command's RESULT, returning whether it succeeded
+func writeResult(w http.ResponseWriter, ok bool, reason string, err error) bool {
+	switch {
+	case err != nil:
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+	case !ok && reason == "":
+		writeAPIError(w, http.StatusBadRequest, "FAILED")
+	case !ok:
+		writeAPIError(w, reasonStatus(reason), reason)
+	}
+	return err == nil && ok
+}
+
+// Decodes a JSON body into v, answering for the request if it's missing or malformed
+func readBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, badArguments)
+		return false
+	}
+	return true
+}
+
+type httpRemote string
+
+func (a httpRemote) Network() string { return "tcp" }
+func (a httpRemote) String() string  { return string(a) }
+
+// Opens a connection for the request, answering for it if that fails
+func (s *Server) apiDial(w http.ResponseWriter, r *http.Request) (*rpcConn, bool) {
+	var remote net.Addr = httpRemote(r.RemoteAddr)
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		remote = addr
+	}
+	conn, err := s.dialRPC(r.Context(), remote)
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return nil, false
+	}
+	return conn, true
+}
+
+// The session token in the request's Authorization header, if any
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Opens a connection logged in with the request's session token, answering for the
+// request if that fails
+func (s *Server) apiDialSession(w http.ResponseWriter, r *http.Request) (*rpcConn, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		writeAPIError(w, http.StatusUnauthorized, notLoggedIn)
+		return nil, false
+	}
+	conn, ok := s.apiDial(w, r)
+	if !ok {
+		return nil, false
+	}
+	resumed, err := conn.resume(r.Context(), token)
+	if err != nil || !resumed {
+		conn.close()
+		writeResult(w, false, notLoggedIn, err)
+		return nil, false
+	}
+	return conn, true
+}
+
+func (s *Server) apiChannels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	conn, ok := s.apiDial(w, r)
+	if !ok {
+		return
+	}
+	defer conn.close()
+	var options []string
+	for _, option := range []string{"match", "after", "limit"} {
+		if value := r.URL.Query().Get(option); value != "" {
+			options = append(options, "-"+option, value)
+		}
+	}
+	if !validArgs(options...) {
+		writeAPIError(w, http.StatusBadRequest, badArguments)
+		return
+	}
+	channels, next, ok, err := conn.channels(r.Context(), options...)
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, badArguments)
+		return
+	}
+	if next != "" {
+		w.Header().Set("Next-After", next)
+	}
+	writeJSON(w, http.StatusOK, channels)
+}
+
+// /api/channels/<name>/history and /api/channels/<name>/messages
+func (s *Server) apiChannel(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/channels/"), "/")
+	if len(parts) != 2 || !validArgs(parts[0]) {
+		http.NotFound(w, r)
+		return
+	}
+	channelName := parts[0]
+	switch {
+	case parts[1] == "history" && r.Method == http.MethodGet:
+		s.apiHistory(w, r, channelName)
+	case parts[1] == "messages" && r.Method == http.MethodPost:
+		s.apiPost(w, r, channelName)
+	case parts[1] == "history" || parts[1] == "messages":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) apiHistory(w http.ResponseWriter, r *http.Request, channelName string) {
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		since = "0"
+	}
+	if _, ok := parsePosition(since); !ok {
+		writeAPIError(w, http.StatusBadRequest, badArguments)
+		return
+	}
+	conn, ok := s.apiDialSession(w, r)
+	if !ok {
+		return
+	}
+	defer conn.close()
+
+	// Read straight from the channel, as JOIN -since does, since joining and leaving
+	// around the read would show up to its members and linked servers
+	name, ok := s.sessionAccount(bearerToken(r))
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, notLoggedIn)
+		return
+	}
+	channel, ok := s.channels.get(channelName)
+	// Private channels aren't there to anyone not let in
+	if !ok || !channel.admits(name) {
+		writeAPIError(w, http.StatusNotFound, noSuchChannel)
+		return
+	}
+	history, _ := channel.since(since)
+
+	messages := []apiMessage{}
+	for _, m := range history {
+		messages = append(messages, apiMessage{Seq: m.seq, From: m.from, Text: m.text, Binary: m.binary})
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+func (s *Server) apiPost(w http.ResponseWriter, r *http.Request, channelName string) {
+	var body struct {
+		Text string `json:"text"`
+	}
+	if !readBody(w, r, &body) {
+		return
+	}
+	if body.Text == "" || !validCommand(body.Text) {
+		writeAPIError(w, http.StatusBadRequest, badArguments)
+		return
+	}
+	conn, ok := s.apiDialSession(w, r)
+	if !ok {
+		return
+	}
+	defer conn.close()
+
+	// Posted straight to the channel, as webhooks are, since joining and leaving around
+	// the post would show up to its members and linked servers
+	name, ok := s.sessionAccount(bearerToken(r))
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, notLoggedIn)
+		return
+	}
+	channel, ok := s.channels.get(channelName)
+	// Private channels aren't there to anyone not let in
+	if !ok || !channel.admits(name) {
+		writeAPIError(w, http.StatusNotFound, noSuchChannel)
+		return
+	}
+	if channel.mutes(name, time.Now()) {
+		writeAPIError(w, reasonStatus(mutedInChannel), mutedInChannel)
+		return
+	}
+	if !s.runHooks("on_message", channelName, name, body.Text) {
+		writeAPIError(w, reasonStatus(rejectedByScript), rejectedByScript)
+		return
+	}
+	s.post(channel, name, channelName, body.Text)
+	s.relay("SAY", name, channelName, body.Text)
+	s.countMessage()
+	s.notify(channel, name, channelName, body.Text)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiAccounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !readBody(w, r, &body) {
+		return
+	}
+	if !validArgs(body.Username, body.Password) {
+		writeAPIError(w, http.StatusBadRequest, badArguments)
+		return
+	}
+	conn, ok := s.apiDial(w, r)
+	if !ok {
+		return
+	}
+	defer conn.close()
+	conn.send("REGISTER", body.Username, body.Password)
+	registered, reason, err := conn.result(r.Context(), "REGISTER", 0)
+	if writeResult(w, registered, reason, err) {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (s *Server) apiSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !readBody(w, r, &body) {
+		return
+	}
+	if !validArgs(body.Username, body.Password) {
+		writeAPIError(w, http.StatusBadRequest, badArguments)
+		return
+	}
+	conn, ok := s.apiDial(w, r)
+	if !ok {
+		return
+	}
+	defer conn.close()
+	ctx := r.Context()
+	if err := conn.hello(ctx, "sessions"); err != nil {
+		writeResult(w, false, "", err)
+		return
+	}
+	conn.send("LOGIN", body.Username, body.Password)
+	loggedIn, reason, err := conn.result(ctx, "LOGIN", 0)
+	if !loggedIn && reason == "" && err == nil {
+		reason = notLoggedIn
+	}
+	if !writeResult(w, loggedIn, reason, err) {
+		return
+	}
+	writeSession(w, ctx, conn)
+}
+
+// Replies with the token from the SESSION frame that follows a successful LOGIN or PASSWD
+// on a connection that asked for one
+func writeSession(w http.ResponseWriter, ctx context.Context, conn *rpcConn) {
+	session, err := conn.await(ctx, "SESSION", "")
+	if err != nil || len(session) != 1 {
+		writeAPIError(w, http.StatusServiceUnavailable, "no session")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"session": session[0]})
+}
+
+func (s *Server) apiPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Old string `json:"old"`
+		New string `json:"new"`
+	}
+	if !readBody(w, r, &body) {
+		return
+	}
+	if !validArgs(body.Old, body.New) {
+		writeAPIError(w, http.StatusBadRequest, badArguments)
+		return
+	}
+	conn, ok := s.apiDialSession(w, r)
+	if !ok {
+		return
+	}
+	defer conn.close()
+	ctx := r.Context()
+	if err := conn.hello(ctx, "sessions"); err != nil {
+		writeResult(w, false, "", err)
+		return
+	}
+	conn.send("PASSWD", body.Old, body.New)
+	changed, reason, err := conn.result(ctx, "PASSWD", 0)
+	if !changed && reason == "" && err == nil {
+		reason = notLoggedIn
+	}
+	if !writeResult(w, changed, reason, err) {
+		return
+	}
+	writeSession(w, ctx, conn)
+}
+
+func (s *Server) apiAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Password string `json:"password"`
+	}
+	if !readBody(w, r, &body) {
+		return
+	}
+	if !validArgs(body.Password) {
+		writeAPIError(w, http.StatusBadRequest, badArguments)
+		return
+	}
+	conn, ok := s.apiDialSession(w, r)
+	if !ok {
+		return
+	}
+	defer conn.close()
+	conn.send("UNREGISTER", body.Password)
+	unregistered, _, err := conn.result(r.Context(), "UNREGISTER", 0)
+	// The session logged the connection in, so it was the password that was wrong
+	if writeResult(w, unregistered, wrongPassword, err) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /events/<channel>?token=<session>
+//
+// Streams the channel's messages as Server-Sent Events, each a RECV event whose data is
+// {"from", "text"}, for as long as the client stays. EventSource can't set headers, hence
+// the token in the query. The session is held for the length of the stream.
+func (s *Server) apiEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	channelName := strings.TrimPrefix(r.URL.Path, "/events/")
+	if !validArgs(channelName) || strings.Contains(channelName, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	conn, ok := s.apiDialSession(w, r)
+	if !ok {
+		return
+	}
+	defer conn.close()
+	name, ok := s.sessionAccount(bearerToken(r))
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, notLoggedIn)
+		return
+	}
+	channel, ok := s.channels.get(channelName)
+	// Private channels aren't there to anyone not let in
+	if !ok || !channel.admits(name) {
+		writeAPIError(w, http.StatusNotFound, noSuchChannel)
+		return
+	}
+
+	// Subscribed rather than joined, so that streams coming and going don't show up to
+	// members or linked servers, nor take the channel from the account's connections
+	stream := channel.subscribe()
+	defer channel.unsubscribe(stream)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The connection only holds the session, so whatever it's sent is thrown away
+	conn.conn.SetReadDeadline(time.Time{})
+	go io.Copy(io.Discard, conn.reader)
+	for {
+		select {
+		case m := <-stream.messages:
+			data, _ := json.Marshal(map[string]string{"from": m.from, "text": m.text})
+			if _, err := fmt.Fprintf(w, "event: RECV\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-stream.overflowed:
+			return
+		case <-conn.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// How many messages an event stream can fall behind by before it's dropped
+const eventStreamBacklog = 256
+
+// A channel's messages on their way to an /events stream, which isn't a member
+type eventStream struct {
+	messages chan message
+	// Closed once the stream falls too far behind, which ends it
+	overflowed   chan struct{}
+	overflowOnce sync.Once
+}
+
+// Passes m on without waiting, ending the stream if it's too far behind to take it
+func (e *eventStream) offer(m message) {
+	select {
+	case e.messages <- m:
+	default:
+		e.overflowOnce.Do(func() { close(e.overflowed) })
+	}
+}
+
+func (c *channel) subscribe() *eventStream {
+	e := &eventStream{messages: make(chan message, eventStreamBacklog), overflowed: make(chan struct{})}
+	c.usersLock.Lock()
+	c.streams[e] = true
+	c.usersLock.Unlock()
+	return e
+}
+
+func (c *channel) unsubscribe(e *eventStream) {
+	c.usersLock.Lock()
+	delete(c.streams, e)
+	c.usersLock.Unlock()
+}
+
+// The channel's event streams, to offer messages to once usersLock is released. Must be
+// called with usersLock held.
+func (c *channel) eventStreams() []*eventStream {
+	streams := make([]*eventStream, 0, len(c.streams))
+	for e := range c.streams {
+		streams = append(streams, e)
+	}
+	return streams
+}
@@ -0,0 +1,33 @@
+package brerver
+
+// The members to tell that name joined or left: everyone but name that asked with HELLO
+// members. Must be called with usersLock held.
+func (c *channel) watchers(name string) []*user {
+	var watchers []*user
+	for member, u := range c.users {
+		if member != name && u.members.Load() {
+			watchers = append(watchers, u)
+		}
+	}
+	return watchers
+}
+
+// The members joined to the channel here, to send to once usersLock is released. Must be
+// called with usersLock held.
+func (c *channel) connections() []*user {
+	members := make([]*user, 0, len(c.users))
+	for _, u := range c.users {
+		members = append(members, u)
+	}
+	return members
+}
+
+// Tells watchers that name joined or left, as JOINED <user> <channel> or LEFT <user>
+// <channel>, so clients can keep track of who is there without asking WHO. Must be called
+// once usersLock is released, as sending can wait on slow connections.
+func announceMembership(watchers []*user, kind, name, channelName string) {
+	msg := []byte(kind + " " + name + " " + channelName + "\n")
+	for _, u := range watchers {
+		u.send(msg)
+	}
+}
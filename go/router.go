@@ -0,0 +1,98 @@
+package brerver
+
+import "strings"
+
+// How a command is handled and what it needs before its handler runs
+type route struct {
+	handler func(s *Server, u *user, args []string)
+	// The fewest and most words the command takes, counting itself. Commands with any
+	// other number are ignored, as a client sending them is confused.
+	minWords, maxWords int
+	// Refused with NOT_LOGGED_IN until the client logs in
+	loggedIn bool
+	// How many of the command's space separated arguments its RESULT repeats, so that a
+	// refusal can repeat them too. Fewer are repeated if fewer were given.
+	echo int
+}
+
+// The commands built into the line protocol, so that adding one is a call to register
+// rather than another case and another check of len(args)
+type router struct {
+	routes map[string]route
+}
+
+// Set up in init, as handlers like ADMIN RELOAD lead back to ParseConfig, which needs it
+var builtins *router
+
+func init() {
+	builtins = &router{routes: map[string]route{}}
+	builtins.register("LOGIN", route{handler: login, minWords: 3, maxWords: 3})
+	builtins.register("HELLO", route{handler: hello, minWords: 1, maxWords: 3})
+	builtins.register("CAPS", route{handler: caps, minWords: 1, maxWords: 3})
+	builtins.register("AUTH", route{handler: authenticate, minWords: 3, maxWords: 3, echo: 1})
+	builtins.register("PASSWD", route{handler: passwd, minWords: 3, maxWords: 3})
+	builtins.register("UNREGISTER", route{handler: unregister, minWords: 2, maxWords: 2})
+	builtins.register("RESUME", route{handler: resume, minWords: 2, maxWords: 3})
+	builtins.register("REGISTER", route{handler: register, minWords: 3, maxWords: 3})
+	builtins.register("JOIN", route{handler: join, minWords: 2, maxWords: 3, loggedIn: true, echo: 1})
+	builtins.register("CREATE", route{handler: create, minWords: 2, maxWords: 3, echo: 1})
+	builtins.register("LEAVE", route{handler: leave, minWords: 2, maxWords: 2, echo: 1})
+	builtins.register("SAY", route{handler: say, minWords: 3, maxWords: 3, loggedIn: true, echo: 1})
+	builtins.register("SAYB", route{handler: sayBinary, minWords: 3, maxWords: 3, loggedIn: true, echo: 1})
+	builtins.register("E2E", route{handler: setE2E, minWords: 2, maxWords: 3, echo: 2})
+	builtins.register("REACT", route{handler: react, minWords: 3, maxWords: 3, echo: 2})
+	builtins.register("REACTIONS", route{handler: reactions, minWords: 2, maxWords: 3, echo: 2})
+	builtins.register("PIN", route{handler: pinMessage, minWords: 3, maxWords: 3, echo: 2})
+	builtins.register("UNPIN", route{handler: unpinMessage, minWords: 3, maxWords: 3, echo: 2})
+	builtins.register("INVITE", route{handler: invite, minWords: 3, maxWords: 3, echo: 2})
+	builtins.register("UNINVITE", route{handler: uninvite, minWords: 3, maxWords: 3, echo: 2})
+	builtins.register("MEMBERLIMIT", route{handler: setMemberLimit, minWords: 3, maxWords: 3, echo: 2})
+	builtins.register("PINLIMIT", route{handler: setPinLimit, minWords: 3, maxWords: 3, echo: 2})
+	builtins.register("NOTIFYPOLICY", route{handler: notifyPolicy, minWords: 3, maxWords: 3, echo: 3})
+	builtins.register("CHANNELS", route{handler: listChannels, minWords: 1, maxWords: 3})
+	builtins.register("WHO", route{handler: who, minWords: 2, maxWords: 2, loggedIn: true, echo: 1})
+	builtins.register("PRESENCE", route{handler: presence, minWords: 1, maxWords: 1})
+	builtins.register("PING", route{handler: ping, minWords: 1, maxWords: 3})
+	builtins.register("EXPORT", route{handler: exportHistory, minWords: 3, maxWords: 3, echo: 1})
+	builtins.register("DOWNLOAD", route{handler: download, minWords: 2, maxWords: 2, echo: 1})
+	builtins.register("ADMIN", route{handler: admin, minWords: 2, maxWords: 3, echo: 2})
+}
+
+func (r *router) register(name string, rt route) {
+	if _, ok := r.routes[name]; ok {
+		panic("Command registered twice: " + name)
+	}
+	r.routes[name] = rt
+}
+
+func (r *router) has(name string) bool {
+	_, ok := r.routes[name]
+	return ok
+}
+
+// Answers a command that won't run with RESULT, as many of its arguments as its route
+// echoes, and 0 for reason
+func (r *router) refuse(u *user, words []string, reason string) {
+	args := strings.Fields(strings.Join(words[1:], " "))
+	echo := min(r.routes[words[0]].echo, len(args))
+	echoed := append([]string{"RESULT", words[0]}, args[:echo]...)
+	u.send([]byte(strings.Join(echoed, " ") + " " + u.outcome(0, reason) + "\n"))
+}
+
+// Runs the command's handler if it has the words and login it needs, reporting whether
+// the router has the command at all
+func (r *router) dispatch(s *Server, u *user, words []string) bool {
+	rt, ok := r.routes[words[0]]
+	if !ok {
+		return false
+	}
+	if len(words) < rt.minWords || len(words) > rt.maxWords {
+		return true
+	}
+	if rt.loggedIn && !u.loggedIn() {
+		r.refuse(u, words, notLoggedIn)
+		return true
+	}
+	rt.handler(s, u, words)
+	return true
+}
@@ -0,0 +1,126 @@
+package brerver
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// A JSON Schema for Config, built from its struct tags. ParseConfig checks minimums and
+// enums by hand rather than from the tags, so changing one means changing the other.
+func ConfigSchema() map[string]any {
+	schema := schemaFor(reflect.TypeOf(Config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "brerver configuration"
+	return schema
+}
+
+func schemaFor(t reflect.Type) map[string]any {
+	schema := map[string]any{}
+	switch t.Kind() {
+	case reflect.String:
+		schema["type"] = "string"
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema["type"] = "integer"
+	case reflect.Float32, reflect.Float64:
+		schema["type"] = "number"
+	case reflect.Slice:
+		schema["type"] = "array"
+		schema["items"] = schemaFor(t.Elem())
+	case reflect.Map:
+		schema["type"] = "object"
+		schema["additionalProperties"] = schemaFor(t.Elem())
+	case reflect.Struct:
+		properties := map[string]any{}
+		dependencies := map[string][]string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := jsonName(field)
+			if name == "" {
+				continue
+			}
+			properties[name] = fieldSchema(field)
+			if requires, ok := field.Tag.Lookup("requires"); ok {
+				dependencies[name] = strings.Split(requires, ",")
+			}
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+		schema["additionalProperties"] = false
+		if len(dependencies) > 0 {
+			schema["dependentRequired"] = dependencies
+		}
+	}
+	return schema
+}
+
+func fieldSchema(field reflect.StructField) map[string]any {
+	schema := schemaFor(field.Type)
+	if doc, ok := field.Tag.Lookup("doc"); ok {
+		schema["description"] = doc
+	}
+	if def, ok := field.Tag.Lookup("default"); ok {
+		var value any
+		if field.Type.Kind() == reflect.String {
+			value = def
+		} else if err := json.Unmarshal([]byte(def), &value); err != nil {
+			panic("Bad default for " + field.Name + ": " + err.Error())
+		}
+		schema["default"] = value
+	}
+	for _, constraint := range []string{"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum"} {
+		if bound, ok := field.Tag.Lookup(constraint); ok {
+			var value float64
+			if err := json.Unmarshal([]byte(bound), &value); err != nil {
+				panic("Bad " + constraint + " for " + field.Name + ": " + err.Error())
+			}
+			schema[constraint] = value
+		}
+	}
+	if enum, ok := field.Tag.Lookup("enum"); ok {
+		if field.Type.Kind() == reflect.Slice {
+			schema["items"].(map[string]any)["enum"] = strings.Split(enum, ",")
+		} else {
+			schema["enum"] = strings.Split(enum, ",")
+		}
+	}
+	if keys, ok := field.Tag.Lookup("keys"); ok {
+		schema["propertyNames"] = map[string]any{"enum": strings.Split(keys, ",")}
+	}
+	return schema
+}
+
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" || !field.IsExported() {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// Sets every field with a default tag, recursing into nested structs
+func applyDefaults(config any) error {
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if def, ok := field.Tag.Lookup("default"); ok {
+			target := value.Field(i).Addr().Interface()
+			if field.Type.Kind() == reflect.String {
+				value.Field(i).SetString(def)
+			} else if err := json.Unmarshal([]byte(def), target); err != nil {
+				return err
+			}
+		} else if field.Type.Kind() == reflect.Struct {
+			if err := applyDefaults(value.Field(i).Addr().Interface()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
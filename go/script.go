@@ -0,0 +1,138 @@
+package brerver
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// Keeps a runaway script from hanging the connection that triggered it
+const scriptSteps = 1000000
+
+// An operator supplied Starlark file.
+//
+// Scripts may define on_message(channel, user, text) and on_join(channel, user), which
+// reject the action by returning False. They get send(channel, text), mute(channel,
+// user, seconds) and op(channel, user) to act on the server, and nothing else, so
+// they can't touch the filesystem or network.
+type script struct {
+	name    string
+	globals starlark.StringDict
+}
+
+func loadScripts(s *Server, paths []string) ([]*script, error) {
+	var scripts []*script
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		thread := s.scriptThread(name)
+		globals, err := starlark.ExecFile(thread, path, nil, s.scriptBuiltins(name))
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, &script{name, globals})
+	}
+	return scripts, nil
+}
+
+func (s *Server) scriptThread(name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(thread *starlark.Thread, msg string) {
+			s.logger.Info(msg, "script", thread.Name)
+		},
+	}
+	thread.SetMaxExecutionSteps(scriptSteps)
+	return thread
+}
+
+// Calls hook in every script that defines it, reporting whether they all let the
+// action go ahead. Scripts that fail are logged and otherwise ignored.
+func (s *Server) runHooks(hook string, args ...string) bool {
+	values := make(starlark.Tuple, len(args))
+	for i, arg := range args {
+		values[i] = starlark.String(arg)
+	}
+
+	allowed := true
+	for _, script := range s.loadedScripts() {
+		function, ok := script.globals[hook].(starlark.Callable)
+		if !ok {
+			continue
+		}
+		result, err := starlark.Call(s.scriptThread(script.name), function, values, nil)
+		if err != nil {
+			s.logger.Warn("Script failed", "script", script.name, "hook", hook, "err", err)
+			continue
+		}
+		if result == starlark.False {
+			allowed = false
+		}
+	}
+	return allowed
+}
+
+func (s *Server) scriptChannel(name string) (*channel, error) {
+	channel, ok := s.channels.get(name)
+	if !ok {
+		return nil, fmt.Errorf("no such channel '%s'", name)
+	}
+	return channel, nil
+}
+
+func (s *Server) scriptBuiltins(name string) starlark.StringDict {
+	send := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var channelName, text string
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "channel", &channelName, "text", &text); err != nil {
+			return nil, err
+		}
+		if strings.ContainsAny(text, "\r\n") {
+			return nil, fmt.Errorf("%s: text can't contain newlines", b.Name())
+		}
+		channel, err := s.scriptChannel(channelName)
+		if err != nil {
+			return nil, err
+		}
+		s.post(channel, name, channelName, text)
+		return starlark.None, nil
+	}
+
+	mute := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var channelName, username string
+		var seconds int
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "channel", &channelName, "user", &username, "seconds", &seconds); err != nil {
+			return nil, err
+		}
+		channel, err := s.scriptChannel(channelName)
+		if err != nil {
+			return nil, err
+		}
+		channel.settingsLock.Lock()
+		channel.muted[username] = time.Now().Add(time.Duration(seconds) * time.Second)
+		channel.settingsLock.Unlock()
+		return starlark.None, nil
+	}
+
+	op := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var channelName, username string
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "channel", &channelName, "user", &username); err != nil {
+			return nil, err
+		}
+		channel, err := s.scriptChannel(channelName)
+		if err != nil {
+			return nil, err
+		}
+		channel.settingsLock.Lock()
+		channel.operators[username] = true
+		channel.settingsLock.Unlock()
+		return starlark.None, nil
+	}
+
+	return starlark.StringDict{
+		"send": starlark.NewBuiltin("send", send),
+		"mute": starlark.NewBuiltin("mute", mute),
+		"op":   starlark.NewBuiltin("op", op),
+	}
+}
@@ -1,329 +1,1241 @@
-package main
+package brerver
 
 import (
-	"bytes"
+	"bufio"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// How many messages each channel remembers for JOIN -since
+const historySize = 1000
+
+// How long to wait before accepting again after a temporary failure
+const acceptRetryDelay = 100 * time.Millisecond
+
 type user struct {
-	name          string
+	name    string
+	session string
+	// Set by HELLO sessions or RESUME, after which logging in and PASSWD send a SESSION token
+	sessions bool
+	// Set by HELLO reasons, after which failed RESULTs say why
+	reasons bool
+	// Set by HELLO members, after which JOINED and LEFT come from the user's channels.
+	// Atomic because they're sent from whoever changed the membership.
+	members       atomic.Bool
 	conn          net.Conn
 	channels      map[string]*channel
 	remoteChannel chan string
+	// Other connections ask this one to log out by sending it a channel, which it closes
+	// once it has
+	logOuts chan chan struct{}
+	// Presence-only connections get PRESENCE and NOTIFY frames but never join channels
+	presenceOnly bool
+	out          outbound
+	// What the writer goroutine has yet to write, until done is closed
+	queue chan outgoing
+	done  chan struct{}
+	// Counts the queue filling up and says what slow_consumers does about it
+	overflow func() string
+	// Messages thrown away since the client was last told, with DROPPED
+	lost atomic.Uint64
+	// Set once the connection is dropped for being slow
+	slow atomic.Bool
+	// Held for each write, so that compressed messages aren't interleaved
+	writeLock sync.Mutex
+	// Set by HELLO zlib, after which everything sent goes through it
+	compressor *zlib.Writer
+	// What the last batch of messages was written from, reused under writeLock
+	buffers net.Buffers
+	// How long each write may take, or 0 for as long as it takes
+	writeDeadline func() time.Duration
+	// textFormat unless HELLO json or binaryMagic said otherwise. Read when sending from
+	// other connections' goroutines, hence atomic.
+	format uint32
+
+	// Rate limiting state for each command class
+	buckets map[string]*bucket
+	strikes int
+	// When recent SAYs to each channel happened, for flood protection
+	recentSays map[string][]time.Time
+	// Set between the challenge and the proof of AUTH SCRAM-SHA-256
+	scram *scramState
+	// Where text commands are split, again for each one
+	words [3]string
 }
 
-func (u user) loggedIn() bool {
+func (u *user) loggedIn() bool {
 	return u.name != ""
 }
 
 type channel struct {
 	usersLock sync.RWMutex
 	users     map[string]*user
+	// How many users there are, for reading without usersLock
+	joined atomic.Int64
+	// Set by MEMBERLIMIT, no limit if zero. Kept under usersLock, so that joins at the
+	// same time can't take the channel past it.
+	memberLimit int
+	// Following the channel's messages on /events without being members, kept under
+	// usersLock
+	streams map[*eventStream]bool
+
+	// Appended to while holding usersLock for reading, so taking usersLock for writing
+	// gives a consistent view of membership and history together
+	historyLock sync.Mutex
+	history     []message
+	nextSeq     uint64
+
+	settingsLock sync.RWMutex
+	operators    map[string]bool
+	// Username to when their mute runs out
+	muted map[string]time.Time
+	// Reactions REACT accepts, anything valid if empty
+	reactions map[string]bool
+	// Oldest first, and no more than the pin limit
+	pins []pin
+	// Set by PINLIMIT, the configured maximum if zero
+	pinLimit int
+	// Everyone who has ever joined, who NOTIFY reaches for every message under the all policy
+	members        map[string]bool
+	notifyDefault  string
+	notifyPolicies map[string]string
+	// Set by E2E, which keeps messages out of history
+	e2e bool
+	// Invited to a private channel by INVITE
+	invited map[string]bool
+	// Set by CREATE -private and never changed, so read without a lock: out of CHANNELS,
+	// kept from linked servers, and only joined by invitation
+	private bool
+}
+
+func newChannel(operator string) *channel {
+	c := &channel{
+		users:          map[string]*user{},
+		streams:        map[*eventStream]bool{},
+		operators:      map[string]bool{},
+		muted:          map[string]time.Time{},
+		members:        map[string]bool{},
+		notifyDefault:  notifyMentions,
+		notifyPolicies: map[string]string{},
+		invited:        map[string]bool{},
+	}
+	if operator != "" {
+		c.operators[operator] = true
+	}
+	return c
+}
+
+type message struct {
+	seq  uint64
+	time time.Time
+	from string
+	text string
+	// From SAYB, so text is base64
+	binary bool
+}
+
+func (c *channel) record(from, text string, binary bool) {
+	c.historyLock.Lock()
+	defer c.historyLock.Unlock()
+
+	c.nextSeq++
+	c.history = append(c.history, message{
+		seq:    c.nextSeq,
+		time:   time.Now(),
+		from:   from,
+		text:   text,
+		binary: binary,
+	})
+	if len(c.history) > historySize {
+		c.history = c.history[len(c.history)-historySize:]
+	}
+}
+
+// Adds u as a member, returning the messages after since if it is not empty, or the
+// reason u can't be added
+func (c *channel) add(u *user, channelName, since string) ([]message, string) {
+	// Deferred first, so it runs once usersLock is released
+	var watchers []*user
+	defer func() { announceMembership(watchers, "JOINED", u.name, channelName) }()
+	c.usersLock.Lock()
+	defer c.usersLock.Unlock()
+
+	if c.full(u) {
+		return nil, channelFull
+	}
+	var backlog []message
+	if since != "" {
+		var ok bool
+		if backlog, ok = c.since(since); !ok {
+			return nil, badArguments
+		}
+	}
+	if c.setMember(u) {
+		watchers = c.watchers(u.name)
+	}
+	return backlog, ""
+}
+
+// Records and logs the message and sends it to every member
+func (s *Server) post(c *channel, from, channelName, text string) {
+	e2e := c.isE2E()
+	// Recorded along with who to send it to, so that anyone joining meanwhile gets it
+	// either in their backlog or live
+	c.usersLock.RLock()
+	if !e2e {
+		s.logEvent(sayEvent, from, channelName, text)
+		c.record(from, text, false)
+	}
+	members := c.connections()
+	streams := c.eventStreams()
+	c.usersLock.RUnlock()
+
+	line := newSharedLine("RECV", from, channelName, text)
+	s.broadcast(members, func(u *user) { u.sendShared(line) })
+	line.release()
+	for _, e := range streams {
+		e.offer(message{from: from, text: text})
+	}
+}
+
+func (c *channel) lastSeq() uint64 {
+	c.historyLock.Lock()
+	defer c.historyLock.Unlock()
+	return c.nextSeq
+}
+
+func historyLine(channelName string, m message) string {
+	if m.binary {
+		return fmt.Sprintf("HISTORYB %s %d %s %s\n", channelName, m.seq, m.from, m.text)
+	}
+	return fmt.Sprintf("HISTORY %s %d %s %s\n", channelName, m.seq, m.from, m.text)
 }
 
-// Essentially all the global state, extracted into a struct for testing purposes
+func sendHistory(u *user, channelName string, backlog []message) {
+	for _, m := range backlog {
+		u.send([]byte(historyLine(channelName, m)))
+	}
+}
+
+// A point in a channel's history, either a sequence number or an RFC 3339 timestamp
+type position struct {
+	seq  uint64
+	time time.Time
+}
+
+func parsePosition(text string) (position, bool) {
+	if seq, err := strconv.ParseUint(text, 10, 64); err == nil {
+		return position{seq: seq}, true
+	}
+	if t, err := time.Parse(time.RFC3339, text); err == nil {
+		return position{time: t}, true
+	}
+	return position{}, false
+}
+
+// Negative if m comes before p, positive if after
+func (p position) compare(m message) int {
+	if p.time.IsZero() {
+		switch {
+		case m.seq < p.seq:
+			return -1
+		case m.seq > p.seq:
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case m.time.Before(p.time):
+		return -1
+	case m.time.After(p.time):
+		return 1
+	}
+	return 0
+}
+
+// Messages after since
+func (c *channel) since(since string) ([]message, bool) {
+	p, ok := parsePosition(since)
+	if !ok {
+		return nil, false
+	}
+	return c.filter(func(m message) bool { return p.compare(m) > 0 }), true
+}
+
+// Messages from from to to, inclusive
+func (c *channel) between(from, to position) []message {
+	return c.filter(func(m message) bool { return from.compare(m) >= 0 && to.compare(m) <= 0 })
+}
+
+func (c *channel) filter(keep func(message) bool) []message {
+	c.historyLock.Lock()
+	defer c.historyLock.Unlock()
+
+	var messages []message
+	for _, m := range c.history {
+		if keep(m) {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// A chat server: its accounts, channels and connections, and the links to other servers.
+// Make one with NewServer and serve with Run or RunWithConfig until the context is done.
 type Server struct {
 	port string
+	// Listeners from WithListener, served alongside those the server opens itself
+	given []net.Listener
+	// What Run is configured by, from WithConfig
+	initialConfig string
 	// Don't worry about one user on multiple devices idt
-	usersLock sync.RWMutex
-	users     map[string]string
+	users *shardedMap[string]
+	// Keys the salts AUTH SCRAM-SHA-256 makes up for unknown users, so each name always
+	// gets the same one. Random for each process unless handed over.
+	saltKey []byte
+
+	// Each channel has a lock of its own for everything but its place in the map
+	channels *shardedMap[*channel]
+
+	connectionsLock sync.RWMutex
+	connections     map[*user]struct{}
+	// Names nobody can log in as while their account is being unregistered, by how many
+	// unregisterings are holding each
+	loginsHeld map[string]int
+	// The connections, and those of them logged in, changed along with them
+	openConnections     atomic.Int64
+	loggedInConnections atomic.Int64
+
+	// Connections counted against the caps, by remote IP
+	admittedLock  sync.Mutex
+	admitted      map[string]int
+	admittedTotal int
+	// Connections accepted that have yet to be admitted or turned away
+	accepted int
+	// Closed when a connection is released, for accept loops paused by busy_action
+	vacancy chan struct{}
+
+	presenceLock sync.RWMutex
+	presence     map[*user]struct{}
+
+	sessionsLock sync.Mutex
+	sessions     map[string]*session
 
-	// Each channel has a lock so you only need to take this lock when modifying the map
-	channelsLock sync.RWMutex
-	channels     map[string]*channel
+	// Failed logins by account and by IP, for lockout
+	failuresLock  sync.Mutex
+	failures      map[string]*failures
+	failuresSwept time.Time
+
+	exportsLock sync.Mutex
+	exports     map[string]*export
+	lastExport  map[string]time.Time
 
 	serversLock sync.RWMutex
-	servers     map[string]net.Conn
+	servers     map[string]*serverLink
+	peers       map[string]*peerState
+	// Addresses of the servers this one knows of, and which of them it keeps dialing
+	known   map[string]string
+	dialing map[string]bool
+	// Shares out broadcasts to big channels, nil without fanout_workers
+	fanout *fanoutPool
+	// Where channels have their homes, with federation_sharding
+	ring *hashRing
+	// REGISTERs waiting on the leader, by the id sent with their CLAIM
+	claims    map[string]claim
+	lastClaim uint64
+	// For the ids of messages relayed to linked servers, of which seen has those lately
+	// delivered here
+	epoch       string
+	lastMessage atomic.Uint64
+	seenLock    sync.Mutex
+	seen        map[string]*seenIDs
+
+	// Everything ADMIN RELOAD replaces is guarded by configLock
+	configLock   sync.RWMutex
+	config       Config
+	configLoader func() (string, error)
+	scripts      []*script
+	plugins      map[string]CommandPlugin
+	bans         banList
+	events       *eventLog
+	auditLog     *eventLog
+	// Maps a verified client certificate to the account it logs in as
+	certificateUser func(*x509.Certificate) string
+	oidc            *oidcProvider
+	// Where LOGIN checks passwords for accounts the local store doesn't know
+	directory authProvider
+	// From WithStore, asked before the directory and never replaced
+	store authProvider
+	// Run around every command, from WithBeforeCommand and WithAfterCommand
+	beforeCommand []Hook
+	afterCommand  []Hook
+	// Added with RegisterCommand
+	commandsLock sync.RWMutex
+	commands     map[string]CommandHandler
 
-	// a message will be sent when the server starts and one will be received for shutdown
-	control chan struct{}
+	// SAYs accepted on statsDay, for the stats ticker
+	statsLock     sync.Mutex
+	statsDay      string
+	statsMessages int
+
+	// Closed once Run is serving, and once it returns
+	started chan struct{}
+	stopped chan struct{}
+	// Closed by Shutdown, which may be called more than once
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	// Set under connectionsLock once draining starts, after which no connection is served
+	closing bool
+	// Every userConnection still running
+	connectionsWait sync.WaitGroup
+	// Served on metrics_port
+	metrics metrics
+	// Every listener by "network address", to hand over to a new process, and those a
+	// process handing over passed on that haven't been listened on yet
+	listenersLock sync.Mutex
+	listening     map[string]net.Listener
+	inherited     map[string]net.Listener
+	// Where the line protocol is served, once it is
+	addr net.Addr
+	// Where to say this process is serving, when it was started by a handover
+	handoverReady *os.File
+	// slog.Default unless WithLogger says otherwise
+	logger *slog.Logger
 }
 
-func NewServer(port string) *Server {
-	return &Server{
-		port:     port,
-		users:    map[string]string{},
-		channels: map[string]*channel{},
-		servers:  map[string]net.Conn{},
+// A server set up by options, with the default configuration until Run or RunWithConfig.
+// Without WithPort or WithListener it only listens where its configuration says to.
+func NewServer(options ...Option) *Server {
+	config, err := ParseConfig("")
+	if err != nil {
+		panic("The default configuration is invalid: " + err.Error())
 	}
+	s := &Server{
+		config:      config,
+		users:       newShardedMap[string](),
+		saltKey:     newSaltKey(),
+		channels:    newShardedMap[*channel](),
+		sessions:    map[string]*session{},
+		connections: map[*user]struct{}{},
+		loginsHeld:  map[string]int{},
+		admitted:    map[string]int{},
+		failures:    map[string]*failures{},
+		presence:    map[*user]struct{}{},
+		exports:     map[string]*export{},
+		lastExport:  map[string]time.Time{},
+		servers:     map[string]*serverLink{},
+		peers:       map[string]*peerState{},
+		known:       map[string]string{},
+		dialing:     map[string]bool{},
+		claims:      map[string]claim{},
+		commands:    map[string]CommandHandler{},
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		seen:        map[string]*seenIDs{},
+		listening:   map[string]net.Listener{},
+		inherited:   map[string]net.Listener{},
+		shutdown:    make(chan struct{}),
+		started:     make(chan struct{}),
+		stopped:     make(chan struct{}),
+		logger:      slog.Default(),
+		certificateUser: func(cert *x509.Certificate) string {
+			return cert.Subject.CommonName
+		},
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
 }
 
+// Blocks until Run is serving, or has returned without getting that far
 func (s *Server) WaitForStartup() {
-	if s.control != nil {
-		<-s.control
-	} else {
-		panic("Tried to wait on server startup with no control channel")
+	select {
+	case <-s.started:
+	case <-s.stopped:
 	}
 }
 
-func (s *Server) SetControl(control chan struct{}) {
-	s.control = control
+// The address the line protocol is served on, the port's if there is one, or nil until
+// Run is serving. With a port of 0 this is where to find the one the system chose.
+func (s *Server) Addr() net.Addr {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+	return s.addr
+}
+
+// Stops accepting connections and returns from Run
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
 }
 
 func login(s *Server, u *user, args []string) {
-	if len(args) != 3 {
-		return
-	}
 	username := args[1]
 	password := args[2]
 
-	s.usersLock.RLock()
-	defer s.usersLock.RUnlock()
+	if !s.settings().PlaintextLogin {
+		u.send([]byte("RESULT LOGIN 0\n"))
+		return
+	}
+	if s.lockedOut(u, username) {
+		s.audit(u, loginFailedAudit, username, "locked")
+		u.send([]byte("RESULT LOGIN " + u.outcome(0, tooManyFailures) + "\n"))
+		return
+	}
+	provider, ok := s.checkPassword(username, password)
+	if _, local := provider.(localStore); ok && !local {
+		ok = s.provision(username)
+	}
+	if ok {
+		s.loginSucceeded(username)
+		if !loggedIn(s, u, username, "password", "RESULT LOGIN 1\n") {
+			u.send([]byte("RESULT LOGIN 0\n"))
+		}
+	} else {
+		s.loginFailed(u, username)
+		s.audit(u, loginFailedAudit, username, "password")
+		u.send([]byte("RESULT LOGIN 0\n"))
+	}
+}
+
+// Whatever the means of authentication, this is what a successful login looks like. Sends
+// result once the connection has the name, or returns false without sending it if the
+// account is gone or going by then.
+func loggedIn(s *Server, u *user, username, method, result string) bool {
+	if !s.claimName(u, username) {
+		return false
+	}
+	u.send([]byte(result))
+	s.audit(u, loginAudit, username, method)
+	if u.sessions {
+		s.startSession(u)
+	}
+	s.sendMOTD(u)
+	s.joinDefaultChannels(u)
+	s.announcePresence(u.name, true)
+	return true
+}
 
-	var confirmation int
-	if pass, ok := s.users[username]; ok && username != "" && pass == password {
-		u.name = username
-		confirmation = 1
+// One MOTD frame for each line of the message of the day, if there is one
+func (s *Server) sendMOTD(u *user) {
+	motd := s.settings().MOTD
+	if motd == "" {
+		return
+	}
+	for _, line := range strings.Split(motd, "\n") {
+		u.send([]byte("MOTD " + line + "\n"))
 	}
+}
 
-	msg := fmt.Sprintf("RESULT LOGIN %d\n", confirmation)
-	u.conn.Write([]byte(msg))
+// Names are only read by other connections with connectionsLock held, as ADMIN KICK does
+func (s *Server) setName(u *user, name string) {
+	s.connectionsLock.Lock()
+	defer s.connectionsLock.Unlock()
+	s.rename(u, name)
 }
 
-func register(s *Server, u *user, args []string) {
-	if len(args) != 3 {
+// Gives u the name of an account that still exists and isn't being unregistered,
+// reporting whether it did. Checked under connectionsLock, so an unregistering either
+// finds u logged in as the account or keeps u from it.
+func (s *Server) claimName(u *user, name string) bool {
+	s.connectionsLock.Lock()
+	defer s.connectionsLock.Unlock()
+	if s.loginsHeld[name] > 0 || !s.accountExists(name) {
+		return false
+	}
+	s.rename(u, name)
+	return true
+}
+
+// Keeps anyone from logging in as name until the function returned is called
+func (s *Server) holdLogins(name string) func() {
+	s.connectionsLock.Lock()
+	s.loginsHeld[name]++
+	s.connectionsLock.Unlock()
+	return func() {
+		s.connectionsLock.Lock()
+		defer s.connectionsLock.Unlock()
+		if s.loginsHeld[name]--; s.loginsHeld[name] == 0 {
+			delete(s.loginsHeld, name)
+		}
+	}
+}
+
+// Changes u's name with connectionsLock held, keeping count of logged in connections
+func (s *Server) rename(u *user, name string) {
+	if u.loggedIn() {
+		s.loggedInConnections.Add(-1)
+	}
+	u.name = name
+	if u.loggedIn() {
+		s.loggedInConnections.Add(1)
+	}
+}
+
+// Logs the connection in as the account its verified client certificate maps to, if any
+func certificateLogin(s *Server, u *user, state tls.ConnectionState) {
+	if !s.settings().TLSClientLogin || len(state.VerifiedChains) == 0 {
+		return
+	}
+
+	username := s.certificateUser(state.VerifiedChains[0][0])
+	if username == "" {
 		return
 	}
+	loggedIn(s, u, username, "certificate", "RESULT LOGIN 1\n")
+}
+
+func register(s *Server, u *user, args []string) {
 	username := args[1]
 	password := args[2]
 
-	s.usersLock.Lock()
-	defer s.usersLock.Unlock()
-
-	var confirmation int
-	if _, ok := s.users[username]; !ok {
-		s.users[username] = password
-		confirmation = 1
+	if s.settings().LDAP.DisableRegister {
+		u.send([]byte("RESULT REGISTER " + u.outcome(0, featureDisabled) + "\n"))
+		return
+	}
+	if reason := s.settings().Accounts.check(username, password); reason != "" {
+		msg := fmt.Sprintf("RESULT REGISTER %s\n", u.outcome(0, reason))
+		u.send([]byte(msg))
+		return
 	}
 
-	msg := fmt.Sprintf("RESULT REGISTER %d\n", confirmation)
-	u.conn.Write([]byte(msg))
+	if reason := s.claimAccount(username, newCredential(password)); reason != "" {
+		msg := fmt.Sprintf("RESULT REGISTER %s\n", u.outcome(0, reason))
+		u.send([]byte(msg))
+		return
+	}
+	s.audit(u, registerAudit, username, "")
+	u.send([]byte("RESULT REGISTER 1\n"))
 }
 
+// JOIN <channel> [-since <seq|timestamp>]
 func join(s *Server, u *user, args []string) {
-	if len(args) != 2 {
-		return
-	}
 	channelName := args[1]
 
+	// Deferred first so the backlog and pins go out after the result
+	var backlog []message
+	var pins []pin
+	defer func() {
+		sendHistory(u, channelName, backlog)
+		sendPins(u, channelName, pins)
+	}()
+
 	var confirmation int
+	var reason string
 	defer func() {
-		msg := fmt.Sprintf("RESULT JOIN %s %d\n", channelName, confirmation)
-		u.conn.Write([]byte(msg))
+		msg := fmt.Sprintf("RESULT JOIN %s %s\n", channelName, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
 	}()
 
-	if !u.loggedIn() {
+	var since string
+	if len(args) == 3 {
+		option := strings.Fields(args[2])
+		if len(option) != 2 || option[0] != "-since" {
+			reason = badArguments
+			return
+		}
+		since = option[1]
+	}
+
+	if u.presenceOnly {
+		reason = presenceOnlyConnection
 		return
 	}
 	if _, ok := u.channels[channelName]; ok {
+		reason = alreadyJoined
 		return
 	}
 
-	s.channelsLock.RLock()
-	channel, ok := s.channels[channelName]
-	s.channelsLock.RUnlock()
-	if !ok {
+	channel, ok := s.channels.get(channelName)
+	// Private channels aren't there to anyone not let in
+	if !ok || !channel.admits(u.name) {
+		reason = noSuchChannel
 		return
 	}
 
-	channel.usersLock.Lock()
-	defer channel.usersLock.Unlock()
-	channel.users[u.name] = u
+	if !s.runHooks("on_join", channelName, u.name) {
+		reason = rejectedByScript
+		return
+	}
+
+	if backlog, reason = channel.add(u, channelName, since); reason != "" {
+		return
+	}
 	u.channels[channelName] = channel
+	s.logEvent(joinEvent, u.name, channelName, "")
+	s.shareMembership("JOIN", channelName, u.name)
+	channel.settingsLock.Lock()
+	channel.members[u.name] = true
+	channel.settingsLock.Unlock()
+	pins = channel.pinned()
 	confirmation = 1
 }
 
+// CREATE <channel> [-private]
+//
+// Private channels are left out of CHANNELS and can only be joined by invitation, so they
+// need someone logged in to run them. Their names are still taken, so CREATE with one
+// fails with CHANNEL_EXISTS and tells whoever tries that the channel is there, though not
+// who is in it or what is said. Private channels that must stay unknown want names that
+// are hard to guess. Linked servers don't know who was let in, so neither the messages
+// in a private channel nor its members are shared with them.
 func create(s *Server, u *user, args []string) {
-	if len(args) != 2 {
-		return
-	}
 	channelName := args[1]
 
 	var confirmation int
+	var reason string
 	defer func() {
-		msg := fmt.Sprintf("RESULT CREATE %s %d\n", channelName, confirmation)
-		u.conn.Write([]byte(msg))
+		msg := fmt.Sprintf("RESULT CREATE %s %s\n", channelName, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
 	}()
 
-	s.channelsLock.Lock()
-	defer s.channelsLock.Unlock()
-	if _, ok := s.channels[channelName]; ok {
-		return
+	var option string
+	if len(args) == 3 {
+		option = args[2]
+		if option != "-private" {
+			reason = badArguments
+			return
+		}
+		if !u.loggedIn() {
+			reason = notLoggedIn
+			return
+		}
 	}
 
-	s.channels[channelName] = &channel{
-		users: map[string]*user{},
-	}
-	confirmation = 1
+	s.channels.update(channelName, func(c *channel, ok bool) (*channel, bool) {
+		if ok {
+			reason = channelExists
+			return c, true
+		}
+		// Logged before anyone can find the channel to join it
+		s.logEvent(createEvent, u.name, channelName, option)
+		confirmation = 1
+		// Whoever creates a channel runs it, if we know who they are
+		c = newChannel(u.name)
+		c.private = option == "-private"
+		return c, true
+	})
 }
 
 func say(s *Server, u *user, args []string) {
-	if len(args) != 3 {
-		return
-	}
 	channelName := args[1]
 	message := args[2]
 
 	var confirmation int
+	var reason string
 	defer func() {
-		msg := fmt.Sprintf("RESULT SAY %s %d\n", channelName, confirmation)
-		u.conn.Write([]byte(msg))
+		msg := fmt.Sprintf("RESULT SAY %s %s\n", channelName, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
 	}()
 
-	if !u.loggedIn() {
-		return
-	}
 	channel, ok := u.channels[channelName]
 	if !ok {
+		reason = notJoined
 		return
 	}
-
-	channel.usersLock.RLock()
-	defer channel.usersLock.RUnlock()
-	msg := []byte(fmt.Sprintf("RECV %s %s %s\n", u.name, channelName, message))
-	for _, user := range channel.users {
-		user.conn.Write(msg)
+	if !s.floodCheck(u, channelName, channel) {
+		reason = mutedInChannel
+		return
+	}
+	if !s.runHooks("on_message", channelName, u.name, message) {
+		reason = rejectedByScript
+		return
 	}
+
+	s.post(channel, u.name, channelName, message)
+	s.relay("SAY", u.name, channelName, message)
+	s.countMessage()
+	s.notify(channel, u.name, channelName, message)
 	confirmation = 1
 }
 
-func listChannels(s *Server, u *user, args []string) {
-	s.channelsLock.RLock()
-	defer s.channelsLock.RUnlock()
+// LEAVE <channel>
+func leave(s *Server, u *user, args []string) {
+	channelName := args[1]
 
-	var builder bytes.Buffer
-	builder.WriteString("RESULT CHANNELS")
-	for name := range s.channels {
-		builder.WriteRune(' ')
-		builder.WriteString(name)
-		builder.WriteRune(',')
-	}
-	if len(s.channels) > 0 {
-		builder.Truncate(builder.Len() - 1)
+	var confirmation int
+	var reason string
+	defer func() {
+		msg := fmt.Sprintf("RESULT LEAVE %s %s\n", channelName, u.outcome(confirmation, reason))
+		u.send([]byte(msg))
+	}()
+
+	channel, ok := u.channels[channelName]
+	if !ok {
+		reason = notJoined
+		return
 	}
-	builder.WriteRune('\n')
+	s.part(u, channelName, channel)
+	confirmation = 1
+}
 
-	bytes := builder.Bytes()
-	u.conn.Write(bytes)
+// Takes u out of a channel it's joined to, unless another connection to the account has
+// taken its place
+func (s *Server) part(u *user, channelName string, channel *channel) {
+	var watchers []*user
+	channel.usersLock.Lock()
+	if channel.users[u.name] == u && channel.removeMember(u.name) {
+		watchers = channel.watchers(u.name)
+	}
+	channel.usersLock.Unlock()
+	announceMembership(watchers, "LEFT", u.name, channelName)
+	delete(u.channels, channelName)
+	s.logEvent(leaveEvent, u.name, channelName, "")
+	s.shareMembership("LEAVE", channelName, u.name)
 }
 
-func userConnection(s *Server, conn net.Conn) {
+// Serves conn until it closes or ctx is done
+func userConnection(ctx context.Context, s *Server, conn net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	u := &user{
 		conn:          conn,
 		channels:      map[string]*channel{},
 		remoteChannel: make(chan string),
+		logOuts:       make(chan chan struct{}),
+		writeDeadline: s.writeDeadline,
+		queue:         make(chan outgoing, sendQueueLength),
+		done:          make(chan struct{}),
+		overflow:      s.overflowed,
+	}
+
+	s.connectionsLock.Lock()
+	if s.closing {
+		s.connectionsLock.Unlock()
+		s.release(conn)
+		conn.Close()
+		return
 	}
+	s.connections[u] = struct{}{}
+	s.openConnections.Add(1)
+	s.connectionsWait.Add(1)
+	s.connectionsLock.Unlock()
+	defer s.connectionsWait.Done()
+	go u.writeQueued()
 
 	defer func() {
-		for _, channel := range u.channels {
-			channel.usersLock.Lock()
-			delete(channel.users, u.name)
-			channel.usersLock.Unlock()
+		s.connectionsLock.Lock()
+		delete(s.connections, u)
+		s.openConnections.Add(-1)
+		if u.loggedIn() {
+			s.loggedInConnections.Add(-1)
+		}
+		s.connectionsLock.Unlock()
+		s.release(conn)
+
+		s.detachSession(u)
+		s.leavePresence(u)
+		for name, channel := range u.channels {
+			s.part(u, name, channel)
 		}
+		// Whatever was last sent, like why the connection is being dropped, goes out first
+		u.flush()
+		close(u.done)
 		// Avoid closing user socket to prevent the port from staying open
 		// https://stackoverflow.com/questions/880557/socket-accept-too-many-open-files
 		u.conn.Close()
 	}()
 
-	connection := make(chan string)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			s.userLogger(u).Info("TLS handshake failed", "err", err)
+			return
+		}
+		certificateLogin(s, u, tlsConn.ConnectionState())
+	}
+
+	connection := make(chan inbound)
+	// Why the reader below gave up, logged once connection is closed. The name changes
+	// under the reader as the connection logs in and out, so it leaves this to the loop.
+	var stopped func(logger *slog.Logger)
 	go func() {
-		buf := make([]byte, 1024)
+		defer close(connection)
+		// Commands can arrive split across reads or several to a read, so buffer up to each newline
+		reader := bufio.NewReader(u.conn)
+		s.setReadDeadline(u)
+		if first, err := reader.Peek(1); err == nil && first[0] == binaryMagic {
+			reader.Discard(1)
+			u.setWireFormat(binaryFormat)
+		}
+		tooLong := 0
 		for {
-			nbytes, err := u.conn.Read(buf)
+			var in inbound
+			var ok bool
+			var err error
+			s.setReadDeadline(u)
+			if u.wireFormat() == binaryFormat {
+				var fields []string
+				fields, ok, err = readBinaryCommand(reader, s.settings().MaxLineLength)
+				if ok && err == nil {
+					if in.words, ok = binaryCommand(fields); !ok {
+						u.send([]byte("ERROR INVALID\n"))
+						continue
+					}
+				}
+			} else {
+				in.line, ok, err = readCommand(reader, s.settings().MaxLineLength)
+			}
 			if err != nil {
-				if err == io.EOF {
+				// Closed on our side when the connection is dropped. A command without
+				// a newline before the end never finished, so it is dropped too.
+				if err == io.EOF || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+					break
+				}
+				if timedOut(err) {
+					stopped = func(logger *slog.Logger) { logger.Info("Disconnecting after the read deadline passed") }
 					break
 				}
-				log.Fatalf("Failed to read bytes from connection: %v\n", err)
+				// Resets and the like only end this connection
+				stopped = func(logger *slog.Logger) { logger.Warn("Failed to read, disconnecting", "err", err) }
+				break
 			}
-
-			msg := string(buf[:nbytes])
-			last := len(msg) - 1
-			if msg[last] != '\n' {
-				log.Printf("Ignoring message without newline at the end: '%s'.", msg)
+			if !ok {
+				tooLong++
+				u.send([]byte("ERROR TOOLONG\n"))
+				if strikes := s.settings().MaxLineStrikes; strikes > 0 && tooLong >= strikes {
+					stopped = func(logger *slog.Logger) {
+						logger.Info("Disconnecting after commands that were too long", "count", tooLong)
+					}
+					break
+				}
 				continue
 			}
-			msg = msg[:last] // Trime newline
-			connection <- msg
+			tooLong = 0
+			select {
+			case connection <- in:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
+	session := &Session{s, u}
+	idle := s.newIdleTimer()
+	defer idle.stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case msg := <-u.remoteChannel:
-			u.conn.Write([]byte(msg))
-		case msg := <-connection:
-			words := strings.SplitN(msg, " ", 3)
-			switch words[0] {
-			case "LOGIN":
-				login(s, u, words)
-			case "REGISTER":
-				register(s, u, words)
-			case "JOIN":
-				join(s, u, words)
-			case "CREATE":
-				create(s, u, words)
-			case "SAY":
-				say(s, u, words)
-			case "CHANNELS":
-				listChannels(s, u, words)
-			default:
-				log.Printf("Unknown command %s\n", words[0])
+			u.send([]byte(msg))
+		case loggedOut := <-u.logOuts:
+			logOut(s, u)
+			close(loggedOut)
+		case <-idle.expired():
+			s.userLogger(u).Info("Disconnecting after being idle")
+			u.send([]byte("ERROR IDLE\n"))
+			return
+		case in, ok := <-connection:
+			if !ok {
+				if stopped != nil {
+					stopped(s.userLogger(u))
+				}
+				return
 			}
+			words, ok := u.parseCommand(in)
+			if !ok {
+				u.send([]byte("ERROR INVALID\n"))
+				continue
+			}
+			idle.reset()
+			if allowed, drop := s.rateLimit(u, words); drop {
+				return
+			} else if !allowed {
+				continue
+			}
+			if !s.beforeHooks(ctx, session, words) {
+				continue
+			}
+			start := time.Now()
+			if !builtins.dispatch(s, u, words) && !s.customCommand(ctx, session, words) {
+				s.userLogger(u).Debug("Unknown command", "command", words[0])
+				continue
+			}
+			s.metrics.observeCommand(words[0], time.Since(start))
+			s.afterHooks(ctx, session, words)
 		}
 	}
 }
 
-func Run(s *Server) {
-	RunWithConfig(s, "")
+// Serves with the configuration from WithConfig, or the defaults, until ctx is done or
+// Shutdown is called, returning why it couldn't start or stopped early
+func (s *Server) Run(ctx context.Context) error {
+	return s.RunWithConfig(ctx, s.initialConfig)
 }
 
-func RunWithConfig(s *Server, config string) {
-	ln, err := net.Listen("tcp", ":"+s.port)
+// Like Run, configured by the JSON in config instead
+func (s *Server) RunWithConfig(ctx context.Context, config string) error {
+	defer close(s.stopped)
+	conf, err := ParseConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to parse configuration: %w", err)
+	}
+	if conf.EventLog != "" {
+		s.events, err = openEventLog(conf.EventLog)
+		if err != nil {
+			return fmt.Errorf("failed to open event log: %w", err)
+		}
+		defer s.events.file.Close()
+	}
+	if conf.AuditLog != "" {
+		s.auditLog, err = openEventLog(conf.AuditLog)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer s.auditLog.file.Close()
+	}
+	if err := s.configure(conf); err != nil {
+		return fmt.Errorf("failed to load script: %w", err)
+	}
+
+	var tlsConfig *tls.Config
+	if conf.TLSCert != "" {
+		tlsConfig, err = conf.tlsConfig()
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+	}
 
-	// For testing
-	fmt.Println(ln.Addr().String())
+	// Every TCP port speaking the line protocol, so load balancers can sit in front of any
+	var trustedProxies []*net.IPNet
+	for _, proxy := range conf.ProxyProtocol {
+		ipNet, _ := parseBan(proxy)
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+	listenTCP := func(address string) (net.Listener, error) {
+		ln, err := s.listen("tcp", address)
+		if err != nil || len(trustedProxies) == 0 {
+			return ln, err
+		}
+		return proxyListener{ln, trustedProxies, s.logger}, nil
+	}
 
-	if err != nil {
-		log.Fatalln("Failed to start TCP server: " + err.Error())
+	// What connections are served with, which outlives ctx until they've been drained
+	serving, stopServing := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopServing()
+	if conf.FanoutWorkers > 0 {
+		s.fanout = newFanoutPool(serving, conf.FanoutWorkers)
+	}
+
+	// Everything listened on so far is closed again if starting fails
+	var listeners []net.Listener
+	// Listeners served by something other than the accept loop
+	var services []net.Listener
+	fail := func(err error) error {
+		closeAll(listeners)
+		closeAll(services)
+		return err
+	}
+
+	// A port of - leaves just the addresses in listen, and 0 lets the system choose
+	if s.port != "" && s.port != "-" {
+		ln, err := listenTCP(":" + s.port)
+		if err != nil {
+			return fail(fmt.Errorf("failed to start TCP server: %w", err))
+		}
+
+		if tlsConfig != nil && conf.TLSPort == "" {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		listeners = append(listeners, ln)
+	}
+	if conf.TLSPort != "" {
+		tlsLn, err := listenTCP(":" + conf.TLSPort)
+		if err != nil {
+			return fail(fmt.Errorf("failed to start TLS server: %w", err))
+		}
+		listeners = append(listeners, tls.NewListener(tlsLn, tlsConfig))
+	}
+	for _, address := range conf.Listen {
+		ln, err := listenTCP(address.Address)
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen on %s: %w", address.Address, err))
+		}
+		if address.TLS {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		listeners = append(listeners, ln)
+	}
+	if conf.UnixSocket != "" {
+		unixLn, err := s.listenUnix(conf.UnixSocket, conf.UnixSocketMode)
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen on unix socket: %w", err))
+		}
+		listeners = append(listeners, unixLn)
+	}
+	if conf.IRCPort != "" {
+		ircLn, err := listenTCP(":" + conf.IRCPort)
+		if err != nil {
+			return fail(fmt.Errorf("failed to start IRC server: %w", err))
+		}
+		listeners = append(listeners, ircListener{ircLn})
+	}
+	if conf.WebSocketPort != "" {
+		wsLn, err := s.listen("tcp", ":"+conf.WebSocketPort)
+		if err != nil {
+			return fail(fmt.Errorf("failed to start WebSocket server: %w", err))
+		}
+		services = append(services, wsLn)
+		go s.serveWebSocket(serving, wsLn)
+	}
+	if conf.GRPCPort != "" {
+		grpcLn, err := s.listen("tcp", ":"+conf.GRPCPort)
+		if err != nil {
+			return fail(fmt.Errorf("failed to start gRPC server: %w", err))
+		}
+		services = append(services, grpcLn)
+		go s.serveGRPC(grpcLn)
+	}
+	if conf.HTTPPort != "" {
+		httpLn, err := s.listen("tcp", ":"+conf.HTTPPort)
+		if err != nil {
+			return fail(fmt.Errorf("failed to start HTTP server: %w", err))
+		}
+		services = append(services, httpLn)
+		go s.serveHTTP(serving, httpLn)
+	}
+	if conf.MetricsPort != "" {
+		metricsLn, err := s.listen("tcp", ":"+conf.MetricsPort)
+		if err != nil {
+			return fail(fmt.Errorf("failed to start metrics server: %w", err))
+		}
+		services = append(services, metricsLn)
+		go s.serveMetrics(metricsLn)
+	}
+	if conf.DebugAddress != "" {
+		debugLn, err := s.listen("tcp", conf.DebugAddress)
+		if err != nil {
+			return fail(fmt.Errorf("failed to start debug server: %w", err))
+		}
+		services = append(services, debugLn)
+		go s.serveDebug(debugLn)
+	}
+	if conf.FederationPort != "" {
+		federationLn, err := s.listen("tcp", ":"+conf.FederationPort)
+		if err != nil {
+			return fail(fmt.Errorf("failed to start federation server: %w", err))
+		}
+		services = append(services, federationLn)
+		go s.serveFederation(serving, federationLn)
 	}
-	defer ln.Close()
 
-	if s.control != nil {
-		s.control <- struct{}{}
+	listeners = append(listeners, s.activatedListeners()...)
+	listeners = append(listeners, s.given...)
+	if len(listeners) == 0 {
+		return fail(errors.New("nothing to listen on, give a port or set listen in the configuration"))
 	}
+	s.finishInheriting()
+	s.listenersLock.Lock()
+	s.addr = listeners[0].Addr()
+	s.listenersLock.Unlock()
+	close(s.started)
 
-	/*
-		lines := strings.Split(config, "\n")
-		for _, line := range lines {
-			go serverConnection(server, line)
+	s.serversLock.Lock()
+	for _, peer := range conf.Peers {
+		if peer.Address != "" {
+			s.dialLater(serving, peer)
 		}
-	*/
+	}
+	s.placeServers()
+	s.serversLock.Unlock()
 
+	// Accepting stops as soon as the server is stopped, but connections carry on until
+	// they've been drained
+	accepting, stopAccepting := context.WithCancel(ctx)
+	defer stopAccepting()
 	connections := make(chan net.Conn)
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				log.Println("Failed to accept TCP connection: " + err.Error())
-				continue
+	acceptErrors := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			for s.waitForRoom(accepting) {
+				conn, err := ln.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// Running out of file descriptors and the like pass, so wait them out
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Temporary() {
+					s.logger.Warn("Failed to accept a connection, trying again", "err", err)
+					select {
+					case <-time.After(acceptRetryDelay):
+						continue
+					case <-accepting.Done():
+						return
+					}
+				}
+				if err != nil {
+					acceptErrors <- fmt.Errorf("failed to accept connections on %s: %w", ln.Addr(), err)
+					return
+				}
+				s.accepting(1)
+				admit := func() {
+					welcome := s.welcome(conn)
+					s.accepting(-1)
+					if !welcome {
+						return
+					}
+					select {
+					case connections <- conn:
+					case <-accepting.Done():
+						s.release(conn)
+						conn.Close()
+					}
+				}
+				// Finding out who a proxied connection is from means waiting on its header,
+				// so only those get a goroutine before they're turned away
+				if awaitsHeader(conn) {
+					go admit()
+				} else {
+					admit()
+				}
 			}
-			connections <- conn
-		}
-	}()
+		}(ln)
+	}
+
+	var statsTick <-chan time.Time
+	if conf.Stats.Channel != "" {
+		ticker := time.NewTicker(time.Duration(conf.Stats.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		statsTick = ticker.C
+	}
 
+	var stopped error
 Loop:
 	for {
 		select {
 		case conn := <-connections:
-			go userConnection(s, conn)
-		case <-s.control:
+			if irc, ok := conn.(ircConn); ok {
+				go ircConnection(serving, s, irc.Conn)
+			} else {
+				go userConnection(serving, s, conn)
+			}
+		case <-statsTick:
+			go s.postStats()
+		case <-s.shutdown:
+			break Loop
+		case <-accepting.Done():
+			break Loop
+		case stopped = <-acceptErrors:
 			break Loop
 		}
 	}
+
+	s.Shutdown()
+	stopAccepting()
+	closeAll(listeners)
+	closeAll(services)
+	s.drain(time.Duration(s.settings().ShutdownSeconds) * time.Second)
+	return stopped
 }
@@ -1,17 +1,58 @@
-package main
+package brerver
 
 import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math/big"
+	mathrand "math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"brerver/chatpb"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 var port uint32 = 8000
 
 func writeThenRead(t *testing.T, conn net.Conn, write string, read ...string) {
+	t.Helper()
 	var (
 		nbytes int
 		err    error
@@ -23,7 +64,11 @@ func writeThenRead(t *testing.T, conn net.Conn, write string, read ...string) {
 	concat := strings.Join(read, "")
 	for len(concat) > 0 {
 		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-		nbytes, err = conn.Read(buf)
+		limit := len(buf)
+		if len(concat) < limit {
+			limit = len(concat)
+		}
+		nbytes, err = conn.Read(buf[:limit])
 		if err != nil {
 			t.Fatalf("Error reading from socket '%s'", err.Error())
 		}
@@ -37,22 +82,64 @@ func writeThenRead(t *testing.T, conn net.Conn, write string, read ...string) {
 	}
 }
 
+func readLine(t *testing.T, conn net.Conn) string {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("Error reading from socket '%s'", err.Error())
+		}
+		if buf[0] == '\n' {
+			return string(line)
+		}
+		line = append(line, buf[0])
+	}
+}
+
+// Logs in successfully
+func writeLogin(t *testing.T, conn net.Conn, username, password string) {
+	writeThenRead(t, conn, fmt.Sprintf("LOGIN %s %s\n", username, password), "RESULT LOGIN 1\n")
+}
+
+// Asks for failure reasons after the 0 in RESULT
+func writeReasons(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.Write([]byte("HELLO reasons\n"))
+	if line := readLine(t, conn); !strings.HasPrefix(line, "RESULT HELLO 1") {
+		t.Fatalf("Expected reasons but got '%s'", line)
+	}
+}
+
+// Asks for a session token, then logs in successfully and returns it
+func writeSessionLogin(t *testing.T, conn net.Conn, username, password string) string {
+	writeThenRead(t, conn, "HELLO sessions\n", "RESULT HELLO 1 LOGIN SCRAM-SHA-256\n")
+	writeLogin(t, conn, username, password)
+	line := readLine(t, conn)
+	token := strings.TrimPrefix(line, "SESSION ")
+	if token == line || token == "" {
+		t.Fatalf("Expected a session token but got '%s'", line)
+	}
+	return token
+}
+
 func harnessed(t *testing.T, numConns int, test func(*testing.T, []net.Conn)) {
+	harnessedWithConfig(t, "", numConns, test)
+}
+
+func harnessedWithConfig(t *testing.T, config string, numConns int, test func(*testing.T, []net.Conn)) {
 	t.Parallel()
-	port := atomic.AddUint32(&port, 1)
-	p := fmt.Sprintf("%d", port)
-	server := NewServer(p)
-	exit := make(chan struct{})
-	server.SetControl(exit)
+	server := NewServer(WithPort("0"))
+	ctx, cancel := context.WithCancel(context.Background())
 
-	go Run(server)
-	defer close(exit)
+	go server.RunWithConfig(ctx, config)
+	defer cancel()
 
 	server.WaitForStartup()
+	_, p, _ := net.SplitHostPort(server.Addr().String())
 
 	conns := make([]net.Conn, 0, numConns)
-	for numConns > 0 {
-
+	for ; numConns > 0; numConns-- {
 		conn, err := net.Dial("tcp", ":"+p)
 		if err != nil {
 			t.Fatalf("Error connecting to server: '%s'", err.Error())
@@ -64,11 +151,49 @@ func harnessed(t *testing.T, numConns int, test func(*testing.T, []net.Conn)) {
 	test(t, conns)
 }
 
+// Writes a self-signed certificate, returning the certificate and key paths
+func writeCertificate(t *testing.T, commonName string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certPath, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
 func TestBasicSuccess(t *testing.T) {
 	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
 		conn := conns[0]
 		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
-		writeThenRead(t, conn, "LOGIN username password\n", "RESULT LOGIN 1\n")
+		writeLogin(t, conn, "username", "password")
 		writeThenRead(t, conn, "CHANNELS\n", "RESULT CHANNELS\n")
 		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
 		writeThenRead(t, conn, "CHANNELS\n", "RESULT CHANNELS channel\n")
@@ -126,7 +251,7 @@ func TestJoinNoSuchChannel(t *testing.T) {
 	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
 		conn := conns[0]
 		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
-		writeThenRead(t, conn, "LOGIN username password\n", "RESULT LOGIN 1\n")
+		writeLogin(t, conn, "username", "password")
 		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 0\n")
 	})
 }
@@ -135,7 +260,7 @@ func TestJoinChannelAlreadyMember(t *testing.T) {
 	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
 		conn := conns[0]
 		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
-		writeThenRead(t, conn, "LOGIN username password\n", "RESULT LOGIN 1\n")
+		writeLogin(t, conn, "username", "password")
 		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
 		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
 		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 0\n")
@@ -153,7 +278,7 @@ func TestSayNoSuchChannel(t *testing.T) {
 	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
 		conn := conns[0]
 		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
-		writeThenRead(t, conn, "LOGIN username password\n", "RESULT LOGIN 1\n")
+		writeLogin(t, conn, "username", "password")
 		writeThenRead(t, conn, "SAY channel Here is the message.\n", "RESULT SAY channel 0\n")
 	})
 }
@@ -162,24 +287,4345 @@ func TestSayNotChannelMember(t *testing.T) {
 	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
 		conn := conns[0]
 		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
-		writeThenRead(t, conn, "LOGIN username password\n", "RESULT LOGIN 1\n")
+		writeLogin(t, conn, "username", "password")
 		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
 		writeThenRead(t, conn, "SAY channel Here is the message.\n", "RESULT SAY channel 0\n")
 	})
 }
 
-/*
 func TestTwoDistributedLogin(t *testing.T) {
+	t.Parallel()
+	servers, ports := federated(t, "", "a", "b")
+	conn1, err := net.Dial("tcp", ":"+ports[0])
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn1.Close()
+	conn2, err := net.Dial("tcp", ":"+ports[1])
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn2.Close()
+	writeReasons(t, conn2)
+
 	t.Run("Register For Each Other", func(t *testing.T) {
-		harnessed(t, 2, func(t *testing.T, conns []net.Conn) {
-			conn1 := conns[0]
-			conn2 := conns[1]
-			writeThenRead(t, conn1, "REGISTER user1 password1\n", "RESULT REGISTER 1\n")
-			writeThenRead(t, conn2, "REGISTER user2 password2\n", "RESULT REGISTER 1\n")
-
-			writeThenRead(t, conn1, "LOGIN user2 password2\n", "RESULT LOGIN 1\n")
-			writeThenRead(t, conn2, "LOGIN user1 password1\n", "RESULT LOGIN 1\n")
+		writeThenRead(t, conn1, "REGISTER user1 password1\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn2, "REGISTER user2 password2\n", "RESULT REGISTER 1\n")
+		eventually(t, "the accounts to reach the other server", func() bool {
+			return servers[1].accountExists("user1") && servers[0].accountExists("user2")
+		})
+
+		writeLogin(t, conn1, "user2", "password2")
+		writeLogin(t, conn2, "user1", "password1")
+		writeThenRead(t, conn2, "REGISTER user2 password\n", "RESULT REGISTER 0 USERNAME_TAKEN\n")
+	})
+	t.Run("Password Changes", func(t *testing.T) {
+		writeThenRead(t, conn2, "PASSWD password1 changed\n", "RESULT PASSWD 1\n")
+		eventually(t, "the new password to reach the other server", func() bool {
+			_, ok := servers[0].checkPassword("user1", "changed")
+			return ok
+		})
+	})
+	t.Run("Unregister", func(t *testing.T) {
+		writeThenRead(t, conn1, "UNREGISTER password2\n", "RESULT UNREGISTER 1\n")
+		eventually(t, "the account to be deleted from the other server", func() bool {
+			return !servers[1].accountExists("user2")
+		})
+	})
+	t.Run("Unregister Logs Out Everywhere", func(t *testing.T) {
+		writeLogin(t, conn1, "user1", "changed")
+		writeThenRead(t, conn1, "UNREGISTER changed\n", "RESULT UNREGISTER 1\n")
+		eventually(t, "the other server to log its connection out", func() bool {
+			return servers[1].loggedInConnections.Load() == 0
+		})
+		writeThenRead(t, conn2, "JOIN channel\n", "RESULT JOIN channel 0 NOT_LOGGED_IN\n")
+		// The link went on being read while the connection was logged out
+		writeThenRead(t, conn2, "REGISTER user3 password\n", "RESULT REGISTER 1\n")
+	})
+}
+
+func TestAccountLeader(t *testing.T) {
+	t.Parallel()
+	servers, ports := federated(t, "", "a", "b", "c")
+	for _, server := range servers {
+		if leader := server.leader(); leader != "a" {
+			t.Fatalf("Expected a to lead, got %s", leader)
+		}
+	}
+	conns := make([]net.Conn, len(ports))
+	for i, p := range ports {
+		conn, err := net.Dial("tcp", ":"+p)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		writeReasons(t, conn)
+		conns[i] = conn
+	}
+
+	// Registered through the leader, so it's there by the time the result is
+	writeThenRead(t, conns[1], "REGISTER follower password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conns[1], "follower", "password")
+
+	// The same name at once on two servers that both follow a makes one account
+	conns[1].Write([]byte("REGISTER contested password1\n"))
+	conns[2].Write([]byte("REGISTER contested password2\n"))
+	results := []string{readLine(t, conns[1]), readLine(t, conns[2])}
+	winner := ""
+	switch {
+	case results[0] == "RESULT REGISTER 1" && results[1] == "RESULT REGISTER 0 USERNAME_TAKEN":
+		winner = "password1"
+	case results[1] == "RESULT REGISTER 1" && results[0] == "RESULT REGISTER 0 USERNAME_TAKEN":
+		winner = "password2"
+	default:
+		t.Fatalf("Expected one REGISTER to win, got %q", results)
+	}
+	eventually(t, "every server to have the winning account", func() bool {
+		for _, server := range servers {
+			if _, ok := server.checkPassword("contested", winner); !ok {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestAccountsSyncOnLink(t *testing.T) {
+	t.Parallel()
+	federationPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	aPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	a := NewServer(WithPort(aPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	go a.RunWithConfig(ctx, fmt.Sprintf(`{"server_name": "a", "federation_port": %q, "peers": [{"name": "b", "secret": "secret"}]}`, federationPort))
+	defer cancel()
+	a.WaitForStartup()
+	conn, err := net.Dial("tcp", ":"+aPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "REGISTER early password\n", "RESULT REGISTER 1\n")
+
+	b := NewServer(WithPort(fmt.Sprintf("%d", atomic.AddUint32(&port, 1))))
+	config := fmt.Sprintf(`{"server_name": "b", "peers": [{"name": "a", "address": "127.0.0.1:%s", "secret": "secret"}]}`, federationPort)
+	go b.RunWithConfig(ctx, config)
+	b.WaitForStartup()
+	b.provision("directory")
+	eventually(t, "accounts made before linking to reach the other server", func() bool {
+		return b.accountExists("early") && a.accountExists("directory")
+	})
+	if _, ok := b.checkPassword("early", "password"); !ok {
+		t.Fatalf("Expected the synced account to keep its password")
+	}
+}
+
+func TestAccountConflictOnLink(t *testing.T) {
+	t.Parallel()
+	federationPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	bPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Dialing a, which isn't up yet
+	b := NewServer(WithPort(bPort))
+	go b.RunWithConfig(ctx, fmt.Sprintf(`{"server_name": "b", "peers": [{"name": "a", "address": "127.0.0.1:%s", "secret": "secret"}]}`, federationPort))
+	b.WaitForStartup()
+	conn, err := net.Dial("tcp", ":"+bPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeReasons(t, conn)
+	writeThenRead(t, conn, "REGISTER taken password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "taken", "password")
+
+	// Taken on the other side of the split too, by the leader
+	a := NewServer(WithPort(fmt.Sprintf("%d", atomic.AddUint32(&port, 1))))
+	a.users.add("taken", newCredential("other"))
+	go a.RunWithConfig(ctx, fmt.Sprintf(`{"server_name": "a", "federation_port": %q, "peers": [{"name": "b", "secret": "secret"}]}`, federationPort))
+	a.WaitForStartup()
+	eventually(t, "the connection to the replaced account to be logged out", func() bool {
+		conn.Write([]byte("JOIN channel\n"))
+		return readLine(t, conn) == "RESULT JOIN channel 0 NOT_LOGGED_IN"
+	})
+	if _, ok := b.checkPassword("taken", "other"); !ok {
+		t.Fatalf("Expected the leader's account to win")
+	}
+}
+
+// Starts a server for each name that links to the ones before it, and waits for every
+// pair to be linked. Returns the servers and the ports their clients connect to.
+func federated(t *testing.T, config string, names ...string) ([]*Server, []string) {
+	var servers []*Server
+	var ports []string
+	var peers []PeerConfig
+	for i, name := range names {
+		// The ones after dial in
+		later := append([]PeerConfig(nil), peers...)
+		for _, next := range names[i+1:] {
+			later = append(later, PeerConfig{Name: next, Secret: "secret"})
+		}
+
+		conf := map[string]interface{}{}
+		if config != "" {
+			if err := json.Unmarshal([]byte(config), &conf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		federationPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+		conf["server_name"] = name
+		conf["federation_port"] = federationPort
+		conf["peers"] = later
+		encoded, err := json.Marshal(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+		server := NewServer(WithPort(plainPort))
+		ctx, cancel := context.WithCancel(context.Background())
+		go server.RunWithConfig(ctx, string(encoded))
+		t.Cleanup(cancel)
+		server.WaitForStartup()
+		servers = append(servers, server)
+		ports = append(ports, plainPort)
+		peers = append(peers, PeerConfig{Name: name, Address: "127.0.0.1:" + federationPort, Secret: "secret"})
+	}
+	eventually(t, "every server to be linked", func() bool {
+		for i, server := range servers {
+			for j, name := range names {
+				if i != j && !server.linked(name) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return servers, ports
+}
+
+// Fails unless condition holds within a few seconds
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChannelCounts(t *testing.T) {
+	harnessed(t, 3, func(t *testing.T, conns []net.Conn) {
+		first, second, third := conns[0], conns[1], conns[2]
+		writeThenRead(t, first, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, first, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, first, "username", "password")
+		writeLogin(t, second, "other", "password")
+		writeLogin(t, third, "other", "password")
+		writeThenRead(t, first, "CREATE channel\nCHANNELS -counts\n", "RESULT CREATE channel 1\n", "RESULT CHANNELS channel=0\n")
+		writeThenRead(t, first, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, second, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		// Another connection to the same account takes its place rather than adding to it
+		writeThenRead(t, third, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, first, "CHANNELS -counts\n", "RESULT CHANNELS channel=2\n")
+		writeThenRead(t, first, "CHANNELS\n", "RESULT CHANNELS channel\n")
+
+		writeThenRead(t, first, "LEAVE channel\n", "RESULT LEAVE channel 1\n")
+		writeThenRead(t, first, "CHANNELS -counts\n", "RESULT CHANNELS channel=1\n")
+		third.Close()
+		eventually(t, "the closed connection to leave", func() bool {
+			first.Write([]byte("CHANNELS -counts\n"))
+			return readLine(t, first) == "RESULT CHANNELS channel=0"
+		})
+	})
+}
+
+func TestChannelsPages(t *testing.T) {
+	harnessedWithConfig(t, `{"channels_page_size": 3}`, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeReasons(t, conn)
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		for _, name := range []string{"team-b", "gamma", "alpha", "team-a", "beta"} {
+			writeThenRead(t, conn, "CREATE "+name+"\n", "RESULT CREATE "+name+" 1\n")
+		}
+		writeThenRead(t, conn, "JOIN team-b\n", "RESULT JOIN team-b 1\n")
+
+		// Paged only when asked to be
+		writeThenRead(t, conn, "CHANNELS\n", "RESULT CHANNELS alpha, beta, gamma, team-a, team-b\n")
+		writeThenRead(t, conn, "CHANNELS -limit 10\n", "MORE CHANNELS gamma\n", "RESULT CHANNELS alpha, beta, gamma\n")
+		writeThenRead(t, conn, "CHANNELS -after gamma\n", "RESULT CHANNELS team-a, team-b\n")
+		writeThenRead(t, conn, "CHANNELS -after team-b\n", "RESULT CHANNELS\n")
+		writeThenRead(t, conn, "CHANNELS -limit 1 -after alpha\n", "MORE CHANNELS beta\n", "RESULT CHANNELS beta\n")
+		writeThenRead(t, conn, "CHANNELS -limit 2 -after gamma\n", "RESULT CHANNELS team-a, team-b\n")
+		writeThenRead(t, conn, "CHANNELS -match team-* -counts\n", "RESULT CHANNELS team-a=0, team-b=1\n")
+		writeThenRead(t, conn, "CHANNELS -counts -match *a -limit 1\n", "MORE CHANNELS alpha\n", "RESULT CHANNELS alpha=0\n")
+
+		for _, options := range []string{"-match [", "-limit 0", "-limit", "-sort name"} {
+			writeThenRead(t, conn, "CHANNELS "+options+"\n", "RESULT CHANNELS 0 BAD_ARGUMENTS\n")
+		}
+	})
+}
+
+func TestDefaultChannels(t *testing.T) {
+	harnessedWithConfig(t, `{"default_channels": ["general", "announcements"], "motd": "Hi"}`, 3, func(t *testing.T, conns []net.Conn) {
+		conn, companion, other := conns[0], conns[1], conns[2]
+		writeReasons(t, companion)
+		writeThenRead(t, conn, "CHANNELS\n", "RESULT CHANNELS announcements, general\n")
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, conn, "", "MOTD Hi\n", "RESULT JOIN general 1\n", "RESULT JOIN announcements 1\n")
+		writeThenRead(t, conn, "SAY general hello\n", "RECV username general hello\n", "RESULT SAY general 1\n")
+
+		// Only joined to what it has left
+		writeThenRead(t, conn, "LEAVE general\n", "RESULT LEAVE general 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, conn, "", "MOTD Hi\n", "RESULT JOIN general 1\n")
+		writeThenRead(t, conn, "PING\n", "PONG\n")
+
+		// Already joined through the other connection, which keeps them
+		writeLogin(t, companion, "username", "password")
+		writeThenRead(t, companion, "PRESENCE\n", "MOTD Hi\n", "RESULT PRESENCE 1\n")
+		writeThenRead(t, companion, "JOIN general\n", "RESULT JOIN general 0 PRESENCE_ONLY\n")
+		writeThenRead(t, conn, "CHANNELS -counts\n", "RESULT CHANNELS announcements=1, general=1\n")
+
+		// Companions for other accounts are taken back out
+		writeThenRead(t, other, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, other, "other", "password")
+		writeThenRead(t, other, "", "MOTD Hi\n", "RESULT JOIN general 1\n", "RESULT JOIN announcements 1\n")
+		writeThenRead(t, conn, "CHANNELS -counts\n", "RESULT CHANNELS announcements=2, general=2\n")
+		writeThenRead(t, other, "PRESENCE\n", "RESULT PRESENCE 1\n")
+		writeThenRead(t, conn, "CHANNELS -counts\n", "RESULT CHANNELS announcements=1, general=1\n")
+	})
+}
+
+func TestMembershipNotices(t *testing.T) {
+	harnessed(t, 4, func(t *testing.T, conns []net.Conn) {
+		conn, older, newer, third := conns[0], conns[1], conns[2], conns[3]
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "REGISTER third password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeLogin(t, older, "other", "password")
+		writeLogin(t, newer, "other", "password")
+		writeLogin(t, third, "third", "password")
+		// Only the connections that ask hear about it
+		writeThenRead(t, conn, "HELLO members\n", "RESULT HELLO 1 LOGIN SCRAM-SHA-256\n")
+		writeThenRead(t, newer, "HELLO members\n", "RESULT HELLO 1 LOGIN SCRAM-SHA-256\n")
+		writeThenRead(t, conn, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+
+		writeThenRead(t, older, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conn, "", "JOINED other channel\n")
+		// Another connection to the account taking its place neither joins nor leaves
+		writeThenRead(t, newer, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conn, "PING\n", "PONG\n")
+		older.Close()
+
+		// Disconnecting leaves, as long as nobody has taken the connection's place
+		writeThenRead(t, third, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, newer, "", "JOINED third channel\n")
+		third.Close()
+		writeThenRead(t, conn, "", "JOINED third channel\n", "LEFT third channel\n")
+		writeThenRead(t, newer, "", "LEFT third channel\n")
+		writeThenRead(t, conn, "CHANNELS -counts\n", "RESULT CHANNELS channel=2\n")
+
+		writeThenRead(t, newer, "LEAVE channel\n", "RESULT LEAVE channel 1\n")
+		writeThenRead(t, conn, "", "LEFT other channel\n")
+		writeThenRead(t, conn, "LEAVE channel\n", "RESULT LEAVE channel 1\n")
+		writeThenRead(t, newer, "PING\n", "PONG\n")
+	})
+}
+
+func TestJoinSince(t *testing.T) {
+	harnessed(t, 2, func(t *testing.T, conns []net.Conn) {
+		conn1 := conns[0]
+		conn2 := conns[1]
+		writeThenRead(t, conn1, "REGISTER user1 password1\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn1, "user1", "password1")
+		writeThenRead(t, conn1, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conn1, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conn1, "SAY channel first\n", "RECV user1 channel first\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, conn1, "SAY channel second\n", "RECV user1 channel second\n", "RESULT SAY channel 1\n")
+
+		writeThenRead(t, conn2, "REGISTER user2 password2\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn2, "user2", "password2")
+		writeThenRead(t, conn2, "JOIN channel -since 1\n", "RESULT JOIN channel 1\n", "HISTORY channel 2 user1 second\n")
+	})
+}
+
+func TestJoinSinceMalformed(t *testing.T) {
+	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeReasons(t, conn)
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conn, "JOIN channel -since yesterday\n", "RESULT JOIN channel 0 BAD_ARGUMENTS\n")
+	})
+}
+
+func TestResume(t *testing.T) {
+	harnessed(t, 3, func(t *testing.T, conns []net.Conn) {
+		conn1 := conns[0]
+		writeThenRead(t, conn1, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		token := writeSessionLogin(t, conn1, "username", "password")
+		writeThenRead(t, conn1, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conn1, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		conn1.Close()
+
+		conn2 := conns[1]
+		writeThenRead(t, conn2, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn2, "other", "password")
+		// The server notices the disconnect asynchronously
+		eventually(t, "the closed connection to leave", func() bool {
+			conn2.Write([]byte("CHANNELS -counts\n"))
+			return readLine(t, conn2) == "RESULT CHANNELS channel=0"
 		})
+		writeThenRead(t, conn2, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conn2, "SAY channel missed\n", "RECV other channel missed\n", "RESULT SAY channel 1\n")
+
+		conn3 := conns[2]
+		for i := 0; ; i++ {
+			conn3.Write([]byte("RESUME " + token + " -replay\n"))
+			line := readLine(t, conn3)
+			if line == "RESULT RESUME 1" {
+				break
+			}
+			if i == 50 {
+				t.Fatalf("Expected 'RESULT RESUME 1' but got '%s'", line)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		writeThenRead(t, conn3, "", "RESULT JOIN channel 1\n", "HISTORY channel 1 other missed\n")
+		writeThenRead(t, conn3, "SAY channel back\n", "RECV username channel back\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, conn2, "", "RECV username channel back\n")
+	})
+}
+
+func TestHelloSessions(t *testing.T) {
+	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "LOGIN username password\n", "RESULT LOGIN 1\n")
+		writeThenRead(t, conn, "HELLO sessions sessions\n", "RESULT HELLO 0\n")
+		// Logged in already, so the token comes straight away
+		writeThenRead(t, conn, "HELLO sessions\n", "RESULT HELLO 1 LOGIN SCRAM-SHA-256\n")
+		if line := readLine(t, conn); !strings.HasPrefix(line, "SESSION ") {
+			t.Fatalf("Expected a session token but got '%s'", line)
+		}
+	})
+}
+
+func TestHelloReasons(t *testing.T) {
+	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 0\n")
+		writeThenRead(t, conn, "HELLO reasons reasons\n", "RESULT HELLO 0\n")
+		writeThenRead(t, conn, "HELLO reasons\n", "RESULT HELLO 1 LOGIN SCRAM-SHA-256\n")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 0 NOT_LOGGED_IN\n")
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 0 NO_SUCH_CHANNEL\n")
+		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 0 CHANNEL_EXISTS\n")
+		writeThenRead(t, conn, "SAY channel Here is the message.\n", "RESULT SAY channel 0 NOT_JOINED\n")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 0 ALREADY_JOINED\n")
+	})
+}
+
+func TestResumeUnknownToken(t *testing.T) {
+	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeThenRead(t, conn, "RESUME nonsense\n", "RESULT RESUME 0\n")
+	})
+}
+
+func TestPresenceOnly(t *testing.T) {
+	harnessed(t, 2, func(t *testing.T, conns []net.Conn) {
+		companion := conns[0]
+		writeReasons(t, companion)
+		writeThenRead(t, companion, "REGISTER watcher password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, companion, "watcher", "password")
+		writeThenRead(t, companion, "PRESENCE\n", "RESULT PRESENCE 1\n")
+		writeThenRead(t, companion, "PING\n", "PONG\n")
+
+		conn := conns[1]
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, companion, "", "PRESENCE username 1\n")
+
+		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, companion, "JOIN channel\n", "RESULT JOIN channel 0 PRESENCE_ONLY\n")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conn, "SAY channel hey @watcher\n", "RECV username channel hey @watcher\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, companion, "", "NOTIFY channel username\n")
+
+		conn.Close()
+		writeThenRead(t, companion, "", "PRESENCE username 0\n")
+	})
+}
+
+func TestConnectionReset(t *testing.T) {
+	harnessed(t, 2, func(t *testing.T, conns []net.Conn) {
+		companion := conns[0]
+		writeThenRead(t, companion, "REGISTER watcher password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, companion, "watcher", "password")
+		writeThenRead(t, companion, "PRESENCE\n", "RESULT PRESENCE 1\n")
+
+		conn := conns[1]
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, companion, "", "PRESENCE username 1\n")
+		writeThenRead(t, conn, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+
+		// Closing without lingering resets the connection instead of ending it cleanly
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+		writeThenRead(t, companion, "", "PRESENCE username 0\n")
+		writeThenRead(t, companion, "PING\n", "PONG\n")
+
+		again, err := net.Dial("tcp", companion.RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer again.Close()
+		writeLogin(t, again, "username", "password")
+		writeThenRead(t, companion, "", "PRESENCE username 1\n")
+		writeThenRead(t, again, "JOIN channel\n", "RESULT JOIN channel 1\n")
+	})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	config := `{"idle_seconds": 1}`
+	harnessedWithConfig(t, config, 2, func(t *testing.T, conns []net.Conn) {
+		idle, busy := conns[0], conns[1]
+		writeThenRead(t, idle, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, idle, "username", "password")
+		writeThenRead(t, idle, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+
+		// Keepalives hold off the timeout for one while the other says nothing
+		for i := 0; i < 4; i++ {
+			time.Sleep(400 * time.Millisecond)
+			writeThenRead(t, busy, "PING\n", "PONG\n")
+		}
+		writeThenRead(t, idle, "", "ERROR IDLE\n")
+		idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected to be disconnected but got '%v'", err)
+		}
+
+		writeThenRead(t, busy, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, busy, "other", "password")
+		writeThenRead(t, busy, "JOIN channel\nSAY channel hello\n", "RESULT JOIN channel 1\n", "RECV other channel hello\n", "RESULT SAY channel 1\n")
+	})
+}
+
+func TestReadDeadline(t *testing.T) {
+	config := `{"read_deadline_seconds": 1}`
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		// Half a command is as good as nothing once the deadline passes
+		conns[0].Write([]byte("PIN"))
+		conns[0].SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := conns[0].Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected to be disconnected but got '%v'", err)
+		}
+	})
+}
+
+func TestWriteDeadline(t *testing.T) {
+	config := `{"write_deadline_seconds": 1, "rate_limits": {"chat": {"rate": 100000, "burst": 100000}}}`
+	harnessedWithConfig(t, config, 2, func(t *testing.T, conns []net.Conn) {
+		talker, stalled := conns[0], conns[1]
+		writeThenRead(t, talker, "REGISTER talker password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, talker, "talker", "password")
+		writeThenRead(t, talker, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, stalled, "REGISTER stalled password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, stalled, "stalled", "password")
+		writeThenRead(t, stalled, "JOIN channel\n", "RESULT JOIN channel 1\n")
+
+		// Far more than the socket buffers hold, which the stalled client never reads
+		const messages = 5000
+		done := make(chan int)
+		go func() {
+			results := 0
+			reader := bufio.NewReader(talker)
+			for results < messages {
+				talker.SetReadDeadline(time.Now().Add(10 * time.Second))
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					break
+				}
+				if strings.HasPrefix(line, "RESULT SAY") {
+					results++
+				}
+			}
+			done <- results
+		}()
+		text := strings.Repeat("x", 900)
+		for i := 0; i < messages; i++ {
+			talker.Write([]byte("SAY channel " + text + "\n"))
+		}
+		select {
+		case results := <-done:
+			if results != messages {
+				t.Fatalf("Expected %d results but got %d", messages, results)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Expected the stalled client to stop holding up the channel")
+		}
 	})
 }
-*/
+
+func TestTLSAlongsidePlain(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	tlsPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	certPath, keyPath := writeCertificate(t, "localhost", x509.ExtKeyUsageServerAuth)
+	config := fmt.Sprintf(`{"tls_cert": %q, "tls_key": %q, "tls_port": %q}`, certPath, keyPath, tlsPort)
+
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, config)
+	defer cancel()
+	server.WaitForStartup()
+
+	tlsConn, err := tls.Dial("tcp", "localhost:"+tlsPort, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer tlsConn.Close()
+	writeThenRead(t, tlsConn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+
+	plainConn, err := net.Dial("tcp", ":"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer plainConn.Close()
+	writeThenRead(t, plainConn, "CHANNELS\n", "RESULT CHANNELS channel\n")
+}
+
+func TestIRCGateway(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	ircPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	// LIST takes a page for each channel
+	go server.RunWithConfig(ctx, fmt.Sprintf(`{"irc_port": %q, "channels_page_size": 1}`, ircPort))
+	defer cancel()
+	server.WaitForStartup()
+
+	plain, err := net.Dial("tcp", ":"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer plain.Close()
+	writeReasons(t, plain)
+	writeThenRead(t, plain, "REGISTER alice password\n", "RESULT REGISTER 1\n")
+	writeThenRead(t, plain, "REGISTER bob password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, plain, "bob", "password")
+
+	irc, err := net.Dial("tcp", ":"+ircPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer irc.Close()
+	writeThenRead(t, irc, "CAP LS 302\r\n", ":brerver CAP * LS :\r\n")
+	writeThenRead(t, irc, "JOIN #general\r\n", ":brerver 451 * :You have not registered\r\n")
+	writeThenRead(t, irc, "PASS password\r\nNICK alice\r\nUSER alice 0 * :Alice\r\n",
+		":brerver 001 alice :Welcome to brerver, alice\r\n",
+		":brerver 002 alice :Your host is brerver\r\n",
+		":brerver 003 alice :This server speaks IRC through a gateway\r\n",
+		":brerver 004 alice brerver brerver o o\r\n",
+		":brerver 422 alice :MOTD File is missing\r\n")
+	writeThenRead(t, irc, "JOIN #general\r\n",
+		":alice!alice@brerver JOIN #general\r\n",
+		":brerver 353 alice = #general :alice\r\n",
+		":brerver 366 alice #general :End of /NAMES list\r\n")
+	writeThenRead(t, plain, "JOIN general\n", "RESULT JOIN general 1\n")
+
+	writeThenRead(t, irc, "PRIVMSG #general :hello  bob\r\n")
+	writeThenRead(t, plain, "", "RECV alice general hello  bob\n")
+	writeThenRead(t, plain, "SAY general hi alice\n", "RECV bob general hi alice\n", "RESULT SAY general 1\n")
+	writeThenRead(t, irc, "", ":bob!bob@brerver JOIN #general\r\n", ":bob!bob@brerver PRIVMSG #general :hi alice\r\n")
+	writeThenRead(t, irc, "PRIVMSG bob :psst\r\n", ":brerver 401 alice bob :No such nick/channel\r\n")
+
+	writeThenRead(t, plain, "CREATE random\n", "RESULT CREATE random 1\n")
+	writeThenRead(t, irc, "LIST\r\n",
+		":brerver 321 alice Channel :Users  Name\r\n",
+		":brerver 322 alice #general 2 :\r\n",
+		":brerver 322 alice #random 0 :\r\n",
+		":brerver 323 alice :End of /LIST\r\n")
+	writeThenRead(t, irc, "PART #general\r\n", ":alice!alice@brerver PART #general\r\n")
+	writeThenRead(t, irc, "PRIVMSG #general :gone\r\n", ":brerver 404 alice #general :Cannot send to channel (NOT_JOINED)\r\n")
+	writeThenRead(t, irc, "PING :token\r\n", ":brerver PONG brerver :token\r\n")
+
+	writeThenRead(t, plain, "LEAVE general\n", "RESULT LEAVE general 1\n")
+	writeThenRead(t, plain, "LEAVE general\n", "RESULT LEAVE general 0 NOT_JOINED\n")
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	wsPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, fmt.Sprintf(`{"websocket_port": %q, "websocket_origins": ["https://chat.example.com"]}`, wsPort))
+	defer cancel()
+	server.WaitForStartup()
+
+	if _, err := websocket.Dial("ws://localhost:"+wsPort+"/ws", "", "https://evil.example.com"); err == nil {
+		t.Fatalf("Expected a page from another origin to be refused")
+	}
+	allowed, err := websocket.Dial("ws://localhost:"+wsPort+"/ws", "", "https://chat.example.com")
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	allowed.Close()
+
+	ws, err := websocket.Dial("ws://localhost:"+wsPort+"/ws", "", "http://localhost:"+wsPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer ws.Close()
+	writeThenRead(t, ws, "REGISTER username password\n", "RESULT REGISTER 1\n")
+	writeThenRead(t, ws, "REGISTER other password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, ws, "username", "password")
+	writeThenRead(t, ws, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+
+	plain, err := net.Dial("tcp", ":"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer plain.Close()
+	writeLogin(t, plain, "other", "password")
+	writeThenRead(t, plain, "JOIN channel\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, ws, "SAY channel hello from a browser\n", "RECV username channel hello from a browser\n", "RESULT SAY channel 1\n")
+	writeThenRead(t, plain, "", "RECV username channel hello from a browser\n")
+}
+
+func TestGRPC(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	grpcPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	serverCtx, stopServer := context.WithCancel(context.Background())
+	// Listing takes a page for each channel
+	go server.RunWithConfig(serverCtx, fmt.Sprintf(`{"grpc_port": %q, "channels_page_size": 1}`, grpcPort))
+	defer stopServer()
+	server.WaitForStartup()
+
+	cc, err := grpc.Dial("localhost:"+grpcPort, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer cc.Close()
+	client := chatpb.NewChatClient(cc)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"username", "other"} {
+		result, err := client.Register(ctx, &chatpb.RegisterRequest{Username: name, Password: "password"})
+		if err != nil || !result.Ok {
+			t.Fatalf("Failed to register %s: %v %v", name, result, err)
+		}
+	}
+	if _, err := client.Register(ctx, &chatpb.RegisterRequest{Username: "bad name", Password: "password"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected an invalid argument, got %v", err)
+	}
+	login, err := client.Login(ctx, &chatpb.LoginRequest{Username: "username", Password: "password"})
+	if err != nil || !login.Result.Ok || login.Session == "" {
+		t.Fatalf("Failed to log in: %v %v", login, err)
+	}
+	result, err := client.Create(ctx, &chatpb.CreateRequest{Channel: "channel", Session: "nonsense"})
+	if err != nil || result.Ok || result.Reason != notLoggedIn {
+		t.Fatalf("Expected a bad session to fail, got %v %v", result, err)
+	}
+	for _, name := range []string{"channel", "another"} {
+		result, err = client.Create(ctx, &chatpb.CreateRequest{Channel: name, Session: login.Session})
+		if err != nil || !result.Ok {
+			t.Fatalf("Failed to create: %v %v", result, err)
+		}
+	}
+	list, err := client.ListChannels(ctx, &chatpb.ListChannelsRequest{})
+	if err != nil || !slices.Equal(list.Channels, []string{"another", "channel"}) {
+		t.Fatalf("Unexpected channels: %v %v", list, err)
+	}
+
+	stream, err := client.Chat(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open chat: '%s'", err.Error())
+	}
+	expect := func(kind string, args ...string) {
+		t.Helper()
+		for {
+			frame, err := stream.Recv()
+			if err != nil {
+				t.Fatalf("Failed to receive: '%s'", err.Error())
+			}
+			if frame.Type != kind || strings.Join(frame.Args, "|") != strings.Join(args, "|") {
+				t.Fatalf("Expected %s %q, got %s %q", kind, args, frame.Type, frame.Args)
+			}
+			return
+		}
+	}
+	send := func(command string, args ...string) {
+		t.Helper()
+		if err := stream.Send(&chatpb.Command{Command: command, Args: args}); err != nil {
+			t.Fatalf("Failed to send: '%s'", err.Error())
+		}
+	}
+	send("LOGIN", "other", "password")
+	expect("RESULT", "LOGIN", "1")
+	send("JOIN", "channel")
+	expect("RESULT", "JOIN", "channel", "1")
+
+	plain, err := net.Dial("tcp", ":"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer plain.Close()
+	writeThenRead(t, plain, "RESUME "+login.Session+"\n", "RESULT RESUME 1\n")
+	writeThenRead(t, plain, "JOIN channel\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, plain, "SAY channel hello over tcp\n", "RECV username channel hello over tcp\n", "RESULT SAY channel 1\n")
+	expect("RECV", "username", "channel", "hello over tcp")
+	send("SAY", "channel", "hello over grpc")
+	expect("RECV", "other", "channel", "hello over grpc")
+	expect("RESULT", "SAY", "channel", "1")
+	writeThenRead(t, plain, "", "RECV other channel hello over grpc\n")
+	stream.CloseSend()
+}
+
+func TestRESTAPI(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	httpPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, fmt.Sprintf(`{"http_port": %q}`, httpPort))
+	defer cancel()
+	server.WaitForStartup()
+
+	base := "http://localhost:" + httpPort + "/api"
+	request := func(method, path, session, body string, code int) string {
+		t.Helper()
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Bad request: '%s'", err.Error())
+		}
+		if session != "" {
+			req.Header.Set("Authorization", "Bearer "+session)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: '%s'", err.Error())
+		}
+		defer resp.Body.Close()
+		reply, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != code {
+			t.Fatalf("%s %s: expected %d, got %d %s", method, path, code, resp.StatusCode, reply)
+		}
+		return strings.TrimSpace(string(reply))
+	}
+	login := func(username, password string) string {
+		t.Helper()
+		var reply struct {
+			Session string `json:"session"`
+		}
+		body := fmt.Sprintf(`{"username": %q, "password": %q}`, username, password)
+		json.Unmarshal([]byte(request("POST", "/sessions", "", body, http.StatusCreated)), &reply)
+		return reply.Session
+	}
+
+	request("POST", "/accounts", "", `{"username": "username", "password": "password"}`, http.StatusCreated)
+	request("POST", "/accounts", "", `{"username": "username", "password": "password"}`, http.StatusBadRequest)
+	request("POST", "/accounts", "", `{"username": "bad name", "password": "password"}`, http.StatusBadRequest)
+	request("POST", "/sessions", "", `{"username": "username", "password": "wrong"}`, http.StatusUnauthorized)
+	session := login("username", "password")
+
+	conn, err := net.Dial("tcp", ":"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "HELLO members\n", "RESULT HELLO 1 LOGIN SCRAM-SHA-256\n")
+	writeThenRead(t, conn, "REGISTER other password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "other", "password")
+	writeThenRead(t, conn, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, conn, "SAY channel first\n", "RECV other channel first\n", "RESULT SAY channel 1\n")
+
+	if reply := request("GET", "/channels", "", "", http.StatusOK); reply != `["channel"]` {
+		t.Fatalf("Unexpected channels: %s", reply)
+	}
+	request("POST", "/channels/channel/messages", "", `{"text": "hi"}`, http.StatusUnauthorized)
+	request("POST", "/channels/channel/messages", "nonsense", `{"text": "hi"}`, http.StatusUnauthorized)
+	request("POST", "/channels/nowhere/messages", session, `{"text": "hi"}`, http.StatusNotFound)
+	request("POST", "/channels/channel/messages", session, `{"text": "hello from a script"}`, http.StatusNoContent)
+	// Posting doesn't join the channel, so its members see only the message
+	writeThenRead(t, conn, "", "RECV username channel hello from a script\n")
+
+	history := request("GET", "/channels/channel/history", session, "", http.StatusOK)
+	expected := `[{"seq":1,"from":"other","text":"first"},{"seq":2,"from":"username","text":"hello from a script"}]`
+	if history != expected {
+		t.Fatalf("Expected history %s, got %s", expected, history)
+	}
+	if history := request("GET", "/channels/channel/history?since=1", session, "", http.StatusOK); !strings.HasPrefix(history, `[{"seq":2,`) {
+		t.Fatalf("Unexpected history since 1: %s", history)
+	}
+	request("GET", "/channels/channel/history?since=never", session, "", http.StatusBadRequest)
+	// Reading history doesn't join the channel, so its members see nothing
+	writeThenRead(t, conn, "PING\n", "PONG\n")
+	writeThenRead(t, conn, "CREATE secret -private\n", "RESULT CREATE secret 1\n")
+	request("GET", "/channels/secret/history", session, "", http.StatusNotFound)
+	request("POST", "/channels/secret/messages", session, `{"text": "hi"}`, http.StatusNotFound)
+	request("GET", "/channels/nowhere/history", session, "", http.StatusNotFound)
+
+	request("PUT", "/account/password", session, `{"old": "password", "new": "changed"}`, http.StatusCreated)
+	request("GET", "/channels/channel/history", session, "", http.StatusUnauthorized)
+	session = login("username", "changed")
+	request("DELETE", "/account", session, `{"password": "wrong"}`, http.StatusForbidden)
+	request("DELETE", "/account", "nonsense", `{"password": "changed"}`, http.StatusUnauthorized)
+	request("DELETE", "/account", session, `{"password": "changed"}`, http.StatusNoContent)
+	request("POST", "/sessions", "", `{"username": "username", "password": "changed"}`, http.StatusUnauthorized)
+}
+
+func TestWebhook(t *testing.T) {
+	httpPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	path := filepath.Join(t.TempDir(), "moderator.star")
+	script := `
+def on_message(channel, user, text):
+    if "spam" in text:
+        mute(channel, user, 60)
+        return False
+`
+	if err := os.WriteFile(path, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf(`{"http_port": %q, "scripts": [%q], "webhooks": [{"name": "ci", "token": "s3cret", "channel": "builds", "user": "ci*"}]}`, httpPort, path)
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		hook := func(path, token, body string, code int) {
+			t.Helper()
+			req, err := http.NewRequest("POST", "http://localhost:"+httpPort+path, strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("Bad request: '%s'", err.Error())
+			}
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: '%s'", err.Error())
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != code {
+				reply, _ := io.ReadAll(resp.Body)
+				t.Fatalf("POST %s: expected %d, got %d %s", path, code, resp.StatusCode, reply)
+			}
+		}
+
+		hook("/hooks/ci", "s3cret", `{"text": "build passed"}`, http.StatusNotFound)
+		writeThenRead(t, conn, "REGISTER user password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "user", "password")
+		writeThenRead(t, conn, "CREATE builds\nJOIN builds\n", "RESULT CREATE builds 1\n", "RESULT JOIN builds 1\n")
+
+		hook("/hooks/ci", "", `{"text": "build passed"}`, http.StatusUnauthorized)
+		hook("/hooks/ci", "wrong", `{"text": "build passed"}`, http.StatusUnauthorized)
+		hook("/hooks/elsewhere", "s3cret", `{"text": "build passed"}`, http.StatusNotFound)
+		hook("/hooks/ci", "s3cret", `{"text": ""}`, http.StatusBadRequest)
+		hook("/hooks/ci", "s3cret", `{"text": "build #12 passed\nin 3m"}`, http.StatusNoContent)
+		writeThenRead(t, conn, "", "RECV ci* builds build #12 passed\n", "RECV ci* builds in 3m\n")
+		// Moderated like SAY
+		hook("/hooks/ci", "s3cret", `{"text": "buy spam"}`, http.StatusForbidden)
+		hook("/hooks/ci", "s3cret", `{"text": "build #13 passed"}`, http.StatusForbidden)
+		writeThenRead(t, conn, "PING\n", "PONG\n")
+	})
+}
+
+func TestServerSentEvents(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	httpPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, fmt.Sprintf(`{"http_port": %q}`, httpPort))
+	defer cancel()
+	server.WaitForStartup()
+
+	conn, err := net.Dial("tcp", ":"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+	writeThenRead(t, conn, "REGISTER dashboard password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "username", "password")
+	writeThenRead(t, conn, "HELLO members\n", "RESULT HELLO 1 LOGIN SCRAM-SHA-256\n")
+	writeThenRead(t, conn, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, conn, "CREATE secret -private\n", "RESULT CREATE secret 1\n")
+
+	resp, err := http.Post("http://localhost:"+httpPort+"/api/sessions", "application/json", strings.NewReader(`{"username": "dashboard", "password": "password"}`))
+	if err != nil {
+		t.Fatalf("Request failed: '%s'", err.Error())
+	}
+	var reply struct {
+		Session string `json:"session"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	resp.Body.Close()
+
+	resp, err = http.Get("http://localhost:" + httpPort + "/events/channel?token=nonsense")
+	if err != nil {
+		t.Fatalf("Request failed: '%s'", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a bad token to be refused, got %d", resp.StatusCode)
+	}
+	resp, err = http.Get("http://localhost:" + httpPort + "/events/secret?token=" + reply.Session)
+	if err != nil {
+		t.Fatalf("Request failed: '%s'", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected a private channel to be hidden, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get("http://localhost:" + httpPort + "/events/channel?token=" + reply.Session)
+	if err != nil {
+		t.Fatalf("Request failed: '%s'", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	// The stream doesn't join the channel, so its members see only the message
+	writeThenRead(t, conn, "SAY channel hello dashboard\n", "RECV username channel hello dashboard\n", "RESULT SAY channel 1\n")
+	events := bufio.NewReader(resp.Body)
+	for _, expected := range []string{"event: RECV\n", `data: {"from":"username","text":"hello dashboard"}` + "\n", "\n"} {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: '%s'", err.Error())
+		}
+		if line != expected {
+			t.Fatalf("Expected %q, got %q", expected, line)
+		}
+	}
+	// Nor do they see it leave once it's closed
+	resp.Body.Close()
+	writeThenRead(t, conn, "PING\n", "PONG\n")
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	metricsPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, fmt.Sprintf(`{"metrics_port": %q}`, metricsPort))
+	defer cancel()
+	server.WaitForStartup()
+
+	conns := make([]net.Conn, 2)
+	for i := range conns {
+		conn, err := net.Dial("tcp", ":"+plainPort)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	writeThenRead(t, conns[0], "REGISTER username password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conns[0], "username", "password")
+	writeThenRead(t, conns[0], "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, conns[0], "SAY channel hello\n", "RECV username channel hello\n", "RESULT SAY channel 1\n")
+	writeThenRead(t, conns[1], "PING\n", "PONG\n")
+
+	resp, err := http.Get("http://localhost:" + metricsPort + "/metrics")
+	if err != nil {
+		t.Fatalf("Request failed: '%s'", err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, expected := range []string{
+		"# TYPE brerver_connections gauge\nbrerver_connections 2\n",
+		"\nbrerver_users_logged_in 1\n",
+		"# TYPE brerver_send_queue_depth gauge\n",
+		"\nbrerver_send_queue_drops 0\n",
+		"# TYPE brerver_send_queue_oldest_seconds gauge\n",
+		"# TYPE brerver_messages_total counter\nbrerver_messages_total 1\n",
+		"\nbrerver_command_duration_seconds_count{command=\"SAY\"} 1\n",
+		"\nbrerver_command_duration_seconds_bucket{command=\"PING\",le=\"+Inf\"} 1\n",
+		"\nbrerver_channel_members{channel=\"channel\"} 1\n",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected '%s' in the metrics:\n%s", expected, body)
+		}
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	metricsPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	probe := func(path string, code int, body string) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		server.readyz(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != code || recorder.Body.String() != body {
+			t.Errorf("%s: expected %d %q, got %d %q", path, code, body, recorder.Code, recorder.Body.String())
+		}
+	}
+	probe("/readyz", http.StatusServiceUnavailable, "starting\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, fmt.Sprintf(`{"metrics_port": %q}`, metricsPort))
+	defer cancel()
+	server.WaitForStartup()
+
+	for path, expected := range map[string]string{"/healthz": "ok\n", "/readyz": "ready\n"} {
+		resp, err := http.Get("http://localhost:" + metricsPort + path)
+		if err != nil {
+			t.Fatalf("Request failed: '%s'", err.Error())
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != expected {
+			t.Errorf("%s: expected 200 %q, got %d %q", path, expected, resp.StatusCode, body)
+		}
+	}
+
+	server.Shutdown()
+	probe("/readyz", http.StatusServiceUnavailable, "shutting down\n")
+}
+
+func TestDebugEndpoint(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	debugPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, fmt.Sprintf(`{"debug_address": "127.0.0.1:%s"}`, debugPort))
+	defer cancel()
+	server.WaitForStartup()
+
+	conn, err := net.Dial("tcp", ":"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "PING\n", "PONG\n")
+
+	resp, err := http.Get("http://127.0.0.1:" + debugPort + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatalf("Request failed: '%s'", err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "userConnection") {
+		t.Errorf("Expected a goroutine profile showing the connection, got %d:\n%s", resp.StatusCode, body)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	t.Parallel()
+	// t.TempDir can be too long for a socket path
+	dir, err := os.MkdirTemp("", "brerver")
+	if err != nil {
+		t.Fatalf("Failed to make a directory: '%s'", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "brerver.sock")
+
+	// Left behind by a server that never got to clean up
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to make a stale socket: '%s'", err.Error())
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, fmt.Sprintf(`{"unix_socket": %q, "unix_socket_mode": "0600"}`, path))
+	defer cancel()
+	server.WaitForStartup()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Expected the socket to exist: '%s'", err.Error())
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the socket to be 0600, got %o", info.Mode().Perm())
+	}
+	if _, err := NewServer().listenUnix(path, "0600"); err == nil {
+		t.Fatalf("Expected a socket in use not to be replaced")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "username", "password")
+	writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+}
+
+func TestListenAddresses(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	tlsPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	certPath, keyPath := writeCertificate(t, "localhost", x509.ExtKeyUsageServerAuth)
+	config := fmt.Sprintf(
+		`{"listen": [{"address": "127.0.0.1:%s"}, {"address": "127.0.0.1:%s", "tls": true}], "tls_cert": %q, "tls_key": %q}`,
+		plainPort, tlsPort, certPath, keyPath,
+	)
+
+	// No port of its own, just the listen addresses
+	server := NewServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, config)
+	defer cancel()
+	server.WaitForStartup()
+
+	plainConn, err := net.Dial("tcp", "127.0.0.1:"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer plainConn.Close()
+	writeThenRead(t, plainConn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+
+	tlsConn, err := tls.Dial("tcp", "127.0.0.1:"+tlsPort, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer tlsConn.Close()
+	writeThenRead(t, tlsConn, "CHANNELS\n", "RESULT CHANNELS channel\n")
+}
+
+func TestEphemeralPort(t *testing.T) {
+	t.Parallel()
+	server := NewServer(WithPort("0"))
+	if server.Addr() != nil {
+		t.Fatalf("Expected no address before serving but got '%s'", server.Addr())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Run(ctx)
+	defer cancel()
+	server.WaitForStartup()
+
+	addr, ok := server.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("Expected the port the system chose but got '%v'", server.Addr())
+	}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+}
+
+// Connects to a server serving ln
+func dialPipe(t testing.TB, ln *PipeListener) net.Conn {
+	t.Helper()
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	return conn
+}
+
+func TestPipeListener(t *testing.T) {
+	t.Parallel()
+	ln := NewPipeListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ln.DialContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected dialing with nothing accepting to wait for the context but got '%v'", err)
+	}
+
+	server := NewServer(WithListener(ln))
+	ctx, cancel = context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		server.Run(ctx)
+		close(stopped)
+	}()
+	server.WaitForStartup()
+	conn := dialPipe(t, ln)
+	writeThenRead(t, conn, "PING\n", "PONG\n")
+	conn.Close()
+	cancel()
+	<-stopped
+
+	// Closed along with the server
+	if _, err := ln.Dial(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected dialing a closed listener to fail but got '%v'", err)
+	}
+}
+
+type testStore map[string]string
+
+func (s testStore) Authenticate(username, password string) (bool, bool, error) {
+	stored, ok := s[username]
+	return ok, ok && stored == password, nil
+}
+
+func TestOptions(t *testing.T) {
+	t.Parallel()
+	ln := NewPipeListener()
+	logs := &lockedBuffer{}
+	logger, err := NewLogger(logs, "debug", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(
+		WithListener(ln),
+		WithLogger(logger),
+		WithStore(testStore{"outsider": "secret"}),
+		WithConfig(`{"motd": "Hi"}`),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		server.Run(ctx)
+		close(stopped)
+	}()
+	server.WaitForStartup()
+	if server.Addr() != ln.Addr() {
+		t.Fatalf("Expected to be serving on the given listener but got '%v'", server.Addr())
+	}
+
+	conn := dialPipe(t, ln)
+	defer conn.Close()
+	writeThenRead(t, conn, "LOGIN outsider wrong\n", "RESULT LOGIN 0\n")
+	writeLogin(t, conn, "outsider", "secret")
+	if line := readLine(t, conn); line != "MOTD Hi" {
+		t.Fatalf("Expected the configured MOTD but got '%s'", line)
+	}
+	writeThenRead(t, conn, "BOGUS\n")
+	// The store vouched for the account, which can't be registered over it
+	conn.Write([]byte("REGISTER outsider other\n"))
+	if line := readLine(t, conn); !strings.HasPrefix(line, "RESULT REGISTER 0") {
+		t.Fatalf("Expected the store's account to be taken but got '%s'", line)
+	}
+
+	conn.Close()
+	cancel()
+	<-stopped
+	select {
+	case <-ln.closed:
+	default:
+		t.Fatal("Expected the listener to be closed once the server stopped")
+	}
+	if !strings.Contains(logs.String(), "Unknown command") {
+		t.Fatalf("Expected the server to log to the given logger but got '%s'", logs.String())
+	}
+}
+
+func TestCommandHooks(t *testing.T) {
+	t.Parallel()
+	ln := NewPipeListener()
+	var after []string
+	var afterLock sync.Mutex
+	server := NewServer(
+		WithListener(ln),
+		WithBeforeCommand(func(ctx context.Context, session *Session, command Command) error {
+			if command.Name == "SAY" && strings.Contains(command.Args[len(command.Args)-1], "rude") {
+				session.Send("NOTICE Mind your language, " + session.Username())
+				return errors.New("rude")
+			}
+			return nil
+		}),
+		WithAfterCommand(func(ctx context.Context, session *Session, command Command) error {
+			afterLock.Lock()
+			defer afterLock.Unlock()
+			after = append(after, command.Name+" "+strings.Join(command.Args, " "))
+			return nil
+		}),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Run(ctx)
+	defer cancel()
+	server.WaitForStartup()
+
+	conn := dialPipe(t, ln)
+	defer conn.Close()
+	writeReasons(t, conn)
+	writeThenRead(t, conn, "REGISTER user password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "user", "password")
+	writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+	writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, conn, "SAY channel something rude\n", "NOTICE Mind your language, user\n", "RESULT SAY 0 REJECTED\n")
+	writeThenRead(t, conn, "SAY channel something nice\n", "RECV user channel something nice\n", "RESULT SAY channel 1\n")
+
+	afterLock.Lock()
+	defer afterLock.Unlock()
+	expected := []string{"HELLO reasons", "REGISTER user password", "LOGIN user password", "CREATE channel", "JOIN channel", "SAY channel something nice"}
+	if !slices.Equal(after, expected) {
+		t.Fatalf("Expected the hook after commands to see %q but got %q", expected, after)
+	}
+}
+
+func TestCustomCommands(t *testing.T) {
+	t.Parallel()
+	plugin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Command string
+			User    string
+			Args    []string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Command != "ROLL" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if len(body.Args) == 0 {
+			http.Error(w, "nothing to roll", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "RESULT ROLL 1\nROLLED %s %s 4\n", body.User, body.Args[0])
+	}))
+	defer plugin.Close()
+
+	ln := NewPipeListener()
+	server := NewServer(WithListener(ln), WithConfig(fmt.Sprintf(`{"command_plugins": [{"command": "ROLL", "url": %q}]}`, plugin.URL)))
+	echo := func(ctx context.Context, session *Session, command Command) {
+		session.Send("RESULT ECHO 1 " + strings.Join(command.Args, " "))
+	}
+	if err := server.RegisterCommand("ECHO", echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RegisterCommand("ECHO", echo); err == nil {
+		t.Fatal("Expected registering a command twice to fail")
+	}
+	if err := server.RegisterCommand("SAY", echo); err == nil {
+		t.Fatal("Expected registering a built in command to fail")
+	}
+	if err := server.RegisterCommand("echo", echo); err == nil {
+		t.Fatal("Expected registering a lower case command to fail")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Run(ctx)
+	defer cancel()
+	server.WaitForStartup()
+
+	conn := dialPipe(t, ln)
+	defer conn.Close()
+	writeReasons(t, conn)
+	writeThenRead(t, conn, "ECHO hello there world\n", "RESULT ECHO 1 hello there world\n")
+	writeThenRead(t, conn, "REGISTER user password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "user", "password")
+	writeThenRead(t, conn, "ROLL 1d6\n", "RESULT ROLL 1\n", "ROLLED user 1d6 4\n")
+	writeThenRead(t, conn, "ROLL\n", "RESULT ROLL 0 UNAVAILABLE\n")
+
+	// Gone again, so unknown like any other
+	server.UnregisterCommand("ECHO")
+	writeThenRead(t, conn, "ECHO hello\nPING\n", "PONG\n")
+}
+
+func TestProxyProtocol(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, `{"proxy_protocol": ["127.0.0.1"], "bans": ["203.0.113.7"], "max_connections_per_ip": 1}`)
+	defer cancel()
+	server.WaitForStartup()
+
+	dial := func(header []byte) net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", "127.0.0.1:"+plainPort)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		if _, err := conn.Write(header); err != nil {
+			t.Fatalf("Failed to write header: '%s'", err.Error())
+		}
+		return conn
+	}
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"), 198, 51, 100, 2, 127, 0, 0, 1, 0x13, 0x88, 0x1b, 0x58)
+
+	first := dial([]byte("PROXY TCP4 198.51.100.1 127.0.0.1 5000 7000\r\n"))
+	defer first.Close()
+	writeThenRead(t, first, "CREATE a\n", "RESULT CREATE a 1\n")
+	// A different client behind the same balancer has a limit of its own
+	second := dial(v2)
+	defer second.Close()
+	writeThenRead(t, second, "CREATE b\n", "RESULT CREATE b 1\n")
+	again := dial([]byte("PROXY TCP4 198.51.100.1 127.0.0.1 5001 7000\r\n"))
+	defer again.Close()
+	writeThenRead(t, again, "", "ERROR TOOMANY\n")
+
+	for _, header := range []string{"PROXY TCP4 203.0.113.7 127.0.0.1 5000 7000\r\n", "CHANNELS\n"} {
+		refused := dial([]byte(header))
+		defer refused.Close()
+		refused.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, err := refused.Read(make([]byte, 64)); err != io.EOF {
+			t.Fatalf("Expected %q to be hung up on, got %d bytes and %v", header, n, err)
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		server.RunWithConfig(ctx, `{"shutdown_seconds": 5}`)
+		close(stopped)
+	}()
+	server.WaitForStartup()
+
+	conns := make([]net.Conn, 2)
+	for i := range conns {
+		conn, err := net.Dial("tcp", ":"+plainPort)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	writeThenRead(t, conns[0], "REGISTER username password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conns[0], "username", "password")
+	writeThenRead(t, conns[0], "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, conns[1], "CHANNELS\n", "RESULT CHANNELS channel\n")
+
+	cancel()
+	for _, conn := range conns {
+		writeThenRead(t, conn, "", "SHUTDOWN\n")
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, err := conn.Read(make([]byte, 64)); err != io.EOF {
+			t.Fatalf("Expected the connection to be closed, got %d bytes and %v", n, err)
+		}
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the server to finish shutting down")
+	}
+	if _, err := net.Dial("tcp", ":"+plainPort); err == nil {
+		t.Fatalf("Expected new connections to be refused")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Error listening: '%s'", err.Error())
+	}
+	defer ln.Close()
+	taken := fmt.Sprintf("%d", ln.Addr().(*net.TCPAddr).Port)
+	if err := NewServer(WithPort(taken)).Run(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to start TCP server") {
+		t.Fatalf("Expected listening on a taken port to fail, got %v", err)
+	}
+	failed := NewServer()
+	if err := failed.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "nothing to listen on") {
+		t.Fatalf("Expected having nothing to listen on to fail, got %v", err)
+	}
+	// Doesn't wait for a startup that never comes
+	failed.WaitForStartup()
+	// Whatever was listened on before the failure is closed again
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	config := fmt.Sprintf(`{"metrics_port": %q}`, taken)
+	if err := NewServer(WithPort(plainPort)).RunWithConfig(context.Background(), config); err == nil {
+		t.Fatalf("Expected listening for metrics on a taken port to fail")
+	}
+	if conn, err := net.Dial("tcp", ":"+plainPort); err == nil {
+		conn.Close()
+		t.Fatalf("Expected the plain port to be closed after failing to start")
+	}
+
+	// Cancelling the context stops the server
+	plainPort = fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- server.Run(ctx) }()
+	server.WaitForStartup()
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Expected stopping to return no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected cancelling the context to stop the server")
+	}
+}
+
+func TestConnectionContext(t *testing.T) {
+	t.Parallel()
+	conn, pipe := net.Pipe()
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		userConnection(ctx, NewServer(), pipe)
+		close(done)
+	}()
+	writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected cancelling the context to end the connection")
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(make([]byte, 64)); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %d bytes and %v", n, err)
+	}
+}
+
+func TestHandover(t *testing.T) {
+	t.Parallel()
+	oldPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	old := NewServer(WithPort(oldPort))
+	oldCtx, cancelOld := context.WithCancel(context.Background())
+	go old.RunWithConfig(oldCtx, "")
+	defer cancelOld()
+	old.WaitForStartup()
+
+	conn, err := net.Dial("tcp", ":"+oldPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "REGISTER username password\nREGISTER other password\n", "RESULT REGISTER 1\n", "RESULT REGISTER 1\n")
+	token := writeSessionLogin(t, conn, "username", "password")
+	writeThenRead(t, conn, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, conn, "SAY channel before\n", "RECV username channel before\n", "RESULT SAY channel 1\n")
+
+	// Goes through JSON as it would between processes
+	var state handoverState
+	encoded, err := json.Marshal(old.handoverState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, &state); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new process listens on a socket that's already bound, as it would be when
+	// handed over
+	newPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	ln, err := net.Listen("tcp", ":"+newPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(WithPort(newPort))
+	server.inherited["tcp :"+newPort] = ln
+	server.restoreHandover(state)
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, "")
+	defer cancel()
+	server.WaitForStartup()
+
+	resumed, err := net.Dial("tcp", ":"+newPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer resumed.Close()
+	writeThenRead(t, resumed, "RESUME "+token+" -replay\n", "RESULT RESUME 1\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, resumed, "SAY channel after\n", "RECV username channel after\n", "RESULT SAY channel 1\n")
+
+	other, err := net.Dial("tcp", ":"+newPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer other.Close()
+	writeLogin(t, other, "other", "password")
+	writeThenRead(t, other, "JOIN channel -since 0\n", "RESULT JOIN channel 1\n", "HISTORY channel 1 username before\n", "HISTORY channel 2 username after\n")
+}
+
+// Links conn to the server at its other end as the server called name, checking that the
+// other end proves it's peer with the same secret
+func writeLink(t *testing.T, conn net.Conn, name, secret, peer string) {
+	t.Helper()
+	conn.Write([]byte("SERVER " + name + " nonce\n"))
+	line := readLine(t, conn)
+	fields := strings.Split(line, " ")
+	if len(fields) != 4 || fields[0] != "SERVER" || fields[1] != peer || !validProof(fields[3], secret, "acceptor", "nonce", fields[2], name, peer) {
+		t.Fatalf("Expected %s to prove it has the secret but got '%s'", peer, line)
+	}
+	conn.Write([]byte("PROOF " + linkProof(secret, "dialer", "nonce", fields[2], name, peer) + "\n"))
+}
+
+func TestLinkProofReflection(t *testing.T) {
+	t.Parallel()
+	// Two servers sharing a federation_secret that haven't linked to each other
+	var federationPorts []string
+	for _, name := range []string{"a", "b"} {
+		federationPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+		server := NewServer(WithPort(fmt.Sprintf("%d", atomic.AddUint32(&port, 1))))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go server.RunWithConfig(ctx, fmt.Sprintf(`{"server_name": %q, "federation_port": %q, "federation_secret": "mesh"}`, name, federationPort))
+		server.WaitForStartup()
+		federationPorts = append(federationPorts, federationPort)
+	}
+
+	// Dialing a as b, and then b as a with a's nonce to have b answer a's challenge
+	toA, err := net.Dial("tcp", ":"+federationPorts[0])
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer toA.Close()
+	toA.Write([]byte("SERVER b nonce\n"))
+	fields := strings.Split(readLine(t, toA), " ")
+	if len(fields) != 4 {
+		t.Fatalf("Expected a to answer SERVER a <nonce> <proof> but got %q", fields)
+	}
+	toB, err := net.Dial("tcp", ":"+federationPorts[1])
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer toB.Close()
+	toB.Write([]byte("SERVER a " + fields[2] + "\n"))
+	reflected := strings.Split(readLine(t, toB), " ")
+	if len(reflected) != 4 {
+		t.Fatalf("Expected b to answer SERVER b <nonce> <proof> but got %q", reflected)
+	}
+
+	// b's proof as acceptor doesn't pass for b's proof as dialer
+	writeThenRead(t, toA, "PROOF "+reflected[3]+"\n", "ERROR LINK\n")
+}
+
+func TestFederationLink(t *testing.T) {
+	t.Parallel()
+	servers, _ := federated(t, "", "a", "b", "c")
+	servers[0].serversLock.RLock()
+	links := len(servers[0].servers)
+	servers[0].serversLock.RUnlock()
+	if links != 2 {
+		t.Fatalf("Expected a to have one link to each other server, got %d", links)
+	}
+
+	// Anything that isn't a peer with its secret is refused
+	aPort := strings.TrimPrefix(servers[1].settings().Peers[0].Address, "127.0.0.1:")
+	for _, line := range []string{"LOGIN username password\n", "SERVER d nonce\n", "SERVER b nonce\nPROOF wrong\n"} {
+		conn, err := net.Dial("tcp", ":"+aPort)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		conn.Write([]byte(line))
+		response := readLine(t, conn)
+		if strings.HasPrefix(response, "SERVER a ") {
+			response = readLine(t, conn)
+		}
+		if response != "ERROR LINK" {
+			t.Fatalf("Expected 'ERROR LINK' but got '%s'", response)
+		}
+	}
+
+	// A peer that goes away is dialed again until it's back
+	federationPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	config := fmt.Sprintf(`{"server_name": "d", "peers": [{"name": "e", "address": "127.0.0.1:%s", "secret": "secret"}]}`, federationPort)
+	d := NewServer(WithPort(fmt.Sprintf("%d", atomic.AddUint32(&port, 1))))
+	dCtx, stopD := context.WithCancel(context.Background())
+	go d.RunWithConfig(dCtx, config)
+	defer stopD()
+	d.WaitForStartup()
+	time.Sleep(2 * linkRetryMin)
+
+	config = fmt.Sprintf(`{"server_name": "e", "federation_port": %q, "peers": [{"name": "d", "secret": "secret"}]}`, federationPort)
+	e := NewServer(WithPort(fmt.Sprintf("%d", atomic.AddUint32(&port, 1))))
+	eCtx, stopE := context.WithCancel(context.Background())
+	go e.RunWithConfig(eCtx, config)
+	e.WaitForStartup()
+	eventually(t, "d to link to e once it starts", func() bool { return d.linked("e") && e.linked("d") })
+	stopE()
+	eventually(t, "d to notice e stopping", func() bool { return !d.linked("e") })
+
+	e = NewServer(WithPort(fmt.Sprintf("%d", atomic.AddUint32(&port, 1))))
+	eCtx, stopE = context.WithCancel(context.Background())
+	go e.RunWithConfig(eCtx, config)
+	defer stopE()
+	e.WaitForStartup()
+	eventually(t, "d to link to e again", func() bool { return d.linked("e") && e.linked("d") })
+}
+
+func TestFederationRelay(t *testing.T) {
+	t.Parallel()
+	_, ports := federated(t, "", "a", "b", "c")
+	conns := make([]net.Conn, len(ports))
+	for i, p := range ports {
+		conn, err := net.Dial("tcp", ":"+p)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+		name := fmt.Sprintf("user%d", i)
+		writeThenRead(t, conn, "REGISTER "+name+" password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, name, "password")
+	}
+	// c has no channel by that name, so nobody there hears it
+	for _, conn := range conns[:2] {
+		writeThenRead(t, conn, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+	}
+	writeThenRead(t, conns[2], "CREATE other\nJOIN other\n", "RESULT CREATE other 1\n", "RESULT JOIN other 1\n")
+
+	writeThenRead(t, conns[0], "SAY channel hello there\n", "RECV user0 channel hello there\n", "RESULT SAY channel 1\n")
+	writeThenRead(t, conns[1], "", "RECV user0 channel hello there\n")
+	writeThenRead(t, conns[1], "SAYB channel aGk=\n", "RECVB user1 channel aGk=\n", "RESULT SAYB channel 1\n")
+	writeThenRead(t, conns[0], "", "RECVB user1 channel aGk=\n")
+	writeThenRead(t, conns[2], "SAY other nobody else\n", "RECV user2 other nobody else\n", "RESULT SAY other 1\n")
+	// Nothing from other reached a, whose next line answers this
+	writeThenRead(t, conns[0], "PING\n", "PONG\n")
+}
+
+func TestFederationPrivate(t *testing.T) {
+	t.Parallel()
+	servers, ports := federated(t, "", "a", "b")
+	conns := make([]net.Conn, 3)
+	for i, p := range []string{ports[0], ports[1], ports[0]} {
+		conn, err := net.Dial("tcp", ":"+p)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+		name := fmt.Sprintf("user%d", i)
+		writeReasons(t, conn)
+		writeThenRead(t, conn, "REGISTER "+name+" password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, name, "password")
+	}
+	inside, elsewhere, outsider := conns[0], conns[1], conns[2]
+	// Private on a, public on b, and a channel on both to tell when the links have caught up
+	writeThenRead(t, inside, "CREATE secret -private\nJOIN secret\n", "RESULT CREATE secret 1\n", "RESULT JOIN secret 1\n")
+	writeThenRead(t, elsewhere, "CREATE secret\nJOIN secret\n", "RESULT CREATE secret 1\n", "RESULT JOIN secret 1\n")
+	for _, conn := range conns[:2] {
+		writeThenRead(t, conn, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+	}
+	eventually(t, "a and b to hear of the joins", func() bool {
+		return servers[0].remoteMember("channel", "user1") && servers[1].remoteMember("channel", "user0")
+	})
+
+	// Neither the messages nor the members of the private channel leave a
+	if servers[1].remoteMember("secret", "user0") {
+		t.Fatal("Expected b not to know who is in a's private channel")
+	}
+	writeThenRead(t, elsewhere, "WHO secret\n", "RESULT WHO secret 1 user1\n")
+	writeThenRead(t, inside, "SAY secret hush\n", "RECV user0 secret hush\n", "RESULT SAY secret 1\n")
+	writeThenRead(t, inside, "SAY channel after\n", "RECV user0 channel after\n", "RESULT SAY channel 1\n")
+	writeThenRead(t, elsewhere, "", "RECV user0 channel after\n")
+
+	// Nor do those of the public one get in
+	writeThenRead(t, elsewhere, "SAY secret hello\n", "RECV user1 secret hello\n", "RESULT SAY secret 1\n")
+	writeThenRead(t, elsewhere, "SAY channel after\n", "RECV user1 channel after\n", "RESULT SAY channel 1\n")
+	writeThenRead(t, inside, "", "RECV user1 channel after\n")
+
+	// WHO here leaves out those in b's channel, which isn't this one
+	if !servers[0].remoteMember("secret", "user1") {
+		t.Fatal("Expected a to know who is in b's public channel")
+	}
+	writeThenRead(t, outsider, "WHO secret\n", "RESULT WHO secret 0 NO_SUCH_CHANNEL\n")
+	writeThenRead(t, inside, "WHO secret\n", "RESULT WHO secret 1 user0\n")
+}
+
+func TestRemotePresence(t *testing.T) {
+	t.Parallel()
+	servers, ports := federated(t, "", "a", "b")
+	watcher, err := net.Dial("tcp", ":"+ports[1])
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer watcher.Close()
+	writeReasons(t, watcher)
+	writeThenRead(t, watcher, "REGISTER user1 password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, watcher, "user1", "password")
+	writeThenRead(t, watcher, "PRESENCE\n", "RESULT PRESENCE 1\n")
+
+	conn, err := net.Dial("tcp", ":"+ports[0])
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	writeThenRead(t, conn, "REGISTER user0 password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "user0", "password")
+	writeThenRead(t, watcher, "", "PRESENCE user0 1\n")
+
+	// b has no such channel, but knows who is in it on a
+	writeThenRead(t, conn, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+	eventually(t, "b to hear of the join", func() bool { return servers[1].remoteMember("channel", "user0") })
+	writeThenRead(t, watcher, "WHO channel\n", "RESULT WHO channel 1 user0@a\n")
+	writeThenRead(t, watcher, "WHO other\n", "RESULT WHO other 0 NO_SUCH_CHANNEL\n")
+
+	writeThenRead(t, conn, "SAY channel hi @user1\n", "RECV user0 channel hi @user1\n", "RESULT SAY channel 1\n")
+	writeThenRead(t, watcher, "", "NOTIFY channel user0\n")
+
+	conn.Close()
+	writeThenRead(t, watcher, "", "PRESENCE user0 0\n")
+	eventually(t, "b to hear of the leave", func() bool { return !servers[1].remoteMember("channel", "user0") })
+}
+
+func TestNetsplit(t *testing.T) {
+	t.Parallel()
+	servers, ports := federated(t, `{"federation_ping_seconds": 1}`, "a", "b")
+	conns := make([]net.Conn, len(ports))
+	for i, p := range ports {
+		conn, err := net.Dial("tcp", ":"+p)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+		name := fmt.Sprintf("user%d", i)
+		writeThenRead(t, conn, "REGISTER "+name+" password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, name, "password")
+		writeThenRead(t, conn, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+	}
+	members := func(s *Server, peer string) map[string]bool {
+		s.serversLock.RLock()
+		defer s.serversLock.RUnlock()
+		return copyMap(s.peers[peer].members["channel"])
+	}
+	eventually(t, "each server to know the other's members", func() bool {
+		return members(servers[0], "b")["user1"] && members(servers[1], "a")["user0"]
+	})
+
+	// Both ends notice the link dropping, and say what a missed once it's back
+	servers[0].serversLock.RLock()
+	servers[0].servers["b"].conn.Close()
+	servers[0].serversLock.RUnlock()
+	writeThenRead(t, conns[0], "", "SPLIT b channel\n")
+	writeThenRead(t, conns[1], "", "SPLIT a channel\n")
+	writeThenRead(t, conns[1], "SAY channel while split\n", "RECV user1 channel while split\n", "RESULT SAY channel 1\n")
+	if !members(servers[0], "b")["user1"] {
+		t.Fatalf("Expected the split server's members to be kept")
+	}
+	got := map[string]bool{readLine(t, conns[0]): true, readLine(t, conns[0]): true}
+	if !got["UNSPLIT b channel"] || !got["RECV user1 channel while split"] {
+		t.Fatalf("Expected to hear what was said during the split and that it's over, got %v", got)
+	}
+	readLine(t, conns[1])
+	writeThenRead(t, conns[0], "PING\n", "PONG\n")
+
+	// A peer that stops answering pings is split off
+	federationPort := strings.TrimPrefix(servers[1].settings().Peers[0].Address, "127.0.0.1:")
+	servers[0].configLock.Lock()
+	servers[0].config.Peers = append(servers[0].config.Peers, PeerConfig{Name: "silent", Secret: "secret"})
+	servers[0].configLock.Unlock()
+	silent, err := net.Dial("tcp", ":"+federationPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer silent.Close()
+	writeLink(t, silent, "silent", "secret", "a")
+	eventually(t, "the silent server to be linked", func() bool { return servers[0].linked("silent") })
+	deadline := time.Now().Add(10 * time.Second)
+	for servers[0].linked("silent") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a server that doesn't answer pings to be dropped")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestRelayDedup(t *testing.T) {
+	t.Parallel()
+	federationPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunWithConfig(ctx, fmt.Sprintf(`{"server_name": "a", "federation_port": %q, "federation_secret": "mesh"}`, federationPort))
+	server.WaitForStartup()
+
+	conn, err := net.Dial("tcp", ":"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "username", "password")
+	writeThenRead(t, conn, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+
+	peer, err := net.Dial("tcp", ":"+federationPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer peer.Close()
+	writeLink(t, peer, "b", "mesh", "a")
+	eventually(t, "b to be linked", func() bool { return server.linked("b") })
+
+	// Once directly, again directly, again routed, and then b after starting again
+	peer.Write([]byte("SAY b:1:1 channel other hello\nSAY b:1:1 channel other hello\n" +
+		"ROUTE SAY b:1:1 channel other hello\nSAY b:2:1 channel other restarted\n"))
+	writeThenRead(t, conn, "", "RECV other channel hello\n")
+	writeThenRead(t, conn, "", "RECV other channel restarted\n")
+	// A backlog from before b started again, mixed with what it said since
+	peer.Write([]byte("SAY b:1:1 channel other hello\nSAY b:1:2 channel other late\n" +
+		"SAY b:2:1 channel other restarted\nSAY b:1:1 channel other hello\n"))
+	writeThenRead(t, conn, "", "RECV other channel late\n")
+	writeThenRead(t, conn, "PING\n", "PONG\n")
+}
+
+func TestFederationGossip(t *testing.T) {
+	t.Parallel()
+	start := func(name, secret, peer string) (*Server, string) {
+		federationPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+		config := fmt.Sprintf(`{"server_name": %q, "federation_port": %q, "federation_address": "127.0.0.1:%s", "federation_secret": %q}`,
+			name, federationPort, federationPort, secret)
+		if peer != "" {
+			config = strings.TrimSuffix(config, "}") + fmt.Sprintf(`, "peers": [{"name": "a", "address": %q, "secret": %q}]}`, peer, secret)
+		}
+		server := NewServer(WithPort(fmt.Sprintf("%d", atomic.AddUint32(&port, 1))))
+		ctx, cancel := context.WithCancel(context.Background())
+		go server.RunWithConfig(ctx, config)
+		t.Cleanup(cancel)
+		server.WaitForStartup()
+		return server, "127.0.0.1:" + federationPort
+	}
+
+	// b and c only know of a, which tells each about the other
+	a, aAddress := start("a", "mesh", "")
+	b, _ := start("b", "mesh", aAddress)
+	eventually(t, "b to link to a", func() bool { return a.linked("b") && b.linked("a") })
+	c, _ := start("c", "mesh", aAddress)
+	eventually(t, "b and c to link through gossip", func() bool { return b.linked("c") && c.linked("b") })
+
+	// Without the mesh's secret there's no joining it
+	d, _ := start("d", "wrong", aAddress)
+	time.Sleep(2 * linkRetryMin)
+	if a.linked("d") || d.linked("a") || b.linked("d") {
+		t.Fatal("Expected a server without the federation_secret not to link")
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	t.Parallel()
+	before := newHashRing([]string{"a", "b", "c"})
+	after := newHashRing([]string{"a", "b", "c", "d"})
+	homes := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		channelName := fmt.Sprintf("channel%d", i)
+		home := after.owner(channelName)
+		homes[home]++
+		// Adding a server only moves channels to it
+		if old := before.owner(channelName); old != home && home != "d" {
+			t.Fatalf("Expected %s to stay on %s or move to d, it moved to %s", channelName, old, home)
+		}
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if homes[name] < 100 {
+			t.Fatalf("Expected channels to spread between servers, got %v", homes)
+		}
+	}
+}
+
+func TestFederationSharding(t *testing.T) {
+	t.Parallel()
+	servers, ports := federated(t, `{"federation_sharding": true}`, "a", "b", "c")
+	// A channel homed on b, where nobody is in it
+	channelName := ""
+	for i := 0; channelName == ""; i++ {
+		if name := fmt.Sprintf("channel%d", i); servers[0].home(name) == "b" {
+			channelName = name
+		}
+	}
+	for _, server := range servers {
+		if home := server.home(channelName); home != "b" {
+			t.Fatalf("Expected every server to make b the home, got %s", home)
+		}
+	}
+
+	var conns []net.Conn
+	for i, p := range []string{ports[0], ports[2]} {
+		conn, err := net.Dial("tcp", ":"+p)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		name := fmt.Sprintf("user%d", i)
+		writeThenRead(t, conn, "REGISTER "+name+" password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, name, "password")
+		writeThenRead(t, conn, "CREATE "+channelName+"\nJOIN "+channelName+"\n",
+			"RESULT CREATE "+channelName+" 1\n", "RESULT JOIN "+channelName+" 1\n")
+	}
+	members := func(s *Server, peer string) int {
+		s.serversLock.RLock()
+		defer s.serversLock.RUnlock()
+		return len(s.peers[peer].members[channelName])
+	}
+	eventually(t, "the home to hear of both members", func() bool {
+		return members(servers[1], "a") == 1 && members(servers[1], "c") == 1
+	})
+
+	writeThenRead(t, conns[0], "SAY "+channelName+" through b\n", "RECV user0 "+channelName+" through b\n", "RESULT SAY "+channelName+" 1\n")
+	writeThenRead(t, conns[1], "", "RECV user0 "+channelName+" through b\n")
+	writeThenRead(t, conns[1], "SAY "+channelName+" and back\n", "RECV user1 "+channelName+" and back\n", "RESULT SAY "+channelName+" 1\n")
+	writeThenRead(t, conns[0], "", "RECV user1 "+channelName+" and back\n")
+	// Each heard the other once, so their next lines answer these
+	writeThenRead(t, conns[0], "PING\n", "PONG\n")
+	writeThenRead(t, conns[1], "PING\n", "PONG\n")
+}
+
+func TestSocketActivation(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	extraPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(plainPort))
+	// Bound already, as systemd's sockets would be, so listening again would fail
+	for _, p := range []string{plainPort, extraPort} {
+		ln, err := net.Listen("tcp", ":"+p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.activate(ln)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, "")
+	defer cancel()
+	server.WaitForStartup()
+
+	for _, p := range []string{plainPort, extraPort} {
+		conn, err := net.Dial("tcp", ":"+p)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		writeThenRead(t, conn, "PING\n", "PONG\n")
+	}
+}
+
+func TestSignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no SIGHUP or SIGTERM to send")
+	}
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	config := `{"admins": ["root"]}`
+	server := NewServer(WithPort(plainPort), WithConfigLoader(func() (string, error) { return config, nil }))
+	stopped := make(chan struct{})
+	go func() {
+		server.RunWithConfig(context.Background(), "")
+		close(stopped)
+	}()
+	server.WaitForStartup()
+	stop := server.HandleSignals()
+	defer stop()
+
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("Failed to find this process: '%s'", err.Error())
+	}
+	self.Signal(syscall.SIGHUP)
+	for start := time.Now(); len(server.settings().Admins) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("Expected SIGHUP to reload the configuration")
+		}
+	}
+
+	self.Signal(syscall.SIGTERM)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected SIGTERM to shut the server down")
+	}
+}
+
+func TestReloadWhileConnected(t *testing.T) {
+	t.Parallel()
+	p := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	var config atomic.Value
+	config.Store(`{"admins": ["admin"]}`)
+	server := NewServer(WithPort(p), WithConfigLoader(func() (string, error) { return config.Load().(string), nil }))
+	go server.RunWithConfig(ctx, config.Load().(string))
+	defer cancel()
+	server.WaitForStartup()
+
+	conns := make([]net.Conn, 2)
+	for i := range conns {
+		conn, err := net.Dial("tcp", ":"+p)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	admin, other := conns[0], conns[1]
+	writeThenRead(t, admin, "REGISTER admin password\n", "RESULT REGISTER 1\n")
+	writeThenRead(t, admin, "REGISTER other password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, admin, "admin", "password")
+	writeThenRead(t, admin, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+
+	config.Store(`{"admins": ["admin"], "motd": "Welcome\nBe nice", "rate_limits": {"chat": {"rate": 0.01, "burst": 2}}}`)
+	writeThenRead(t, admin, "ADMIN RELOAD\n", "RESULT ADMIN RELOAD 1\n")
+
+	// Nobody was disconnected, and new logins and commands go by the new configuration
+	writeReasons(t, other)
+	writeThenRead(t, other, "LOGIN other password\n", "RESULT LOGIN 1\n")
+	writeThenRead(t, other, "", "MOTD Welcome\n", "MOTD Be nice\n")
+	writeThenRead(t, other, "JOIN channel\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, other, "SAY channel hello\n", "RECV other channel hello\n", "RESULT SAY channel 1\n")
+	writeThenRead(t, admin, "", "RECV other channel hello\n")
+	writeThenRead(t, other, "SAY channel again\n", "RESULT SAY channel 0 RATE_LIMITED\n")
+}
+
+func TestRateLimitedEcho(t *testing.T) {
+	harnessedWithConfig(t, `{"rate_limits": {"chat": {"rate": 0.01, "burst": 1}}}`, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeReasons(t, conn)
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+
+		// Refusals repeat what the command's RESULT would have
+		writeThenRead(t, conn, "CREATE other -private\n", "RESULT CREATE other 0 RATE_LIMITED\n")
+		writeThenRead(t, conn, "LEAVE channel\n", "RESULT LEAVE channel 0 RATE_LIMITED\n")
+		writeThenRead(t, conn, "REACT channel 1 :shipit:\n", "RESULT REACT channel 1 0 RATE_LIMITED\n")
+		writeThenRead(t, conn, "NOTIFYPOLICY channel DEFAULT all\n", "RESULT NOTIFYPOLICY channel DEFAULT all 0 RATE_LIMITED\n")
+		writeThenRead(t, conn, "E2E channel\n", "RESULT E2E channel 0 RATE_LIMITED\n")
+	})
+}
+
+func TestClientCertificateLogin(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	tlsPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	certPath, keyPath := writeCertificate(t, "localhost", x509.ExtKeyUsageServerAuth)
+	clientCertPath, clientKeyPath := writeCertificate(t, "username", x509.ExtKeyUsageClientAuth)
+	config := fmt.Sprintf(
+		`{"tls_cert": %q, "tls_key": %q, "tls_port": %q, "tls_client_ca": %q, "tls_client_login": true}`,
+		certPath, keyPath, tlsPort, clientCertPath,
+	)
+
+	server := NewServer(WithPort(plainPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, config)
+	defer cancel()
+	server.WaitForStartup()
+
+	plainConn, err := net.Dial("tcp", ":"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer plainConn.Close()
+	writeThenRead(t, plainConn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+
+	anonymous, err := tls.Dial("tcp", "localhost:"+tlsPort, &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		anonymous.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err = anonymous.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Expected a connection without a client certificate to be rejected")
+		}
+		anonymous.Close()
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn, err := tls.Dial("tcp", "localhost:"+tlsPort, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer tlsConn.Close()
+	writeThenRead(t, tlsConn, "", "RESULT LOGIN 1\n")
+	writeThenRead(t, tlsConn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+	writeThenRead(t, tlsConn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+}
+
+func TestExport(t *testing.T) {
+	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conn, "EXPORT channel 1 3\n", "RESULT EXPORT channel 0\n")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		for _, m := range []string{"one", "two", "three"} {
+			writeThenRead(t, conn, "SAY channel "+m+"\n", "RECV username channel "+m+"\n", "RESULT SAY channel 1\n")
+		}
+
+		writeThenRead(t, conn, "EXPORT channel 2 3\n", "RESULT EXPORT channel 1\n")
+		fields := strings.Fields(readLine(t, conn))
+		if len(fields) != 4 || fields[0] != "EXPORT" || fields[3] != "2" {
+			t.Fatalf("Expected an export of 2 messages but got '%s'", strings.Join(fields, " "))
+		}
+		token := fields[2]
+		writeThenRead(t, conn, "EXPORT channel 1 3\n", "RESULT EXPORT channel 0\n")
+
+		writeThenRead(t, conn, "DOWNLOAD "+token+"\n",
+			"RESULT DOWNLOAD "+token+" 1\n",
+			"HISTORY channel 2 username two\n",
+			"HISTORY channel 3 username three\n",
+		)
+		writeThenRead(t, conn, "DOWNLOAD nonsense\n", "RESULT DOWNLOAD nonsense 0\n")
+	})
+}
+
+func TestQueueStats(t *testing.T) {
+	t.Parallel()
+	p := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Run(ctx)
+	defer cancel()
+	server.WaitForStartup()
+
+	conn, err := net.Dial("tcp", ":"+p)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+
+	total, connections := server.QueueStats()
+	if len(connections) != 1 || connections[0].RemoteAddr != conn.LocalAddr().String() {
+		t.Fatalf("Expected stats for just '%s' but got %v", conn.LocalAddr(), connections)
+	}
+	if total.Depth != 0 || total.Drops != 0 || total.OldestPending != 0 {
+		t.Fatalf("Expected an empty queue but got %+v", total)
+	}
+}
+
+func TestShardedMap(t *testing.T) {
+	t.Parallel()
+	m := newShardedMap[int]()
+	// Only one of many adding the same name at once gets it
+	var added atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if m.add("contested", i) {
+				added.Add(1)
+			}
+			m.set(fmt.Sprintf("name%d", i), i)
+		}(i)
+	}
+	wg.Wait()
+	if added.Load() != 1 || m.len() != 51 {
+		t.Fatalf("Expected one add to win and 51 entries, got %d and %d", added.Load(), m.len())
+	}
+
+	m.update("name1", func(v int, ok bool) (int, bool) { return v + 100, ok })
+	m.update("name2", func(v int, ok bool) (int, bool) { return v, false })
+	if v, _ := m.get("name1"); v != 101 {
+		t.Fatalf("Expected the update to apply, got %d", v)
+	}
+	if _, ok := m.remove("name2"); ok {
+		t.Fatal("Expected the update to have deleted name2")
+	}
+	sum := 0
+	m.each(func(name string, v int) {
+		if name != "contested" {
+			sum += v
+		}
+	})
+	if expected := 49*50/2 + 100 - 2; sum != expected {
+		t.Fatalf("Expected every entry once adding up to %d, got %d", expected, sum)
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	t.Parallel()
+	p := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Run(ctx)
+	defer cancel()
+	server.WaitForStartup()
+
+	// A pipe holds nothing, so every write to it waits for the client to read
+	slow, pipe := net.Pipe()
+	defer slow.Close()
+	go userConnection(ctx, server, pipe)
+	writeThenRead(t, slow, "REGISTER slow password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, slow, "slow", "password")
+	writeThenRead(t, slow, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+
+	conn, err := net.Dial("tcp", ":"+p)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "REGISTER fast password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "fast", "password")
+	writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+	// The slow client reads none of these, which wait in its queue
+	for i := 0; i < 10; i++ {
+		writeThenRead(t, conn, "SAY channel hello\n", "RECV fast channel hello\n", "RESULT SAY channel 1\n")
+	}
+	for i := 0; i < 10; i++ {
+		writeThenRead(t, slow, "", "RECV fast channel hello\n")
+	}
+}
+
+// Connects a client that reads nothing until told to and one that says count messages to
+// a channel they're both in, returning the slow one
+func slowConsumer(t *testing.T, config string, count int) net.Conn {
+	p := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, config)
+	t.Cleanup(cancel)
+	server.WaitForStartup()
+
+	slow, pipe := net.Pipe()
+	t.Cleanup(func() { slow.Close() })
+	go userConnection(ctx, server, pipe)
+	writeThenRead(t, slow, "REGISTER slow password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, slow, "slow", "password")
+	writeThenRead(t, slow, "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+
+	conn, err := net.Dial("tcp", ":"+p)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	writeThenRead(t, conn, "REGISTER fast password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "fast", "password")
+	writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+	for i := 0; i < count; i++ {
+		line := fmt.Sprintf("channel %d\n", i)
+		writeThenRead(t, conn, "SAY "+line, "RECV fast "+line, "RESULT SAY channel 1\n")
+	}
+	return slow
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	t.Parallel()
+	const said = sendQueueLength + 50
+	for _, policy := range []string{dropOldestPolicy, lossyPolicy} {
+		slow := slowConsumer(t, `{"slow_consumers": "`+policy+`"}`, said)
+
+		// Every message either arrives, in order, or is owned up to
+		received, dropped, last := 0, 0, -1
+		for received+dropped < said {
+			line := readLine(t, slow)
+			if n, ok := strings.CutPrefix(line, "DROPPED "); ok {
+				count, _ := strconv.Atoi(n)
+				dropped += count
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimPrefix(line, "RECV fast channel "))
+			if err != nil || n <= last {
+				t.Fatalf("%s: expected a later message than %d but got '%s'", policy, last, line)
+			}
+			received, last = received+1, n
+		}
+		if dropped == 0 || last != said-1 && policy == dropOldestPolicy {
+			t.Fatalf("%s: expected the oldest to be dropped but got %d dropped, ending at %d", policy, dropped, last)
+		}
+		writeThenRead(t, slow, "SAY channel caught up\n", "RECV slow channel caught up\n", "RESULT SAY channel 1\n")
+	}
+
+	slow := slowConsumer(t, `{"slow_consumers": "disconnect"}`, said)
+	for line := readLine(t, slow); line != "ERROR SLOW"; line = readLine(t, slow) {
+		if !strings.HasPrefix(line, "RECV fast channel ") {
+			t.Fatalf("Expected ERROR SLOW but got '%s'", line)
+		}
+	}
+	slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := slow.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the slow client to be dropped but got '%v'", err)
+	}
+}
+
+func TestBatchedWrites(t *testing.T) {
+	t.Parallel()
+	p := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Run(ctx)
+	defer cancel()
+	server.WaitForStartup()
+
+	// Nothing is written to a pipe until it's read, so messages pile up in the queue and
+	// go out in batches, compressed together
+	slow, pipe := net.Pipe()
+	defer slow.Close()
+	go userConnection(ctx, server, pipe)
+	writeThenRead(t, slow, "HELLO zlib\n", "RESULT HELLO 1 LOGIN SCRAM-SHA-256\n")
+	go slow.Write([]byte("REGISTER slow password\nLOGIN slow password\nCREATE channel\nJOIN channel\n"))
+	slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	decompressor, err := zlib.NewReader(slow)
+	if err != nil {
+		t.Fatalf("Expected a zlib stream: '%s'", err.Error())
+	}
+	reader := bufio.NewReader(decompressor)
+	expect := func(expected string) {
+		t.Helper()
+		slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading from socket '%s'", err.Error())
+		}
+		if !strings.HasPrefix(line, expected) {
+			t.Fatalf("Expected %q, got %q", expected, line)
+		}
+	}
+	for _, expected := range []string{"RESULT REGISTER 1\n", "RESULT LOGIN 1\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n"} {
+		expect(expected)
+	}
+
+	conn, err := net.Dial("tcp", ":"+p)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "REGISTER fast password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "fast", "password")
+	writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+	for i := 0; i < 200; i++ {
+		line := fmt.Sprintf("channel %d\n", i)
+		writeThenRead(t, conn, "SAY "+line, "RECV fast "+line, "RESULT SAY channel 1\n")
+	}
+	for i := 0; i < 200; i++ {
+		expect(fmt.Sprintf("RECV fast channel %d\n", i))
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	config := `{"rate_limits": {"auth": {"rate": 0.001, "burst": 2}}, "rate_limit_strikes": 2}`
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "LOGIN username wrong\n", "RESULT LOGIN 0\n")
+		writeThenRead(t, conn, "LOGIN username password\n", "RESULT LOGIN 0\n")
+		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conn, "LOGIN username password\n", "RESULT LOGIN 0\n")
+		writeThenRead(t, conn, "LOGIN username password\n", "RESULT LOGIN 0\n")
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected the server to hang up but got '%v'", err)
+		}
+	})
+}
+
+func TestFloodMute(t *testing.T) {
+	config := `{"flood": {"messages": 2, "seconds": 60, "mute_seconds": 60}}`
+	harnessedWithConfig(t, config, 2, func(t *testing.T, conns []net.Conn) {
+		operator := conns[0]
+		writeThenRead(t, operator, "REGISTER operator password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, operator, "operator", "password")
+		writeThenRead(t, operator, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, operator, "JOIN channel\n", "RESULT JOIN channel 1\n")
+
+		conn := conns[1]
+		writeReasons(t, conn)
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		for _, m := range []string{"one", "two"} {
+			writeThenRead(t, conn, "SAY channel "+m+"\n", "RECV username channel "+m+"\n", "RESULT SAY channel 1\n")
+			writeThenRead(t, operator, "", "RECV username channel "+m+"\n")
+		}
+		writeThenRead(t, conn, "SAY channel three\n", "MUTED username channel 60\n", "RESULT SAY channel 0 MUTED\n")
+		writeThenRead(t, operator, "", "MUTED username channel 60\n")
+		writeThenRead(t, conn, "SAY channel four\n", "RESULT SAY channel 0 MUTED\n")
+
+		writeThenRead(t, operator, "SAY channel unaffected\n", "RECV operator channel unaffected\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, conn, "", "RECV operator channel unaffected\n")
+	})
+}
+
+func TestBan(t *testing.T) {
+	config := `{"admins": ["admin"]}`
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeThenRead(t, conn, "REGISTER admin password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "ADMIN BAN 127.0.0.2\n", "RESULT ADMIN BAN 127.0.0.2 0\n")
+		writeLogin(t, conn, "admin", "password")
+
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+		other, err := dialer.Dial("tcp", conn.RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer other.Close()
+		writeThenRead(t, other, "CREATE channel\n", "RESULT CREATE channel 1\n")
+
+		writeThenRead(t, conn, "ADMIN BAN 127.0.0.2\n", "RESULT ADMIN BAN 127.0.0.2 1\n")
+		writeThenRead(t, conn, "ADMIN BANS\n", "RESULT ADMIN BANS 127.0.0.2/32\n")
+		other.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := other.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected the banned connection to be dropped but got '%v'", err)
+		}
+
+		banned, err := dialer.Dial("tcp", conn.RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer banned.Close()
+		banned.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := banned.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected the banned connection to be refused but got '%v'", err)
+		}
+
+		writeThenRead(t, conn, "ADMIN UNBAN 127.0.0.2/32\n", "RESULT ADMIN UNBAN 127.0.0.2/32 1\n")
+		writeThenRead(t, conn, "ADMIN BANS\n", "RESULT ADMIN BANS\n")
+		unbanned, err := dialer.Dial("tcp", conn.RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer unbanned.Close()
+		writeThenRead(t, unbanned, "CHANNELS\n", "RESULT CHANNELS channel\n")
+	})
+}
+
+func TestScriptHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greeter.star")
+	script := `
+def on_join(channel, user):
+    if user == "banned":
+        return False
+    send(channel, "welcome " + user)
+
+def on_message(channel, user, text):
+    if "spam" in text:
+        mute(channel, user, 60)
+        return False
+`
+	if err := os.WriteFile(path, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := fmt.Sprintf(`{"scripts": [%q]}`, path)
+	harnessedWithConfig(t, config, 2, func(t *testing.T, conns []net.Conn) {
+		member := conns[0]
+		writeThenRead(t, member, "REGISTER member password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, member, "member", "password")
+		writeThenRead(t, member, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, member, "JOIN channel\n", "RESULT JOIN channel 1\n")
+
+		conn := conns[1]
+		writeReasons(t, conn)
+		writeThenRead(t, conn, "REGISTER banned password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "banned", "password")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 0 REJECTED\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, member, "", "RECV greeter channel welcome username\n")
+		writeThenRead(t, conn, "SAY channel hello\n", "RECV username channel hello\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, member, "", "RECV username channel hello\n")
+		writeThenRead(t, conn, "SAY channel spam\n", "RESULT SAY channel 0 REJECTED\n")
+		writeThenRead(t, conn, "SAY channel sorry\n", "RESULT SAY channel 0 MUTED\n")
+	})
+}
+
+func TestConnectionsPerIP(t *testing.T) {
+	config := `{"max_connections_per_ip": 2}`
+	harnessedWithConfig(t, config, 2, func(t *testing.T, conns []net.Conn) {
+		writeThenRead(t, conns[0], "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conns[1], "CHANNELS\n", "RESULT CHANNELS channel\n")
+
+		third, err := net.Dial("tcp", conns[0].RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer third.Close()
+		writeThenRead(t, third, "", "ERROR TOOMANY\n")
+
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+		other, err := dialer.Dial("tcp", conns[0].RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer other.Close()
+		writeThenRead(t, other, "CHANNELS\n", "RESULT CHANNELS channel\n")
+	})
+}
+
+func TestMaxConnections(t *testing.T) {
+	config := `{"max_connections": 1}`
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		writeThenRead(t, conns[0], "CREATE channel\n", "RESULT CREATE channel 1\n")
+
+		second, err := net.Dial("tcp", conns[0].RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer second.Close()
+		writeThenRead(t, second, "", "ERROR BUSY\n")
+	})
+}
+
+func TestMaxConnectionsPaused(t *testing.T) {
+	config := `{"max_connections": 1, "busy_action": "pause"}`
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		writeThenRead(t, conns[0], "CREATE channel\n", "RESULT CREATE channel 1\n")
+
+		// Left in the backlog until the first connection goes
+		second, err := net.Dial("tcp", conns[0].RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer second.Close()
+		second.Write([]byte("CREATE other\n"))
+		second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, err := second.Read(make([]byte, 1)); !timedOut(err) {
+			t.Fatalf("Expected the connection to wait but read %d bytes and '%v'", n, err)
+		}
+		conns[0].Close()
+		writeThenRead(t, second, "", "RESULT CREATE other 1\n")
+	})
+}
+
+func TestReplayEventLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	config := fmt.Sprintf(`{"event_log": %q}`, path)
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conn, "CREATE other\n", "RESULT CREATE other 1\n")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conn, "SAY channel one\n", "RECV username channel one\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, conn, "SAY channel two\n", "RECV username channel two\n", "RESULT SAY channel 1\n")
+	})
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var sink strings.Builder
+	server, err := Replay(file, &sink, 0)
+	if err != nil {
+		t.Fatalf("Failed to replay: '%s'", err.Error())
+	}
+	if expected := "RECV username channel one\nRECV username channel two\n"; sink.String() != expected {
+		t.Fatalf("Expected '%s' but got '%s'", expected, sink.String())
+	}
+	if _, ok := server.users.get("username"); !ok || server.channels.len() != 2 {
+		t.Fatalf("Expected one account and two channels but got %d and %d", server.users.len(), server.channels.len())
+	}
+	c, _ := server.channels.get("channel")
+	messages, _ := c.since("0")
+	if len(messages) != 2 || messages[1].text != "two" {
+		t.Fatalf("Expected both messages in the history but got %v", messages)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	config := fmt.Sprintf(`{"audit_log": %q, "admins": ["admin"]}`, path)
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeThenRead(t, conn, "REGISTER admin password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "LOGIN admin wrong\n", "RESULT LOGIN 0\n")
+		writeLogin(t, conn, "admin", "password")
+		writeThenRead(t, conn, "ADMIN BAN 127.0.0.2\n", "RESULT ADMIN BAN 127.0.0.2 1\n")
+		writeThenRead(t, conn, "ADMIN KICK nobody\n", "RESULT ADMIN KICK nobody 0\n")
+	})
+
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, line := range strings.Split(strings.TrimSpace(string(bytes)), "\n") {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Failed to parse '%s': %s", line, err.Error())
+		}
+		if entry.User != "admin" || !strings.HasPrefix(entry.Remote, "127.0.0.1:") || entry.Time.IsZero() {
+			t.Fatalf("Expected the user, remote address and time to be recorded but got %+v", entry)
+		}
+		kinds = append(kinds, entry.Kind+" "+entry.Detail)
+	}
+	expected := []string{"register ", "login_failed password", "login password", "ban 127.0.0.2", "kick nobody"}
+	if strings.Join(kinds, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v but got %v", expected, kinds)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	config := `{"lockout": {"attempts": 2, "seconds": 1}}`
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeReasons(t, conn)
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "LOGIN username wrong\n", "RESULT LOGIN 0\n")
+		writeThenRead(t, conn, "LOGIN username wrong\n", "RESULT LOGIN 0\n")
+		writeThenRead(t, conn, "LOGIN username password\n", "RESULT LOGIN 0 LOCKED\n")
+		// The IP is locked too, whichever account it tries
+		writeThenRead(t, conn, "LOGIN other password\n", "RESULT LOGIN 0 LOCKED\n")
+		writeThenRead(t, conn, "AUTH SCRAM-SHA-256 n,,n=other,r=nonce\n", "RESULT AUTH SCRAM-SHA-256 0 LOCKED\n")
+
+		time.Sleep(1100 * time.Millisecond)
+		writeLogin(t, conn, "username", "password")
+	})
+}
+
+func TestLoginFailuresForgotten(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	server.config.Lockout = LockoutConfig{Attempts: 2, Seconds: 1}
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	u := &user{conn: conn}
+
+	// Spraying guesses at many accounts leaves an entry for each
+	for i := 0; i < 100; i++ {
+		server.loginFailed(u, fmt.Sprintf("user%d", i))
+	}
+	time.Sleep(1100 * time.Millisecond)
+	server.loginFailed(u, "another")
+	server.failuresLock.Lock()
+	left := len(server.failures)
+	server.failuresLock.Unlock()
+	// Just the latest account and the IP
+	if left != 2 {
+		t.Fatalf("Expected failures that ran out to be forgotten, but %d are left", left)
+	}
+}
+
+func TestFraming(t *testing.T) {
+	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		// One command split across writes
+		conn.Write([]byte("REGISTER user"))
+		time.Sleep(50 * time.Millisecond)
+		writeThenRead(t, conn, "name password\n", "RESULT REGISTER 1\n")
+		// Several commands in one write
+		writeThenRead(t, conn, "PING\nCREATE channel\nPING\n", "PONG\n", "RESULT CREATE channel 1\n", "PONG\n")
+	})
+}
+
+func TestMaxLineLength(t *testing.T) {
+	config := `{"max_line_length": 16, "max_line_strikes": 2}`
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeThenRead(t, conn, strings.Repeat("x", 5000)+"\n", "ERROR TOOLONG\n")
+		// A good command in between starts the count again
+		writeThenRead(t, conn, "REGISTER a bcdef\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "REGISTER a bcdefg\n", "ERROR TOOLONG\n")
+		writeThenRead(t, conn, "REGISTER a bcdefg\n", "ERROR TOOLONG\n")
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected to be disconnected but got '%v'", err)
+		}
+	})
+}
+
+func TestWrongArgumentCount(t *testing.T) {
+	harnessed(t, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		// Ignored, whether or not they would need a login
+		writeThenRead(t, conn, "SAY channel\nWHO a b\nCREATE\nPRESENCE now\nPING\n", "PONG\n")
+		writeThenRead(t, conn, "WHO channel\n", "RESULT WHO channel 0\n")
+	})
+}
+
+// A bytes.Buffer that the server can log to while the test reads it
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+func TestStructuredLogging(t *testing.T) {
+	t.Parallel()
+	plainPort := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	logs := &lockedBuffer{}
+	logger, err := NewLogger(logs, "debug", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(WithPort(plainPort), WithLogger(logger))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, `{"max_line_length": 16, "max_line_strikes": 1}`)
+	defer cancel()
+	server.WaitForStartup()
+
+	conn, err := net.Dial("tcp", ":"+plainPort)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "REGISTER a bcdef\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "a", "bcdef")
+	writeThenRead(t, conn, strings.Repeat("x", 100)+"\n", "ERROR TOOLONG\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected to be disconnected but got '%v'", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected JSON logs but got '%s'", line)
+		}
+		if record["msg"] == "Disconnecting after commands that were too long" {
+			if record["level"] != "INFO" || record["user"] != "a" || record["remote"] != conn.LocalAddr().String() || record["count"] != 1.0 {
+				t.Errorf("Unexpected fields in %s", line)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected the disconnection to be logged in '%s'", logs.String())
+}
+
+func TestNewLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger, err := NewLogger(&logs, "WARN", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if strings.Contains(logs.String(), "hidden") || !strings.Contains(logs.String(), "msg=shown") {
+		t.Errorf("Expected only warnings in '%s'", logs.String())
+	}
+
+	if _, err := NewLogger(&logs, "loud", "text"); err == nil {
+		t.Errorf("Expected an unknown level to be refused")
+	}
+	if _, err := NewLogger(&logs, "info", "xml"); err == nil {
+		t.Errorf("Expected an unknown format to be refused")
+	}
+}
+
+func TestInvalidText(t *testing.T) {
+	harnessed(t, 2, func(t *testing.T, conns []net.Conn) {
+		writeThenRead(t, conns[0], "REGISTER username password\r\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conns[0], "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conns[0], "username", "password")
+		writeLogin(t, conns[1], "other", "password")
+		writeThenRead(t, conns[0], "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conns[0], "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conns[1], "JOIN channel\n", "RESULT JOIN channel 1\n")
+
+		writeThenRead(t, conns[0], "SAY channel hi\rRESULT LOGIN 1\n", "ERROR INVALID\n")
+		writeThenRead(t, conns[0], "SAY channel \x1b[2Jhi\n", "ERROR INVALID\n")
+		writeThenRead(t, conns[0], "SAY channel \xff\xfe\n", "ERROR INVALID\n")
+		writeThenRead(t, conns[0], "SAY channel héllo\tthere\n", "RECV username channel héllo\tthere\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, conns[1], "", "RECV username channel héllo\tthere\n")
+	})
+}
+
+func TestBroadcastBurst(t *testing.T) {
+	harnessed(t, 2, func(t *testing.T, conns []net.Conn) {
+		for i, conn := range conns {
+			name := fmt.Sprintf("user%d", i)
+			writeThenRead(t, conn, "REGISTER "+name+" password\n", "RESULT REGISTER 1\n")
+			writeLogin(t, conn, name, "password")
+		}
+		writeThenRead(t, conns[0], "CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conns[1], "JOIN channel\n", "RESULT JOIN channel 1\n")
+
+		// Each line's pooled buffer is reused for the next ones, never before it's written
+		var burst, said, heard strings.Builder
+		for i := 0; i < 200; i++ {
+			fmt.Fprintf(&burst, "SAY channel message %d %s\n", i, strings.Repeat("x", i))
+			fmt.Fprintf(&said, "RECV user0 channel message %d %s\nRESULT SAY channel 1\n", i, strings.Repeat("x", i))
+			fmt.Fprintf(&heard, "RECV user0 channel message %d %s\n", i, strings.Repeat("x", i))
+		}
+		writeThenRead(t, conns[0], burst.String(), said.String())
+		writeThenRead(t, conns[1], "", heard.String())
+	})
+}
+
+func TestFanout(t *testing.T) {
+	harnessedWithConfig(t, `{"fanout_workers": 2, "fanout_threshold": 1}`, 5, func(t *testing.T, conns []net.Conn) {
+		for i, conn := range conns {
+			name := fmt.Sprintf("user%d", i)
+			writeThenRead(t, conn, "REGISTER "+name+" password\n", "RESULT REGISTER 1\n")
+			writeLogin(t, conn, name, "password")
+			if i == 0 {
+				writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+			}
+			writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		}
+
+		// Shared out between the workers, but in order for everyone
+		var burst, said, heard strings.Builder
+		for i := 0; i < 50; i++ {
+			fmt.Fprintf(&burst, "SAY channel message %d\n", i)
+			fmt.Fprintf(&said, "RECV user0 channel message %d\nRESULT SAY channel 1\n", i)
+			fmt.Fprintf(&heard, "RECV user0 channel message %d\n", i)
+		}
+		writeThenRead(t, conns[0], burst.String(), said.String())
+		for _, conn := range conns[1:] {
+			writeThenRead(t, conn, "", heard.String())
+		}
+	})
+}
+
+func TestJSONMode(t *testing.T) {
+	harnessed(t, 2, func(t *testing.T, conns []net.Conn) {
+		conn, other := conns[0], conns[1]
+		writeThenRead(t, conn, "HELLO yaml\n", "RESULT HELLO 0\n")
+		writeThenRead(t, conn, "HELLO json\n", `{"type":"RESULT","args":["HELLO","1","LOGIN","SCRAM-SHA-256"]}`+"\n")
+		writeThenRead(t, conn, `{"command":"REGISTER","args":["username","pass word"]}`+"\n", `{"type":"RESULT","args":["REGISTER","1"]}`+"\n")
+		writeThenRead(t, conn, `{"command":"LOGIN","args":["username","pass word"]}`+"\n", `{"type":"RESULT","args":["LOGIN","1"]}`+"\n")
+		writeThenRead(t, conn, "CREATE channel\n", `{"type":"ERROR","args":["INVALID"]}`+"\n")
+		writeThenRead(t, conn, `{"command":"CREATE","args":["chan nel"]}`+"\n", `{"type":"ERROR","args":["INVALID"]}`+"\n")
+		writeThenRead(t, conn, `{"command":"CREATE","args":["channel"]}`+"\n", `{"type":"RESULT","args":["CREATE","channel","1"]}`+"\n")
+		writeThenRead(t, conn, `{"command":"JOIN","args":["channel"]}`+"\n", `{"type":"RESULT","args":["JOIN","channel","1"]}`+"\n")
+
+		// Text clients in the same channel are none the wiser
+		writeThenRead(t, other, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, other, "other", "password")
+		writeThenRead(t, other, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conn, `{"command":"SAY","args":["channel","hello  there"]}`+"\n",
+			`{"type":"RECV","args":["username","channel","hello  there"]}`+"\n",
+			`{"type":"RESULT","args":["SAY","channel","1"]}`+"\n")
+		writeThenRead(t, other, "", "RECV username channel hello  there\n")
+		writeThenRead(t, other, "SAY channel hi back\n", "RECV other channel hi back\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, conn, "", `{"type":"RECV","args":["other","channel","hi back"]}`+"\n")
+		writeThenRead(t, conn, `{"command":"SAY","args":["channel","\u001b[2J"]}`+"\n", `{"type":"ERROR","args":["INVALID"]}`+"\n")
+	})
+}
+
+// Counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	n      int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.n += n
+	return n, err
+}
+
+func TestCompression(t *testing.T) {
+	harnessed(t, 2, func(t *testing.T, conns []net.Conn) {
+		conn, other := conns[0], conns[1]
+		writeThenRead(t, conn, "HELLO gzip\n", "RESULT HELLO 0\n")
+		writeThenRead(t, conn, "HELLO zlib zlib\n", "RESULT HELLO 0\n")
+		// The reply itself isn't compressed, only what comes after
+		writeThenRead(t, conn, "HELLO zlib\n", "RESULT HELLO 1 LOGIN SCRAM-SHA-256\n")
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("REGISTER username password\n")); err != nil {
+			t.Fatalf("Error writing to socket '%s'", err.Error())
+		}
+		counter := &countingReader{reader: conn}
+		decompressor, err := zlib.NewReader(counter)
+		if err != nil {
+			t.Fatalf("Expected a zlib stream: '%s'", err.Error())
+		}
+		reader := bufio.NewReader(decompressor)
+		exchange := func(write string, read ...string) {
+			t.Helper()
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := conn.Write([]byte(write)); err != nil {
+				t.Fatalf("Error writing to socket '%s'", err.Error())
+			}
+			for _, expected := range read {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatalf("Error reading from socket '%s'", err.Error())
+				}
+				if line != expected {
+					t.Fatalf("Expected %q, got %q", expected, line)
+				}
+			}
+		}
+		exchange("", "RESULT REGISTER 1\n")
+		exchange("HELLO zlib\n", "RESULT HELLO 0\n")
+		exchange("LOGIN username password\n", "RESULT LOGIN 1\n")
+		exchange("CREATE channel\nJOIN channel\n", "RESULT CREATE channel 1\n", "RESULT JOIN channel 1\n")
+
+		writeThenRead(t, other, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, other, "other", "password")
+		writeThenRead(t, other, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		chatter := strings.Repeat("chatter ", 100)
+		before := counter.n
+		for i := 0; i < 10; i++ {
+			writeThenRead(t, other, "SAY channel "+chatter+"\n", "RECV other channel "+chatter+"\n", "RESULT SAY channel 1\n")
+			exchange("", "RECV other channel "+chatter+"\n")
+		}
+		if sent := counter.n - before; sent > len(chatter) {
+			t.Fatalf("Expected ten messages of %d bytes to compress, but %d bytes were sent", len(chatter), sent)
+		}
+	})
+}
+
+func TestBinaryFraming(t *testing.T) {
+	config := `{"max_line_length": 64}`
+	harnessedWithConfig(t, config, 2, func(t *testing.T, conns []net.Conn) {
+		conn, other := conns[0], conns[1]
+		reader := bufio.NewReader(conn)
+		exchange := func(write []string, read ...[]string) {
+			t.Helper()
+			if write != nil {
+				conn.Write(appendBinaryFrame(nil, write[0], write[1:]))
+			}
+			for _, expected := range read {
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				fields, _, err := readBinaryCommand(reader, 1024)
+				if err != nil {
+					t.Fatalf("Error reading frame: '%s'", err.Error())
+				}
+				if strings.Join(fields, "|") != strings.Join(expected, "|") {
+					t.Fatalf("Expected %q but got %q", expected, fields)
+				}
+			}
+		}
+
+		conn.Write([]byte{binaryMagic})
+		exchange([]string{"REGISTER", "username", "pass word"}, []string{"RESULT", "REGISTER", "1"})
+		exchange([]string{"LOGIN", "username", "pass word"}, []string{"RESULT", "LOGIN", "1"})
+		exchange([]string{"HELLO", "json"}, []string{"RESULT", "HELLO", "0"})
+		exchange([]string{"CREATE", "channel"}, []string{"RESULT", "CREATE", "channel", "1"})
+		exchange([]string{"JOIN", "channel"}, []string{"RESULT", "JOIN", "channel", "1"})
+
+		writeThenRead(t, other, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, other, "other", "password")
+		writeThenRead(t, other, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		exchange([]string{"SAY", "channel", "hello  there"}, []string{"RECV", "username", "channel", "hello  there"}, []string{"RESULT", "SAY", "channel", "1"})
+		writeThenRead(t, other, "", "RECV username channel hello  there\n")
+
+		exchange([]string{"SAY", "channel", strings.Repeat("x", 64)}, []string{"ERROR", "TOOLONG"})
+		exchange([]string{"SAY", "channel", "\r"}, []string{"ERROR", "INVALID"})
+		conn.Write([]byte{0, 0, 0, 2, 5, 'x'})
+		exchange(nil, []string{"ERROR", "INVALID"})
+		exchange([]string{"PING"}, []string{"PONG"})
+	})
+}
+
+func TestBinaryFrameTooLong(t *testing.T) {
+	// As long as a frame can say it is, which mustn't be taken for a negative anywhere
+	reader := bufio.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 'x', 'y'}))
+	fields, ok, err := readBinaryCommand(reader, 1024)
+	if fields != nil || ok || err != io.EOF {
+		t.Fatalf("Expected the frame to be skipped until the end, got %q %v %v", fields, ok, err)
+	}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	config := `{"accounts": {"username_max": 8}}`
+	harnessedWithConfig(t, config, 1, func(t *testing.T, conns []net.Conn) {
+		conn := conns[0]
+		writeReasons(t, conn)
+		writeThenRead(t, conn, "REGISTER  password\n", "RESULT REGISTER 0 USERNAME_LENGTH\n")
+		writeThenRead(t, conn, "REGISTER username1 password\n", "RESULT REGISTER 0 USERNAME_LENGTH\n")
+		writeThenRead(t, conn, "REGISTER us$er password\n", "RESULT REGISTER 0 USERNAME_CHARS\n")
+		writeThenRead(t, conn, "REGISTER user \n", "RESULT REGISTER 0 PASSWORD_LENGTH\n")
+		writeThenRead(t, conn, "REGISTER user pass\tword\n", "RESULT REGISTER 0 PASSWORD_CHARS\n")
+		writeThenRead(t, conn, "REGISTER user pass word\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "REGISTER user password\n", "RESULT REGISTER 0 USERNAME_TAKEN\n")
+		writeLogin(t, conn, "user", "pass word")
+	})
+}
+
+// Serves OIDC discovery and a key set for one P-256 key, returning the issuer and a
+// function that signs ID tokens with it
+func oidcIssuer(t *testing.T) (string, func(claims map[string]interface{}) string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	issuer := httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "jwks_uri": issuer.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "key",
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+
+	sign := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "key"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	return issuer.URL, sign
+}
+
+func TestAuthOIDC(t *testing.T) {
+	issuer, sign := oidcIssuer(t)
+	config := fmt.Sprintf(`{"oidc": {"issuer": %q, "client_id": "brerver"}}`, issuer)
+	exp := time.Now().Add(time.Hour).Unix()
+
+	harnessedWithConfig(t, config, 4, func(t *testing.T, conns []net.Conn) {
+		token := sign(map[string]interface{}{"iss": issuer, "aud": "brerver", "sub": "username", "exp": exp})
+		writeThenRead(t, conns[0], "AUTH OIDC "+token+"\n", "RESULT AUTH OIDC 1\n")
+		writeThenRead(t, conns[0], "CREATE channel\n", "RESULT CREATE channel 1\n")
+
+		writeReasons(t, conns[1])
+		// The account has no password to log in with or to register over
+		writeThenRead(t, conns[1], "LOGIN username \n", "RESULT LOGIN 0\n")
+		writeThenRead(t, conns[1], "REGISTER username password\n", "RESULT REGISTER 0 USERNAME_TAKEN\n")
+
+		expired := sign(map[string]interface{}{"iss": issuer, "aud": "brerver", "sub": "username", "exp": time.Now().Add(-time.Hour).Unix()})
+		writeThenRead(t, conns[1], "AUTH OIDC "+expired+"\n", "RESULT AUTH OIDC 0\n")
+		elsewhere := sign(map[string]interface{}{"iss": issuer, "aud": "other", "sub": "username", "exp": exp})
+		writeThenRead(t, conns[1], "AUTH OIDC "+elsewhere+"\n", "RESULT AUTH OIDC 0\n")
+		tampered := token[:len(token)-4] + "AAAA"
+		writeThenRead(t, conns[1], "AUTH OIDC "+tampered+"\n", "RESULT AUTH OIDC 0\n")
+
+		// Never takes over an account with a local password
+		writeThenRead(t, conns[2], "REGISTER local password\n", "RESULT REGISTER 1\n")
+		local := sign(map[string]interface{}{"iss": issuer, "aud": []string{"brerver"}, "sub": "local", "exp": exp})
+		writeThenRead(t, conns[2], "AUTH OIDC "+local+"\n", "RESULT AUTH OIDC 0\n")
+
+		unusable := sign(map[string]interface{}{"iss": issuer, "aud": "brerver", "sub": "has space", "exp": exp})
+		writeThenRead(t, conns[3], "AUTH OIDC "+unusable+"\n", "RESULT AUTH OIDC 0\n")
+	})
+}
+
+func TestSayBinary(t *testing.T) {
+	harnessed(t, 3, func(t *testing.T, conns []net.Conn) {
+		writeReasons(t, conns[0])
+		writeThenRead(t, conns[0], "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conns[0], "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conns[0], "username", "password")
+		writeLogin(t, conns[1], "other", "password")
+		writeLogin(t, conns[2], "other", "password")
+		writeThenRead(t, conns[0], "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conns[0], "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conns[1], "JOIN channel\n", "RESULT JOIN channel 1\n")
+
+		writeThenRead(t, conns[0], "SAYB channel AAEC/w==\n", "RECVB username channel AAEC/w==\n", "RESULT SAYB channel 1\n")
+		writeThenRead(t, conns[1], "", "RECVB username channel AAEC/w==\n")
+		writeThenRead(t, conns[0], "SAYB channel not base64\n", "RESULT SAYB channel 0 BAD_ARGUMENTS\n")
+		writeThenRead(t, conns[1], "PIN channel 1\n", "RESULT PIN channel 1 0\n")
+
+		// Only operators turn E2E on, after which nothing more is kept
+		writeThenRead(t, conns[1], "E2E channel\n", "RESULT E2E channel 1 OFF\n")
+		writeThenRead(t, conns[1], "E2E channel ON\n", "RESULT E2E channel ON 0\n")
+		writeThenRead(t, conns[0], "E2E channel ON\n", "RESULT E2E channel ON 1\n")
+		writeThenRead(t, conns[1], "E2E channel\n", "RESULT E2E channel 1 ON\n")
+		writeThenRead(t, conns[0], "SAYB channel c2VjcmV0\n", "RECVB username channel c2VjcmV0\n", "RESULT SAYB channel 1\n")
+		writeThenRead(t, conns[1], "", "RECVB username channel c2VjcmV0\n")
+		writeThenRead(t, conns[0], "SAY channel plain\n", "RECV username channel plain\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, conns[1], "", "RECV username channel plain\n")
+
+		writeThenRead(t, conns[2], "JOIN channel -since 0\n", "RESULT JOIN channel 1\n", "HISTORYB channel 1 username AAEC/w==\n")
+		writeThenRead(t, conns[2], "PING\n", "PONG\n")
+	})
+}
+
+func TestReactions(t *testing.T) {
+	harnessed(t, 2, func(t *testing.T, conns []net.Conn) {
+		writeThenRead(t, conns[0], "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conns[0], "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conns[0], "username", "password")
+		writeLogin(t, conns[1], "other", "password")
+		writeThenRead(t, conns[0], "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conns[0], "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conns[1], "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conns[0], "SAY channel hello\n", "RECV username channel hello\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, conns[1], "", "RECV username channel hello\n")
+
+		writeThenRead(t, conns[1], "REACTIONS channel\n", "RESULT REACTIONS channel 1\n")
+		writeThenRead(t, conns[1], "REACT channel 1 👍\n", "REACT channel 1 other 👍\n", "RESULT REACT channel 1 1\n")
+		writeThenRead(t, conns[0], "", "REACT channel 1 other 👍\n")
+		writeThenRead(t, conns[1], "REACT channel 2 👍\n", "RESULT REACT channel 2 0\n")
+		writeThenRead(t, conns[1], "REACT channel 1 nope\n", "RESULT REACT channel 1 0\n")
+
+		// Only operators curate the set, and then only what is in it goes
+		writeThenRead(t, conns[1], "REACTIONS channel SET :shipit:\n", "RESULT REACTIONS channel SET 0\n")
+		writeThenRead(t, conns[0], "REACTIONS channel SET :shipit: 🎉\n", "RESULT REACTIONS channel SET 1\n")
+		writeThenRead(t, conns[1], "REACTIONS channel\n", "RESULT REACTIONS channel 1 :shipit: 🎉\n")
+		writeThenRead(t, conns[1], "REACT channel 1 👍\n", "RESULT REACT channel 1 0\n")
+		writeThenRead(t, conns[1], "REACT channel 1 :shipit:\n", "REACT channel 1 other :shipit:\n", "RESULT REACT channel 1 1\n")
+		writeThenRead(t, conns[0], "", "REACT channel 1 other :shipit:\n")
+
+		writeThenRead(t, conns[0], "REACTIONS channel SET\n", "RESULT REACTIONS channel SET 1\n")
+		writeThenRead(t, conns[1], "REACTIONS channel\n", "RESULT REACTIONS channel 1\n")
+		writeThenRead(t, conns[1], "REACTIONS nowhere\n", "RESULT REACTIONS nowhere 0\n")
+	})
+}
+
+// Answers simple binds, accepting only the DN and password given, and returns its URL
+func ldapDirectory(t *testing.T, dn, password string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					request, err := ber.ReadPacket(conn)
+					if err != nil || len(request.Children) < 2 || request.Children[1].Tag != ldap.ApplicationBindRequest {
+						return
+					}
+					bind := request.Children[1]
+					code := int64(ldap.LDAPResultInvalidCredentials)
+					if bind.Children[1].Value == dn && bind.Children[2].Data.String() == password {
+						code = ldap.LDAPResultSuccess
+					}
+
+					response := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, request.Children[0].Value, ""))
+					result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindResponse, nil, "")
+					result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+					result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+					result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+					response.AppendChild(result)
+					conn.Write(response.Bytes())
+				}
+			}()
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func TestLDAPLogin(t *testing.T) {
+	url := ldapDirectory(t, "uid=username,ou=people", "secret")
+	config := fmt.Sprintf(`{"ldap": {"url": %q, "bind_dn": "uid=%%s,ou=people", "disable_register": true}}`, url)
+
+	harnessedWithConfig(t, config, 2, func(t *testing.T, conns []net.Conn) {
+		writeReasons(t, conns[0])
+		writeThenRead(t, conns[0], "REGISTER other password\n", "RESULT REGISTER 0 DISABLED\n")
+		writeThenRead(t, conns[0], "LOGIN username wrong\n", "RESULT LOGIN 0\n")
+		writeThenRead(t, conns[0], "LOGIN username \n", "RESULT LOGIN 0\n")
+		writeLogin(t, conns[0], "username", "secret")
+		writeThenRead(t, conns[0], "CREATE channel\n", "RESULT CREATE channel 1\n")
+
+		// The directory account stays usable once it exists here
+		writeLogin(t, conns[1], "username", "secret")
+		writeThenRead(t, conns[1], "JOIN channel\n", "RESULT JOIN channel 1\n")
+	})
+}
+
+func TestEscapeDNValue(t *testing.T) {
+	cases := map[string]string{
+		"username":  "username",
+		"a,b+c":     `a\,b\+c`,
+		" #x ":      `\ #x\ `,
+		"#x":        `\#x`,
+		`q"<>;=\`:   `q\"\<\>\;\=\\`,
+		"nul\x00it": `nul\00it`,
+	}
+	for value, expected := range cases {
+		if escaped := escapeDNValue(value); escaped != expected {
+			t.Errorf("Expected '%s' to escape to '%s' but got '%s'", value, expected, escaped)
+		}
+	}
+}
+
+func TestStatsTicker(t *testing.T) {
+	t.Parallel()
+	p := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, `{"stats": {"channel": "status", "include": ["users_online", "messages_today", "channels"]}}`)
+	defer cancel()
+	server.WaitForStartup()
+
+	conn, err := net.Dial("tcp", ":"+p)
+	if err != nil {
+		t.Fatalf("Error connecting to server: '%s'", err.Error())
+	}
+	defer conn.Close()
+	writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, conn, "username", "password")
+	writeThenRead(t, conn, "CREATE status\n", "RESULT CREATE status 1\n")
+	writeThenRead(t, conn, "JOIN status\n", "RESULT JOIN status 1\n")
+	writeThenRead(t, conn, "SAY status hello\n", "RECV username status hello\n", "RESULT SAY status 1\n")
+
+	server.postStats()
+	writeThenRead(t, conn, "", "RECV * status users_online=1 messages_today=1 channels=1\n")
+}
+
+func TestPins(t *testing.T) {
+	harnessedWithConfig(t, `{"pins": {"max": 3, "max_seconds": 60}}`, 2, func(t *testing.T, conns []net.Conn) {
+		op, member := conns[0], conns[1]
+		writeThenRead(t, op, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, op, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, op, "username", "password")
+		writeLogin(t, member, "other", "password")
+		writeThenRead(t, op, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, op, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		for i := 1; i <= 4; i++ {
+			text := fmt.Sprintf("message%d", i)
+			writeThenRead(t, op, "SAY channel "+text+"\n", "RECV username channel "+text+"\n", "RESULT SAY channel 1\n")
+		}
+
+		writeThenRead(t, op, "PIN channel 9\n", "RESULT PIN channel 9 0\n")
+		writeThenRead(t, op, "PIN channel 1 61\n", "RESULT PIN channel 1 0\n")
+		writeThenRead(t, op, "PIN channel 1\n", "PINNED channel 1 username message1\n", "RESULT PIN channel 1 1\n")
+		writeThenRead(t, op, "PIN channel 2\n", "PINNED channel 2 username message2\n", "RESULT PIN channel 2 1\n")
+		writeThenRead(t, op, "PIN channel 3\n", "PINNED channel 3 username message3\n", "RESULT PIN channel 3 1\n")
+		// Over the limit, so the oldest goes
+		writeThenRead(t, op, "PIN channel 4\n", "UNPINNED channel 1 LIMIT\n", "PINNED channel 4 username message4\n", "RESULT PIN channel 4 1\n")
+
+		writeThenRead(t, member, "JOIN channel\n",
+			"RESULT JOIN channel 1\n",
+			"PINNED channel 2 username message2\n",
+			"PINNED channel 3 username message3\n",
+			"PINNED channel 4 username message4\n",
+		)
+		writeThenRead(t, member, "PIN channel 1\n", "RESULT PIN channel 1 0\n")
+		writeThenRead(t, member, "PINLIMIT channel 1\n", "RESULT PINLIMIT channel 1 0\n")
+
+		writeThenRead(t, op, "UNPIN channel 3\n", "UNPINNED channel 3\n", "RESULT UNPIN channel 3 1\n")
+		writeThenRead(t, member, "", "UNPINNED channel 3\n")
+		writeThenRead(t, op, "PINLIMIT channel 4\n", "RESULT PINLIMIT channel 4 0\n")
+		writeThenRead(t, op, "PINLIMIT channel 1\n", "UNPINNED channel 2 LIMIT\n", "RESULT PINLIMIT channel 1 1\n")
+		writeThenRead(t, member, "", "UNPINNED channel 2 LIMIT\n")
+
+		writeThenRead(t, op, "PIN channel 1 1\n", "UNPINNED channel 4 LIMIT\n", "PINNED channel 1 username message1\n", "RESULT PIN channel 1 1\n")
+		writeThenRead(t, member, "", "UNPINNED channel 4 LIMIT\n", "PINNED channel 1 username message1\n")
+		writeThenRead(t, member, "", "UNPINNED channel 1 EXPIRED\n")
+		writeThenRead(t, op, "", "UNPINNED channel 1 EXPIRED\n")
+	})
+}
+
+func TestMemberLimit(t *testing.T) {
+	harnessed(t, 3, func(t *testing.T, conns []net.Conn) {
+		op, member, late := conns[0], conns[1], conns[2]
+		for _, conn := range conns {
+			writeReasons(t, conn)
+		}
+		for i, conn := range conns {
+			name := fmt.Sprintf("user%d", i)
+			writeThenRead(t, conn, "REGISTER "+name+" password\n", "RESULT REGISTER 1\n")
+			writeLogin(t, conn, name, "password")
+		}
+		writeThenRead(t, op, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, op, "MEMBERLIMIT channel 2\n", "RESULT MEMBERLIMIT channel 2 0 NOT_JOINED\n")
+		writeThenRead(t, op, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, op, "MEMBERLIMIT channel -1\n", "RESULT MEMBERLIMIT channel -1 0 BAD_ARGUMENTS\n")
+		writeThenRead(t, op, "MEMBERLIMIT channel 2\n", "RESULT MEMBERLIMIT channel 2 1\n")
+
+		writeThenRead(t, member, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, member, "MEMBERLIMIT channel 0\n", "RESULT MEMBERLIMIT channel 0 0\n")
+		writeThenRead(t, late, "JOIN channel\n", "RESULT JOIN channel 0 FULL\n")
+		writeThenRead(t, member, "LEAVE channel\n", "RESULT LEAVE channel 1\n")
+		writeThenRead(t, late, "JOIN channel\n", "RESULT JOIN channel 1\n")
+
+		writeThenRead(t, member, "JOIN channel\n", "RESULT JOIN channel 0 FULL\n")
+		writeThenRead(t, op, "MEMBERLIMIT channel 0\n", "RESULT MEMBERLIMIT channel 0 1\n")
+		writeThenRead(t, member, "JOIN channel\n", "RESULT JOIN channel 1\n")
+	})
+}
+
+func TestPrivateChannels(t *testing.T) {
+	harnessed(t, 5, func(t *testing.T, conns []net.Conn) {
+		op, guest, outsider, roamer, resumed := conns[0], conns[1], conns[2], conns[3], conns[4]
+		for _, conn := range conns {
+			writeReasons(t, conn)
+		}
+		writeThenRead(t, op, "CREATE secret -private\n", "RESULT CREATE secret 0 NOT_LOGGED_IN\n")
+		for i, conn := range conns[:3] {
+			name := fmt.Sprintf("user%d", i)
+			writeThenRead(t, conn, "REGISTER "+name+" password\n", "RESULT REGISTER 1\n")
+			writeLogin(t, conn, name, "password")
+		}
+		writeThenRead(t, op, "CREATE secret -public\n", "RESULT CREATE secret 0 BAD_ARGUMENTS\n")
+		writeThenRead(t, op, "CREATE secret -private\n", "RESULT CREATE secret 1\n")
+
+		// Only there to its members
+		writeThenRead(t, op, "CHANNELS\n", "RESULT CHANNELS\n")
+		writeThenRead(t, op, "JOIN secret\n", "RESULT JOIN secret 1\n")
+		writeThenRead(t, op, "CHANNELS\n", "RESULT CHANNELS secret\n")
+		writeThenRead(t, guest, "CHANNELS\n", "RESULT CHANNELS\n")
+		writeThenRead(t, guest, "WHO secret\n", "RESULT WHO secret 0 NO_SUCH_CHANNEL\n")
+		writeThenRead(t, guest, "JOIN secret\n", "RESULT JOIN secret 0 NO_SUCH_CHANNEL\n")
+
+		writeThenRead(t, guest, "INVITE secret user2\n", "RESULT INVITE secret user2 0 NOT_JOINED\n")
+		writeThenRead(t, op, "INVITE secret user1\n", "RESULT INVITE secret user1 1\n")
+		writeThenRead(t, guest, "", "INVITED secret user0\n")
+		writeThenRead(t, guest, "JOIN secret\n", "RESULT JOIN secret 1\n")
+		writeThenRead(t, guest, "WHO secret\n", "RESULT WHO secret 1 user0,user1\n")
+		writeThenRead(t, guest, "INVITE secret user2\n", "RESULT INVITE secret user2 0\n")
+		writeThenRead(t, outsider, "JOIN secret\n", "RESULT JOIN secret 0 NO_SUCH_CHANNEL\n")
+
+		// Having been let in once is enough
+		writeThenRead(t, guest, "LEAVE secret\n", "RESULT LEAVE secret 1\n")
+		writeThenRead(t, guest, "CHANNELS\n", "RESULT CHANNELS\n")
+		writeThenRead(t, guest, "JOIN secret\n", "RESULT JOIN secret 1\n")
+
+		// Until an operator takes it back, which only keeps them out once they leave
+		writeThenRead(t, guest, "UNINVITE secret user0\n", "RESULT UNINVITE secret user0 0\n")
+		writeThenRead(t, op, "UNINVITE secret user0\n", "RESULT UNINVITE secret user0 0\n")
+		writeThenRead(t, op, "UNINVITE secret user1\n", "RESULT UNINVITE secret user1 1\n")
+		writeThenRead(t, guest, "LEAVE secret\n", "RESULT LEAVE secret 1\n")
+		writeThenRead(t, guest, "JOIN secret\n", "RESULT JOIN secret 0 NO_SUCH_CHANNEL\n")
+
+		// Nor does resuming a session that was in it let them back in
+		writeThenRead(t, op, "REGISTER user3 password\n", "RESULT REGISTER 1\n")
+		token := writeSessionLogin(t, roamer, "user3", "password")
+		writeThenRead(t, op, "INVITE secret user3\n", "RESULT INVITE secret user3 1\n")
+		writeThenRead(t, roamer, "", "INVITED secret user0\n")
+		writeThenRead(t, roamer, "JOIN secret\n", "RESULT JOIN secret 1\n")
+		roamer.Close()
+		writeThenRead(t, op, "UNINVITE secret user3\n", "RESULT UNINVITE secret user3 1\n")
+		// The server notices the disconnect asynchronously
+		eventually(t, "the session to be detached", func() bool {
+			resumed.Write([]byte("RESUME " + token + "\n"))
+			return readLine(t, resumed) == "RESULT RESUME 1"
+		})
+		writeThenRead(t, resumed, "", "RESULT JOIN secret 0 NO_SUCH_CHANNEL\n")
+
+		// The name is taken all the same
+		writeThenRead(t, outsider, "CREATE secret\n", "RESULT CREATE secret 0 CHANNEL_EXISTS\n")
+	})
+}
+
+func TestPrivateChannelSettings(t *testing.T) {
+	harnessed(t, 3, func(t *testing.T, conns []net.Conn) {
+		op, outsider, companion := conns[0], conns[1], conns[2]
+		writeReasons(t, outsider)
+		writeThenRead(t, op, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, op, "REGISTER outsider password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, op, "username", "password")
+		writeLogin(t, outsider, "outsider", "password")
+		writeLogin(t, companion, "outsider", "password")
+		writeThenRead(t, companion, "PRESENCE\n", "RESULT PRESENCE 1\n")
+		writeThenRead(t, op, "CREATE secret -private\n", "RESULT CREATE secret 1\n")
+		writeThenRead(t, op, "JOIN secret\n", "RESULT JOIN secret 1\n")
+		writeThenRead(t, op, "E2E secret ON\n", "RESULT E2E secret ON 1\n")
+
+		// Its settings are no more there than it is
+		writeThenRead(t, outsider, "E2E secret\n", "RESULT E2E secret 0 NO_SUCH_CHANNEL\n")
+		writeThenRead(t, outsider, "E2E secret OFF\n", "RESULT E2E secret OFF 0 NO_SUCH_CHANNEL\n")
+		writeThenRead(t, outsider, "REACTIONS secret\n", "RESULT REACTIONS secret 0 NO_SUCH_CHANNEL\n")
+		writeThenRead(t, outsider, "REACTIONS secret SET :shipit:\n", "RESULT REACTIONS secret SET 0 NO_SUCH_CHANNEL\n")
+		writeThenRead(t, outsider, "NOTIFYPOLICY secret all\n", "RESULT NOTIFYPOLICY secret all 0 NO_SUCH_CHANNEL\n")
+
+		// Nor does mentioning someone not let in tell them about it
+		writeThenRead(t, op, "SAY secret @outsider\n", "RECV username secret @outsider\n", "RESULT SAY secret 1\n")
+		writeThenRead(t, companion, "PING\n", "PONG\n")
+
+		// Until they're invited
+		writeThenRead(t, op, "INVITE secret outsider\n", "RESULT INVITE secret outsider 1\n")
+		writeThenRead(t, outsider, "", "INVITED secret username\n")
+		writeThenRead(t, companion, "", "INVITED secret username\n")
+		writeThenRead(t, outsider, "E2E secret\n", "RESULT E2E secret 1 ON\n")
+		writeThenRead(t, outsider, "REACTIONS secret\n", "RESULT REACTIONS secret 1\n")
+		writeThenRead(t, op, "SAY secret @outsider\n", "RECV username secret @outsider\n", "RESULT SAY secret 1\n")
+		writeThenRead(t, companion, "", "NOTIFY secret username\n")
+	})
+}
+
+// Runs the client side of AUTH SCRAM-SHA-256, returning the server's final reply
+func writeScram(t *testing.T, conn net.Conn, username, password string) string {
+	t.Helper()
+	clientFirstBare := "n=" + username + ",r=clientnonce"
+	fmt.Fprintf(conn, "AUTH SCRAM-SHA-256 n,,%s\n", clientFirstBare)
+	challenge := readLine(t, conn)
+	serverFirst := strings.TrimPrefix(challenge, "CHALLENGE SCRAM-SHA-256 ")
+	if serverFirst == challenge {
+		t.Fatalf("Expected a challenge but got '%s'", challenge)
+	}
+	attributes := strings.Split(serverFirst, ",")
+	nonce := strings.TrimPrefix(attributes[0], "r=")
+	salt, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(attributes[1], "s="))
+	iterations, _ := strconv.Atoi(strings.TrimPrefix(attributes[2], "i="))
+
+	c := deriveCredential(password, salt, iterations)
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + withoutProof)
+	clientSignature := hmacSHA256(c.storedKey, authMessage)
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	proof := hmacSHA256(salted, []byte("Client Key"))
+	for i := range proof {
+		proof[i] ^= clientSignature[i]
+	}
+	fmt.Fprintf(conn, "AUTH SCRAM-SHA-256 %s,p=%s\n", withoutProof, base64.StdEncoding.EncodeToString(proof))
+	result := readLine(t, conn)
+
+	expected := "RESULT AUTH SCRAM-SHA-256 1 v=" + base64.StdEncoding.EncodeToString(hmacSHA256(c.serverKey, authMessage))
+	if strings.HasPrefix(result, "RESULT AUTH SCRAM-SHA-256 1") && result != expected {
+		t.Fatalf("Expected the server signature '%s' but got '%s'", expected, result)
+	}
+	return result
+}
+
+func TestScramLogin(t *testing.T) {
+	harnessedWithConfig(t, `{"plaintext_login": false}`, 3, func(t *testing.T, conns []net.Conn) {
+		writeThenRead(t, conns[0], "HELLO\n", "RESULT HELLO 1 SCRAM-SHA-256\n")
+		writeThenRead(t, conns[0], "CAPS\n", fmt.Sprintf("RESULT CAPS 1 %d %s\n", protocolVersion, strings.Join(capabilities, " ")))
+		writeThenRead(t, conns[0], "CAPS please\n", "RESULT CAPS 0\n")
+		writeThenRead(t, conns[0], "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conns[0], "LOGIN username password\n", "RESULT LOGIN 0\n")
+
+		if result := writeScram(t, conns[0], "username", "password"); !strings.HasPrefix(result, "RESULT AUTH SCRAM-SHA-256 1 ") {
+			t.Fatalf("Expected to log in but got '%s'", result)
+		}
+		writeThenRead(t, conns[0], "CREATE channel\n", "RESULT CREATE channel 1\n")
+
+		if result := writeScram(t, conns[1], "username", "wrong"); result != "RESULT AUTH SCRAM-SHA-256 0" {
+			t.Fatalf("Expected a wrong password to fail but got '%s'", result)
+		}
+		if result := writeScram(t, conns[1], "nobody", "password"); result != "RESULT AUTH SCRAM-SHA-256 0" {
+			t.Fatalf("Expected an unknown user to fail but got '%s'", result)
+		}
+		// An unknown user's salt is no different each time, just as a real one's isn't
+		salt := func(conn net.Conn) string {
+			t.Helper()
+			conn.Write([]byte("AUTH SCRAM-SHA-256 n,,n=nobody,r=nonce\n"))
+			challenge := readLine(t, conn)
+			attributes := strings.Split(strings.TrimPrefix(challenge, "CHALLENGE SCRAM-SHA-256 "), ",")
+			if len(attributes) != 3 {
+				t.Fatalf("Expected a challenge but got '%s'", challenge)
+			}
+			return attributes[1]
+		}
+		if first, second := salt(conns[1]), salt(conns[2]); first != second {
+			t.Fatalf("Expected the same salt for an unknown user twice but got %s and %s", first, second)
+		}
+		writeThenRead(t, conns[2], "AUTH SCRAM-SHA-256 c=biws,r=nonce,p=AAAA\n", "RESULT AUTH SCRAM-SHA-256 0\n")
+		writeThenRead(t, conns[2], "AUTH SCRAM-SHA-256 y,,n=username,r=nonce\n", "RESULT AUTH SCRAM-SHA-256 0\n")
+	})
+}
+
+func TestNotifyPolicy(t *testing.T) {
+	harnessed(t, 3, func(t *testing.T, conns []net.Conn) {
+		op, member, companion := conns[0], conns[1], conns[2]
+		writeThenRead(t, op, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, op, "REGISTER watcher password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, op, "username", "password")
+		writeLogin(t, member, "watcher", "password")
+		writeLogin(t, companion, "watcher", "password")
+		writeThenRead(t, companion, "PRESENCE\n", "RESULT PRESENCE 1\n")
+		writeThenRead(t, op, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, op, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, member, "JOIN channel\n", "RESULT JOIN channel 1\n")
+
+		say := func(text string) {
+			writeThenRead(t, op, "SAY channel "+text+"\n", "RECV username channel "+text+"\n", "RESULT SAY channel 1\n")
+			writeThenRead(t, member, "", "RECV username channel "+text+"\n")
+		}
+
+		// Mentions only by default, so the first message goes unnoticed
+		say("quiet")
+		writeThenRead(t, companion, "PING\n", "PONG\n")
+		say("@watcher")
+		writeThenRead(t, companion, "", "NOTIFY channel username\n")
+
+		writeThenRead(t, member, "NOTIFYPOLICY channel DEFAULT all\n", "RESULT NOTIFYPOLICY channel DEFAULT all 0\n")
+		writeThenRead(t, op, "NOTIFYPOLICY channel DEFAULT loud\n", "RESULT NOTIFYPOLICY channel DEFAULT loud 0\n")
+		writeThenRead(t, op, "NOTIFYPOLICY channel DEFAULT all\n", "RESULT NOTIFYPOLICY channel DEFAULT all 1\n")
+		say("everything")
+		writeThenRead(t, companion, "", "NOTIFY channel username\n")
+
+		// The member's own choice wins over the default until they inherit it again
+		writeThenRead(t, member, "NOTIFYPOLICY channel none\n", "RESULT NOTIFYPOLICY channel none 1\n")
+		say("@watcher")
+		writeThenRead(t, companion, "PING\n", "PONG\n")
+		writeThenRead(t, member, "NOTIFYPOLICY channel inherit\n", "RESULT NOTIFYPOLICY channel inherit 1\n")
+		say("again")
+		writeThenRead(t, companion, "PING\n", "NOTIFY channel username\n", "PONG\n")
+	})
+}
+
+func TestPasswd(t *testing.T) {
+	harnessed(t, 3, func(t *testing.T, conns []net.Conn) {
+		writeThenRead(t, conns[0], "PASSWD password secret\n", "RESULT PASSWD 0\n")
+		writeThenRead(t, conns[0], "REGISTER username password\n", "RESULT REGISTER 1\n")
+		token := writeSessionLogin(t, conns[0], "username", "password")
+		conns[0].Close()
+
+		conn := conns[1]
+		writeReasons(t, conn)
+		writeSessionLogin(t, conn, "username", "password")
+		writeThenRead(t, conn, "PASSWD wrong secret\n", "RESULT PASSWD 0\n")
+		writeThenRead(t, conn, "PASSWD password pass\tword\n", "RESULT PASSWD 0 PASSWORD_CHARS\n")
+		writeThenRead(t, conn, "PASSWD password secret\n", "RESULT PASSWD 1\n")
+		if line := readLine(t, conn); !strings.HasPrefix(line, "SESSION ") {
+			t.Fatalf("Expected a new session token but got '%s'", line)
+		}
+
+		writeThenRead(t, conns[2], "RESUME "+token+"\n", "RESULT RESUME 0\n")
+		writeThenRead(t, conns[2], "LOGIN username password\n", "RESULT LOGIN 0\n")
+		writeLogin(t, conns[2], "username", "secret")
+	})
+}
+
+func TestUnregister(t *testing.T) {
+	harnessed(t, 4, func(t *testing.T, conns []net.Conn) {
+		conn, otherSession, other, third := conns[0], conns[1], conns[2], conns[3]
+		writeReasons(t, conn)
+		writeReasons(t, otherSession)
+		writeThenRead(t, conn, "UNREGISTER password\n", "RESULT UNREGISTER 0\n")
+		writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "REGISTER other password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, conn, "REGISTER third password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, "username", "password")
+		writeLogin(t, otherSession, "username", "password")
+		writeLogin(t, other, "other", "password")
+		writeLogin(t, third, "third", "password")
+
+		writeThenRead(t, conn, "CREATE channel\n", "RESULT CREATE channel 1\n")
+		writeThenRead(t, conn, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, other, "JOIN channel\n", "RESULT JOIN channel 1\n")
+		writeThenRead(t, conn, "SAY channel mine\n", "RECV username channel mine\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, other, "", "RECV username channel mine\n")
+		writeThenRead(t, other, "SAY channel theirs\n", "RECV other channel theirs\n", "RESULT SAY channel 1\n")
+		writeThenRead(t, conn, "", "RECV other channel theirs\n")
+
+		writeThenRead(t, conn, "UNREGISTER wrong\n", "RESULT UNREGISTER 0\n")
+		writeThenRead(t, conn, "UNREGISTER password\n", "RESULT UNREGISTER 1\n")
+		writeThenRead(t, conn, "SAY channel ghost\n", "RESULT SAY channel 0 NOT_LOGGED_IN\n")
+
+		// The name can be taken again, and the account's other connection doesn't become
+		// the new account's
+		writeThenRead(t, third, "LOGIN username password\n", "RESULT LOGIN 0\n")
+		writeThenRead(t, third, "REGISTER username password\n", "RESULT REGISTER 1\n")
+		writeThenRead(t, otherSession, "JOIN channel\n", "RESULT JOIN channel 0 NOT_LOGGED_IN\n")
+
+		// Their messages are gone from history
+		writeThenRead(t, third, "JOIN channel -since 0\n", "RESULT JOIN channel 1\n", "HISTORY channel 2 other theirs\n")
+	})
+}
+
+func TestUnregisterConcurrentLogin(t *testing.T) {
+	t.Parallel()
+	p := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, "")
+	defer cancel()
+	server.WaitForStartup()
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ":"+p)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	conn, racer := conns[0], conns[1]
+	writeReasons(t, racer)
+
+	// A login landing while the account's connections are being logged out is refused
+	writeThenRead(t, conn, "REGISTER username password\n", "RESULT REGISTER 1\n")
+	release := server.holdLogins("username")
+	writeThenRead(t, racer, "LOGIN username password\n", "RESULT LOGIN 0\n")
+	release()
+
+	// Logins land before, during and after the account goes, and none is left logged in
+	const attempts = 20
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("gone%d", i)
+		writeThenRead(t, conn, "REGISTER "+name+" password\n", "RESULT REGISTER 1\n")
+		writeLogin(t, conn, name, "password")
+		racer.Write([]byte(strings.Repeat("LOGIN "+name+" password\n", attempts)))
+		writeThenRead(t, conn, "UNREGISTER password\n", "RESULT UNREGISTER 1\n")
+		for j := 0; j < attempts; j++ {
+			if line := readLine(t, racer); !strings.HasPrefix(line, "RESULT LOGIN ") {
+				t.Fatalf("Expected a RESULT LOGIN but got '%s'", line)
+			}
+		}
+		writeThenRead(t, racer, "JOIN channel\n", "RESULT JOIN channel 0 NOT_LOGGED_IN\n")
+	}
+}
+
+func TestSmoketest(t *testing.T) {
+	t.Parallel()
+	p := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, "")
+	defer cancel()
+	server.WaitForStartup()
+
+	options := SmoketestOptions{Timeout: 2 * time.Second}
+	// Again, to use the channel left from the first time
+	for i := 0; i < 2; i++ {
+		if err := Smoketest("localhost:"+p, options); err != nil {
+			t.Fatalf("Expected the smoke test to pass but got '%s'", err.Error())
+		}
+	}
+	// The throwaway accounts are cleaned up afterwards, and only the one channel is made
+	accounts := server.users.len()
+	if accounts != 0 {
+		t.Errorf("Expected no accounts left but found %d", accounts)
+	}
+	if channels := server.channels.len(); channels != 1 {
+		t.Errorf("Expected one channel but found %d", channels)
+	}
+
+	options.Username, options.Password = "nobody", "password"
+	if err := Smoketest("localhost:"+p, options); err == nil {
+		t.Fatal("Expected the smoke test to fail with unknown credentials")
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	t.Parallel()
+	p := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	var config atomic.Value
+	config.Store(`{"admins": ["admin"]}`)
+	server := NewServer(WithPort(p), WithConfigLoader(func() (string, error) { return config.Load().(string), nil }))
+	stopped := make(chan struct{})
+	go func() {
+		server.RunWithConfig(ctx, config.Load().(string))
+		close(stopped)
+	}()
+	defer cancel()
+	server.WaitForStartup()
+
+	conns := make([]net.Conn, 3)
+	for i := range conns {
+		conn, err := net.Dial("tcp", ":"+p)
+		if err != nil {
+			t.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	admin, other, third := conns[0], conns[1], conns[2]
+	writeThenRead(t, admin, "REGISTER admin password\n", "RESULT REGISTER 1\n")
+	writeThenRead(t, admin, "REGISTER other password\n", "RESULT REGISTER 1\n")
+	writeLogin(t, admin, "admin", "password")
+	writeLogin(t, other, "other", "password")
+	writeThenRead(t, other, "ADMIN KICK admin\n", "RESULT ADMIN KICK admin 0\n")
+
+	admin.Write([]byte("ADMIN CONNECTIONS\n"))
+	line := readLine(t, admin)
+	if !strings.HasPrefix(line, "RESULT ADMIN CONNECTIONS ") || !strings.Contains(line, " admin ") || !strings.Contains(line, " other ") || !strings.Contains(line, " - ") {
+		t.Fatalf("Expected every connection to be listed but got '%s'", line)
+	}
+	for _, connection := range strings.Split(strings.TrimPrefix(line, "RESULT ADMIN CONNECTIONS "), ", ") {
+		if fields := strings.Fields(connection); len(fields) != 3 || strings.Trim(fields[2], "0123456789") != "" {
+			t.Fatalf("Expected an address, name and queue depth but got '%s'", connection)
+		}
+	}
+
+	writeThenRead(t, admin, "CREATE channel\n", "RESULT CREATE channel 1\n")
+	writeThenRead(t, admin, "JOIN channel\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, admin, "SAY channel hello\n", "RECV admin channel hello\n", "RESULT SAY channel 1\n")
+	writeThenRead(t, admin, "ADMIN PURGE channel\n", "PURGED channel\n", "RESULT ADMIN PURGE channel 1\n")
+	writeThenRead(t, admin, "ADMIN PURGE nowhere\n", "RESULT ADMIN PURGE nowhere 0\n")
+	writeThenRead(t, other, "JOIN channel -since 0\n", "RESULT JOIN channel 1\n")
+	writeThenRead(t, other, "SAY channel after\n", "RECV other channel after\n", "RESULT SAY channel 1\n")
+	writeThenRead(t, admin, "", "RECV other channel after\n")
+
+	config.Store(`{"admins": ["admin", "other"]}`)
+	writeThenRead(t, admin, "ADMIN RELOAD\n", "RESULT ADMIN RELOAD 1\n")
+	writeThenRead(t, other, "ADMIN BANS\n", "RESULT ADMIN BANS\n")
+	config.Store(`{"admins": "everyone"}`)
+	writeThenRead(t, admin, "ADMIN RELOAD\n", "RESULT ADMIN RELOAD 0\n")
+	writeThenRead(t, other, "ADMIN BANS\n", "RESULT ADMIN BANS\n")
+
+	writeThenRead(t, admin, "ADMIN KICK other\n", "RESULT ADMIN KICK other 1\n")
+	other.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := other.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the kicked connection to be dropped but got '%v'", err)
+	}
+
+	writeThenRead(t, third, "ADMIN SHUTDOWN\n", "RESULT ADMIN SHUTDOWN 0\n")
+	writeThenRead(t, admin, "ADMIN SHUTDOWN\n", "RESULT ADMIN SHUTDOWN 1\n")
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the server to stop")
+	}
+}
+
+// go test -race -run TestStress -stress runs TestStress with hundreds of clients. Without
+// it a smaller run still goes with every go test.
+var stress = flag.Bool("stress", false, "run TestStress with hundreds of clients")
+
+// Each client's commands come from its own generator seeded from this, so a failure can be
+// replayed with the same commands, though not the same interleaving
+var stressSeed = flag.Int64("stress.seed", 1, "seed for the commands TestStress's clients send")
+
+// A TestStress client, which only one goroutine uses at a time
+type stressClient struct {
+	name string
+	conn net.Conn
+	rng  *mathrand.Rand
+	// Replies to the client's own commands, which never have more than one outstanding.
+	// Everything else is thrown away as it comes, so that no queue ever fills.
+	replies chan string
+	// Where the client should be joined, going by the results it has had
+	joined map[string]bool
+}
+
+func newStressClient(t *testing.T, ln *PipeListener, name string, seed int64) *stressClient {
+	c := &stressClient{
+		name:    name,
+		conn:    dialPipe(t, ln),
+		rng:     mathrand.New(mathrand.NewSource(seed)),
+		replies: make(chan string, 1),
+		joined:  map[string]bool{},
+	}
+	go func() {
+		defer close(c.replies)
+		scanner := bufio.NewScanner(c.conn)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "RESULT ") || line == "PONG" {
+				c.replies <- line
+			}
+		}
+	}()
+	return c
+}
+
+// Sends line and returns the reply to it
+func (c *stressClient) command(line string) (string, error) {
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		return "", fmt.Errorf("%s sending '%s': %w", c.name, line, err)
+	}
+	select {
+	case reply, ok := <-c.replies:
+		if !ok {
+			return "", fmt.Errorf("%s disconnected after '%s'", c.name, line)
+		}
+		return reply, nil
+	// Slow under -race, with every SAY waiting on the queues of everyone it goes to
+	case <-time.After(30 * time.Second):
+		return "", fmt.Errorf("%s got no reply to '%s'", c.name, line)
+	}
+}
+
+// Sends ops random JOINs, SAYs and LEAVEs, checking each result against where the client
+// should be joined
+func (c *stressClient) run(channels []string, ops int) error {
+	for i := 0; i < ops; i++ {
+		channel := channels[c.rng.Intn(len(channels))]
+		var line string
+		var succeeds bool
+		switch c.rng.Intn(3) {
+		case 0:
+			line, succeeds = "JOIN "+channel, !c.joined[channel]
+		case 1:
+			line, succeeds = "SAY "+channel+" hello from "+c.name, c.joined[channel]
+		case 2:
+			line, succeeds = "LEAVE "+channel, c.joined[channel]
+		}
+		reply, err := c.command(line)
+		if err != nil {
+			return err
+		}
+		command := strings.Fields(line)[0]
+		if expected := fmt.Sprintf("RESULT %s %s 0", command, channel); !succeeds && !strings.HasPrefix(reply, expected) {
+			return fmt.Errorf("%s expected '%s...' for '%s' but got '%s'", c.name, expected, line, reply)
+		}
+		if expected := fmt.Sprintf("RESULT %s %s 1", command, channel); succeeds && reply != expected {
+			return fmt.Errorf("%s expected '%s' for '%s' but got '%s'", c.name, expected, line, reply)
+		}
+		switch {
+		case command == "JOIN" && succeeds:
+			c.joined[channel] = true
+		case command == "LEAVE" && succeeds:
+			delete(c.joined, channel)
+		}
+	}
+	// Answered only once everything before it has been handled
+	if reply, err := c.command("PING"); err != nil || reply != "PONG" {
+		return fmt.Errorf("%s expected 'PONG' but got '%s' (%v)", c.name, reply, err)
+	}
+	return nil
+}
+
+// Checks that channels, the users joined to them and the counts of both agree, and that
+// they agree with where clients should be joined. Only holds while no command is being
+// handled.
+func checkMembership(t *testing.T, s *Server, clients []*stressClient) {
+	t.Helper()
+	members := map[string]map[string]bool{}
+	s.channels.each(func(name string, c *channel) {
+		c.usersLock.RLock()
+		defer c.usersLock.RUnlock()
+		if c.memberCount() != len(c.users) {
+			t.Errorf("Channel '%s' counts %d members but has %d", name, c.memberCount(), len(c.users))
+		}
+		members[name] = map[string]bool{}
+		for username, u := range c.users {
+			if u.name != username {
+				t.Errorf("Channel '%s' has '%s' as '%s'", name, u.name, username)
+			}
+			if u.channels[name] != c {
+				t.Errorf("Channel '%s' has '%s', who doesn't have it", name, username)
+			}
+			members[name][username] = true
+		}
+	})
+
+	s.connectionsLock.RLock()
+	for u := range s.connections {
+		for name, c := range u.channels {
+			c.usersLock.RLock()
+			if c.users[u.name] != u {
+				t.Errorf("'%s' has channel '%s', which doesn't have them", u.name, name)
+			}
+			c.usersLock.RUnlock()
+		}
+	}
+	s.connectionsLock.RUnlock()
+
+	for _, client := range clients {
+		for name := range client.joined {
+			if !members[name][client.name] {
+				t.Errorf("'%s' joined '%s' but isn't a member", client.name, name)
+			}
+			delete(members[name], client.name)
+		}
+	}
+	for name, left := range members {
+		for username := range left {
+			t.Errorf("'%s' is a member of '%s' without having joined", username, name)
+		}
+	}
+}
+
+// Many clients JOIN, SAY and LEAVE at once, over pipes, which under -race catches
+// membership changes that race or take locks out of order. Between rounds, with every
+// client quiet, the membership maps are checked against each other and the results the
+// clients had.
+func TestStress(t *testing.T) {
+	t.Parallel()
+	numClients, numChannels, rounds, ops := 32, 4, 4, 25
+	if *stress {
+		numClients, numChannels, rounds, ops = 300, 16, 5, 40
+	}
+	if testing.Short() && !*stress {
+		t.Skip("Skipping the stress test in short mode")
+	}
+
+	ln := NewPipeListener()
+	accounts := testStore{"creator": "password"}
+	for i := 0; i < numClients; i++ {
+		accounts[fmt.Sprintf("user%d", i)] = "password"
+	}
+	// Every client reads all the time, so blocking never stalls, where dropping would lose
+	// the results they wait for
+	server := NewServer(WithListener(ln), WithStore(accounts), WithConfig(`{"slow_consumers": "block"}`))
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		server.Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	server.WaitForStartup()
+	defer func() {
+		if t.Failed() {
+			t.Logf("Clients were seeded from %d", *stressSeed)
+		}
+	}()
+
+	creator := newStressClient(t, ln, "creator", 0)
+	defer creator.conn.Close()
+	if reply, err := creator.command("LOGIN creator password"); err != nil || reply != "RESULT LOGIN 1" {
+		t.Fatalf("Expected to log in but got '%s' (%v)", reply, err)
+	}
+	var channels []string
+	for i := 0; i < numChannels; i++ {
+		name := fmt.Sprintf("channel%d", i)
+		if reply, err := creator.command("CREATE " + name); err != nil || reply != "RESULT CREATE "+name+" 1" {
+			t.Fatalf("Expected to create '%s' but got '%s' (%v)", name, reply, err)
+		}
+		channels = append(channels, name)
+	}
+
+	clients := make([]*stressClient, numClients)
+	for i := range clients {
+		clients[i] = newStressClient(t, ln, fmt.Sprintf("user%d", i), *stressSeed+int64(i))
+		defer clients[i].conn.Close()
+	}
+	// Everyone at once, as the rounds are, to log in while the others do
+	var wg sync.WaitGroup
+	errs := make(chan error, numClients)
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *stressClient) {
+			defer wg.Done()
+			if reply, err := client.command("LOGIN " + client.name + " password"); err != nil || reply != "RESULT LOGIN 1" {
+				errs <- fmt.Errorf("%s expected to log in but got '%s' (%v)", client.name, reply, err)
+			}
+		}(client)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < rounds; round++ {
+		errs := make(chan error, numClients)
+		for _, client := range clients {
+			wg.Add(1)
+			go func(client *stressClient) {
+				defer wg.Done()
+				if err := client.run(channels, ops); err != nil {
+					errs <- err
+				}
+			}(client)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+		if t.Failed() {
+			t.FailNow()
+		}
+		checkMembership(t, server, clients)
+	}
+
+	// Leaving by disconnecting has to clear out membership as LEAVE does
+	for _, client := range clients {
+		client.conn.Close()
+		client.joined = map[string]bool{}
+	}
+	// Connections stop being counted before they leave their channels
+	joined := func() int {
+		total := 0
+		server.channels.each(func(_ string, c *channel) { total += c.memberCount() })
+		return total
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.connectionCount() > 1 || joined() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the clients to be gone but %d connections are open and %d joined", server.connectionCount(), joined())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkMembership(t, server, nil)
+}
+
+// Starts a server for a benchmark, returning connections to it that have each registered
+// and logged in as user<i>, read through the returned readers
+func benchmarked(b *testing.B, config string, numConns int) ([]net.Conn, []*bufio.Reader) {
+	b.Helper()
+	p := fmt.Sprintf("%d", atomic.AddUint32(&port, 1))
+	server := NewServer(WithPort(p))
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.RunWithConfig(ctx, config)
+	b.Cleanup(cancel)
+	server.WaitForStartup()
+
+	conns := make([]net.Conn, numConns)
+	readers := make([]*bufio.Reader, numConns)
+	for i := range conns {
+		conn, err := net.Dial("tcp", ":"+p)
+		if err != nil {
+			b.Fatalf("Error connecting to server: '%s'", err.Error())
+		}
+		b.Cleanup(func() { conn.Close() })
+		conns[i], readers[i] = conn, bufio.NewReader(conn)
+		fmt.Fprintf(conn, "REGISTER user%d password\nLOGIN user%d password\n", i, i)
+		benchmarkRead(b, readers[i], "RESULT REGISTER 1\n", "RESULT LOGIN 1\n")
+	}
+	return conns, readers
+}
+
+// Reads a line for each of expected, which a line needs only start with
+func benchmarkRead(b *testing.B, reader *bufio.Reader, expected ...string) {
+	for _, want := range expected {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			b.Fatalf("Error reading from socket '%s'", err.Error())
+		}
+		if !strings.HasPrefix(line, want) {
+			b.Fatalf("Expected '%s' but got '%s'", want, line)
+		}
+	}
+}
+
+func TestParseAllocs(t *testing.T) {
+	u := &user{}
+	for _, line := range []string{"", "SAY", "JOIN channel", "SAY channel hello there, everyone", "SAY  channel  spaced "} {
+		if words, _ := u.parseCommand(inbound{line: line}); strings.Join(words, "|") != strings.Join(strings.SplitN(line, " ", 3), "|") {
+			t.Fatalf("Expected '%s' to split like strings.SplitN but got %q", line, words)
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { u.parseCommand(inbound{line: "SAY channel hello there"}) }); allocs != 0 {
+		t.Fatalf("Expected parsing to allocate nothing but it allocated %v times", allocs)
+	}
+
+	// The command read is the only copy made of it
+	lines := strings.NewReader(strings.Repeat("SAY channel hello there\n", 200))
+	reader := bufio.NewReader(lines)
+	if allocs := testing.AllocsPerRun(100, func() { readCommand(reader, 1024) }); allocs != 1 {
+		t.Fatalf("Expected reading a command to allocate once but it allocated %v times", allocs)
+	}
+}
+
+func FuzzParseCommand(f *testing.F) {
+	for _, seed := range []string{
+		"", "SAY", "JOIN channel", "SAY channel hello there", "SAY  channel  spaced ", "LOGIN user pass\r",
+		"\x00", "\xff\xfe", "SAY channel \x1b[2J", `{"command": "SAY", "args": ["channel", "hi there"]}`,
+		`{"command": ""}`, `{"args": 5}`, `[]`, strings.Repeat("A ", 600),
+	} {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+	f.Fuzz(func(t *testing.T, line string, json bool) {
+		format := uint32(textFormat)
+		if json {
+			format = jsonFormat
+		}
+		var array [3]string
+		words, ok := parseLine(&array, line, format)
+		if !ok {
+			return
+		}
+		if len(words) == 0 || len(words) > 3 {
+			t.Fatalf("Expected one to three words from '%q' but got %q", line, words)
+		}
+		for _, word := range words {
+			if !validCommand(word) {
+				t.Fatalf("Expected '%q' to be rejected for control characters but got %q", line, words)
+			}
+		}
+		if !json && strings.Join(words, " ") != strings.TrimSuffix(line, "\r") {
+			t.Fatalf("Expected the words of '%q' to make it up again but got %q", line, words)
+		}
+		if json && (words[0] == "" || strings.Contains(words[0], " ")) {
+			t.Fatalf("Expected a JSON command to be one word but got %q from '%q'", words, line)
+		}
+	})
+}
+
+func FuzzReadCommand(f *testing.F) {
+	f.Add([]byte("SAY channel hello\nPING\n"), 16)
+	f.Add([]byte("no newline"), 4)
+	f.Add([]byte(strings.Repeat("x", 5000)+"\nPING\n"), 1024)
+	f.Add([]byte("\n\n\r\n"), 0)
+	f.Fuzz(func(t *testing.T, data []byte, max int) {
+		if max < 0 || max > 1<<16 {
+			return
+		}
+		reader := bufio.NewReaderSize(bytes.NewReader(data), 16)
+		for {
+			line, ok, err := readCommand(reader, max)
+			if err != nil {
+				return
+			}
+			if ok && (len(line) > max || strings.Contains(line, "\n")) {
+				t.Fatalf("Expected a line of at most %d bytes without a newline but got '%q'", max, line)
+			}
+		}
+	})
+}
+
+func FuzzBinaryCommand(f *testing.F) {
+	f.Add(appendBinaryFrame(nil, "SAY", []string{"channel", "hello there"})[4:])
+	f.Add(appendBinaryFrame(nil, "", nil)[4:])
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{5, 'S', 'A', 'Y'})
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		words, ok := binaryCommand(binaryFields(payload))
+		if ok && (len(words) == 0 || len(words) > 3 || words[0] == "") {
+			t.Fatalf("Expected a command and up to two arguments but got %q", words)
+		}
+		// Whatever the payload, reading it as a frame gives the same
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+		reader := bufio.NewReader(bytes.NewReader(append(size[:], payload...)))
+		if fields, _, err := readBinaryCommand(reader, 1<<20); err != nil || !slices.Equal(fields, binaryFields(payload)) {
+			t.Fatalf("Expected reading the frame to give %q but got %q, '%v'", binaryFields(payload), fields, err)
+		}
+	})
+}
+
+func BenchmarkParseCommand(b *testing.B) {
+	u := &user{}
+	in := inbound{line: "SAY channel hello there, everyone"}
+	b.Run("text", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			u.parseCommand(in)
+		}
+	})
+	b.Run("read", func(b *testing.B) {
+		b.ReportAllocs()
+		lines := strings.NewReader(strings.Repeat("SAY channel hello there, everyone\n", 1000))
+		reader := bufio.NewReader(lines)
+		for i := 0; i < b.N; i++ {
+			if _, _, err := readCommand(reader, 1024); err != nil {
+				lines.Seek(0, io.SeekStart)
+				reader.Reset(lines)
+			}
+		}
+	})
+	b.Run("frame", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			splitFrame("RECV user channel hello there, everyone")
+		}
+	})
+}
+
+func BenchmarkLogin(b *testing.B) {
+	conns, readers := benchmarked(b, "", 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conns[0].Write([]byte("LOGIN user0 password\n"))
+		benchmarkRead(b, readers[0], "RESULT LOGIN 1\n")
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, members := range []int{10, 100} {
+		b.Run(fmt.Sprintf("%d", members), func(b *testing.B) {
+			conns, readers := benchmarked(b, "", members)
+			for i, conn := range conns {
+				if i == 0 {
+					conn.Write([]byte("CREATE channel\n"))
+					benchmarkRead(b, readers[i], "RESULT CREATE channel 1\n")
+				}
+				conn.Write([]byte("JOIN channel\n"))
+				benchmarkRead(b, readers[i], "RESULT JOIN channel 1\n")
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conns[0].Write([]byte("SAY channel hello\n"))
+				benchmarkRead(b, readers[0], "RECV user0 channel hello\n", "RESULT SAY channel 1\n")
+				for _, reader := range readers[1:] {
+					benchmarkRead(b, reader, "RECV user0 channel hello\n")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package brerver
+
+// Only Windows has a service manager that needs talking to
+func RunAsService(server *Server) bool {
+	return false
+}
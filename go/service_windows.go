@@ -0,0 +1,68 @@
+//go:build windows
+
+package brerver
+
+import (
+	"context"
+	"log"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+const serviceName = "brerver"
+
+type service struct {
+	server *Server
+}
+
+// Runs the server under the Windows service manager when started by it, reporting
+// whether it did
+func RunAsService(server *Server) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Fatalln("Failed to detect the Windows service manager: " + err.Error())
+	}
+	if !isService {
+		return false
+	}
+
+	if err := svc.Run(serviceName, &service{server}); err != nil {
+		log.Fatalln("Failed to run as a Windows service: " + err.Error())
+	}
+	return true
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		if err := s.server.Run(ctx); err != nil {
+			log.Println(err)
+		}
+		close(stopped)
+	}()
+	s.server.WaitForStartup()
+	select {
+	case <-stopped:
+		// Failed to start, which has been logged
+		return false, 1
+	default:
+	}
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			changes <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			changes <- svc.Status{State: svc.StopPending}
+			stop()
+			<-stopped
+			return false, 0
+		}
+	}
+	return false, 0
+}
@@ -0,0 +1,166 @@
+package brerver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// How long a session survives after its connection drops
+const sessionLifetime = 10 * time.Minute
+
+type session struct {
+	name string
+	// Whether a connection currently holds the session, only detached sessions can be resumed
+	attached bool
+	detached time.Time
+	// Channel name to the last sequence number the connection could have seen
+	channels map[string]uint64
+}
+
+func newToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (s *Server) startSession(u *user) {
+	token := newToken()
+
+	s.sessionsLock.Lock()
+	s.expireSessions()
+	if u.session != "" {
+		delete(s.sessions, u.session)
+	}
+	s.sessions[token] = &session{
+		name:     u.name,
+		attached: true,
+	}
+	s.sessionsLock.Unlock()
+
+	u.session = token
+	msg := fmt.Sprintf("SESSION %s\n", token)
+	u.send([]byte(msg))
+}
+
+// Remembers where the user left off so it can be picked back up with RESUME
+func (s *Server) detachSession(u *user) {
+	if u.session == "" {
+		return
+	}
+
+	channels := map[string]uint64{}
+	for name, channel := range u.channels {
+		channels[name] = channel.lastSeq()
+	}
+
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	if session, ok := s.sessions[u.session]; ok {
+		session.attached = false
+		session.detached = time.Now()
+		session.channels = channels
+	}
+}
+
+// Forgets every session token of the account, so none of them can be resumed
+func (s *Server) revokeSessions(name string) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	for token, session := range s.sessions {
+		if session.name == name {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+// The account the session token belongs to, if the session is still there
+func (s *Server) sessionAccount(token string) (string, bool) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	session, ok := s.sessions[token]
+	if !ok {
+		return "", false
+	}
+	return session.name, true
+}
+
+// Must be called with sessionsLock held
+func (s *Server) expireSessions() {
+	for token, session := range s.sessions {
+		if !session.attached && time.Since(session.detached) > sessionLifetime {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+// RESUME <token> [-replay]
+func resume(s *Server, u *user, args []string) {
+	token := args[1]
+	replay := len(args) == 3 && args[2] == "-replay"
+	if len(args) == 3 && !replay {
+		return
+	}
+
+	s.sessionsLock.Lock()
+	s.expireSessions()
+	session, ok := s.sessions[token]
+	if ok && !session.attached && !u.loggedIn() {
+		session.attached = true
+	} else {
+		ok = false
+	}
+	s.sessionsLock.Unlock()
+	// The session goes along with its account if that's being unregistered
+	if ok && !s.claimName(u, session.name) {
+		ok = false
+	}
+
+	var confirmation int
+	if ok {
+		confirmation = 1
+	}
+	msg := fmt.Sprintf("RESULT RESUME %d\n", confirmation)
+	u.send([]byte(msg))
+	if !ok {
+		return
+	}
+
+	s.audit(u, loginAudit, session.name, "resume")
+	u.session = token
+	u.sessions = true
+	s.announcePresence(u.name, true)
+	for channelName, seq := range session.channels {
+		channel, ok := s.channels.get(channelName)
+		if !ok {
+			continue
+		}
+
+		var since string
+		if replay {
+			since = strconv.FormatUint(seq, 10)
+		}
+		// Filled up while the session was detached
+		var backlog []message
+		reason := noSuchChannel
+		// Uninvited while detached, as JOIN would be
+		if channel.admits(u.name) {
+			backlog, reason = channel.add(u, channelName, since)
+		}
+		if reason != "" {
+			u.send([]byte(fmt.Sprintf("RESULT JOIN %s %s\n", channelName, u.outcome(0, reason))))
+			continue
+		}
+		u.channels[channelName] = channel
+		s.logEvent(joinEvent, u.name, channelName, "")
+		s.shareMembership("JOIN", channelName, u.name)
+
+		msg := fmt.Sprintf("RESULT JOIN %s 1\n", channelName)
+		u.send([]byte(msg))
+		sendHistory(u, channelName, backlog)
+	}
+}
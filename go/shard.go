@@ -0,0 +1,112 @@
+package brerver
+
+import "sync"
+
+// Shards in each of the server's maps of accounts and channels
+const mapShards = 32
+
+// A map by name split into shards, each with its own lock, so that commands about
+// different accounts or channels don't wait on each other. Nothing holds more than one
+// shard's lock at once, which makes going over every entry, as each does, a view of each
+// shard in turn rather than of the whole map at one moment.
+type shardedMap[V any] struct {
+	shards [mapShards]mapShard[V]
+}
+
+type mapShard[V any] struct {
+	lock    sync.RWMutex
+	entries map[string]V
+}
+
+func newShardedMap[V any]() *shardedMap[V] {
+	m := &shardedMap[V]{}
+	for i := range m.shards {
+		m.shards[i].entries = map[string]V{}
+	}
+	return m
+}
+
+// FNV-1a, inline so that finding a shard allocates nothing
+func (m *shardedMap[V]) shard(name string) *mapShard[V] {
+	hash := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		hash ^= uint32(name[i])
+		hash *= 16777619
+	}
+	return &m.shards[hash%mapShards]
+}
+
+func (m *shardedMap[V]) get(name string) (V, bool) {
+	shard := m.shard(name)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	v, ok := shard.entries[name]
+	return v, ok
+}
+
+func (m *shardedMap[V]) set(name string, v V) {
+	shard := m.shard(name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.entries[name] = v
+}
+
+// Sets name to v unless it's already there, reporting whether it did
+func (m *shardedMap[V]) add(name string, v V) bool {
+	shard := m.shard(name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if _, ok := shard.entries[name]; ok {
+		return false
+	}
+	shard.entries[name] = v
+	return true
+}
+
+// Deletes name, returning what it was if it was there
+func (m *shardedMap[V]) remove(name string) (V, bool) {
+	shard := m.shard(name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	v, ok := shard.entries[name]
+	delete(shard.entries, name)
+	return v, ok
+}
+
+// Replaces name with what change makes of it, all under the shard's lock. change gets
+// the entry and whether there was one, and returns the new entry and whether to keep
+// it, deleting it if not.
+func (m *shardedMap[V]) update(name string, change func(v V, ok bool) (V, bool)) {
+	shard := m.shard(name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	v, ok := shard.entries[name]
+	if v, keep := change(v, ok); keep {
+		shard.entries[name] = v
+	} else if ok {
+		delete(shard.entries, name)
+	}
+}
+
+// Calls f with every entry, each shard's under its read lock
+func (m *shardedMap[V]) each(f func(name string, v V)) {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.lock.RLock()
+		for name, v := range shard.entries {
+			f(name, v)
+		}
+		shard.lock.RUnlock()
+	}
+}
+
+func (m *shardedMap[V]) len() int {
+	n := 0
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.lock.RLock()
+		n += len(shard.entries)
+		shard.lock.RUnlock()
+	}
+	return n
+}
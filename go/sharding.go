@@ -0,0 +1,182 @@
+package brerver
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// With federation_sharding, each channel has a home server, picked by hashing its name
+// onto a ring of every server in the federation. Rather than every message going to
+// every server, messages said elsewhere go to the home as ROUTE SAY|SAYB ..., and the
+// home passes them on to only the servers with members in the channel, which it knows
+// from joins and leaves going to every server.
+//
+// Every server must have federation_sharding and know of the same servers, or they'll
+// disagree about homes. While a channel's home is split off its messages go to every
+// server, as they do without sharding.
+
+// Points each server has on the ring, so that channels spread evenly between them
+const ringReplicas = 64
+
+type hashRing struct {
+	// Sorted, with owners[i] the server at points[i]
+	points []uint64
+	owners []string
+}
+
+// FNV and the like clump names that differ in a character or two, which channel and
+// server names tend to
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newHashRing(names []string) *hashRing {
+	r := &hashRing{}
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(names)*ringReplicas)
+	for _, name := range names {
+		for i := 0; i < ringReplicas; i++ {
+			points = append(points, point{ringHash(fmt.Sprintf("%s#%d", name, i)), name})
+		}
+	}
+	// Ties go to the name that sorts first, so that every server agrees
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.owner)
+	}
+	return r
+}
+
+// The server owning key, the first one at or after its hash going round the ring
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// Puts every server this one knows of on the ring: itself, its peers and any it learned
+// of. Called with serversLock held.
+func (s *Server) placeServers() {
+	conf := s.settings()
+	if !conf.FederationSharding {
+		return
+	}
+	names := []string{conf.ServerName}
+	for _, peer := range conf.Peers {
+		names = append(names, peer.Name)
+	}
+	for name := range s.known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	unique := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	s.ring = newHashRing(unique)
+}
+
+// The home server of channelName, or the empty string without federation_sharding
+func (s *Server) home(channelName string) string {
+	s.serversLock.RLock()
+	defer s.serversLock.RUnlock()
+	if s.ring == nil {
+		return ""
+	}
+	return s.ring.owner(channelName)
+}
+
+// Sends line to the linked server name, reporting whether it went. A link that can't
+// take it is split off.
+func (s *Server) sendTo(name, line string) bool {
+	s.serversLock.RLock()
+	l, ok := s.servers[name]
+	s.serversLock.RUnlock()
+	if !ok {
+		return false
+	}
+	if err := l.send(line); err != nil {
+		s.logger.Warn("Failed to send to a linked server", "server", l.name, "err", err)
+		l.conn.Close()
+		s.removeLink(l)
+		return false
+	}
+	return true
+}
+
+// Sends a message said here in channelName where it needs to go: its home if that's
+// elsewhere and linked, the servers with members if this server is the home, and
+// otherwise every linked server
+func (s *Server) sendHome(channelName, line string) {
+	switch home := s.home(channelName); home {
+	case "":
+		s.broadcastLinks(line)
+	case s.settings().ServerName:
+		s.forward(nil, channelName, line)
+	default:
+		if !s.sendTo(home, "ROUTE "+line) {
+			s.broadcastLinks(line)
+		}
+	}
+}
+
+// Passes a message on, from this channel's home, to the linked servers with members in
+// the channel other than from, keeping it for those that are split
+func (s *Server) forward(from *serverLink, channelName, line string) {
+	var links []*serverLink
+	s.serversLock.Lock()
+	for name, peer := range s.peers {
+		if (from != nil && name == from.name) || len(peer.members[channelName]) == 0 {
+			continue
+		}
+		if l, ok := s.servers[name]; ok {
+			links = append(links, l)
+		} else if !peer.split.IsZero() {
+			peer.keep(line)
+		}
+	}
+	s.serversLock.Unlock()
+
+	for _, l := range links {
+		if err := l.send(line); err != nil {
+			s.logger.Warn("Failed to send to a linked server", "server", l.name, "err", err)
+			l.conn.Close()
+			s.removeLink(l)
+		}
+	}
+}
+
+// Delivers a message routed here by a server that takes this one to be the channel's
+// home, and passes it on the first time it comes
+func (s *Server) routed(l *serverLink, line string) {
+	inner := strings.TrimPrefix(line, "ROUTE ")
+	fields := strings.SplitN(inner, " ", 5)
+	if fields[0] != "SAY" && fields[0] != "SAYB" {
+		s.logger.Warn("Dropped a malformed routed message from a linked server", "server", l.name)
+		return
+	}
+	if s.deliverRelayed(l, fields) {
+		s.forward(l, fields[2], inner+"\n")
+	}
+}
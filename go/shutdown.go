@@ -0,0 +1,73 @@
+package brerver
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// How often draining checks whether connections have caught up
+const drainPoll = 10 * time.Millisecond
+
+// Shuts down in order once the listeners are closed: every connection is told SHUTDOWN,
+// given until the deadline to take what is still being written to it, then closed. Waits
+// for the connections to finish cleaning up, detaching sessions and the like, until the
+// deadline too.
+func (s *Server) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	s.connectionsLock.Lock()
+	s.closing = true
+	users := make([]*user, 0, len(s.connections))
+	for u := range s.connections {
+		users = append(users, u)
+	}
+	s.connectionsLock.Unlock()
+	if len(users) > 0 {
+		s.logger.Info("Shutting down connections", "count", len(users))
+	}
+
+	// A slow client holds up its own notice and nobody else's
+	var notified sync.WaitGroup
+	for _, u := range users {
+		notified.Add(1)
+		go func(u *user) {
+			defer notified.Done()
+			u.send([]byte("SHUTDOWN\n"))
+		}(u)
+	}
+	waitUntil(&notified, deadline)
+	for _, u := range users {
+		for u.out.stats().Depth > 0 && time.Now().Before(deadline) {
+			time.Sleep(drainPoll)
+		}
+	}
+	for _, u := range users {
+		u.conn.Close()
+	}
+
+	if !waitUntil(&s.connectionsWait, deadline) {
+		s.logger.Warn("Gave up waiting for connections to close")
+	}
+}
+
+// Returns whether the wait finished before the deadline
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
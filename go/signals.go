@@ -0,0 +1,47 @@
+package brerver
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Shuts down gracefully on SIGINT or SIGTERM, and at once on a second one for when
+// draining takes too long. Reloads the configuration on SIGHUP, and hands over to a new
+// process on SIGUSR2 where there is one. Returns a function that stops handling them.
+func (s *Server) HandleSignals() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	if handoverSignal != nil {
+		signal.Notify(signals, handoverSignal)
+	}
+	go func() {
+		stopping := false
+		for sig := range signals {
+			switch {
+			case sig == syscall.SIGHUP:
+				if err := s.reload(); err != nil {
+					s.logger.Error("Failed to reload configuration", "err", err)
+				} else {
+					s.logger.Info("Reloaded configuration")
+				}
+			case sig == handoverSignal:
+				s.logger.Info("Handing over to a new process")
+				if err := s.handover(); err != nil {
+					s.logger.Error("Failed to hand over", "err", err)
+				}
+			case stopping:
+				s.logger.Warn("Exiting on a second signal", "signal", sig)
+				os.Exit(1)
+			default:
+				s.logger.Info("Shutting down", "signal", sig)
+				stopping = true
+				s.Shutdown()
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
@@ -0,0 +1,143 @@
+package brerver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// How the smoke test reaches the server and who it is when it gets there
+type SmoketestOptions struct {
+	// Log in with these instead of registering a throwaway account, which is unregistered afterwards
+	Username string
+	Password string
+	TLS      bool
+	// For each step, not the whole test
+	Timeout time.Duration
+}
+
+// Every run says its message in the same channel, since channels can't be removed
+const smokeChannel = "smoketest"
+
+type smokeConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+func dialSmoke(addr string, options SmoketestOptions) (*smokeConn, error) {
+	dialer := &net.Dialer{Timeout: options.Timeout}
+	var conn net.Conn
+	var err error
+	if options.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &smokeConn{conn, bufio.NewReader(conn), options.Timeout}, nil
+}
+
+// Sends command, if any, and checks the lines that come back, where a trailing * matches any rest of the line
+func (c *smokeConn) step(command string, expected ...string) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if command != "" {
+		if _, err := fmt.Fprintf(c.conn, "%s\n", command); err != nil {
+			return fmt.Errorf("%s: %w", command, err)
+		}
+	}
+	for _, want := range expected {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("%s: waiting for '%s': %w", command, want, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if prefix := strings.TrimSuffix(want, "*"); prefix != want && strings.HasPrefix(line, prefix) {
+			continue
+		}
+		if line != want {
+			return fmt.Errorf("%s: expected '%s' but got '%s'", command, want, line)
+		}
+	}
+	return nil
+}
+
+// Reads lines until one that starts with prefix and ends with suffix, for when whatever
+// comes before it doesn't matter
+func (c *smokeConn) until(command, prefix, suffix string) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("%s: waiting for '%s...%s': %w", command, prefix, suffix, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if strings.HasPrefix(line, prefix) && strings.HasSuffix(line, suffix) {
+			return nil
+		}
+	}
+}
+
+// Connects to a running server and goes through login, create, join, say and history,
+// returning what went wrong first. Every run uses the smoketest channel, creating it if
+// it isn't there yet, so runs don't leave a channel each behind.
+func Smoketest(addr string, options SmoketestOptions) (err error) {
+	conn, err := dialSmoke(addr, options)
+	if err != nil {
+		return err
+	}
+	defer conn.conn.Close()
+
+	suffix := newToken()[:8]
+	username, password := options.Username, options.Password
+	if username == "" {
+		username, password = "smoke-"+suffix, newToken()
+		if err := conn.step("REGISTER "+username+" "+password, "RESULT REGISTER 1"); err != nil {
+			return err
+		}
+		defer func() {
+			if cleanup := conn.step("UNREGISTER "+password, "RESULT UNREGISTER 1"); err == nil {
+				err = cleanup
+			}
+		}()
+	}
+
+	channelName := smokeChannel
+	text := "smoke test " + suffix
+	if err := conn.step("HELLO sessions", "RESULT HELLO 1 *"); err != nil {
+		return err
+	}
+	if err := conn.step("LOGIN "+username+" "+password, "RESULT LOGIN 1", "SESSION *"); err != nil {
+		return err
+	}
+	if err := conn.step("CREATE "+channelName, "RESULT CREATE "+channelName+" *"); err != nil {
+		return err
+	}
+	if err := conn.step("JOIN "+channelName, "RESULT JOIN "+channelName+" 1"); err != nil {
+		return err
+	}
+	if err := conn.step("SAY "+channelName+" "+text, "RECV "+username+" "+channelName+" "+text, "RESULT SAY "+channelName+" 1"); err != nil {
+		return err
+	}
+
+	// A second connection sees the message in history
+	history, err := dialSmoke(addr, options)
+	if err != nil {
+		return err
+	}
+	defer history.conn.Close()
+	if err := history.step("LOGIN "+username+" "+password, "RESULT LOGIN 1"); err != nil {
+		return err
+	}
+	// Earlier runs' messages may come first
+	command := "JOIN " + channelName + " -since 0"
+	if err := history.step(command, "RESULT JOIN "+channelName+" 1"); err != nil {
+		return err
+	}
+	return history.until(command, "HISTORY "+channelName+" ", " "+username+" "+text)
+}
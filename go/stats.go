@@ -0,0 +1,82 @@
+package brerver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The stats section of Config
+type StatsConfig struct {
+	Channel         string   `json:"channel" doc:"Periodically post server statistics to this channel, if it exists"`
+	IntervalSeconds int      `json:"interval_seconds" doc:"How often the statistics are posted" default:"3600" minimum:"60"`
+	Include         []string `json:"include" doc:"Which statistics to post, in order" default:"[\"users_online\", \"messages_today\"]" enum:"users_online,messages_today,channels,connections"`
+}
+
+// What the statistics are posted as, which the default username_pattern doesn't allow
+const statsName = "*"
+
+// The statistics stats can include
+var statistics = map[string]func(s *Server) int{
+	"users_online":   (*Server).usersOnline,
+	"messages_today": (*Server).messagesToday,
+	"channels":       (*Server).channelCount,
+	"connections":    (*Server).connectionCount,
+}
+
+// Counts an accepted SAY towards messages_today
+func (s *Server) countMessage() {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	today := time.Now().Format("2006-01-02")
+	if s.statsDay != today {
+		s.statsDay = today
+		s.statsMessages = 0
+	}
+	s.statsMessages++
+	s.metrics.countMessage()
+}
+
+func (s *Server) messagesToday() int {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	if s.statsDay != time.Now().Format("2006-01-02") {
+		return 0
+	}
+	return s.statsMessages
+}
+
+// Distinct accounts with a connection logged in
+func (s *Server) usersOnline() int {
+	s.connectionsLock.RLock()
+	defer s.connectionsLock.RUnlock()
+
+	names := map[string]bool{}
+	for u := range s.connections {
+		if u.loggedIn() {
+			names[u.name] = true
+		}
+	}
+	return len(names)
+}
+
+func (s *Server) channelCount() int {
+	return s.channels.len()
+}
+
+// Posts the configured statistics to the stats channel, like "users_online=3 messages_today=120"
+func (s *Server) postStats() {
+	channelName := s.settings().Stats.Channel
+	channel, ok := s.channels.get(channelName)
+	if !ok {
+		return
+	}
+
+	fields := make([]string, 0, len(s.settings().Stats.Include))
+	for _, name := range s.settings().Stats.Include {
+		fields = append(fields, fmt.Sprintf("%s=%d", name, statistics[name](s)))
+	}
+	s.post(channel, statsName, channelName, strings.Join(fields, " "))
+}
@@ -0,0 +1,43 @@
+//go:build !windows
+
+package brerver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Where systemd's socket activation starts passing sockets
+const listenFDsStart = 3
+
+// Takes the sockets systemd passes in with socket activation, as LISTEN_PID and
+// LISTEN_FDS describe, so it can bind privileged ports and start the server on demand.
+// Options listening on the same addresses use them, and the rest are served like the
+// port on the command line.
+func (s *Server) InheritSocketActivation() error {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	// Children shouldn't think the sockets are meant for them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) || fds == "" {
+		return nil
+	}
+
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return fmt.Errorf("LISTEN_FDS is not a count: %s", fds)
+	}
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("socket %d isn't listening: %w", fd, err)
+		}
+		s.activate(ln)
+	}
+	return nil
+}
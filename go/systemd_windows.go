@@ -0,0 +1,8 @@
+//go:build windows
+
+package brerver
+
+// systemd doesn't run on Windows
+func (s *Server) InheritSocketActivation() error {
+	return nil
+}
@@ -0,0 +1,45 @@
+package brerver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Listens on a unix socket at path with the octal permissions in mode. A socket left at
+// path by a server that didn't shut down cleanly is replaced, but nothing else is.
+func (s *Server) listenUnix(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, err
+	}
+	// A handed over socket is already in place with its permissions
+	if s.inherits("unix", path) {
+		return s.listen("unix", path)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// Refuse to take over a socket another server is still listening on
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := s.listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the listener removes the socket
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
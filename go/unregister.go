@@ -0,0 +1,155 @@
+package brerver
+
+import "fmt"
+
+// UNREGISTER <password>
+//
+// Deletes the logged in account along with everything kept about it: its messages in
+// channel history, pins of them, channel roles and preferences, sessions and exports.
+// Every other connection logged in as the account is logged out first, with logins to it
+// held off until it's gone, so none of them is still logged in once the name can be
+// registered again.
+func unregister(s *Server, u *user, args []string) {
+	password := args[1]
+
+	var confirmation int
+	defer func() {
+		msg := fmt.Sprintf("RESULT UNREGISTER %d\n", confirmation)
+		u.send([]byte(msg))
+	}()
+
+	if !u.loggedIn() {
+		return
+	}
+	if _, ok := s.checkPassword(u.name, password); !ok {
+		return
+	}
+
+	name := u.name
+	// Nobody can log in between the others being logged out and the account going
+	release := s.holdLogins(name)
+	s.logOutEverywhere(name, u)
+	_, ok := s.users.remove(name)
+	release()
+	if !ok {
+		return
+	}
+
+	s.shareUnregister(name)
+	s.audit(u, unregisterAudit, name, "")
+	logOut(s, u)
+	s.purgeAccount(name)
+	s.logEvent(unregisterEvent, name, "", "")
+	confirmation = 1
+}
+
+// Removes every trace of the account apart from its place in the users map
+func (s *Server) purgeAccount(name string) {
+	s.revokeSessions(name)
+
+	s.channels.each(func(channelName string, c *channel) {
+		c.purge(name, channelName)
+	})
+
+	s.exportsLock.Lock()
+	for token, export := range s.exports {
+		if export.name == name {
+			delete(s.exports, token)
+		}
+	}
+	delete(s.lastExport, name)
+	s.exportsLock.Unlock()
+}
+
+func (c *channel) purge(name, channelName string) {
+	// Deferred first, so it runs once the locks are released
+	var watchers []*user
+	defer func() { announceMembership(watchers, "LEFT", name, channelName) }()
+	c.settingsLock.Lock()
+	defer c.settingsLock.Unlock()
+	c.usersLock.Lock()
+	defer c.usersLock.Unlock()
+
+	if c.removeMember(name) {
+		watchers = c.watchers(name)
+	}
+	delete(c.operators, name)
+	delete(c.muted, name)
+	delete(c.members, name)
+	delete(c.notifyPolicies, name)
+
+	pins := c.pins[:0]
+	for _, p := range c.pins {
+		if p.from != name {
+			pins = append(pins, p)
+		}
+	}
+	c.pins = pins
+
+	c.historyLock.Lock()
+	defer c.historyLock.Unlock()
+	history := c.history[:0]
+	for _, m := range c.history {
+		if m.from != name {
+			history = append(history, m)
+		}
+	}
+	c.history = history
+}
+
+// Logs out every connection that is logged in as name, other than except, each from its
+// own goroutine, and waits until they have
+func (s *Server) logOutEverywhere(name string, except *user) {
+	var others []*user
+	s.connectionsLock.RLock()
+	for other := range s.connections {
+		if other != except && other.name == name {
+			others = append(others, other)
+		}
+	}
+	s.connectionsLock.RUnlock()
+
+	for _, other := range others {
+		loggedOut := make(chan struct{})
+		for waiting := true; waiting; {
+			select {
+			case other.logOuts <- loggedOut:
+				<-loggedOut
+				waiting = false
+			case <-other.done:
+				waiting = false
+			// Another of the account's connections may be waiting on this one
+			case ours := <-except.ownLogOuts():
+				logOut(s, except)
+				close(ours)
+			}
+		}
+	}
+}
+
+// What other connections send to ask u to log out, or nil, which is never ready, for no
+// connection
+func (u *user) ownLogOuts() chan chan struct{} {
+	if u == nil {
+		return nil
+	}
+	return u.logOuts
+}
+
+// Returns the connection to how it was before logging in, leaving every channel
+func logOut(s *Server, u *user) {
+	s.leavePresence(u)
+	for name, channel := range u.channels {
+		s.part(u, name, channel)
+	}
+	u.channels = map[string]*channel{}
+	s.setName(u, "")
+	u.session = ""
+	u.presenceOnly = false
+	u.scram = nil
+}
+
+func (s *Server) accountExists(name string) bool {
+	_, ok := s.users.get(name)
+	return ok
+}
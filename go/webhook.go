@@ -0,0 +1,102 @@
+package brerver
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Somewhere on http_port that outside systems can post to a channel from
+type WebhookConfig struct {
+	Name    string `json:"name" doc:"The webhook is at /hooks/<name>"`
+	Token   string `json:"token" doc:"Secret the poster sends as Authorization: Bearer <token>"`
+	Channel string `json:"channel" doc:"Channel the messages go to, which must exist"`
+	User    string `json:"user" doc:"Who the messages are from, which must be a name REGISTER refuses, like ci*, so it can't be mistaken for a person"`
+}
+
+func (h WebhookConfig) valid() bool {
+	return validServerName(h.Name) && validServerName(h.Token) && validArgs(h.Channel, h.User)
+}
+
+// Posts {"text"} to the webhook's channel as its user, a message for each line. Like
+// SAY, the posts go through scripts' on_message hooks and not at all while the user is
+// muted in the channel. Flood limits count a connection's messages, so they don't apply.
+//
+//	POST /hooks/<name>  Authorization: Bearer <token>
+func (s *Server) webhook(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/hooks/")
+	var hook WebhookConfig
+	found := false
+	for _, configured := range s.settings().Webhooks {
+		if configured.Name == name {
+			hook, found = configured, true
+			break
+		}
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(hook.Token)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, notLoggedIn)
+		return
+	}
+
+	var body struct {
+		Text string `json:"text"`
+	}
+	if !readBody(w, r, &body) {
+		return
+	}
+	// CI output and the like comes in several lines, which the protocol can't hold in one
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(body.Text, "\r\n", "\n"), "\n"), "\n")
+	for _, line := range lines {
+		if !validCommand(line) {
+			writeAPIError(w, http.StatusBadRequest, badArguments)
+			return
+		}
+	}
+	if body.Text == "" {
+		writeAPIError(w, http.StatusBadRequest, badArguments)
+		return
+	}
+
+	channel, ok := s.channels.get(hook.Channel)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, noSuchChannel)
+		return
+	}
+	// REGISTER refuses the name, but it can still be an account from LDAP, OIDC or from
+	// before the username rules were tightened
+	if s.accountExists(hook.User) {
+		s.logger.Warn("Refused a webhook post from a user that is an account", "webhook", hook.Name, "user", hook.User)
+		writeAPIError(w, http.StatusConflict, usernameTaken)
+		return
+	}
+	if channel.mutes(hook.User, time.Now()) {
+		writeAPIError(w, http.StatusForbidden, mutedInChannel)
+		return
+	}
+	for _, line := range lines {
+		if line != "" && !s.runHooks("on_message", hook.Channel, hook.User, line) {
+			writeAPIError(w, http.StatusForbidden, rejectedByScript)
+			return
+		}
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		s.post(channel, hook.User, hook.Channel, line)
+		s.relay("SAY", hook.User, hook.Channel, line)
+		s.countMessage()
+		s.notify(channel, hook.User, hook.Channel, line)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,66 @@
+package brerver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"golang.org/x/net/websocket"
+)
+
+// A connection that didn't come straight from one of our listeners, like one through
+// the IRC gateway or a WebSocket, which answers to the client's real address so bans,
+// limits and the audit log see where it came from
+type relayedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c relayedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Serves the same line protocol as TCP at /ws, for browsers. Each WebSocket message
+// carries one or more lines, newlines included, in either direction.
+func (s *Server) serveWebSocket(ctx context.Context, ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Server{Handshake: s.checkOrigin, Handler: func(ws *websocket.Conn) {
+		remote, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+		if err != nil {
+			return
+		}
+		conn := relayedConn{ws, remote}
+		if s.welcome(conn) {
+			// The handshake is over once the handler runs, and the WebSocket closes when it returns
+			userConnection(ws.Request().Context(), s, conn)
+		}
+	}})
+	server := &http.Server{Handler: mux, BaseContext: func(net.Listener) context.Context { return ctx }}
+	if err := server.Serve(ln); err != nil {
+		s.logger.Info("Stopped serving WebSockets", "err", err)
+	}
+}
+
+// Browsers say which page opened the WebSocket, and only pages from the server's own host
+// or websocket_origins may, so that no other site can use a visitor's browser to reach a
+// server only the visitor can. Clients that aren't browsers send no Origin and get in.
+func (s *Server) checkOrigin(config *websocket.Config, r *http.Request) error {
+	header := r.Header.Get("Origin")
+	if header == "" {
+		return nil
+	}
+	origin, err := url.Parse(header)
+	if err != nil {
+		return err
+	}
+	config.Origin = origin
+	allowed := s.settings().WebSocketOrigins
+	if origin.Host == r.Host || slices.Contains(allowed, header) || slices.Contains(allowed, "*") {
+		return nil
+	}
+	s.logger.Debug("Refused a WebSocket from another origin", "origin", header, "addr", r.RemoteAddr)
+	return fmt.Errorf("origin %s not allowed", header)
+}
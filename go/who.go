@@ -0,0 +1,71 @@
+package brerver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// WHO <channel>
+//
+// Lists who is in a channel as RESULT WHO <channel> 1 <member>,..., with members on
+// linked servers as <user>@<server>
+func who(s *Server, u *user, args []string) {
+	channelName := args[1]
+
+	var members []string
+	c, exists := s.channels.get(channelName)
+	ok := exists && c.visibleTo(u, channelName)
+	if ok {
+		c.usersLock.RLock()
+		for name := range c.users {
+			members = append(members, name)
+		}
+		c.usersLock.RUnlock()
+	}
+	// Private channels aren't shared, so members elsewhere are in a public channel that
+	// only shares the name
+	if !exists || !c.private {
+		for server, names := range s.remoteMembers(channelName) {
+			for _, name := range names {
+				members = append(members, name+"@"+server)
+			}
+		}
+	}
+	if !ok && len(members) == 0 {
+		msg := fmt.Sprintf("RESULT WHO %s %s\n", channelName, u.outcome(0, noSuchChannel))
+		u.send([]byte(msg))
+		return
+	}
+
+	sort.Strings(members)
+	msg := fmt.Sprintf("RESULT WHO %s 1", channelName)
+	if len(members) > 0 {
+		msg += " " + strings.Join(members, ",")
+	}
+	u.send([]byte(msg + "\n"))
+}
+
+// The members of channelName on each linked server, as last heard
+func (s *Server) remoteMembers(channelName string) map[string][]string {
+	s.serversLock.RLock()
+	defer s.serversLock.RUnlock()
+	members := map[string][]string{}
+	for server, peer := range s.peers {
+		for name := range peer.members[channelName] {
+			members[server] = append(members[server], name)
+		}
+	}
+	return members
+}
+
+func (s *Server) remoteMember(channelName, name string) bool {
+	s.serversLock.RLock()
+	defer s.serversLock.RUnlock()
+	for _, peer := range s.peers {
+		if peer.members[channelName][name] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package brerver
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// How a connection frames what it sends and receives. Everything inside the server is
+// text, converted at the edges for the other two.
+const (
+	textFormat = iota
+	jsonFormat
+	binaryFormat
+)
+
+// A command off the wire, either a line still to be parsed or, from binary clients,
+// already split into words
+type inbound struct {
+	line  string
+	words []string
+}
+
+func (u *user) wireFormat() uint32 {
+	return atomic.LoadUint32(&u.format)
+}
+
+func (u *user) setWireFormat(format uint32) {
+	atomic.StoreUint32(&u.format, format)
+}
+
+// How many arguments come before the free text at the end of frames that have some,
+// which keeps its spaces outside the text format. Every other frame is split on all of them.
+var frameFields = map[string]int{
+	"RECV":     2,
+	"RECVB":    2,
+	"HISTORY":  3,
+	"HISTORYB": 3,
+	"PINNED":   3,
+	"MOTD":     0,
+}
+
+// Splits a text frame, without its newline, into its type and arguments
+func splitFrame(line string) (string, []string) {
+	fields := strings.SplitN(line, " ", 2)
+	args := []string{}
+	if len(fields) == 2 {
+		if n, ok := frameFields[fields[0]]; ok {
+			args = strings.SplitN(fields[1], " ", n+1)
+		} else {
+			args = strings.Fields(fields[1])
+		}
+	}
+	return fields[0], args
+}
+
+// Calls each text frame in msg with its type and arguments
+func eachFrame(msg []byte, f func(string, []string)) {
+	for _, line := range strings.Split(string(msg), "\n") {
+		if line != "" {
+			f(splitFrame(line))
+		}
+	}
+}
+
+// Puts a command that came as separate arguments into what handlers expect: the command,
+// its first argument and the rest, if any. Only the last argument may contain spaces, and
+// never the first, since those end up space separated when they're sent on to text clients.
+func commandWords(command string, args []string) ([]string, bool) {
+	if command == "" || strings.Contains(command, " ") || !validCommand(command) {
+		return nil, false
+	}
+	for i, arg := range args {
+		if !validCommand(arg) || ((i == 0 || i < len(args)-1) && strings.Contains(arg, " ")) {
+			return nil, false
+		}
+	}
+	words := []string{command}
+	if len(args) > 0 {
+		words = append(words, args[0])
+	}
+	if len(args) > 1 {
+		words = append(words, strings.Join(args[1:], " "))
+	}
+	return words, true
+}
+
+func (u *user) parseCommand(in inbound) ([]string, bool) {
+	if in.words != nil {
+		return in.words, true
+	}
+	return parseLine(&u.words, in.line, u.wireFormat())
+}
+
+// Turns a line as read, without its newline, into the command and its arguments,
+// reporting whether it is one. Apart from the words it splits into, it touches nothing
+// but its arguments, so it can be fuzzed without a connection.
+func parseLine(words *[3]string, line string, format uint32) ([]string, bool) {
+	// Clients that end lines with CRLF are forgiven the CR
+	line = strings.TrimSuffix(line, "\r")
+	if !validCommand(line) {
+		return nil, false
+	}
+	if format == jsonFormat {
+		return parseJSONCommand(line)
+	}
+	return splitCommand(words, line), true
+}
+
+// Splits a text command into the command, its first argument and the rest, as
+// strings.SplitN(line, " ", 3) would, but into the array given, like the connection's
+// own, so that nothing is allocated. The words are only good until the next command is
+// split into the same array.
+func splitCommand(array *[3]string, line string) []string {
+	words := array[:0]
+	for len(words) < len(array)-1 {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			break
+		}
+		words = append(words, line[:i])
+		line = line[i+1:]
+	}
+	return append(words, line)
+}
+
+// Converts text frames into the connection's format
+func (u *user) encode(msg []byte) []byte {
+	switch u.wireFormat() {
+	case jsonFormat:
+		return encodeJSONFrames(msg)
+	case binaryFormat:
+		return encodeBinaryFrames(msg)
+	}
+	return msg
+}